@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
+
 	"github.com/Dimss/wafie/apisrv/internal/models"
+	"github.com/Dimss/wafie/apisrv/pkg/alerting"
 	"github.com/Dimss/wafie/apisrv/pkg/apiserver"
 	"github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -11,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -19,12 +24,20 @@ func init() {
 	startCmd.PersistentFlags().StringP("db-user", "", "cwafpg", "Database user")
 	startCmd.PersistentFlags().StringP("db-password", "", "cwafpg", "Database password")
 	startCmd.PersistentFlags().StringP("db-name", "", "cwaf", "Database name")
+	startCmd.PersistentFlags().DurationP("events-retention", "", 7*24*time.Hour, "Security events retention period")
+	startCmd.PersistentFlags().StringP("tracing-exporter", "", tracing.ExporterNone, "Tracing exporter, one of none|otlp|stdout")
+	startCmd.PersistentFlags().StringP("tracing-endpoint", "", "", "OTLP HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces")
+	startCmd.PersistentFlags().DurationP("alerts-eval-interval", "", 30*time.Second, "Alert rules evaluation interval")
 
 	viper.BindPFlag("db-host", startCmd.PersistentFlags().Lookup("db-host"))
 	viper.BindPFlag("db-port", startCmd.PersistentFlags().Lookup("db-port"))
 	viper.BindPFlag("db-user", startCmd.PersistentFlags().Lookup("db-user"))
 	viper.BindPFlag("db-password", startCmd.PersistentFlags().Lookup("db-password"))
 	viper.BindPFlag("db-name", startCmd.PersistentFlags().Lookup("db-name"))
+	viper.BindPFlag("events-retention", startCmd.PersistentFlags().Lookup("events-retention"))
+	viper.BindPFlag("tracing-exporter", startCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-endpoint", startCmd.PersistentFlags().Lookup("tracing-endpoint"))
+	viper.BindPFlag("alerts-eval-interval", startCmd.PersistentFlags().Lookup("alerts-eval-interval"))
 
 	rootCmd.AddCommand(startCmd)
 }
@@ -35,7 +48,12 @@ var startCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		logger := logger.NewLogger()
 		logger.Info("starting api server")
-		_, err := models.NewDb(
+		shutdownTracing, err := tracing.Init("wafie-api-server",
+			viper.GetString("tracing-exporter"), viper.GetString("tracing-endpoint"), logger)
+		if err != nil {
+			logger.Fatal("failed to initialize tracing", zap.Error(err))
+		}
+		_, err = models.NewDb(
 			models.NewDbCfg(
 				viper.GetString("db-host"),
 				viper.GetInt("db-port"),
@@ -48,8 +66,9 @@ var startCmd = &cobra.Command{
 		if err != nil {
 			logger.Error("error during database connection initialization", zap.Error(err))
 		}
-		srv := apiserver.NewApiServer(logger)
+		srv := apiserver.NewApiServer(logger, viper.GetDuration("events-retention"))
 		srv.Start()
+		alerting.NewEvaluator(viper.GetDuration("alerts-eval-interval"), logger).Start()
 
 		// handle interrupts
 		sigCh := make(chan os.Signal, 1)
@@ -58,6 +77,7 @@ var startCmd = &cobra.Command{
 			select {
 			case s := <-sigCh:
 				logger.Info("signal received, shutting down", zap.String("signal", s.String()))
+				shutdownTracing(context.Background())
 				logger.Info("bye bye 👋")
 				os.Exit(0)
 			}
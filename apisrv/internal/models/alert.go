@@ -0,0 +1,455 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	applogger "github.com/Dimss/wafie/logger"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAlertsLimit = 100
+	// redactedValue replaces the credentials returned by the API
+	redactedValue = "****"
+)
+
+type AlertRepository struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+// Uint32List is stored as jsonb
+type Uint32List []uint32
+
+type AlertRule struct {
+	ID                    uint `gorm:"primaryKey"`
+	Name                  string
+	Type                  uint32
+	Metric                uint32
+	Application           *string
+	ProtectionID          *uint32
+	Comparison            uint32
+	Threshold             float64
+	WindowSeconds         uint32
+	BaselineWindowSeconds uint32
+	ChannelIDs            Uint32List `gorm:"type:jsonb"`
+	Enabled               bool
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+}
+
+type WebhookChannel struct {
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type EmailChannel struct {
+	SmtpAddr string   `json:"smtpAddr"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+type ChannelConfig struct {
+	Webhook *WebhookChannel `json:"webhook,omitempty"`
+	Email   *EmailChannel   `json:"email,omitempty"`
+}
+
+type NotificationChannel struct {
+	ID        uint          `gorm:"primaryKey"`
+	Name      string        `gorm:"uniqueIndex:idx_notification_channel_name"`
+	Config    ChannelConfig `gorm:"type:jsonb"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type Alert struct {
+	ID             uint64 `gorm:"primaryKey"`
+	RuleID         uint   `gorm:"index:idx_alert_rule_id"`
+	RuleName       string
+	State          uint32 `gorm:"index:idx_alert_state"`
+	Value          float64
+	Summary        string
+	Silenced       bool
+	StartedAt      time.Time
+	ResolvedAt     *time.Time
+	AcknowledgedAt *time.Time
+	AcknowledgedBy string
+	// NotifiedAt is the last notification time, used for the repeated notifications
+	NotifiedAt *time.Time
+}
+
+type Silence struct {
+	ID          uint `gorm:"primaryKey"`
+	RuleID      *uint32
+	Application *string
+	StartsAt    time.Time
+	EndsAt      time.Time `gorm:"index:idx_silence_ends_at"`
+	Comment     string
+	CreatedBy   string
+	CreatedAt   time.Time
+}
+
+func NewAlertRepository(tx *gorm.DB, logger *zap.Logger) *AlertRepository {
+	modelSvc := &AlertRepository{db: tx, logger: logger}
+	if tx == nil {
+		modelSvc.db = db()
+	}
+	if logger == nil {
+		modelSvc.logger = applogger.NewLogger()
+	}
+	return modelSvc
+}
+
+func (l *Uint32List) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	default:
+		return fmt.Errorf("unsupported type for Uint32List")
+	}
+}
+
+func (l Uint32List) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (c *ChannelConfig) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("unsupported type for ChannelConfig")
+	}
+}
+
+func (c ChannelConfig) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+func (r *AlertRule) FromProto(rulev1 *wv1.AlertRule) error {
+	if rulev1 == nil || rulev1.Name == "" {
+		return errors.New("alert rule name is required")
+	}
+	if rulev1.Type == wv1.AlertRuleType_ALERT_RULE_TYPE_UNSPECIFIED ||
+		rulev1.Metric == wv1.AlertMetric_ALERT_METRIC_UNSPECIFIED ||
+		rulev1.Comparison == wv1.AlertComparison_ALERT_COMPARISON_UNSPECIFIED {
+		return errors.New("alert rule type, metric and comparison are required")
+	}
+	r.Name = rulev1.Name
+	r.Type = uint32(rulev1.Type)
+	r.Metric = uint32(rulev1.Metric)
+	r.Application = rulev1.Application
+	r.ProtectionID = rulev1.ProtectionId
+	r.Comparison = uint32(rulev1.Comparison)
+	r.Threshold = rulev1.Threshold
+	r.WindowSeconds = rulev1.WindowSeconds
+	r.BaselineWindowSeconds = rulev1.BaselineWindowSeconds
+	r.ChannelIDs = rulev1.ChannelIds
+	r.Enabled = rulev1.Enabled
+	return nil
+}
+
+func (r *AlertRule) ToProto() *wv1.AlertRule {
+	return &wv1.AlertRule{
+		Id:                    uint32(r.ID),
+		Name:                  r.Name,
+		Type:                  wv1.AlertRuleType(r.Type),
+		Metric:                wv1.AlertMetric(r.Metric),
+		Application:           r.Application,
+		ProtectionId:          r.ProtectionID,
+		Comparison:            wv1.AlertComparison(r.Comparison),
+		Threshold:             r.Threshold,
+		WindowSeconds:         r.WindowSeconds,
+		BaselineWindowSeconds: r.BaselineWindowSeconds,
+		ChannelIds:            r.ChannelIDs,
+		Enabled:               r.Enabled,
+	}
+}
+
+func (c *NotificationChannel) FromProto(channelv1 *wv1.NotificationChannel) error {
+	if channelv1 == nil || channelv1.Name == "" {
+		return errors.New("notification channel name is required")
+	}
+	c.Name = channelv1.Name
+	switch cfg := channelv1.Config.(type) {
+	case *wv1.NotificationChannel_Webhook:
+		if cfg.Webhook.Url == "" {
+			return errors.New("webhook url is required")
+		}
+		c.Config.Webhook = &WebhookChannel{Url: cfg.Webhook.Url, Headers: cfg.Webhook.Headers}
+	case *wv1.NotificationChannel_Email:
+		if cfg.Email.SmtpAddr == "" || cfg.Email.From == "" || len(cfg.Email.To) == 0 {
+			return errors.New("smtp address, from and to are required")
+		}
+		c.Config.Email = &EmailChannel{
+			SmtpAddr: cfg.Email.SmtpAddr,
+			Username: cfg.Email.Username,
+			Password: cfg.Email.Password,
+			From:     cfg.Email.From,
+			To:       cfg.Email.To,
+		}
+	default:
+		return errors.New("notification channel config is required")
+	}
+	return nil
+}
+
+// ToProto returns the channel without the credentials,
+// the webhook headers values are redacted, only the names are returned
+func (c *NotificationChannel) ToProto() *wv1.NotificationChannel {
+	channel := &wv1.NotificationChannel{Id: uint32(c.ID), Name: c.Name}
+	if c.Config.Webhook != nil {
+		var headers map[string]string
+		if len(c.Config.Webhook.Headers) > 0 {
+			headers = make(map[string]string, len(c.Config.Webhook.Headers))
+			for name := range c.Config.Webhook.Headers {
+				headers[name] = redactedValue
+			}
+		}
+		channel.Config = &wv1.NotificationChannel_Webhook{Webhook: &wv1.WebhookChannel{
+			Url:     c.Config.Webhook.Url,
+			Headers: headers,
+		}}
+	}
+	if c.Config.Email != nil {
+		channel.Config = &wv1.NotificationChannel_Email{Email: &wv1.EmailChannel{
+			SmtpAddr: c.Config.Email.SmtpAddr,
+			Username: c.Config.Email.Username,
+			From:     c.Config.Email.From,
+			To:       c.Config.Email.To,
+		}}
+	}
+	return channel
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func (a *Alert) ToProto() *wv1.Alert {
+	return &wv1.Alert{
+		Id:             a.ID,
+		RuleId:         uint32(a.RuleID),
+		RuleName:       a.RuleName,
+		State:          wv1.AlertState(a.State),
+		Value:          a.Value,
+		Summary:        a.Summary,
+		Silenced:       a.Silenced,
+		StartedAt:      timestamppb.New(a.StartedAt),
+		ResolvedAt:     optionalTimestamp(a.ResolvedAt),
+		AcknowledgedAt: optionalTimestamp(a.AcknowledgedAt),
+		AcknowledgedBy: a.AcknowledgedBy,
+	}
+}
+
+func (s *Silence) FromProto(silencev1 *wv1.Silence) error {
+	if silencev1 == nil || silencev1.EndsAt == nil {
+		return errors.New("silence end time is required")
+	}
+	s.RuleID = silencev1.RuleId
+	s.Application = silencev1.Application
+	s.StartsAt = time.Now()
+	if silencev1.StartsAt != nil {
+		s.StartsAt = silencev1.StartsAt.AsTime()
+	}
+	s.EndsAt = silencev1.EndsAt.AsTime()
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("silence must end after it starts")
+	}
+	s.Comment = silencev1.Comment
+	s.CreatedBy = silencev1.CreatedBy
+	return nil
+}
+
+func (s *Silence) ToProto() *wv1.Silence {
+	return &wv1.Silence{
+		Id:          uint32(s.ID),
+		RuleId:      s.RuleID,
+		Application: s.Application,
+		StartsAt:    timestamppb.New(s.StartsAt),
+		EndsAt:      timestamppb.New(s.EndsAt),
+		Comment:     s.Comment,
+		CreatedBy:   s.CreatedBy,
+	}
+}
+
+// Matches returns true when the silence is active and covers the rule
+func (s *Silence) Matches(rule *AlertRule, now time.Time) bool {
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+	if s.RuleID != nil && uint(*s.RuleID) != rule.ID {
+		return false
+	}
+	if s.Application != nil && (rule.Application == nil || *rule.Application != *s.Application) {
+		return false
+	}
+	return true
+}
+
+func (s *AlertRepository) CreateRule(rulev1 *wv1.AlertRule) (*AlertRule, error) {
+	rule := &AlertRule{}
+	if err := rule.FromProto(rulev1); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if err := s.db.Create(rule).Error; err != nil {
+		return nil, fmt.Errorf("failed to create alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+func (s *AlertRepository) ListRules() ([]*AlertRule, error) {
+	var rules []*AlertRule
+	if err := s.db.Order("id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("failed to list alert rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (s *AlertRepository) DeleteRule(id uint32) error {
+	return s.db.Delete(&AlertRule{}, id).Error
+}
+
+func (s *AlertRepository) CreateChannel(channelv1 *wv1.NotificationChannel) (*NotificationChannel, error) {
+	channel := &NotificationChannel{}
+	if err := channel.FromProto(channelv1); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if err := s.db.Create(channel).Error; err != nil {
+		return nil, fmt.Errorf("failed to create notification channel: %w", err)
+	}
+	return channel, nil
+}
+
+func (s *AlertRepository) ListChannels(ids []uint32) ([]*NotificationChannel, error) {
+	query := s.db.Order("id")
+	if ids != nil {
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		query = query.Where("id IN ?", ids)
+	}
+	var channels []*NotificationChannel
+	if err := query.Find(&channels).Error; err != nil {
+		return nil, fmt.Errorf("failed to list notification channels: %w", err)
+	}
+	return channels, nil
+}
+
+func (s *AlertRepository) DeleteChannel(id uint32) error {
+	return s.db.Delete(&NotificationChannel{}, id).Error
+}
+
+func (s *AlertRepository) ListAlerts(options *wv1.ListAlertsOptions) ([]*Alert, error) {
+	if options == nil {
+		options = &wv1.ListAlertsOptions{}
+	}
+	query := s.db.Model(&Alert{})
+	if options.State != nil {
+		query = query.Where("state = ?", uint32(options.GetState()))
+	}
+	if options.RuleId != nil {
+		query = query.Where("rule_id = ?", options.GetRuleId())
+	}
+	limit := int(options.Limit)
+	if limit == 0 {
+		limit = defaultAlertsLimit
+	}
+	var alerts []*Alert
+	if err := query.Order("started_at desc").Limit(limit).Find(&alerts).Error; err != nil {
+		return nil, fmt.Errorf("failed to list alerts: %w", err)
+	}
+	return alerts, nil
+}
+
+// OpenAlert returns the firing or acknowledged alert of the rule, nil if none
+func (s *AlertRepository) OpenAlert(ruleId uint) (*Alert, error) {
+	alert := &Alert{}
+	err := s.db.
+		Where("rule_id = ? AND state IN ?", ruleId, []uint32{
+			uint32(wv1.AlertState_ALERT_STATE_FIRING),
+			uint32(wv1.AlertState_ALERT_STATE_ACKNOWLEDGED),
+		}).
+		First(alert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get open alert: %w", err)
+	}
+	return alert, nil
+}
+
+func (s *AlertRepository) SaveAlert(alert *Alert) error {
+	return s.db.Save(alert).Error
+}
+
+func (s *AlertRepository) AcknowledgeAlert(id uint64, by string) (*Alert, error) {
+	alert := &Alert{}
+	if err := s.db.First(alert, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("alert not found"))
+		}
+		return nil, err
+	}
+	if alert.State != uint32(wv1.AlertState_ALERT_STATE_FIRING) {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("only firing alerts can be acknowledged"))
+	}
+	now := time.Now()
+	alert.State = uint32(wv1.AlertState_ALERT_STATE_ACKNOWLEDGED)
+	alert.AcknowledgedAt = &now
+	alert.AcknowledgedBy = by
+	if err := s.db.Save(alert).Error; err != nil {
+		return nil, fmt.Errorf("failed to acknowledge alert: %w", err)
+	}
+	return alert, nil
+}
+
+func (s *AlertRepository) CreateSilence(silencev1 *wv1.Silence) (*Silence, error) {
+	silence := &Silence{}
+	if err := silence.FromProto(silencev1); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if err := s.db.Create(silence).Error; err != nil {
+		return nil, fmt.Errorf("failed to create silence: %w", err)
+	}
+	return silence, nil
+}
+
+func (s *AlertRepository) ListSilences(includeExpired bool) ([]*Silence, error) {
+	query := s.db.Order("ends_at desc")
+	if !includeExpired {
+		query = query.Where("ends_at > ?", time.Now())
+	}
+	var silences []*Silence
+	if err := query.Find(&silences).Error; err != nil {
+		return nil, fmt.Errorf("failed to list silences: %w", err)
+	}
+	return silences, nil
+}
+
+func (s *AlertRepository) DeleteSilence(id uint32) error {
+	return s.db.Delete(&Silence{}, id).Error
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	applogger "github.com/Dimss/wafie/logger"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ComponentRepository struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+// ComponentStatus is the last reported status of a component instance
+type ComponentStatus struct {
+	Type         uint32 `gorm:"primaryKey"`
+	InstanceID   string `gorm:"primaryKey"`
+	ProtectionID uint32 `gorm:"index:idx_component_status_protection_id"`
+	NodeName     string
+	Healthy      bool
+	Message      string
+	LastSeen     time.Time
+}
+
+func NewComponentRepository(tx *gorm.DB, logger *zap.Logger) *ComponentRepository {
+	modelSvc := &ComponentRepository{db: tx, logger: logger}
+	if tx == nil {
+		modelSvc.db = db()
+	}
+	if logger == nil {
+		modelSvc.logger = applogger.NewLogger()
+	}
+	return modelSvc
+}
+
+func (c *ComponentStatus) FromProto(statusv1 *wv1.ComponentStatus) {
+	c.Type = uint32(statusv1.Type)
+	c.InstanceID = statusv1.InstanceId
+	c.ProtectionID = statusv1.ProtectionId
+	c.NodeName = statusv1.NodeName
+	c.Healthy = statusv1.Healthy
+	c.Message = statusv1.Message
+	c.LastSeen = time.Now()
+}
+
+func (c *ComponentStatus) ToProto() *wv1.ComponentStatus {
+	return &wv1.ComponentStatus{
+		Type:         wv1.ComponentType(c.Type),
+		InstanceId:   c.InstanceID,
+		ProtectionId: c.ProtectionID,
+		NodeName:     c.NodeName,
+		Healthy:      c.Healthy,
+		Message:      c.Message,
+		LastSeen:     timestamppb.New(c.LastSeen),
+	}
+}
+
+func (s *ComponentRepository) ReportStatus(statuses []*wv1.ComponentStatus) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+	records := make([]*ComponentStatus, 0, len(statuses))
+	for _, statusv1 := range statuses {
+		c := &ComponentStatus{}
+		c.FromProto(statusv1)
+		records = append(records, c)
+	}
+	err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(records).Error
+	if err != nil {
+		return fmt.Errorf("failed to report component status: %w", err)
+	}
+	return nil
+}
+
+func (s *ComponentRepository) ListStatuses(protectionId *uint32) ([]*ComponentStatus, error) {
+	query := s.db.Model(&ComponentStatus{})
+	if protectionId != nil {
+		query = query.Where("protection_id = ?", *protectionId)
+	}
+	var statuses []*ComponentStatus
+	if err := query.Order("last_seen desc").Find(&statuses).Error; err != nil {
+		return nil, fmt.Errorf("failed to list component statuses: %w", err)
+	}
+	return statuses, nil
+}
+
+// CountHealthy returns the healthy instances reported since the given time
+func (s *ComponentRepository) CountHealthy(componentType wv1.ComponentType, protectionId *uint32, since time.Time) (int64, error) {
+	query := s.db.Model(&ComponentStatus{}).
+		Where("type = ? AND healthy AND last_seen >= ?", uint32(componentType), since)
+	if protectionId != nil {
+		query = query.Where("protection_id = ?", *protectionId)
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count healthy components: %w", err)
+	}
+	return count, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/Dimss/wafie/apisrv/internal/models/sql"
+	"github.com/Dimss/wafie/metrics"
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -104,6 +105,16 @@ func NewDb(cfg *DbCfg) (*gorm.DB, error) {
 		return nil, err
 	}
 	//dbConn = dbConn.Debug()
+	if err := dbConn.Use(&tracingPlugin{}); err != nil {
+		return nil, err
+	}
+	sqlDb, err := dbConn.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := metrics.RegisterDBStats(sqlDb, cfg.dbName); err != nil {
+		logger.Error("failed to register db stats metrics", zap.Error(err))
+	}
 	if err := migrate(dbConn); err != nil {
 		return nil, err
 	}
@@ -122,6 +133,13 @@ func migrate(db *gorm.DB) error {
 		&Ingress{},
 		&Port{},
 		&StateVersion{},
+		&SecurityEvent{},
+		&EventStat{},
+		&ComponentStatus{},
+		&AlertRule{},
+		&NotificationChannel{},
+		&Alert{},
+		&Silence{},
 	); err != nil {
 		return err
 	}
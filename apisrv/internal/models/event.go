@@ -0,0 +1,191 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	applogger "github.com/Dimss/wafie/logger"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+type EventRepository struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+// StringList is stored as jsonb, so it can be queried with the @> operator
+type StringList []string
+
+type SecurityEvent struct {
+	ID           uint64     `gorm:"primaryKey"`
+	RequestID    string     `gorm:"index:idx_security_event_request_id"`
+	ProtectionID uint32     `gorm:"index:idx_security_event_protection_id"`
+	Application  string     `gorm:"index:idx_security_event_application"`
+	RuleIDs      StringList `gorm:"type:jsonb"`
+	Severity     uint32
+	ClientIP     string
+	URI          string
+	Method       string
+	StatusCode   uint32
+	Blocked      bool
+	Messages     StringList `gorm:"type:jsonb"`
+	Timestamp    time.Time  `gorm:"index:idx_security_event_timestamp"`
+	CreatedAt    time.Time
+}
+
+func NewEventRepository(tx *gorm.DB, logger *zap.Logger) *EventRepository {
+	modelSvc := &EventRepository{db: tx, logger: logger}
+	if tx == nil {
+		modelSvc.db = db()
+	}
+	if logger == nil {
+		modelSvc.logger = applogger.NewLogger()
+	}
+	return modelSvc
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	default:
+		return fmt.Errorf("unsupported type for StringList")
+	}
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (e *SecurityEvent) FromProto(eventv1 *wv1.SecurityEvent) {
+	e.RequestID = eventv1.RequestId
+	e.ProtectionID = eventv1.ProtectionId
+	e.Application = eventv1.Application
+	e.RuleIDs = eventv1.RuleIds
+	e.Severity = uint32(eventv1.Severity)
+	e.ClientIP = eventv1.ClientIp
+	e.URI = eventv1.Uri
+	e.Method = eventv1.Method
+	e.StatusCode = eventv1.StatusCode
+	e.Blocked = eventv1.Blocked
+	e.Messages = eventv1.Messages
+	e.Timestamp = eventv1.Timestamp.AsTime()
+	if eventv1.Timestamp == nil {
+		e.Timestamp = time.Now()
+	}
+}
+
+func (e *SecurityEvent) ToProto() *wv1.SecurityEvent {
+	return &wv1.SecurityEvent{
+		Id:           e.ID,
+		RequestId:    e.RequestID,
+		ProtectionId: e.ProtectionID,
+		Application:  e.Application,
+		RuleIds:      e.RuleIDs,
+		Severity:     wv1.EventSeverity(e.Severity),
+		ClientIp:     e.ClientIP,
+		Uri:          e.URI,
+		Method:       e.Method,
+		StatusCode:   e.StatusCode,
+		Blocked:      e.Blocked,
+		Messages:     e.Messages,
+		Timestamp:    timestamppb.New(e.Timestamp),
+	}
+}
+
+func (s *EventRepository) CreateEvents(events []*wv1.SecurityEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	records := make([]*SecurityEvent, 0, len(events))
+	for _, eventv1 := range events {
+		e := &SecurityEvent{}
+		e.FromProto(eventv1)
+		records = append(records, e)
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(records, 100).Error; err != nil {
+			return fmt.Errorf("failed to create security events: %w", err)
+		}
+		return NewEventStatsRepository(tx, s.logger).Aggregate(records)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func (s *EventRepository) ListEvents(options *wv1.ListEventsOptions) ([]*SecurityEvent, error) {
+	if options == nil {
+		options = &wv1.ListEventsOptions{}
+	}
+	query := s.db.Model(&SecurityEvent{})
+	if options.From != nil {
+		query = query.Where("timestamp >= ?", options.From.AsTime())
+	}
+	if options.To != nil {
+		query = query.Where("timestamp < ?", options.To.AsTime())
+	}
+	if options.ProtectionId != nil {
+		query = query.Where("protection_id = ?", options.GetProtectionId())
+	}
+	if options.Application != nil {
+		query = query.Where("application = ?", options.GetApplication())
+	}
+	if options.RuleId != nil {
+		ruleIds, _ := StringList{options.GetRuleId()}.Value()
+		query = query.Where("rule_ids @> ?::jsonb", ruleIds)
+	}
+	if options.MinSeverity != nil && options.GetMinSeverity() != wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED {
+		// lower value is more severe
+		query = query.Where("severity > 0 AND severity <= ?", uint32(options.GetMinSeverity()))
+	}
+	if options.ClientIp != nil {
+		query = query.Where("client_ip = ?", options.GetClientIp())
+	}
+	if options.RequestId != nil {
+		query = query.Where("request_id = ?", options.GetRequestId())
+	}
+	if options.Blocked != nil {
+		query = query.Where("blocked = ?", options.GetBlocked())
+	}
+	limit := int(options.Limit)
+	if limit == 0 {
+		limit = defaultEventsLimit
+	}
+	if limit > maxEventsLimit {
+		limit = maxEventsLimit
+	}
+	var events []*SecurityEvent
+	err := query.
+		Order("timestamp desc").
+		Limit(limit).
+		Offset(int(options.Offset)).
+		Find(&events).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list security events: %w", err)
+	}
+	return events, nil
+}
+
+// DeleteEventsOlderThan removes the events older than the retention period
+func (s *EventRepository) DeleteEventsOlderThan(retention time.Duration) (int64, error) {
+	res := s.db.Where("timestamp < ?", time.Now().Add(-retention)).Delete(&SecurityEvent{})
+	return res.RowsAffected, res.Error
+}
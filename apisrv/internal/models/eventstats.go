@@ -0,0 +1,235 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	applogger "github.com/Dimss/wafie/logger"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	statsGranularity     = time.Minute
+	defaultStatsBucket   = time.Hour
+	defaultStatsTop      = 10
+	maxStatsTop          = 100
+	defaultStatsWindow   = 24 * time.Hour
+	statsUpsertBatchSize = 500
+)
+
+// StatDimension is the pre-aggregated event dimension
+type StatDimension uint32
+
+const (
+	StatDimensionTotal StatDimension = iota
+	StatDimensionRuleId
+	StatDimensionClientIp
+	StatDimensionUri
+)
+
+type EventStatsRepository struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+// EventStat is the events count per minute, application and dimension value,
+// aggregated at ingest time
+type EventStat struct {
+	BucketStart time.Time     `gorm:"primaryKey"`
+	Application string        `gorm:"primaryKey"`
+	Dimension   StatDimension `gorm:"primaryKey"`
+	Value       string        `gorm:"primaryKey"`
+	Events      uint64
+	Blocked     uint64
+}
+
+type statsBucketRow struct {
+	Start       time.Time
+	Application string
+	Events      uint64
+	Blocked     uint64
+}
+
+type statsTopRow struct {
+	Value   string
+	Events  uint64
+	Blocked uint64
+}
+
+func NewEventStatsRepository(tx *gorm.DB, logger *zap.Logger) *EventStatsRepository {
+	modelSvc := &EventStatsRepository{db: tx, logger: logger}
+	if tx == nil {
+		modelSvc.db = db()
+	}
+	if logger == nil {
+		modelSvc.logger = applogger.NewLogger()
+	}
+	return modelSvc
+}
+
+// Aggregate adds the events into the stats buckets
+func (s *EventStatsRepository) Aggregate(events []*SecurityEvent) error {
+	type statKey struct {
+		bucketStart time.Time
+		application string
+		dimension   StatDimension
+		value       string
+	}
+	stats := map[statKey]*EventStat{}
+	add := func(e *SecurityEvent, dimension StatDimension, value string) {
+		key := statKey{e.Timestamp.UTC().Truncate(statsGranularity), e.Application, dimension, value}
+		stat, ok := stats[key]
+		if !ok {
+			stat = &EventStat{
+				BucketStart: key.bucketStart,
+				Application: key.application,
+				Dimension:   key.dimension,
+				Value:       key.value,
+			}
+			stats[key] = stat
+		}
+		stat.Events++
+		if e.Blocked {
+			stat.Blocked++
+		}
+	}
+	for _, e := range events {
+		add(e, StatDimensionTotal, "")
+		for _, ruleId := range e.RuleIDs {
+			add(e, StatDimensionRuleId, ruleId)
+		}
+		add(e, StatDimensionClientIp, e.ClientIP)
+		// the query string is dropped to bound the cardinality
+		uri, _, _ := strings.Cut(e.URI, "?")
+		add(e, StatDimensionUri, uri)
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+	records := make([]*EventStat, 0, len(stats))
+	for _, stat := range stats {
+		records = append(records, stat)
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "bucket_start"}, {Name: "application"}, {Name: "dimension"}, {Name: "value"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"events":  gorm.Expr("event_stats.events + excluded.events"),
+			"blocked": gorm.Expr("event_stats.blocked + excluded.blocked"),
+		}),
+	}).CreateInBatches(records, statsUpsertBatchSize).Error
+	if err != nil {
+		return fmt.Errorf("failed to aggregate event stats: %w", err)
+	}
+	return nil
+}
+
+func (s *EventStatsRepository) GetStats(options *wv1.GetStatsOptions) (*wv1.GetStatsResponse, error) {
+	if options == nil {
+		options = &wv1.GetStatsOptions{}
+	}
+	to := time.Now()
+	if options.To != nil {
+		to = options.To.AsTime()
+	}
+	from := to.Add(-defaultStatsWindow)
+	if options.From != nil {
+		from = options.From.AsTime()
+	}
+	bucket := defaultStatsBucket
+	if options.BucketSeconds != 0 {
+		bucket = max(time.Duration(options.BucketSeconds)*time.Second, statsGranularity)
+	}
+	top := int(options.Top)
+	if top == 0 {
+		top = defaultStatsTop
+	}
+	top = min(top, maxStatsTop)
+	window := func(dimension StatDimension) *gorm.DB {
+		query := s.db.Model(&EventStat{}).
+			Where("dimension = ? AND bucket_start >= ? AND bucket_start < ?", dimension, from, to)
+		if options.Application != nil {
+			query = query.Where("application = ?", options.GetApplication())
+		}
+		return query
+	}
+	stats := &wv1.GetStatsResponse{}
+	var buckets []statsBucketRow
+	bucketSeconds := int64(bucket.Seconds())
+	err := window(StatDimensionTotal).
+		Select("to_timestamp(floor(extract(epoch from bucket_start) / ?) * ?) AS start, "+
+			"application, sum(events) AS events, sum(blocked) AS blocked", bucketSeconds, bucketSeconds).
+		Group("start, application").
+		Order("start, application").
+		Scan(&buckets).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats buckets: %w", err)
+	}
+	for _, b := range buckets {
+		stats.Buckets = append(stats.Buckets, &wv1.StatsBucket{
+			Start:       timestamppb.New(b.Start),
+			Application: b.Application,
+			Events:      b.Events,
+			Blocked:     b.Blocked,
+		})
+		stats.Events += b.Events
+		stats.Blocked += b.Blocked
+	}
+	if stats.Events > 0 {
+		stats.BlockRatio = float64(stats.Blocked) / float64(stats.Events)
+	}
+	topEntries := func(dimension StatDimension) ([]*wv1.StatsTopEntry, error) {
+		var rows []statsTopRow
+		err := window(dimension).
+			Select("value, sum(events) AS events, sum(blocked) AS blocked").
+			Group("value").
+			Order("events desc").
+			Limit(top).
+			Scan(&rows).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to get top stats: %w", err)
+		}
+		entries := make([]*wv1.StatsTopEntry, 0, len(rows))
+		for _, r := range rows {
+			entries = append(entries, &wv1.StatsTopEntry{Value: r.Value, Events: r.Events, Blocked: r.Blocked})
+		}
+		return entries, nil
+	}
+	if stats.TopRuleIds, err = topEntries(StatDimensionRuleId); err != nil {
+		return nil, err
+	}
+	if stats.TopClientIps, err = topEntries(StatDimensionClientIp); err != nil {
+		return nil, err
+	}
+	if stats.TopUris, err = topEntries(StatDimensionUri); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DeleteStatsOlderThan removes the stats buckets older than the retention period
+func (s *EventStatsRepository) DeleteStatsOlderThan(retention time.Duration) (int64, error) {
+	res := s.db.Where("bucket_start < ?", time.Now().Add(-retention)).Delete(&EventStat{})
+	return res.RowsAffected, res.Error
+}
+
+// SumEvents returns the events and blocked events counts in the [from, to) range
+func (s *EventStatsRepository) SumEvents(application *string, from, to time.Time) (events, blocked uint64, err error) {
+	query := s.db.Model(&EventStat{}).
+		Where("dimension = ? AND bucket_start >= ? AND bucket_start < ?", StatDimensionTotal, from, to)
+	if application != nil {
+		query = query.Where("application = ?", *application)
+	}
+	var row statsTopRow
+	err = query.
+		Select("coalesce(sum(events), 0) AS events, coalesce(sum(blocked), 0) AS blocked").
+		Scan(&row).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to sum events: %w", err)
+	}
+	return row.Events, row.Blocked, nil
+}
@@ -36,6 +36,7 @@ type Ingress struct {
 	Host             string `gorm:"uniqueIndex:idx_ing_host"`
 	Port             int32
 	Path             string
+	TlsSecretName    string
 	ApplicationID    uint        `gorm:"not null"`
 	Application      Application `gorm:"foreignKey:ApplicationID"`
 	IngressType      uint32
@@ -58,6 +59,7 @@ func NewIngressFromProto(ingReq *wv1.Ingress) *Ingress {
 		ApplicationID:    uint(ingReq.ApplicationId),
 		DiscoveryMessage: ingReq.DiscoveryMessage,
 		DiscoveryStatus:  uint32(ingReq.DiscoveryStatus),
+		TlsSecretName:    ingReq.TlsSecretName,
 	}
 }
 
@@ -73,6 +75,7 @@ func (s *IngressModelSvc) Save(ingress *Ingress) error {
 				"ingress_type",
 				"discovery_message",
 				"discovery_status",
+				"tls_secret_name",
 				"created_at",
 				"updated_at",
 			},
@@ -93,6 +96,7 @@ func (i *Ingress) ToProto() *wv1.Ingress {
 		DiscoveryMessage: i.DiscoveryMessage,
 		DiscoveryStatus:  wv1.DiscoveryStatusType(i.DiscoveryStatus),
 		ApplicationId:    int32(i.ApplicationID),
+		TlsSecretName:    i.TlsSecretName,
 		Upstream:         i.Upstream.ToProto(),
 	}
 }
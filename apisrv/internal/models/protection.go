@@ -10,23 +10,67 @@ import (
 	"connectrpc.com/connect"
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	applogger "github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/tracing"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
+// DefaultGatewayGroup serves the protections without explicit gateway group
+const DefaultGatewayGroup = "default"
+
 type ProtectionRepository struct {
 	db         *gorm.DB
 	logger     *zap.Logger
 	Protection Protection
 }
 
+type BlockResponse struct {
+	StatusCode   uint32 `json:"statusCode"`
+	BodyTemplate string `json:"bodyTemplate"`
+}
+
+type AuditLogMasking struct {
+	Headers         []string `json:"headers,omitempty"`
+	JsonPaths       []string `json:"jsonPaths,omitempty"`
+	FormArgs        []string `json:"formArgs,omitempty"`
+	Patterns        []string `json:"patterns,omitempty"`
+	DisableDefaults bool     `json:"disableDefaults"`
+}
+
 type ModSec struct {
-	Mode          uint32 `json:"protectionMode"`
-	ParanoiaLevel uint32 `json:"paranoiaLevel"`
+	Mode                uint32           `json:"protectionMode"`
+	ParanoiaLevel       uint32           `json:"paranoiaLevel"`
+	BlockResponse       *BlockResponse   `json:"blockResponse,omitempty"`
+	FailurePolicy       uint32           `json:"failurePolicy"`
+	EvaluationTimeoutMs uint32           `json:"evaluationTimeoutMs"`
+	AuditLogMasking     *AuditLogMasking `json:"auditLogMasking,omitempty"`
+}
+
+type RoutePolicy struct {
+	PathMatchType uint32   `json:"pathMatchType"`
+	Path          string   `json:"path"`
+	Methods       []string `json:"methods,omitempty"`
+	ModSec        *ModSec  `json:"modSec"`
+}
+
+type RateLimitPolicy struct {
+	Requests        uint32 `json:"requests"`
+	IntervalSeconds uint32 `json:"intervalSeconds"`
+	KeyType         uint32 `json:"keyType"`
+	HeaderName      string `json:"headerName,omitempty"`
+	PathPrefix      string `json:"pathPrefix,omitempty"`
+	Action          uint32 `json:"action"`
+}
+
+type AccessLogPolicy struct {
+	SamplePercent *uint32 `json:"samplePercent,omitempty"`
 }
 
 type ProtectionDesiredState struct {
-	ModSec *ModSec `json:"modSec"`
+	ModSec        *ModSec            `json:"modSec"`
+	RoutePolicies []*RoutePolicy     `json:"routePolicies,omitempty"`
+	RateLimits    []*RateLimitPolicy `json:"rateLimits,omitempty"`
+	AccessLog     *AccessLogPolicy   `json:"accessLog,omitempty"`
 }
 
 type Protection struct {
@@ -35,6 +79,7 @@ type Protection struct {
 	ApplicationID uint                   `gorm:"not null;uniqueIndex:idx_protection_app_id"`
 	Application   Application            `gorm:"foreignKey:ApplicationID;references:ID"`
 	DesiredState  ProtectionDesiredState `gorm:"type:jsonb"`
+	GatewayGroup  string                 `gorm:"not null;default:default;index"`
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 }
@@ -67,13 +112,147 @@ func (s *ProtectionDesiredState) Value() (driver.Value, error) {
 	return json.Marshal(s)
 }
 
-func (s *ProtectionDesiredState) FromProto(v1desiredState *wv1.ProtectionDesiredState) {
-	s.ModSec = &ModSec{
-		Mode:          uint32(v1desiredState.ModeSec.ProtectionMode),
-		ParanoiaLevel: uint32(v1desiredState.ModeSec.ParanoiaLevel),
+func NewBlockResponseFromProto(br *wv1.BlockResponse) *BlockResponse {
+	if br == nil {
+		return nil
+	}
+	return &BlockResponse{
+		StatusCode:   br.StatusCode,
+		BodyTemplate: br.BodyTemplate,
 	}
 }
 
+func (b *BlockResponse) ToProto() *wv1.BlockResponse {
+	if b == nil {
+		return nil
+	}
+	return &wv1.BlockResponse{
+		StatusCode:   b.StatusCode,
+		BodyTemplate: b.BodyTemplate,
+	}
+}
+
+func NewAuditLogMaskingFromProto(m *wv1.AuditLogMasking) *AuditLogMasking {
+	if m == nil {
+		return nil
+	}
+	return &AuditLogMasking{
+		Headers:         m.Headers,
+		JsonPaths:       m.JsonPaths,
+		FormArgs:        m.FormArgs,
+		Patterns:        m.Patterns,
+		DisableDefaults: m.DisableDefaults,
+	}
+}
+
+func (m *AuditLogMasking) ToProto() *wv1.AuditLogMasking {
+	if m == nil {
+		return nil
+	}
+	return &wv1.AuditLogMasking{
+		Headers:         m.Headers,
+		JsonPaths:       m.JsonPaths,
+		FormArgs:        m.FormArgs,
+		Patterns:        m.Patterns,
+		DisableDefaults: m.DisableDefaults,
+	}
+}
+
+func NewModSecFromProto(m *wv1.ModSec) *ModSec {
+	if m == nil {
+		return nil
+	}
+	return &ModSec{
+		Mode:                uint32(m.ProtectionMode),
+		ParanoiaLevel:       uint32(m.ParanoiaLevel),
+		BlockResponse:       NewBlockResponseFromProto(m.BlockResponse),
+		FailurePolicy:       uint32(m.FailurePolicy),
+		EvaluationTimeoutMs: m.EvaluationTimeoutMs,
+		AuditLogMasking:     NewAuditLogMaskingFromProto(m.AuditLogMasking),
+	}
+}
+
+func (m *ModSec) ToProto() *wv1.ModSec {
+	if m == nil {
+		return nil
+	}
+	return &wv1.ModSec{
+		ProtectionMode:      wv1.ProtectionMode(m.Mode),
+		ParanoiaLevel:       wv1.ParanoiaLevel(m.ParanoiaLevel),
+		BlockResponse:       m.BlockResponse.ToProto(),
+		FailurePolicy:       wv1.FailurePolicy(m.FailurePolicy),
+		EvaluationTimeoutMs: m.EvaluationTimeoutMs,
+		AuditLogMasking:     m.AuditLogMasking.ToProto(),
+	}
+}
+
+func NewRoutePoliciesFromProto(policies []*wv1.RoutePolicy) (routePolicies []*RoutePolicy) {
+	for _, p := range policies {
+		routePolicies = append(routePolicies, &RoutePolicy{
+			PathMatchType: uint32(p.PathMatchType),
+			Path:          p.Path,
+			Methods:       p.Methods,
+			ModSec:        NewModSecFromProto(p.ModeSec),
+		})
+	}
+	return routePolicies
+}
+
+func (p *RoutePolicy) ToProto() *wv1.RoutePolicy {
+	return &wv1.RoutePolicy{
+		PathMatchType: wv1.PathMatchType(p.PathMatchType),
+		Path:          p.Path,
+		Methods:       p.Methods,
+		ModeSec:       p.ModSec.ToProto(),
+	}
+}
+
+func NewRateLimitPoliciesFromProto(policies []*wv1.RateLimitPolicy) (rateLimits []*RateLimitPolicy) {
+	for _, p := range policies {
+		rateLimits = append(rateLimits, &RateLimitPolicy{
+			Requests:        p.Requests,
+			IntervalSeconds: p.IntervalSeconds,
+			KeyType:         uint32(p.KeyType),
+			HeaderName:      p.HeaderName,
+			PathPrefix:      p.PathPrefix,
+			Action:          uint32(p.Action),
+		})
+	}
+	return rateLimits
+}
+
+func (p *RateLimitPolicy) ToProto() *wv1.RateLimitPolicy {
+	return &wv1.RateLimitPolicy{
+		Requests:        p.Requests,
+		IntervalSeconds: p.IntervalSeconds,
+		KeyType:         wv1.RateLimitKeyType(p.KeyType),
+		HeaderName:      p.HeaderName,
+		PathPrefix:      p.PathPrefix,
+		Action:          wv1.RateLimitAction(p.Action),
+	}
+}
+
+func NewAccessLogPolicyFromProto(policy *wv1.AccessLogPolicy) *AccessLogPolicy {
+	if policy == nil {
+		return nil
+	}
+	return &AccessLogPolicy{SamplePercent: policy.SamplePercent}
+}
+
+func (p *AccessLogPolicy) ToProto() *wv1.AccessLogPolicy {
+	if p == nil {
+		return nil
+	}
+	return &wv1.AccessLogPolicy{SamplePercent: p.SamplePercent}
+}
+
+func (s *ProtectionDesiredState) FromProto(v1desiredState *wv1.ProtectionDesiredState) {
+	s.ModSec = NewModSecFromProto(v1desiredState.ModeSec)
+	s.RoutePolicies = NewRoutePoliciesFromProto(v1desiredState.RoutePolicies)
+	s.RateLimits = NewRateLimitPoliciesFromProto(v1desiredState.RateLimits)
+	s.AccessLog = NewAccessLogPolicyFromProto(v1desiredState.AccessLog)
+}
+
 func (s *ProtectionDesiredState) ToProto() *wv1.ProtectionDesiredState {
 	return nil
 }
@@ -85,19 +264,34 @@ func (p *Protection) FromProto(protectionv1 *wv1.Protection) error {
 	p.Mode = uint32(protectionv1.ProtectionMode)
 	p.ApplicationID = uint(protectionv1.ApplicationId)
 	p.DesiredState.FromProto(protectionv1.DesiredState)
+	p.GatewayGroup = gatewayGroup(protectionv1.GatewayGroup)
 	return nil
 }
 
+func gatewayGroup(group string) string {
+	if group == "" {
+		return DefaultGatewayGroup
+	}
+	return group
+}
+
 func (p *Protection) ToProto() *wv1.Protection {
 
 	protection := &wv1.Protection{
 		Id:             uint32(p.ID),
 		ApplicationId:  uint32(p.ApplicationID),
 		ProtectionMode: wv1.ProtectionMode(p.Mode),
-		DesiredState: &wv1.ProtectionDesiredState{ModeSec: &wv1.ModSec{
-			ProtectionMode: wv1.ProtectionMode(p.DesiredState.ModSec.Mode),
-			ParanoiaLevel:  wv1.ParanoiaLevel(p.DesiredState.ModSec.ParanoiaLevel),
-		}},
+		DesiredState: &wv1.ProtectionDesiredState{
+			ModeSec:   p.DesiredState.ModSec.ToProto(),
+			AccessLog: p.DesiredState.AccessLog.ToProto(),
+		},
+		GatewayGroup: p.GatewayGroup,
+	}
+	for _, policy := range p.DesiredState.RoutePolicies {
+		protection.DesiredState.RoutePolicies = append(protection.DesiredState.RoutePolicies, policy.ToProto())
+	}
+	for _, rateLimit := range p.DesiredState.RateLimits {
+		protection.DesiredState.RateLimits = append(protection.DesiredState.RateLimits, rateLimit.ToProto())
 	}
 	if p.Application.ID != 0 {
 		protection.Application = p.Application.ToProto()
@@ -109,6 +303,7 @@ func (s *ProtectionRepository) CreateProtection(req *wv1.CreateProtectionRequest
 	protection := &Protection{
 		ApplicationID: uint(req.ApplicationId),
 		Mode:          uint32(req.ProtectionMode),
+		GatewayGroup:  gatewayGroup(req.GatewayGroup),
 	}
 	protection.DesiredState.FromProto(req.DesiredState)
 	if err := s.db.Create(protection).Error; err != nil {
@@ -128,6 +323,16 @@ func (s *ProtectionRepository) GetProtection(req *wv1.GetProtectionRequest) (*Pr
 	return protection, nil
 }
 
+// ApplicationName returns the name of the protected application,
+// the security events and their stats are keyed by the application name
+func (s *ProtectionRepository) ApplicationName(protectionId uint32) (string, error) {
+	protection := &Protection{ID: uint(protectionId)}
+	if err := s.db.Preload("Application").First(protection).Error; err != nil {
+		return "", err
+	}
+	return protection.Application.Name, nil
+}
+
 func (s *ProtectionRepository) UpdateProtection(req *wv1.PutProtectionRequest) (*Protection, error) {
 	protection := &Protection{ID: uint(req.GetId())}
 	if req.ProtectionMode != nil {
@@ -138,6 +343,9 @@ func (s *ProtectionRepository) UpdateProtection(req *wv1.PutProtectionRequest) (
 		desiredState.FromProto(req.DesiredState)
 		protection.DesiredState = *desiredState
 	}
+	if req.GatewayGroup != nil {
+		protection.GatewayGroup = gatewayGroup(*req.GatewayGroup)
+	}
 	// fetch the application id for the given protection
 	res := s.db.Model(&Protection{}).
 		Select("application_id").
@@ -152,16 +360,27 @@ func (s *ProtectionRepository) UpdateProtection(req *wv1.PutProtectionRequest) (
 	if res.RowsAffected == 0 {
 		return nil, connect.NewError(connect.CodeNotFound, res.Error)
 	}
-	res = s.db.
-		Model(protection).
-		Updates(protection)
-	if res.Error != nil {
-		return nil, connect.NewError(connect.CodeInternal, res.Error)
-	}
-	if res.RowsAffected == 0 {
-		return nil, connect.NewError(connect.CodeNotFound, errors.New("protection id not found"))
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Model(protection).
+			Updates(protection)
+		if res.Error != nil {
+			return connect.NewError(connect.CodeInternal, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return connect.NewError(connect.CodeNotFound, errors.New("protection id not found"))
+		}
+		// link the protection state change to the request trace,
+		// so the control plane and the relay spans are part of it
+		if traceparent := tracing.Traceparent(tx.Statement.Context); traceparent != "" {
+			return NewStateRepository(tx, s.logger).
+				SetTraceparent(wv1.StateTypeId_STATE_TYPE_ID_PROTECTION, traceparent)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return s.GetProtection(&wv1.GetProtectionRequest{Id: uint32(protection.ID)})
 }
 
@@ -183,6 +402,9 @@ func (s *ProtectionRepository) ListProtections(options *wv1.ListProtectionsOptio
 			),
 		)
 	}
+	if options.GatewayGroup != nil {
+		query = query.Where("protections.gateway_group = ?", gatewayGroup(*options.GatewayGroup))
+	}
 
 	if options.IncludeApps != nil && *options.IncludeApps {
 		err = query.
@@ -31,14 +31,22 @@ BEGIN
                 COALESCE(new_keys, '{}'::text[])
                ) THEN
             UPDATE state_versions
-            SET version_id = uuid_generate_v4(), updated_at = NOW()
+            SET version_id = uuid_generate_v4(), updated_at = NOW(), traceparent = ''
             WHERE type_id = 1;
         END IF;
     END IF;
 
+    IF OLD.protocol_options IS DISTINCT FROM NEW.protocol_options
+        OR OLD.traffic_policy IS DISTINCT FROM NEW.traffic_policy
+        OR OLD.mirror_policy IS DISTINCT FROM NEW.mirror_policy THEN
+        UPDATE state_versions
+        SET version_id = uuid_generate_v4(), updated_at = NOW(), traceparent = ''
+        WHERE type_id = 1;
+    END IF;
+
     IF OLD.id IS DISTINCT FROM NEW.id THEN
         UPDATE state_versions
-        SET version_id = uuid_generate_v4(), updated_at = NOW()
+        SET version_id = uuid_generate_v4(), updated_at = NOW(), traceparent = ''
         WHERE type_id = 1;
     END IF;
     RETURN NEW;
@@ -59,11 +67,11 @@ CREATE OR REPLACE FUNCTION ports_insert_delete_trigger()
     RETURNS TRIGGER AS $$
 BEGIN
     IF TG_OP = 'INSERT' THEN
-        UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW() where type_id = 1;
+        UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW(), traceparent='' where type_id = 1;
         RETURN NEW;
 
     ELSIF TG_OP = 'DELETE' THEN
-        UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW() where type_id = 1;
+        UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW(), traceparent='' where type_id = 1;
         RETURN OLD;
     END IF;
 
@@ -84,13 +92,13 @@ CREATE OR REPLACE FUNCTION insert_update_delete_protection() RETURNS TRIGGER AS
 BEGIN
     CASE TG_OP
         WHEN 'INSERT' THEN
-            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW() where type_id = 1;
+            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW(), traceparent='' where type_id = 1;
             RETURN NEW;
         WHEN 'UPDATE' THEN
-            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW() where type_id = 1;
+            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW(), traceparent='' where type_id = 1;
             RETURN NEW;
         WHEN 'DELETE' THEN
-            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW() where type_id = 1;
+            UPDATE state_versions set version_id=uuid_generate_v4(), updated_at=NOW(), traceparent='' where type_id = 1;
             RETURN OLD;
         END CASE;
     RETURN NULL;
@@ -19,8 +19,10 @@ type StateRepository struct {
 type StateVersion struct {
 	TypeId    uint32 `gorm:"primaryKey"`
 	VersionId string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	// Traceparent of the request changed the state, reset by the state triggers
+	Traceparent string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 }
 
 func NewStateRepository(tx *gorm.DB, logger *zap.Logger) *StateRepository {
@@ -55,5 +57,13 @@ func (d *StateVersion) ToProto() *v1.GetStateVersionResponse {
 	return &v1.GetStateVersionResponse{
 		TypeId:         v1.StateTypeId(d.TypeId),
 		StateVersionId: d.VersionId,
+		Traceparent:    d.Traceparent,
 	}
 }
+
+// SetTraceparent links the current state version to the request trace
+func (s *StateRepository) SetTraceparent(typeId v1.StateTypeId, traceparent string) error {
+	return s.db.Model(&StateVersion{}).
+		Where("type_id = ?", uint32(typeId)).
+		Update("traceparent", traceparent).Error
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Dimss/wafie/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "wafie:span"
+
+// tracingPlugin creates a span for each repository database operation,
+// the parent span is taken from the statement context, see WithContext
+type tracingPlugin struct{}
+
+func (p *tracingPlugin) Name() string {
+	return "wafie:tracing"
+}
+
+func (p *tracingPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("wafie:before_create", startSpan("create")),
+		cb.Create().After("gorm:create").Register("wafie:after_create", endSpan),
+		cb.Query().Before("gorm:query").Register("wafie:before_query", startSpan("query")),
+		cb.Query().After("gorm:query").Register("wafie:after_query", endSpan),
+		cb.Update().Before("gorm:update").Register("wafie:before_update", startSpan("update")),
+		cb.Update().After("gorm:update").Register("wafie:after_update", endSpan),
+		cb.Delete().Before("gorm:delete").Register("wafie:before_delete", startSpan("delete")),
+		cb.Delete().After("gorm:delete").Register("wafie:after_delete", endSpan),
+		cb.Row().Before("gorm:row").Register("wafie:before_row", startSpan("row")),
+		cb.Row().After("gorm:row").Register("wafie:after_row", endSpan),
+		cb.Raw().Before("gorm:raw").Register("wafie:before_raw", startSpan("raw")),
+		cb.Raw().After("gorm:raw").Register("wafie:after_raw", endSpan),
+	)
+}
+
+func startSpan(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx := tx.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			// trace only the operations within a traced request
+			return
+		}
+		_, span := tracing.Tracer().Start(ctx, "db."+operation+" "+tx.Statement.Table,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.operation", operation),
+				attribute.String("db.sql.table", tx.Statement.Table),
+			),
+		)
+		tx.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(tx *gorm.DB) {
+	v, ok := tx.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	defer span.End()
+	span.SetAttributes(attribute.Int64("db.rows_affected", tx.Statement.RowsAffected))
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(tx.Error)
+		span.SetStatus(codes.Error, tx.Error.Error())
+	}
+}
+
+// WithContext returns the database session bound to the request context,
+// the repositories created with it are traced as part of the request
+func WithContext(ctx context.Context) *gorm.DB {
+	return db().WithContext(ctx)
+}
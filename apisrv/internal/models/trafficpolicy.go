@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+)
+
+type RetryPolicy struct {
+	RetryOn         []string `json:"retryOn,omitempty"`
+	NumRetries      uint32   `json:"numRetries"`
+	PerTryTimeoutMs uint32   `json:"perTryTimeoutMs"`
+}
+
+type CircuitBreakers struct {
+	MaxConnections     uint32 `json:"maxConnections"`
+	MaxPendingRequests uint32 `json:"maxPendingRequests"`
+	MaxRequests        uint32 `json:"maxRequests"`
+	MaxRetries         uint32 `json:"maxRetries"`
+}
+
+type OutlierDetection struct {
+	Consecutive5xx            uint32 `json:"consecutive5xx"`
+	ConsecutiveGatewayFailure uint32 `json:"consecutiveGatewayFailure"`
+	IntervalMs                uint32 `json:"intervalMs"`
+	BaseEjectionTimeMs        uint32 `json:"baseEjectionTimeMs"`
+	MaxEjectionPercent        uint32 `json:"maxEjectionPercent"`
+}
+
+type HealthCheck struct {
+	Path               string `json:"path"`
+	IntervalMs         uint32 `json:"intervalMs"`
+	TimeoutMs          uint32 `json:"timeoutMs"`
+	UnhealthyThreshold uint32 `json:"unhealthyThreshold"`
+	HealthyThreshold   uint32 `json:"healthyThreshold"`
+}
+
+type TrafficPolicy struct {
+	ConnectTimeoutMs uint32            `json:"connectTimeoutMs"`
+	RequestTimeoutMs uint32            `json:"requestTimeoutMs"`
+	IdleTimeoutMs    uint32            `json:"idleTimeoutMs"`
+	LbPolicy         uint32            `json:"lbPolicy"`
+	RetryPolicy      *RetryPolicy      `json:"retryPolicy,omitempty"`
+	CircuitBreakers  *CircuitBreakers  `json:"circuitBreakers,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+	HealthCheck      *HealthCheck      `json:"healthCheck,omitempty"`
+}
+
+func NewTrafficPolicyFromRequest(tp *wv1.TrafficPolicy) *TrafficPolicy {
+	if tp == nil {
+		return nil
+	}
+	policy := &TrafficPolicy{
+		ConnectTimeoutMs: tp.ConnectTimeoutMs,
+		RequestTimeoutMs: tp.RequestTimeoutMs,
+		IdleTimeoutMs:    tp.IdleTimeoutMs,
+		LbPolicy:         uint32(tp.LbPolicy),
+	}
+	if tp.RetryPolicy != nil {
+		policy.RetryPolicy = &RetryPolicy{
+			RetryOn:         tp.RetryPolicy.RetryOn,
+			NumRetries:      tp.RetryPolicy.NumRetries,
+			PerTryTimeoutMs: tp.RetryPolicy.PerTryTimeoutMs,
+		}
+	}
+	if tp.CircuitBreakers != nil {
+		policy.CircuitBreakers = &CircuitBreakers{
+			MaxConnections:     tp.CircuitBreakers.MaxConnections,
+			MaxPendingRequests: tp.CircuitBreakers.MaxPendingRequests,
+			MaxRequests:        tp.CircuitBreakers.MaxRequests,
+			MaxRetries:         tp.CircuitBreakers.MaxRetries,
+		}
+	}
+	if tp.OutlierDetection != nil {
+		policy.OutlierDetection = &OutlierDetection{
+			Consecutive5xx:            tp.OutlierDetection.Consecutive_5Xx,
+			ConsecutiveGatewayFailure: tp.OutlierDetection.ConsecutiveGatewayFailure,
+			IntervalMs:                tp.OutlierDetection.IntervalMs,
+			BaseEjectionTimeMs:        tp.OutlierDetection.BaseEjectionTimeMs,
+			MaxEjectionPercent:        tp.OutlierDetection.MaxEjectionPercent,
+		}
+	}
+	if tp.HealthCheck != nil {
+		policy.HealthCheck = &HealthCheck{
+			Path:               tp.HealthCheck.Path,
+			IntervalMs:         tp.HealthCheck.IntervalMs,
+			TimeoutMs:          tp.HealthCheck.TimeoutMs,
+			UnhealthyThreshold: tp.HealthCheck.UnhealthyThreshold,
+			HealthyThreshold:   tp.HealthCheck.HealthyThreshold,
+		}
+	}
+	return policy
+}
+
+func (p *TrafficPolicy) ToProto() *wv1.TrafficPolicy {
+	if p == nil {
+		return nil
+	}
+	policy := &wv1.TrafficPolicy{
+		ConnectTimeoutMs: p.ConnectTimeoutMs,
+		RequestTimeoutMs: p.RequestTimeoutMs,
+		IdleTimeoutMs:    p.IdleTimeoutMs,
+		LbPolicy:         wv1.LoadBalancingPolicy(p.LbPolicy),
+	}
+	if p.RetryPolicy != nil {
+		policy.RetryPolicy = &wv1.RetryPolicy{
+			RetryOn:         p.RetryPolicy.RetryOn,
+			NumRetries:      p.RetryPolicy.NumRetries,
+			PerTryTimeoutMs: p.RetryPolicy.PerTryTimeoutMs,
+		}
+	}
+	if p.CircuitBreakers != nil {
+		policy.CircuitBreakers = &wv1.CircuitBreakers{
+			MaxConnections:     p.CircuitBreakers.MaxConnections,
+			MaxPendingRequests: p.CircuitBreakers.MaxPendingRequests,
+			MaxRequests:        p.CircuitBreakers.MaxRequests,
+			MaxRetries:         p.CircuitBreakers.MaxRetries,
+		}
+	}
+	if p.OutlierDetection != nil {
+		policy.OutlierDetection = &wv1.OutlierDetection{
+			Consecutive_5Xx:           p.OutlierDetection.Consecutive5xx,
+			ConsecutiveGatewayFailure: p.OutlierDetection.ConsecutiveGatewayFailure,
+			IntervalMs:                p.OutlierDetection.IntervalMs,
+			BaseEjectionTimeMs:        p.OutlierDetection.BaseEjectionTimeMs,
+			MaxEjectionPercent:        p.OutlierDetection.MaxEjectionPercent,
+		}
+	}
+	if p.HealthCheck != nil {
+		policy.HealthCheck = &wv1.HealthCheck{
+			Path:               p.HealthCheck.Path,
+			IntervalMs:         p.HealthCheck.IntervalMs,
+			TimeoutMs:          p.HealthCheck.TimeoutMs,
+			UnhealthyThreshold: p.HealthCheck.UnhealthyThreshold,
+			HealthyThreshold:   p.HealthCheck.HealthyThreshold,
+		}
+	}
+	return policy
+}
+
+func (p *TrafficPolicy) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	default:
+		return fmt.Errorf("unsupported type for TrafficPolicy")
+	}
+}
+
+func (p *TrafficPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
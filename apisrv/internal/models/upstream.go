@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	applogger "github.com/Dimss/wafie/logger"
@@ -41,24 +42,58 @@ func NewMirrorPolicyFromRequest(mp *wv1.MirrorPolicy) *MirrorPolicy {
 	if mp == nil {
 		return nil
 	}
-	return &MirrorPolicy{
-		Status: uint32(mp.Status),
-		Ip:     mp.Ip,
-		Port:   int(mp.Port),
-		Dns:    mp.Dns,
+	policy := &MirrorPolicy{
+		Status:        uint32(mp.Status),
+		Ip:            mp.Ip,
+		Port:          int(mp.Port),
+		Dns:           mp.Dns,
+		SamplePercent: mp.SamplePercent,
+		PathPrefix:    mp.PathPrefix,
+		Mode:          uint32(mp.Mode),
 	}
+	for _, target := range mp.Targets {
+		policy.Targets = append(policy.Targets, MirrorTarget{
+			Ip:   target.Ip,
+			Port: int(target.Port),
+			Dns:  target.Dns,
+		})
+	}
+	for _, header := range mp.HeaderMatches {
+		policy.HeaderMatches = append(policy.HeaderMatches, MirrorHeaderMatch{
+			Name:  header.Name,
+			Value: header.Value,
+		})
+	}
+	return policy
 }
 
 func (p *MirrorPolicy) ToProto() *wv1.MirrorPolicy {
 	if p == nil {
 		return nil
 	}
-	return &wv1.MirrorPolicy{
-		Status: wv1.MirrorPolicyStatus(p.Status),
-		Ip:     p.Ip,
-		Port:   uint32(p.Port),
-		Dns:    p.Dns,
+	policy := &wv1.MirrorPolicy{
+		Status:        wv1.MirrorPolicyStatus(p.Status),
+		Ip:            p.Ip,
+		Port:          uint32(p.Port),
+		Dns:           p.Dns,
+		SamplePercent: p.SamplePercent,
+		PathPrefix:    p.PathPrefix,
+		Mode:          wv1.MirrorMode(p.Mode),
+	}
+	for _, target := range p.Targets {
+		policy.Targets = append(policy.Targets, &wv1.MirrorTarget{
+			Ip:   target.Ip,
+			Port: uint32(target.Port),
+			Dns:  target.Dns,
+		})
+	}
+	for _, header := range p.HeaderMatches {
+		policy.HeaderMatches = append(policy.HeaderMatches, &wv1.MirrorHeaderMatch{
+			Name:  header.Name,
+			Value: header.Value,
+		})
 	}
+	return policy
 }
 
 func (p *MirrorPolicy) Scan(value interface{}) error {
@@ -76,6 +111,51 @@ func (p *MirrorPolicy) Value() (driver.Value, error) {
 	return json.Marshal(p)
 }
 
+func NewProtocolOptionsFromRequest(po *wv1.UpstreamProtocolOptions) *ProtocolOptions {
+	if po == nil {
+		return nil
+	}
+	options := &ProtocolOptions{Protocol: uint32(po.Protocol)}
+	if po.Tls != nil {
+		options.Tls = &UpstreamTls{
+			Enabled:  po.Tls.Enabled,
+			Sni:      po.Tls.Sni,
+			CaBundle: po.Tls.CaBundle,
+		}
+	}
+	return options
+}
+
+func (o *ProtocolOptions) ToProto() *wv1.UpstreamProtocolOptions {
+	if o == nil {
+		return nil
+	}
+	options := &wv1.UpstreamProtocolOptions{Protocol: wv1.UpstreamProtocol(o.Protocol)}
+	if o.Tls != nil {
+		options.Tls = &wv1.UpstreamTls{
+			Enabled:  o.Tls.Enabled,
+			Sni:      o.Tls.Sni,
+			CaBundle: o.Tls.CaBundle,
+		}
+	}
+	return options
+}
+
+func (o *ProtocolOptions) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, o)
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	default:
+		return fmt.Errorf("unsupported type for ProtocolOptions")
+	}
+}
+
+func (o *ProtocolOptions) Value() (driver.Value, error) {
+	return json.Marshal(o)
+}
+
 type Endpoints map[string]Endpoint
 
 func (e Endpoints) Value() (driver.Value, error) {
@@ -109,17 +189,46 @@ func (e *Endpoints) Scan(value interface{}) error {
 	return json.Unmarshal(jsonData, e)
 }
 
+type MirrorTarget struct {
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
+	Dns  string `json:"dns"`
+}
+
+type MirrorHeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
 type MirrorPolicy struct {
-	Status uint32 `json:"status"`
-	Ip     string `json:"ip"`
-	Port   int    `json:"port"`
-	Dns    string `json:"dns"`
+	Status        uint32              `json:"status"`
+	Ip            string              `json:"ip"`
+	Port          int                 `json:"port"`
+	Dns           string              `json:"dns"`
+	SamplePercent *uint32             `json:"samplePercent,omitempty"`
+	Targets       []MirrorTarget      `json:"targets,omitempty"`
+	HeaderMatches []MirrorHeaderMatch `json:"headerMatches,omitempty"`
+	PathPrefix    string              `json:"pathPrefix,omitempty"`
+	Mode          uint32              `json:"mode,omitempty"`
+}
+
+type UpstreamTls struct {
+	Enabled  bool   `json:"enabled"`
+	Sni      string `json:"sni"`
+	CaBundle string `json:"caBundle"`
+}
+
+type ProtocolOptions struct {
+	Protocol uint32       `json:"protocol"`
+	Tls      *UpstreamTls `json:"tls"`
 }
 
 type Upstream struct {
-	ID                string        `gorm:"primaryKey;size:63"` // svc fqdn acting as a primary key for Upstream
-	Endpoints         *Endpoints    `gorm:"type:jsonb"`
-	MirrorPolicy      *MirrorPolicy `gorm:"type:jsonb"`
+	ID                string           `gorm:"primaryKey;size:63"` // svc fqdn acting as a primary key for Upstream
+	Endpoints         *Endpoints       `gorm:"type:jsonb"`
+	MirrorPolicy      *MirrorPolicy    `gorm:"type:jsonb"`
+	ProtocolOptions   *ProtocolOptions `gorm:"type:jsonb"`
+	TrafficPolicy     *TrafficPolicy   `gorm:"type:jsonb"`
 	UpstreamRouteType uint32
 	Ingresses         []Ingress `gorm:"foreignKey:UpstreamID"`
 	Ports             []Port    `gorm:"foreignKey:UpstreamID"`
@@ -150,6 +259,8 @@ func NewUpstreamFromRequest(upstreamReq *wv1.Upstream) *Upstream {
 		ID:                upstreamReq.SvcFqdn,
 		UpstreamRouteType: uint32(upstreamReq.UpstreamRouteType),
 		MirrorPolicy:      mirrorPolicy,
+		ProtocolOptions:   NewProtocolOptionsFromRequest(upstreamReq.ProtocolOptions),
+		TrafficPolicy:     NewTrafficPolicyFromRequest(upstreamReq.TrafficPolicy),
 	}
 	if upstreamReq.Endpoints != nil {
 		eps := make(Endpoints, len(upstreamReq.Endpoints))
@@ -161,17 +272,54 @@ func NewUpstreamFromRequest(upstreamReq *wv1.Upstream) *Upstream {
 	return u
 }
 
+// Save saves the upstream, the not set columns are omitted and keep their values
 func (s *UpstreamRepository) Save(u *Upstream) (*Upstream, error) {
+	omitColumns := upstreamOmitColumns(u)
+	if u.TrafficPolicy == nil {
+		omitColumns = append(omitColumns, "traffic_policy")
+	}
+	return u, s.db.
+		Omit(omitColumns...).
+		Save(&u).Error
+}
+
+// Update saves the upstream set by the operator, the traffic policy is set by the operator only,
+// so it is written even when not set, the upstream without the traffic policy clears it
+func (s *UpstreamRepository) Update(u *Upstream) (*Upstream, error) {
+	return u, s.db.
+		Omit(upstreamOmitColumns(u)...).
+		Save(&u).Error
+}
+
+func upstreamOmitColumns(u *Upstream) []string {
 	omitColumns := []string{"Ingresses", "Ports"}
 	if u.MirrorPolicy == nil {
 		omitColumns = append(omitColumns, "mirror_policy")
 	}
+	if u.ProtocolOptions == nil {
+		omitColumns = append(omitColumns, "protocol_options")
+	}
 	if u.Endpoints == nil {
 		omitColumns = append(omitColumns, "endpoints")
 	}
-	return u, s.db.
-		Omit(omitColumns...).
-		Save(&u).Error
+	return omitColumns
+}
+
+// SaveDiscovered saves the discovered upstream, the discovered protocol options are
+// the service port appProtocol defaults, set only when the upstream has none,
+// so the options set by the operator, e.g. the CA bundle, are not overwritten on the next discovery
+func (s *UpstreamRepository) SaveDiscovered(u *Upstream) (*Upstream, error) {
+	if u.ProtocolOptions != nil {
+		existing := &Upstream{}
+		err := s.db.Select("protocol_options").Where("id = ?", u.ID).First(existing).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return u, err
+		}
+		if existing.ProtocolOptions != nil {
+			u.ProtocolOptions = nil
+		}
+	}
+	return s.Save(u)
 }
 
 func (s *UpstreamRepository) List(options *wv1.ListRoutesOptions) (upstreams []*Upstream, err error) {
@@ -195,6 +343,8 @@ func (u *Upstream) ToProto() *wv1.Upstream {
 		SvcFqdn:           u.ID,
 		UpstreamRouteType: wv1.UpstreamRouteType(u.UpstreamRouteType),
 		MirrorPolicy:      u.MirrorPolicy.ToProto(),
+		ProtocolOptions:   u.ProtocolOptions.ToProto(),
+		TrafficPolicy:     u.TrafficPolicy.ToProto(),
 	}
 	if u.Endpoints != nil {
 		for ip, ep := range *u.Endpoints {
@@ -0,0 +1,249 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWindow         = 5 * time.Minute
+	defaultBaselineWindow = 24 * time.Hour
+	// firing and not acknowledged alerts are notified again after the repeat interval
+	repeatInterval = time.Hour
+
+	statusFiring   = "firing"
+	statusResolved = "resolved"
+)
+
+// Evaluator periodically evaluates the alert rules
+// over the security events stats and the components statuses
+type Evaluator struct {
+	logger   *zap.Logger
+	interval time.Duration
+	notifier *Notifier
+}
+
+func NewEvaluator(interval time.Duration, log *zap.Logger) *Evaluator {
+	return &Evaluator{
+		logger:   log,
+		interval: interval,
+		notifier: NewNotifier(),
+	}
+}
+
+func (e *Evaluator) Start() {
+	e.logger.Info("starting alert rules evaluator", zap.Duration("interval", e.interval))
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.evaluate(time.Now())
+		}
+	}()
+}
+
+func (e *Evaluator) evaluate(now time.Time) {
+	repo := models.NewAlertRepository(nil, e.logger)
+	rules, err := repo.ListRules()
+	if err != nil {
+		e.logger.Error("failed to list alert rules", zap.Error(err))
+		return
+	}
+	silences, err := repo.ListSilences(false)
+	if err != nil {
+		e.logger.Error("failed to list silences", zap.Error(err))
+		return
+	}
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		l := e.logger.With(zap.Uint("ruleId", rule.ID), zap.String("rule", rule.Name))
+		value, err := e.ruleValue(rule, now)
+		if err != nil {
+			l.Error("failed to evaluate alert rule", zap.Error(err))
+			continue
+		}
+		if err := e.transition(repo, rule, value, silenced(rule, silences, now), now); err != nil {
+			l.Error("failed to update alert", zap.Error(err))
+		}
+	}
+}
+
+// transition fires, updates or resolves the rule alert
+func (e *Evaluator) transition(repo *models.AlertRepository, rule *models.AlertRule, value float64, silenced bool, now time.Time) error {
+	alert, err := repo.OpenAlert(rule.ID)
+	if err != nil {
+		return err
+	}
+	if firing(rule, value) {
+		if alert == nil {
+			alert = &models.Alert{
+				RuleID:    rule.ID,
+				RuleName:  rule.Name,
+				State:     uint32(wv1.AlertState_ALERT_STATE_FIRING),
+				StartedAt: now,
+			}
+		}
+		alert.Value = value
+		alert.Summary = summary(rule, value)
+		alert.Silenced = silenced
+		// the alert must be saved first, so the notification has the alert id
+		if err := repo.SaveAlert(alert); err != nil {
+			return err
+		}
+		notify := !silenced &&
+			alert.State == uint32(wv1.AlertState_ALERT_STATE_FIRING) &&
+			(alert.NotifiedAt == nil || now.Sub(*alert.NotifiedAt) >= repeatInterval)
+		if notify {
+			e.notify(repo, rule, alert, statusFiring)
+			alert.NotifiedAt = &now
+			return repo.SaveAlert(alert)
+		}
+		return nil
+	}
+	if alert == nil {
+		return nil
+	}
+	alert.State = uint32(wv1.AlertState_ALERT_STATE_RESOLVED)
+	alert.ResolvedAt = &now
+	alert.Value = value
+	if err := repo.SaveAlert(alert); err != nil {
+		return err
+	}
+	// resolution is notified only for the notified alerts
+	if alert.NotifiedAt != nil && !silenced {
+		e.notify(repo, rule, alert, statusResolved)
+	}
+	return nil
+}
+
+// notify sends the notifications in the background, so a slow channel does not delay
+// the evaluation of the other rules, each notification is bounded by the notification timeout
+func (e *Evaluator) notify(repo *models.AlertRepository, rule *models.AlertRule, alert *models.Alert, status string) {
+	channels, err := repo.ListChannels(rule.ChannelIDs)
+	if err != nil {
+		e.logger.Error("failed to list notification channels", zap.Error(err))
+		return
+	}
+	// the alert is updated once notified, the notifications are sent with a copy
+	ruleCopy, alertCopy := *rule, *alert
+	for _, channel := range channels {
+		go func(channel *models.NotificationChannel) {
+			ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+			defer cancel()
+			if err := e.notifier.Notify(ctx, channel, &ruleCopy, &alertCopy, status); err != nil {
+				e.logger.Error("failed to send alert notification",
+					zap.String("channel", channel.Name), zap.Uint64("alertId", alertCopy.ID), zap.Error(err))
+			}
+		}(channel)
+	}
+}
+
+// ruleValue returns the rule metric value over the window,
+// or the window to baseline rate ratio for the rate of change rules
+func (e *Evaluator) ruleValue(rule *models.AlertRule, now time.Time) (float64, error) {
+	window := seconds(rule.WindowSeconds, defaultWindow)
+	if wv1.AlertMetric(rule.Metric) == wv1.AlertMetric_ALERT_METRIC_RELAY_INSTANCES {
+		if wv1.AlertRuleType(rule.Type) != wv1.AlertRuleType_ALERT_RULE_TYPE_THRESHOLD {
+			return 0, errors.New("relay instances metric supports only threshold rules")
+		}
+		count, err := models.NewComponentRepository(nil, e.logger).
+			CountHealthy(wv1.ComponentType_COMPONENT_TYPE_RELAY_INSTANCE, rule.ProtectionID, now.Add(-window))
+		return float64(count), err
+	}
+	application := rule.Application
+	if rule.ProtectionID != nil {
+		name, err := models.NewProtectionRepository(nil, e.logger).ApplicationName(*rule.ProtectionID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the rule protection application: %w", err)
+		}
+		// the rule scoped to an application and to the protection of another application matches no events
+		if application != nil && *application != name {
+			return 0, nil
+		}
+		application = &name
+	}
+	current, err := e.eventsValue(rule, application, now.Add(-window), now)
+	if err != nil {
+		return 0, err
+	}
+	switch wv1.AlertRuleType(rule.Type) {
+	case wv1.AlertRuleType_ALERT_RULE_TYPE_THRESHOLD:
+		return current, nil
+	case wv1.AlertRuleType_ALERT_RULE_TYPE_RATE_OF_CHANGE:
+		baselineWindow := seconds(rule.BaselineWindowSeconds, defaultBaselineWindow)
+		baseline, err := e.eventsValue(rule, application, now.Add(-window-baselineWindow), now.Add(-window))
+		if err != nil {
+			return 0, err
+		}
+		return rateOfChange(current, window, baseline, baselineWindow), nil
+	default:
+		return 0, fmt.Errorf("unsupported alert rule type %d", rule.Type)
+	}
+}
+
+// eventsValue sums the rule metric events of the application, all the applications when nil
+func (e *Evaluator) eventsValue(rule *models.AlertRule, application *string, from, to time.Time) (float64, error) {
+	events, blocked, err := models.NewEventStatsRepository(nil, e.logger).SumEvents(application, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if wv1.AlertMetric(rule.Metric) == wv1.AlertMetric_ALERT_METRIC_BLOCKED_EVENTS {
+		return float64(blocked), nil
+	}
+	return float64(events), nil
+}
+
+// rateOfChange divides the window rate by the baseline rate,
+// an empty baseline counts as a single event, so new spikes are detected
+func rateOfChange(current float64, window time.Duration, baseline float64, baselineWindow time.Duration) float64 {
+	currentRate := current / window.Seconds()
+	baselineRate := max(baseline, 1) / baselineWindow.Seconds()
+	return currentRate / baselineRate
+}
+
+func firing(rule *models.AlertRule, value float64) bool {
+	switch wv1.AlertComparison(rule.Comparison) {
+	case wv1.AlertComparison_ALERT_COMPARISON_GREATER_THAN:
+		return value > rule.Threshold
+	case wv1.AlertComparison_ALERT_COMPARISON_LESS_THAN:
+		return value < rule.Threshold
+	default:
+		return false
+	}
+}
+
+func silenced(rule *models.AlertRule, silences []*models.Silence, now time.Time) bool {
+	for _, s := range silences {
+		if s.Matches(rule, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func summary(rule *models.AlertRule, value float64) string {
+	comparison := ">"
+	if wv1.AlertComparison(rule.Comparison) == wv1.AlertComparison_ALERT_COMPARISON_LESS_THAN {
+		comparison = "<"
+	}
+	metric := wv1.AlertMetric(rule.Metric).String()
+	if wv1.AlertRuleType(rule.Type) == wv1.AlertRuleType_ALERT_RULE_TYPE_RATE_OF_CHANGE {
+		return fmt.Sprintf("%s rate changed %.2fx (%s %g)", metric, value, comparison, rule.Threshold)
+	}
+	return fmt.Sprintf("%s is %g (%s %g)", metric, value, comparison, rule.Threshold)
+}
+
+func seconds(s uint32, defaultDuration time.Duration) time.Duration {
+	if s == 0 {
+		return defaultDuration
+	}
+	return time.Duration(s) * time.Second
+}
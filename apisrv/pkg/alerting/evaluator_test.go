@@ -0,0 +1,68 @@
+package alerting
+
+import (
+	"testing"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateOfChange(t *testing.T) {
+	// 100 events in 5 minutes vs 288 events in 24 hours (1 per 5 minutes)
+	assert.InDelta(t, 100, rateOfChange(100, 5*time.Minute, 288, 24*time.Hour), 0.001)
+	// empty baseline counts as a single event
+	assert.InDelta(t, 288, rateOfChange(1, 5*time.Minute, 0, 24*time.Hour), 0.001)
+}
+
+func TestFiring(t *testing.T) {
+	tests := []struct {
+		name       string
+		comparison wv1.AlertComparison
+		value      float64
+		want       bool
+	}{
+		{name: "greater than fires", comparison: wv1.AlertComparison_ALERT_COMPARISON_GREATER_THAN, value: 11, want: true},
+		{name: "greater than equal", comparison: wv1.AlertComparison_ALERT_COMPARISON_GREATER_THAN, value: 10, want: false},
+		{name: "less than fires", comparison: wv1.AlertComparison_ALERT_COMPARISON_LESS_THAN, value: 0, want: true},
+		{name: "less than ok", comparison: wv1.AlertComparison_ALERT_COMPARISON_LESS_THAN, value: 10, want: false},
+		{name: "unspecified", comparison: wv1.AlertComparison_ALERT_COMPARISON_UNSPECIFIED, value: 100, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &models.AlertRule{Comparison: uint32(tt.comparison), Threshold: 10}
+			if tt.comparison == wv1.AlertComparison_ALERT_COMPARISON_LESS_THAN {
+				rule.Threshold = 1
+				if !tt.want {
+					rule.Threshold = 5
+				}
+			}
+			assert.Equal(t, tt.want, firing(rule, tt.value))
+		})
+	}
+}
+
+func TestSilenced(t *testing.T) {
+	now := time.Now()
+	ruleId := uint32(1)
+	otherRuleId := uint32(2)
+	app := "shop"
+	rule := &models.AlertRule{ID: 1, Application: &app}
+	tests := []struct {
+		name    string
+		silence *models.Silence
+		want    bool
+	}{
+		{name: "all rules", silence: &models.Silence{StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Minute)}, want: true},
+		{name: "expired", silence: &models.Silence{StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-time.Minute)}, want: false},
+		{name: "rule", silence: &models.Silence{RuleID: &ruleId, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Minute)}, want: true},
+		{name: "other rule", silence: &models.Silence{RuleID: &otherRuleId, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Minute)}, want: false},
+		{name: "application", silence: &models.Silence{Application: &app, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Minute)}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, silenced(rule, []*models.Silence{tt.silence}, now))
+		})
+	}
+}
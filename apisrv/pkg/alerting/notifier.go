@@ -0,0 +1,159 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const notificationTimeout = 10 * time.Second
+
+// notification is the webhook payload
+type notification struct {
+	Status string          `json:"status"`
+	Rule   json.RawMessage `json:"rule"`
+	Alert  json.RawMessage `json:"alert"`
+}
+
+// Notifier sends the alert notifications to the rule channels
+type Notifier struct {
+	client *http.Client
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{client: &http.Client{Timeout: notificationTimeout}}
+}
+
+// Notify sends the notification to the channel, the ctx deadline bounds the webhook request and the SMTP session
+func (n *Notifier) Notify(ctx context.Context, channel *models.NotificationChannel, rule *models.AlertRule, alert *models.Alert, status string) error {
+	if channel.Config.Webhook != nil {
+		return n.webhook(ctx, channel.Config.Webhook, rule, alert, status)
+	}
+	if channel.Config.Email != nil {
+		return n.email(ctx, channel.Config.Email, rule, alert, status)
+	}
+	return fmt.Errorf("channel %s has no config", channel.Name)
+}
+
+func (n *Notifier) webhook(ctx context.Context, cfg *models.WebhookChannel, rule *models.AlertRule, alert *models.Alert, status string) error {
+	ruleJson, err := protojson.Marshal(rule.ToProto())
+	if err != nil {
+		return err
+	}
+	alertJson, err := protojson.Marshal(alert.ToProto())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&notification{Status: status, Rule: ruleJson, Alert: alertJson})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected webhook response status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) email(ctx context.Context, cfg *models.EmailChannel, rule *models.AlertRule, alert *models.Alert, status string) error {
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := strings.Cut(cfg.SmtpAddr, ":")
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	subject := fmt.Sprintf("[wafie] [%s] %s", strings.ToUpper(status), rule.Name)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", alert.Summary)
+	fmt.Fprintf(&msg, "Rule: %s (%d)\r\n", rule.Name, rule.ID)
+	fmt.Fprintf(&msg, "Alert: %d\r\n", alert.ID)
+	fmt.Fprintf(&msg, "Value: %g\r\n", alert.Value)
+	fmt.Fprintf(&msg, "Started at: %s\r\n", alert.StartedAt.Format(time.RFC3339))
+	if alert.ResolvedAt != nil {
+		fmt.Fprintf(&msg, "Resolved at: %s\r\n", alert.ResolvedAt.Format(time.RFC3339))
+	}
+	return sendMail(ctx, cfg.SmtpAddr, auth, cfg.From, cfg.To, msg.Bytes())
+}
+
+// sendMail is the smtp.SendMail bounded by the ctx deadline
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
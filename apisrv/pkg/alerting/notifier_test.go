@@ -0,0 +1,64 @@
+package alerting
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	alert := &models.Alert{ID: 1, Value: 11, StartedAt: time.Now()}
+	rule := &models.AlertRule{Name: "blocked spike"}
+
+	t.Run("webhook", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the request is cancelled once the notification times out
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		}))
+		defer srv.Close()
+		channel := &models.NotificationChannel{Config: models.ChannelConfig{
+			Webhook: &models.WebhookChannel{Url: srv.URL},
+		}}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := NewNotifier().Notify(ctx, channel, rule, alert, "firing")
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("email", func(t *testing.T) {
+		// the SMTP server accepts the connection and never greets
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer lis.Close()
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			<-release
+		}()
+		channel := &models.NotificationChannel{Config: models.ChannelConfig{
+			Email: &models.EmailChannel{SmtpAddr: lis.Addr().String(), From: "wafie@example.com", To: []string{"ops@example.com"}},
+		}}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err = NewNotifier().Notify(ctx, channel, rule, alert, "firing")
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
@@ -0,0 +1,180 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"go.uber.org/zap"
+)
+
+type AlertService struct {
+	v1.UnimplementedAlertServiceHandler
+	logger *zap.Logger
+}
+
+func NewAlertService(log *zap.Logger) *AlertService {
+	return &AlertService{
+		logger: log,
+	}
+}
+
+func (s *AlertService) CreateAlertRule(
+	ctx context.Context,
+	req *connect.Request[wv1.CreateAlertRuleRequest]) (
+	*connect.Response[wv1.CreateAlertRuleResponse], error) {
+	rule, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).CreateRule(req.Msg.Rule)
+	if err != nil {
+		s.logger.Error("failed to create alert rule", zap.Error(err))
+		return connect.NewResponse(&wv1.CreateAlertRuleResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.CreateAlertRuleResponse{Rule: rule.ToProto()}), nil
+}
+
+func (s *AlertService) ListAlertRules(
+	ctx context.Context,
+	req *connect.Request[wv1.ListAlertRulesRequest]) (
+	*connect.Response[wv1.ListAlertRulesResponse], error) {
+	rules, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).ListRules()
+	if err != nil {
+		s.logger.Error("failed to list alert rules", zap.Error(err))
+		return connect.NewResponse(&wv1.ListAlertRulesResponse{}), connectError(err)
+	}
+	rulesv1 := make([]*wv1.AlertRule, 0, len(rules))
+	for _, r := range rules {
+		rulesv1 = append(rulesv1, r.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListAlertRulesResponse{Rules: rulesv1}), nil
+}
+
+func (s *AlertService) DeleteAlertRule(
+	ctx context.Context,
+	req *connect.Request[wv1.DeleteAlertRuleRequest]) (
+	*connect.Response[wv1.DeleteAlertRuleResponse], error) {
+	if err := models.NewAlertRepository(models.WithContext(ctx), s.logger).DeleteRule(req.Msg.Id); err != nil {
+		s.logger.Error("failed to delete alert rule", zap.Error(err))
+		return connect.NewResponse(&wv1.DeleteAlertRuleResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.DeleteAlertRuleResponse{}), nil
+}
+
+func (s *AlertService) CreateNotificationChannel(
+	ctx context.Context,
+	req *connect.Request[wv1.CreateNotificationChannelRequest]) (
+	*connect.Response[wv1.CreateNotificationChannelResponse], error) {
+	channel, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).CreateChannel(req.Msg.Channel)
+	if err != nil {
+		s.logger.Error("failed to create notification channel", zap.Error(err))
+		return connect.NewResponse(&wv1.CreateNotificationChannelResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.CreateNotificationChannelResponse{Channel: channel.ToProto()}), nil
+}
+
+func (s *AlertService) ListNotificationChannels(
+	ctx context.Context,
+	req *connect.Request[wv1.ListNotificationChannelsRequest]) (
+	*connect.Response[wv1.ListNotificationChannelsResponse], error) {
+	channels, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).ListChannels(nil)
+	if err != nil {
+		s.logger.Error("failed to list notification channels", zap.Error(err))
+		return connect.NewResponse(&wv1.ListNotificationChannelsResponse{}), connectError(err)
+	}
+	channelsv1 := make([]*wv1.NotificationChannel, 0, len(channels))
+	for _, c := range channels {
+		channelsv1 = append(channelsv1, c.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListNotificationChannelsResponse{Channels: channelsv1}), nil
+}
+
+func (s *AlertService) DeleteNotificationChannel(
+	ctx context.Context,
+	req *connect.Request[wv1.DeleteNotificationChannelRequest]) (
+	*connect.Response[wv1.DeleteNotificationChannelResponse], error) {
+	if err := models.NewAlertRepository(models.WithContext(ctx), s.logger).DeleteChannel(req.Msg.Id); err != nil {
+		s.logger.Error("failed to delete notification channel", zap.Error(err))
+		return connect.NewResponse(&wv1.DeleteNotificationChannelResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.DeleteNotificationChannelResponse{}), nil
+}
+
+func (s *AlertService) ListAlerts(
+	ctx context.Context,
+	req *connect.Request[wv1.ListAlertsRequest]) (
+	*connect.Response[wv1.ListAlertsResponse], error) {
+	alerts, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).ListAlerts(req.Msg.Options)
+	if err != nil {
+		s.logger.Error("failed to list alerts", zap.Error(err))
+		return connect.NewResponse(&wv1.ListAlertsResponse{}), connectError(err)
+	}
+	alertsv1 := make([]*wv1.Alert, 0, len(alerts))
+	for _, a := range alerts {
+		alertsv1 = append(alertsv1, a.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListAlertsResponse{Alerts: alertsv1}), nil
+}
+
+func (s *AlertService) AcknowledgeAlert(
+	ctx context.Context,
+	req *connect.Request[wv1.AcknowledgeAlertRequest]) (
+	*connect.Response[wv1.AcknowledgeAlertResponse], error) {
+	l := s.logger.With(zap.Uint64("alertId", req.Msg.Id))
+	alert, err := models.NewAlertRepository(models.WithContext(ctx), l).AcknowledgeAlert(req.Msg.Id, req.Msg.AcknowledgedBy)
+	if err != nil {
+		l.Error("failed to acknowledge alert", zap.Error(err))
+		return connect.NewResponse(&wv1.AcknowledgeAlertResponse{}), connectError(err)
+	}
+	l.Info("alert acknowledged", zap.String("by", req.Msg.AcknowledgedBy))
+	return connect.NewResponse(&wv1.AcknowledgeAlertResponse{Alert: alert.ToProto()}), nil
+}
+
+func (s *AlertService) CreateSilence(
+	ctx context.Context,
+	req *connect.Request[wv1.CreateSilenceRequest]) (
+	*connect.Response[wv1.CreateSilenceResponse], error) {
+	silence, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).CreateSilence(req.Msg.Silence)
+	if err != nil {
+		s.logger.Error("failed to create silence", zap.Error(err))
+		return connect.NewResponse(&wv1.CreateSilenceResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.CreateSilenceResponse{Silence: silence.ToProto()}), nil
+}
+
+func (s *AlertService) ListSilences(
+	ctx context.Context,
+	req *connect.Request[wv1.ListSilencesRequest]) (
+	*connect.Response[wv1.ListSilencesResponse], error) {
+	silences, err := models.NewAlertRepository(models.WithContext(ctx), s.logger).ListSilences(req.Msg.IncludeExpired)
+	if err != nil {
+		s.logger.Error("failed to list silences", zap.Error(err))
+		return connect.NewResponse(&wv1.ListSilencesResponse{}), connectError(err)
+	}
+	silencesv1 := make([]*wv1.Silence, 0, len(silences))
+	for _, silence := range silences {
+		silencesv1 = append(silencesv1, silence.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListSilencesResponse{Silences: silencesv1}), nil
+}
+
+func (s *AlertService) DeleteSilence(
+	ctx context.Context,
+	req *connect.Request[wv1.DeleteSilenceRequest]) (
+	*connect.Response[wv1.DeleteSilenceResponse], error) {
+	if err := models.NewAlertRepository(models.WithContext(ctx), s.logger).DeleteSilence(req.Msg.Id); err != nil {
+		s.logger.Error("failed to delete silence", zap.Error(err))
+		return connect.NewResponse(&wv1.DeleteSilenceResponse{}), connectError(err)
+	}
+	return connect.NewResponse(&wv1.DeleteSilenceResponse{}), nil
+}
+
+// connectError keeps the repository connect errors codes,
+// any other error is returned as an internal error
+func connectError(err error) error {
+	var connectErr *connect.Error
+	if errors.As(err, &connectErr) {
+		return connectErr
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
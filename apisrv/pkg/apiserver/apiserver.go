@@ -2,23 +2,27 @@ package apiserver
 
 import (
 	"net/http"
+	"time"
 
 	"connectrpc.com/connect"
 	"connectrpc.com/grpchealth"
 	"connectrpc.com/grpcreflect"
 	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/metrics"
+	"github.com/Dimss/wafie/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 )
 
 type ApiServer struct {
-	logger *zap.Logger
+	logger          *zap.Logger
+	eventsRetention time.Duration
 }
 
-func NewApiServer(log *zap.Logger) *ApiServer {
+func NewApiServer(log *zap.Logger, eventsRetention time.Duration) *ApiServer {
 
-	return &ApiServer{logger: log}
+	return &ApiServer{logger: log, eventsRetention: eventsRetention}
 }
 
 func (s *ApiServer) Start() {
@@ -36,35 +40,60 @@ func (s *ApiServer) Start() {
 
 func (s *ApiServer) registerHandlers(mux *http.ServeMux) {
 	s.logger.Info("registering handlers")
-	compress1KB := connect.WithCompressMinBytes(1024)
+	handlerOpts := connect.WithHandlerOptions(
+		connect.WithCompressMinBytes(1024),
+		connect.WithInterceptors(metrics.NewRpcInterceptor()),
+		tracing.HandlerOption(),
+	)
+	mux.Handle(metrics.Path, metrics.Handler())
 	mux.Handle(
 		grpchealth.NewHandler(
 			NewHealthCheckService(s.logger),
-			compress1KB,
+			handlerOpts,
 		),
 	)
 	mux.Handle(
 		v1.NewApplicationServiceHandler(
 			NewApplicationService(s.logger),
-			compress1KB,
+			handlerOpts,
 		),
 	)
 	mux.Handle(
 		v1.NewProtectionServiceHandler(
 			NewProtectionService(s.logger),
-			compress1KB,
+			handlerOpts,
 		),
 	)
 	mux.Handle(
 		v1.NewStateVersionServiceHandler(
 			NewStateVersionService(s.logger),
-			compress1KB,
+			handlerOpts,
 		),
 	)
 	mux.Handle(
 		v1.NewRouteServiceHandler(
 			NewRouteService(s.logger),
-			compress1KB,
+			handlerOpts,
+		),
+	)
+	eventSvc := NewEventService(s.logger, s.eventsRetention)
+	eventSvc.StartRetentionCleanup()
+	mux.Handle(
+		v1.NewEventServiceHandler(
+			eventSvc,
+			handlerOpts,
+		),
+	)
+	mux.Handle(
+		v1.NewAlertServiceHandler(
+			NewAlertService(s.logger),
+			handlerOpts,
+		),
+	)
+	mux.Handle(
+		v1.NewComponentServiceHandler(
+			NewComponentService(s.logger),
+			handlerOpts,
 		),
 	)
 }
@@ -76,6 +105,9 @@ func (s *ApiServer) enableReflection(mux *http.ServeMux) {
 		v1.ApplicationServiceName,
 		v1.ProtectionServiceName,
 		v1.StateVersionServiceName,
+		v1.EventServiceName,
+		v1.AlertServiceName,
+		v1.ComponentServiceName,
 	)
 	mux.Handle(grpcreflect.NewHandlerV1(reflector))
 	mux.Handle(grpcreflect.NewHandlerV1Alpha(reflector))
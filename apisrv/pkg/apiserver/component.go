@@ -0,0 +1,49 @@
+package apiserver
+
+import (
+	"context"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"go.uber.org/zap"
+)
+
+type ComponentService struct {
+	v1.UnimplementedComponentServiceHandler
+	logger *zap.Logger
+}
+
+func NewComponentService(log *zap.Logger) *ComponentService {
+	return &ComponentService{
+		logger: log,
+	}
+}
+
+func (s *ComponentService) ReportStatus(
+	ctx context.Context,
+	req *connect.Request[wv1.ReportStatusRequest]) (
+	*connect.Response[wv1.ReportStatusResponse], error) {
+	if err := models.NewComponentRepository(models.WithContext(ctx), s.logger).ReportStatus(req.Msg.Statuses); err != nil {
+		s.logger.Error("failed to report components status", zap.Error(err))
+		return connect.NewResponse(&wv1.ReportStatusResponse{}), connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(&wv1.ReportStatusResponse{}), nil
+}
+
+func (s *ComponentService) ListComponentStatuses(
+	ctx context.Context,
+	req *connect.Request[wv1.ListComponentStatusesRequest]) (
+	*connect.Response[wv1.ListComponentStatusesResponse], error) {
+	statuses, err := models.NewComponentRepository(models.WithContext(ctx), s.logger).ListStatuses(req.Msg.ProtectionId)
+	if err != nil {
+		s.logger.Error("failed to list components statuses", zap.Error(err))
+		return connect.NewResponse(&wv1.ListComponentStatusesResponse{}), connect.NewError(connect.CodeInternal, err)
+	}
+	statusesv1 := make([]*wv1.ComponentStatus, 0, len(statuses))
+	for _, status := range statuses {
+		statusesv1 = append(statusesv1, status.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListComponentStatusesResponse{Statuses: statusesv1}), nil
+}
@@ -0,0 +1,89 @@
+package apiserver
+
+import (
+	"context"
+	"time"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	"go.uber.org/zap"
+)
+
+type EventService struct {
+	v1.UnimplementedEventServiceHandler
+	logger    *zap.Logger
+	retention time.Duration
+}
+
+func NewEventService(log *zap.Logger, retention time.Duration) *EventService {
+	return &EventService{
+		logger:    log,
+		retention: retention,
+	}
+}
+
+func (s *EventService) CreateEvents(
+	ctx context.Context,
+	req *connect.Request[wv1.CreateEventsRequest]) (
+	*connect.Response[wv1.CreateEventsResponse], error) {
+	created, err := models.NewEventRepository(models.WithContext(ctx), s.logger).CreateEvents(req.Msg.Events)
+	if err != nil {
+		s.logger.Error("failed to create security events", zap.Error(err))
+		return connect.NewResponse(&wv1.CreateEventsResponse{}), connect.NewError(connect.CodeInternal, err)
+	}
+	s.logger.Debug("security events created", zap.Int("count", created))
+	return connect.NewResponse(&wv1.CreateEventsResponse{Created: uint32(created)}), nil
+}
+
+func (s *EventService) ListEvents(
+	ctx context.Context,
+	req *connect.Request[wv1.ListEventsRequest]) (
+	*connect.Response[wv1.ListEventsResponse], error) {
+	events, err := models.NewEventRepository(models.WithContext(ctx), s.logger).ListEvents(req.Msg.Options)
+	if err != nil {
+		s.logger.Error("failed to list security events", zap.Error(err))
+		return connect.NewResponse(&wv1.ListEventsResponse{}), connect.NewError(connect.CodeInternal, err)
+	}
+	eventsv1 := make([]*wv1.SecurityEvent, 0, len(events))
+	for _, e := range events {
+		eventsv1 = append(eventsv1, e.ToProto())
+	}
+	return connect.NewResponse(&wv1.ListEventsResponse{Events: eventsv1}), nil
+}
+
+func (s *EventService) GetStats(
+	ctx context.Context,
+	req *connect.Request[wv1.GetStatsRequest]) (
+	*connect.Response[wv1.GetStatsResponse], error) {
+	stats, err := models.NewEventStatsRepository(models.WithContext(ctx), s.logger).GetStats(req.Msg.Options)
+	if err != nil {
+		s.logger.Error("failed to get security events stats", zap.Error(err))
+		return connect.NewResponse(&wv1.GetStatsResponse{}), connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(stats), nil
+}
+
+// StartRetentionCleanup periodically removes the events older than the retention period
+func (s *EventService) StartRetentionCleanup() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			deleted, err := models.NewEventRepository(nil, s.logger).DeleteEventsOlderThan(s.retention)
+			if err != nil {
+				s.logger.Error("failed to cleanup security events", zap.Error(err))
+			} else if deleted > 0 {
+				s.logger.Info("expired security events removed", zap.Int64("count", deleted))
+			}
+			deleted, err = models.NewEventStatsRepository(nil, s.logger).DeleteStatsOlderThan(s.retention)
+			if err != nil {
+				s.logger.Error("failed to cleanup security events stats", zap.Error(err))
+			} else if deleted > 0 {
+				s.logger.Info("expired security events stats removed", zap.Int64("count", deleted))
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+package apiserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	wafiev1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	applogger "github.com/Dimss/wafie/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var eventsHour = time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+func securityEvent(application string, at time.Duration, blocked bool, uri string, ruleIds ...string) *wafiev1.SecurityEvent {
+	return &wafiev1.SecurityEvent{
+		RequestId:   randomString(),
+		Application: application,
+		RuleIds:     ruleIds,
+		ClientIp:    "10.0.0.1",
+		Uri:         uri,
+		Method:      "GET",
+		Blocked:     blocked,
+		Timestamp:   timestamppb.New(eventsHour.Add(at)),
+	}
+}
+
+func createEvents(t *testing.T, svc *EventService, events ...*wafiev1.SecurityEvent) {
+	resp, err := svc.CreateEvents(context.Background(),
+		connect.NewRequest(&wafiev1.CreateEventsRequest{Events: events}))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(len(events)), resp.Msg.Created)
+}
+
+func TestCreateEventsStatsRollup(t *testing.T) {
+	_, db, logger := setupTest(t)
+	svc := NewEventService(applogger.NewLogger(), 24*time.Hour)
+	application := randomString()
+	createEvents(t, svc,
+		securityEvent(application, 10*time.Second, true, "/login?user=admin", "942100"),
+		securityEvent(application, 50*time.Second, false, "/login", "942100", "920350"),
+		securityEvent(application, time.Minute, true, "/search"),
+	)
+	// the stats of the same minute are added up on the next ingest
+	createEvents(t, svc, securityEvent(application, 30*time.Second, true, "/login", "942100"))
+
+	var stats []models.EventStat
+	require.NoError(t, db.
+		Where("application = ? AND dimension = ?", application, models.StatDimensionTotal).
+		Order("bucket_start").
+		Find(&stats).Error)
+	require.Len(t, stats, 2)
+	assert.True(t, eventsHour.Equal(stats[0].BucketStart))
+	assert.Equal(t, uint64(3), stats[0].Events)
+	assert.Equal(t, uint64(2), stats[0].Blocked)
+	assert.True(t, eventsHour.Add(time.Minute).Equal(stats[1].BucketStart))
+	assert.Equal(t, uint64(1), stats[1].Events)
+
+	// the query string is dropped from the uri dimension
+	var uriStats []models.EventStat
+	require.NoError(t, db.
+		Where("application = ? AND dimension = ?", application, models.StatDimensionUri).
+		Order("bucket_start, value").
+		Find(&uriStats).Error)
+	require.Len(t, uriStats, 2)
+	assert.Equal(t, "/login", uriStats[0].Value)
+	assert.Equal(t, uint64(3), uriStats[0].Events)
+	assert.Equal(t, "/search", uriStats[1].Value)
+
+	events, blocked, err := models.NewEventStatsRepository(db, logger).
+		SumEvents(&application, eventsHour, eventsHour.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), events)
+	assert.Equal(t, uint64(2), blocked)
+}
+
+func TestGetStatsBuckets(t *testing.T) {
+	svc := NewEventService(applogger.NewLogger(), 24*time.Hour)
+	application := randomString()
+	createEvents(t, svc,
+		securityEvent(application, 0, true, "/login", "942100"),
+		securityEvent(application, 20*time.Minute, false, "/login", "942100", "920350"),
+		securityEvent(application, 59*time.Minute, true, "/search", "920350"),
+		securityEvent(application, 65*time.Minute, true, "/login", "942100"),
+		// outside of the requested window
+		securityEvent(application, 2*time.Hour, true, "/login", "942100"),
+	)
+	resp, err := svc.GetStats(context.Background(), connect.NewRequest(&wafiev1.GetStatsRequest{
+		Options: &wafiev1.GetStatsOptions{
+			Application:   &application,
+			From:          timestamppb.New(eventsHour),
+			To:            timestamppb.New(eventsHour.Add(2 * time.Hour)),
+			BucketSeconds: 3600,
+		},
+	}))
+	require.NoError(t, err)
+	stats := resp.Msg
+
+	// the minute stats are rolled up into the hour buckets
+	require.Len(t, stats.Buckets, 2)
+	assert.True(t, eventsHour.Equal(stats.Buckets[0].Start.AsTime()))
+	assert.Equal(t, application, stats.Buckets[0].Application)
+	assert.Equal(t, uint64(3), stats.Buckets[0].Events)
+	assert.Equal(t, uint64(2), stats.Buckets[0].Blocked)
+	assert.True(t, eventsHour.Add(time.Hour).Equal(stats.Buckets[1].Start.AsTime()))
+	assert.Equal(t, uint64(1), stats.Buckets[1].Events)
+	assert.Equal(t, uint64(4), stats.Events)
+	assert.Equal(t, uint64(3), stats.Blocked)
+	assert.InDelta(t, 0.75, stats.BlockRatio, 0.001)
+
+	require.Len(t, stats.TopRuleIds, 2)
+	assert.Equal(t, "942100", stats.TopRuleIds[0].Value)
+	assert.Equal(t, uint64(3), stats.TopRuleIds[0].Events)
+	require.Len(t, stats.TopUris, 2)
+	assert.Equal(t, "/login", stats.TopUris[0].Value)
+	require.Len(t, stats.TopClientIps, 1)
+	assert.Equal(t, uint64(4), stats.TopClientIps[0].Events)
+
+	// the bucket is never finer than the stats granularity
+	resp, err = svc.GetStats(context.Background(), connect.NewRequest(&wafiev1.GetStatsRequest{
+		Options: &wafiev1.GetStatsOptions{
+			Application:   &application,
+			From:          timestamppb.New(eventsHour),
+			To:            timestamppb.New(eventsHour.Add(time.Hour)),
+			BucketSeconds: 1,
+		},
+	}))
+	require.NoError(t, err)
+	assert.Len(t, resp.Msg.Buckets, 3)
+}
+
+func TestDeleteEventsOlderThan(t *testing.T) {
+	_, db, logger := setupTest(t)
+	svc := NewEventService(applogger.NewLogger(), 24*time.Hour)
+	application := randomString()
+	recent := securityEvent(application, 0, true, "/login", "942100")
+	recent.Timestamp = timestamppb.New(time.Now().Add(-time.Hour))
+	createEvents(t, svc, securityEvent(application, 0, true, "/login", "942100"), recent)
+
+	deleted, err := models.NewEventRepository(db, logger).DeleteEventsOlderThan(24 * time.Hour)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, deleted, int64(1))
+	deleted, err = models.NewEventStatsRepository(db, logger).DeleteStatsOlderThan(24 * time.Hour)
+	require.NoError(t, err)
+	// the total, rule id, client ip and uri stats of the expired event
+	assert.GreaterOrEqual(t, deleted, int64(4))
+
+	// the events and the stats within the retention period are kept
+	resp, err := svc.ListEvents(context.Background(), connect.NewRequest(&wafiev1.ListEventsRequest{
+		Options: &wafiev1.ListEventsOptions{Application: &application},
+	}))
+	require.NoError(t, err)
+	require.Len(t, resp.Msg.Events, 1)
+	assert.Equal(t, recent.RequestId, resp.Msg.Events[0].RequestId)
+	var stats []models.EventStat
+	require.NoError(t, db.Where("application = ?", application).Find(&stats).Error)
+	assert.Len(t, stats, 4)
+	for _, stat := range stats {
+		assert.True(t, stat.BucketStart.After(time.Now().Add(-24*time.Hour)))
+	}
+}
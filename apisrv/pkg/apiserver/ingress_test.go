@@ -10,21 +10,25 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCreateIngressWithNoneExistingApp(t *testing.T) {
-	svc := NewIngressService(applogger.NewLogger())
-	req := connect.NewRequest(
-		&wafiev1.CreateIngressRequest{
-			Ingress: &wafiev1.Ingress{
-				Name:         randomString(),
-				Host:         randomString(),
-				Port:         80,
-				Path:         "",
-				UpstreamHost: randomString(),
-				UpstreamPort: 90,
-			},
+func createRouteRequest(applicationId int32) *wafiev1.CreateRouteRequest {
+	return &wafiev1.CreateRouteRequest{
+		Ingress: &wafiev1.Ingress{
+			Name:          randomString(),
+			Host:          randomString(),
+			Port:          80,
+			Path:          "",
+			ApplicationId: applicationId,
 		},
-	)
-	_, err := svc.CreateIngress(context.Background(), req)
+		Upstream: &wafiev1.Upstream{
+			SvcFqdn: randomString() + ".default.svc.cluster.local",
+		},
+		Ports: []*wafiev1.Port{{Number: 90}},
+	}
+}
+
+func TestCreateIngressWithNoneExistingApp(t *testing.T) {
+	svc := NewRouteService(applogger.NewLogger())
+	_, err := svc.CreateRoute(context.Background(), connect.NewRequest(createRouteRequest(0)))
 	assert.Nil(t, err)
 }
 
@@ -39,21 +43,9 @@ func TestCreateIngressWithExistingApp(t *testing.T) {
 		),
 	)
 	assert.Nil(t, err)
-	svc := NewIngressService(applogger.NewLogger())
-	_, err = svc.CreateIngress(context.Background(),
-		connect.NewRequest(
-			&wafiev1.CreateIngressRequest{
-				Ingress: &wafiev1.Ingress{
-					Name:          randomString(),
-					Host:          randomString(),
-					Port:          80,
-					Path:          "",
-					UpstreamHost:  randomString(),
-					UpstreamPort:  90,
-					ApplicationId: int32(app.Msg.Id),
-				},
-			},
-		),
+	svc := NewRouteService(applogger.NewLogger())
+	_, err = svc.CreateRoute(context.Background(),
+		connect.NewRequest(createRouteRequest(int32(app.Msg.Id))),
 	)
 
 	assert.Nil(t, err)
@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	wafiev1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	"github.com/Dimss/wafie/apisrv/internal/models"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/go-connections/nat"
@@ -17,63 +16,24 @@ import (
 	"gorm.io/gorm"
 )
 
-func setupTest(t *testing.T) (testcontainers.Container, *gorm.DB, *zap.Logger) {
+// testContainer is the PostgreSQL container started once by TestMain
+var testContainer testcontainers.Container
 
+// setupTest returns the TestMain PostgreSQL container and its db connection,
+// the models share the connection established by TestMain
+func setupTest(t *testing.T) (testcontainers.Container, *gorm.DB, *zap.Logger) {
 	ctx := context.Background()
-	var pgPort nat.Port = "5432/tcp"
-	req := testcontainers.ContainerRequest{
-		Image: "postgres:15-alpine",
-		HostConfigModifier: func(hostConfig *container.HostConfig) {
-			hostConfig.PortBindings = nat.PortMap{
-				"5432/tcp": []nat.PortBinding{
-					{HostIP: "0.0.0.0", HostPort: "5431"},
-				},
-			}
-		},
-		ExposedPorts: []string{string(pgPort)},
-		Env: map[string]string{
-			"POSTGRES_USER":     "test",
-			"POSTGRES_PASSWORD": "test",
-			"POSTGRES_DB":       "testdb",
-		},
-		WaitingFor: wait.ForListeningPort(pgPort),
-	}
-	postgresContainer, err := testcontainers.
-		GenericContainer(
-			ctx,
-			testcontainers.GenericContainerRequest{
-				ContainerRequest: req,
-				Started:          true,
-			},
-		)
+	host, err := testContainer.Host(ctx)
 	if err != nil {
-		t.Fatalf("failed to start PostgreSQL container: %v", err)
+		t.Fatalf("failed to get PostgreSQL container host: %v", err)
 	}
-	// Get the container's host and port
-	host, _ := postgresContainer.Host(ctx)
 	logger, _ := zap.NewDevelopment()
 	dbCfg := models.NewDbCfg(host, 5431, "test", "test", "testdb", logger)
 	db, err := models.NewDb(dbCfg)
 	if err != nil {
 		t.Fatalf("failed to connect to PostgreSQL: %v", err)
 	}
-	return postgresContainer, db, logger
-}
-
-func createApp(db *gorm.DB, logger *zap.Logger) *models.Application {
-	appModelSvc := models.NewApplicationRepository(db, logger)
-	app, _ := appModelSvc.CreateApplication(&wafiev1.CreateApplicationRequest{Name: "testapp"})
-	ingressModelSvc := models.NewIngressModelSvc(db, logger)
-	_ = ingressModelSvc.NewIngressFromRequest(&wafiev1.CreateIngressRequest{Ingress: &wafiev1.Ingress{
-		Name:          "testapp",
-		Host:          "testapp-host",
-		Port:          80,
-		Path:          "/",
-		UpstreamHost:  "testapp-host",
-		UpstreamPort:  8080,
-		ApplicationId: int32(app.ID),
-	}})
-	return app
+	return testContainer, db, logger
 }
 
 func randomString() string {
@@ -118,6 +78,7 @@ func setupTest1() {
 	if err != nil {
 		panic(err)
 	}
+	testContainer = postgresContainer
 	// Get the container's host and port
 	host, _ := postgresContainer.Host(ctx)
 	logger, _ := zap.NewDevelopment()
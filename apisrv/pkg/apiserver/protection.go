@@ -2,7 +2,10 @@ package apiserver
 
 import (
 	"context"
+	"fmt"
+	"regexp"
 
+	"buf.build/go/protovalidate"
 	"connectrpc.com/connect"
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
@@ -28,7 +31,13 @@ func (s *ProtectionService) CreateProtection(
 	l := s.logger.With(zap.Uint32("applicationId", req.Msg.ApplicationId))
 	l.Info("creating new protection entry")
 	defer l.Info("protection entry created")
-	repo := models.NewProtectionRepository(nil, l)
+	if err := protovalidate.Validate(req.Msg); err != nil {
+		return connect.NewResponse(&wv1.CreateProtectionResponse{}), connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if err := validateDesiredState(req.Msg.DesiredState); err != nil {
+		return connect.NewResponse(&wv1.CreateProtectionResponse{}), err
+	}
+	repo := models.NewProtectionRepository(models.WithContext(ctx), l)
 	protection, err := repo.CreateProtection(req.Msg)
 	if err != nil {
 		l.Error("failed to create protection entry", zap.Error(err))
@@ -46,7 +55,7 @@ func (s *ProtectionService) GetProtection(
 	l := s.logger.With(zap.Uint32("protectionId", req.Msg.Id))
 	l.Info("getting protection entry")
 	defer l.Info("protection entry retrieved")
-	repo := models.NewProtectionRepository(nil, l)
+	repo := models.NewProtectionRepository(models.WithContext(ctx), l)
 	protection, err := repo.GetProtection(req.Msg)
 	if err != nil {
 		l.Error("failed to get protection entry", zap.Error(err))
@@ -64,7 +73,13 @@ func (s *ProtectionService) PutProtection(
 	l := s.logger.With(zap.Uint32("protectionId", req.Msg.Id))
 	l.Info("updating protection entry")
 	defer l.Info("protection entry updated")
-	repo := models.NewProtectionRepository(nil, l)
+	if err := protovalidate.Validate(req.Msg); err != nil {
+		return connect.NewResponse(&wv1.PutProtectionResponse{}), connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if err := validateDesiredState(req.Msg.DesiredState); err != nil {
+		return connect.NewResponse(&wv1.PutProtectionResponse{}), err
+	}
+	repo := models.NewProtectionRepository(models.WithContext(ctx), l)
 	protection, err := repo.UpdateProtection(req.Msg)
 	if err != nil {
 		return connect.NewResponse(&wv1.PutProtectionResponse{}), err
@@ -80,7 +95,7 @@ func (s *ProtectionService) ListProtections(
 	*connect.Response[wv1.ListProtectionsResponse], error) {
 	s.logger.Info("listing protections")
 	defer s.logger.Info("protections listed")
-	repo := models.NewProtectionRepository(nil, s.logger)
+	repo := models.NewProtectionRepository(models.WithContext(ctx), s.logger)
 	protections, err := repo.ListProtections(req.Msg.Options)
 	if err != nil {
 		s.logger.Error("failed to list protections", zap.Error(err))
@@ -102,7 +117,7 @@ func (s *ProtectionService) DeleteProtection(
 	l := s.logger.With(zap.Uint32("protectionId", req.Msg.Id))
 	l.Info("deleting protection entry")
 	defer l.Info("protection entry deleted")
-	protectionModelSvc := models.NewProtectionRepository(nil, l)
+	protectionModelSvc := models.NewProtectionRepository(models.WithContext(ctx), l)
 	err := protectionModelSvc.DeleteProtection(req.Msg.Id)
 	if err != nil {
 		l.Error("failed to delete protection entry", zap.Error(err))
@@ -110,3 +125,23 @@ func (s *ProtectionService) DeleteProtection(
 	}
 	return connect.NewResponse(&wv1.DeleteProtectionResponse{}), nil
 }
+
+// validateDesiredState checks the route policies before those are rendered by the gateway,
+// an invalid regex would be rejected by envoy for the whole gateway group
+func validateDesiredState(desiredState *wv1.ProtectionDesiredState) error {
+	if desiredState == nil {
+		return nil
+	}
+	if err := protovalidate.Validate(desiredState); err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	for _, policy := range desiredState.RoutePolicies {
+		if policy.PathMatchType != wv1.PathMatchType_PATH_MATCH_TYPE_REGEX {
+			continue
+		}
+		if _, err := regexp.Compile(policy.Path); err != nil {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid route policy path regex: %w", err))
+		}
+	}
+	return nil
+}
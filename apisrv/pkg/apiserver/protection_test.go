@@ -22,22 +22,10 @@ func createProtectionDependencies(t *testing.T) (appId uint32) {
 		),
 	)
 	assert.Nil(t, err)
-	// create new ingress
-	ingSvc := NewIngressService(applogger.NewLogger())
-	_, err = ingSvc.CreateIngress(context.Background(),
-		connect.NewRequest(
-			&wafiev1.CreateIngressRequest{
-				Ingress: &wafiev1.Ingress{
-					Name:          randomString(),
-					Host:          randomString(),
-					Port:          80,
-					Path:          "",
-					UpstreamHost:  randomString(),
-					UpstreamPort:  90,
-					ApplicationId: int32(app.Msg.Id),
-				},
-			},
-		),
+	// create new route
+	routeSvc := NewRouteService(applogger.NewLogger())
+	_, err = routeSvc.CreateRoute(context.Background(),
+		connect.NewRequest(createRouteRequest(int32(app.Msg.Id))),
 	)
 	assert.Nil(t, err)
 	//create new protection
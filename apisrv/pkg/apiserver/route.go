@@ -31,20 +31,20 @@ func (s *RouteService) CreateRoute(
 	if err := protovalidate.Validate(req.Msg); err != nil {
 		return connect.NewResponse(&wv1.CreateRouteResponse{}), connect.NewError(connect.CodeInternal, err)
 	}
-	// save upstream
-	u, err := models.NewUpstreamRepository(nil, s.logger).
-		Save(models.NewUpstreamFromRequest(req.Msg.Upstream))
+	// save upstream, keeping the protocol options already set
+	u, err := models.NewUpstreamRepository(models.WithContext(ctx), s.logger).
+		SaveDiscovered(models.NewUpstreamFromRequest(req.Msg.Upstream))
 	if err != nil {
 		return connect.NewResponse(&wv1.CreateRouteResponse{}), connect.NewError(connect.CodeInternal, err)
 	}
 	// save ingress
 	i := models.NewIngressFromProto(req.Msg.Ingress)
 	i.UpstreamID = u.ID // set foreign key upstream id
-	if err := models.NewIngressModelSvc(nil, s.logger).Save(i); err != nil {
+	if err := models.NewIngressModelSvc(models.WithContext(ctx), s.logger).Save(i); err != nil {
 		return connect.NewResponse(&wv1.CreateRouteResponse{}), err
 	}
 	// save ports
-	err = models.NewPortModelSvc(u.ID, i.ID, nil, s.logger).
+	err = models.NewPortModelSvc(u.ID, i.ID, models.WithContext(ctx), s.logger).
 		Save(models.NewPortsFromProto(req.Msg.Ports))
 	return connect.NewResponse(&wv1.CreateRouteResponse{}), err
 }
@@ -57,12 +57,13 @@ func (s *RouteService) UpdateRoute(
 	if err := protovalidate.Validate(req.Msg); err != nil {
 		return connect.NewResponse(&wv1.UpdateRouteResponse{}), connect.NewError(connect.CodeInternal, err)
 	}
-	_, err := models.NewUpstreamRepository(nil, s.logger).
-		Save(models.NewUpstreamFromRequest(req.Msg.Upstream))
+	// the upstream without the traffic policy clears it
+	_, err := models.NewUpstreamRepository(models.WithContext(ctx), s.logger).
+		Update(models.NewUpstreamFromRequest(req.Msg.Upstream))
 	if err != nil {
 		return connect.NewResponse(&wv1.UpdateRouteResponse{}), connect.NewError(connect.CodeInternal, err)
 	}
-	//models.NewPortModelSvc(nil, s.logger)
+	//models.NewPortModelSvc(models.WithContext(ctx), s.logger)
 	return connect.NewResponse(&wv1.UpdateRouteResponse{}), nil
 }
 
@@ -74,7 +75,7 @@ func (s *RouteService) ListRoutes(
 		return connect.NewResponse(&wv1.ListRoutesResponse{}), connect.NewError(connect.CodeInternal, err)
 	}
 	upstreams, err := models.
-		NewUpstreamRepository(nil, s.logger).
+		NewUpstreamRepository(models.WithContext(ctx), s.logger).
 		List(req.Msg.Options)
 	if err != nil {
 		return connect.NewResponse(&wv1.ListRoutesResponse{}), connect.NewError(connect.CodeInternal, err)
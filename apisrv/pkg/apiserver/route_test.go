@@ -0,0 +1,40 @@
+package apiserver
+
+import (
+	"context"
+	"testing"
+
+	"connectrpc.com/connect"
+	wafiev1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/apisrv/internal/models"
+	applogger "github.com/Dimss/wafie/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateRouteTrafficPolicy(t *testing.T) {
+	_, db, _ := setupTest(t)
+	svc := NewRouteService(applogger.NewLogger())
+	svcFqdn := randomString() + ".default.svc.cluster.local"
+	update := func(trafficPolicy *wafiev1.TrafficPolicy) *models.Upstream {
+		_, err := svc.UpdateRoute(context.Background(), connect.NewRequest(&wafiev1.UpdateRouteRequest{
+			Upstream: &wafiev1.Upstream{
+				SvcFqdn:           svcFqdn,
+				UpstreamRouteType: wafiev1.UpstreamRouteType_UPSTREAM_ROUTE_TYPE_PORT,
+				TrafficPolicy:     trafficPolicy,
+			},
+		}))
+		require.NoError(t, err)
+		upstream := &models.Upstream{}
+		require.NoError(t, db.Where("id = ?", svcFqdn).First(upstream).Error)
+		return upstream
+	}
+
+	upstream := update(&wafiev1.TrafficPolicy{ConnectTimeoutMs: 500, RequestTimeoutMs: 3000})
+	require.NotNil(t, upstream.TrafficPolicy)
+	assert.Equal(t, uint32(500), upstream.TrafficPolicy.ConnectTimeoutMs)
+
+	// the update without the traffic policy clears it
+	upstream = update(nil)
+	assert.Nil(t, upstream.TrafficPolicy)
+}
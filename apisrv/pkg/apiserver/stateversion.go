@@ -26,7 +26,7 @@ func (s *StateVersionService) GetStateVersion(
 	req *connect.Request[wv1.GetStateVersionRequest]) (
 	*connect.Response[wv1.GetStateVersionResponse], error) {
 	version, err := models.
-		NewStateRepository(nil, s.logger).
+		NewStateRepository(models.WithContext(ctx), s.logger).
 		GetVersionByTypeId(uint32(req.Msg.TypeId))
 	if err != nil {
 		s.logger.Error("error getting protection version", zap.Error(err))
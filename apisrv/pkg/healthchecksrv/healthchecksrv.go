@@ -2,6 +2,7 @@ package ingresscache
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"connectrpc.com/connect"
@@ -9,6 +10,7 @@ import (
 	healthv1 "github.com/Dimss/wafie/api/gen/grpc/health/v1"
 	"github.com/Dimss/wafie/api/gen/grpc/health/v1/healthv1connect"
 	"github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/metrics"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
@@ -18,6 +20,8 @@ type Server struct {
 	logger     *zap.Logger
 	listenAddr string
 	apiAddr    string
+	// checks of the named health services, the empty service name checks the API server
+	checks map[string]func(ctx context.Context) bool
 }
 
 func NewHealthCheckServer(listenAddr, apiAddr string) *Server {
@@ -25,14 +29,22 @@ func NewHealthCheckServer(listenAddr, apiAddr string) *Server {
 		logger:     logger.NewLogger(),
 		listenAddr: listenAddr,
 		apiAddr:    apiAddr,
+		checks:     map[string]func(ctx context.Context) bool{},
 	}
 }
 
+// AddCheck serves the check as the service health, must be called before Serve
+func (s *Server) AddCheck(service string, check func(ctx context.Context) bool) *Server {
+	s.checks[service] = check
+	return s
+}
+
 func (s *Server) Serve() {
 	go func() {
 		s.logger.Info("starting health check server", zap.String("address", s.listenAddr))
 		mux := http.NewServeMux()
 		mux.Handle(grpchealth.NewHandler(s))
+		mux.Handle(metrics.Path, metrics.Handler())
 		go func() {
 			if err := http.ListenAndServe(s.listenAddr, h2c.NewHandler(mux, &http2.Server{})); err != nil {
 				s.logger.Error("failed to start health check server", zap.Error(err))
@@ -41,7 +53,17 @@ func (s *Server) Serve() {
 	}()
 }
 
-func (s *Server) Check(context.Context, *grpchealth.CheckRequest) (*grpchealth.CheckResponse, error) {
+func (s *Server) Check(ctx context.Context, req *grpchealth.CheckRequest) (*grpchealth.CheckResponse, error) {
+	if req.Service != "" {
+		check, ok := s.checks[req.Service]
+		if !ok {
+			return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("unknown health service %q", req.Service))
+		}
+		if check(ctx) {
+			return &grpchealth.CheckResponse{Status: grpchealth.StatusServing}, nil
+		}
+		return &grpchealth.CheckResponse{Status: grpchealth.StatusNotServing}, nil
+	}
 	apiSrvHealthCheck := healthv1connect.NewHealthClient(http.DefaultClient, s.apiAddr)
 	resp, err := apiSrvHealthCheck.Check(context.Background(), connect.NewRequest(&healthv1.HealthCheckRequest{}))
 	if err != nil {
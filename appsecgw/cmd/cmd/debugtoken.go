@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	debugTokenCmd.PersistentFlags().DurationP("ttl", "t", 10*time.Minute, "Debug token time to live")
+	debugTokenCmd.PersistentFlags().StringP("host", "", "", "Host of the traced requests, the token is valid for this host only")
+	viper.BindPFlag("ttl", debugTokenCmd.PersistentFlags().Lookup("ttl"))
+	viper.BindPFlag("host", debugTokenCmd.PersistentFlags().Lookup("host"))
+	rootCmd.AddCommand(debugTokenCmd)
+}
+
+var debugTokenCmd = &cobra.Command{
+	Use:   "debug-token",
+	Short: fmt.Sprintf("Print a signed %s header value, signed with the %s secret", debugtrace.Header, debugtrace.SecretEnv),
+	Run: func(cmd *cobra.Command, args []string) {
+		secret := os.Getenv(debugtrace.SecretEnv)
+		if secret == "" {
+			fmt.Fprintf(os.Stderr, "%s is not set\n", debugtrace.SecretEnv)
+			os.Exit(1)
+		}
+		host := viper.GetString("host")
+		if host == "" {
+			fmt.Fprintln(os.Stderr, "--host is required")
+			os.Exit(1)
+		}
+		fmt.Println(debugtrace.Sign([]byte(secret), host, time.Now().Add(viper.GetDuration("ttl"))))
+	},
+}
@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	hsrv "github.com/Dimss/wafie/apisrv/pkg/healthchecksrv"
 	"github.com/Dimss/wafie/appsecgw/pkg/controlplane"
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	"github.com/Dimss/wafie/appsecgw/pkg/events"
+	"github.com/Dimss/wafie/appsecgw/pkg/gatewaysrv"
 	"github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -18,9 +24,53 @@ func init() {
 	startCmd.PersistentFlags().StringP("namespace", "n", "default", "K8s namespace")
 	startCmd.PersistentFlags().BoolP("envoy-xds-srv-only", "e", false,
 		"Set to true to run only xds, without starting envoy instance")
+	startCmd.PersistentFlags().StringP("sinks-config", "", "", "Security events sinks config file")
+	startCmd.PersistentFlags().Uint32P("domain-listener-port", "", 50080,
+		"Shared listener port of the protections routed by the ingress host")
+	startCmd.PersistentFlags().BoolP("tls-secrets", "", true,
+		"Terminate TLS of the ingress hosts with the ingress tls secrets, requires the secrets watch permission")
+	startCmd.PersistentFlags().StringSliceP("tls-secret-namespaces", "", nil,
+		"Namespaces of the watched ingress tls secrets, all namespaces when empty")
+	startCmd.PersistentFlags().DurationP("drain-period", "", 15*time.Second,
+		"Graceful drain period of the envoy listeners on shutdown")
+	startCmd.PersistentFlags().StringP("node-id", "", "", "Envoy node id, defaults to the hostname")
+	startCmd.PersistentFlags().StringP("gateway-group", "", controlplane.DefaultGatewayGroup,
+		"Gateway group of the envoy node, only the protections assigned to the group are served")
+	startCmd.PersistentFlags().StringP("snapshot-path", "", "/data/xds/snapshot.json",
+		"Last known good xDS snapshot file, set empty to disable the snapshot persistence")
+	startCmd.PersistentFlags().StringSliceP("access-log-sinks", "", []string{controlplane.AccessLogSinkStdout},
+		"Envoy JSON access log sinks, any of stdout|file|grpc")
+	startCmd.PersistentFlags().StringP("access-log-file", "", controlplane.DefaultAccessLogPath,
+		"Access log file of the file sink, rotated by the envoy supervisor")
+	startCmd.PersistentFlags().Int64P("access-log-max-size", "", 100<<20,
+		"Access log file size in bytes triggering the rotation")
+	startCmd.PersistentFlags().Int64P("audit-log-max-size", "", 100<<20,
+		"ModSecurity audit log file size in bytes triggering the rotation")
+	startCmd.PersistentFlags().StringP("access-log-als-addr", "", "",
+		"gRPC access log service host:port of the grpc sink")
+	startCmd.PersistentFlags().StringP("gateway-peers", "", "",
+		"Headless service of all the gateways, the debug trace requests are forwarded to the gateway holding the trace")
+	startCmd.PersistentFlags().StringP("tracing-exporter", "", tracing.ExporterNone, "Tracing exporter, one of none|otlp|stdout")
+	startCmd.PersistentFlags().StringP("tracing-endpoint", "", "", "OTLP HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces")
 	viper.BindPFlag("api-addr", startCmd.PersistentFlags().Lookup("api-addr"))
 	viper.BindPFlag("namespace", startCmd.PersistentFlags().Lookup("namespace"))
 	viper.BindPFlag("envoy-xds-srv-only", startCmd.PersistentFlags().Lookup("envoy-xds-srv-only"))
+	viper.BindPFlag("sinks-config", startCmd.PersistentFlags().Lookup("sinks-config"))
+	viper.BindPFlag("domain-listener-port", startCmd.PersistentFlags().Lookup("domain-listener-port"))
+	viper.BindPFlag("tls-secrets", startCmd.PersistentFlags().Lookup("tls-secrets"))
+	viper.BindPFlag("tls-secret-namespaces", startCmd.PersistentFlags().Lookup("tls-secret-namespaces"))
+	viper.BindPFlag("drain-period", startCmd.PersistentFlags().Lookup("drain-period"))
+	viper.BindPFlag("node-id", startCmd.PersistentFlags().Lookup("node-id"))
+	viper.BindPFlag("gateway-group", startCmd.PersistentFlags().Lookup("gateway-group"))
+	viper.BindPFlag("snapshot-path", startCmd.PersistentFlags().Lookup("snapshot-path"))
+	viper.BindPFlag("access-log-sinks", startCmd.PersistentFlags().Lookup("access-log-sinks"))
+	viper.BindPFlag("access-log-file", startCmd.PersistentFlags().Lookup("access-log-file"))
+	viper.BindPFlag("access-log-max-size", startCmd.PersistentFlags().Lookup("access-log-max-size"))
+	viper.BindPFlag("audit-log-max-size", startCmd.PersistentFlags().Lookup("audit-log-max-size"))
+	viper.BindPFlag("access-log-als-addr", startCmd.PersistentFlags().Lookup("access-log-als-addr"))
+	viper.BindPFlag("gateway-peers", startCmd.PersistentFlags().Lookup("gateway-peers"))
+	viper.BindPFlag("tracing-exporter", startCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-endpoint", startCmd.PersistentFlags().Lookup("tracing-endpoint"))
 	rootCmd.AddCommand(startCmd)
 }
 
@@ -29,24 +79,52 @@ var startCmd = &cobra.Command{
 	Short: "Wafie AppSec Gateway control plane envoy gRPC server",
 	Run: func(cmd *cobra.Command, args []string) {
 		logger := logger.NewLogger()
-		// start health check server
-		hsrv.NewHealthCheckServer(
-			":8082", viper.GetString("api-addr"),
-		).Serve()
+		shutdownTracing, err := tracing.Init("wafie-appsecgw",
+			viper.GetString("tracing-exporter"), viper.GetString("tracing-endpoint"), logger)
+		if err != nil {
+			logger.Fatal("failed to initialize tracing", zap.Error(err))
+		}
+		accessLog, err := controlplane.NewAccessLogConfig(viper.GetStringSlice("access-log-sinks"),
+			viper.GetString("access-log-file"), viper.GetString("access-log-als-addr"))
+		if err != nil {
+			logger.Fatal("invalid access log config", zap.Error(err))
+		}
+		healthCheckSrv := hsrv.NewHealthCheckServer(":8082", viper.GetString("api-addr"))
 		logger.Info("starting AppSec Gateway gRPC server")
-		go controlplane.
-			NewEnvoyControlPlane(
-				viper.GetString("api-addr"),
-				viper.GetString("namespace"),
-			).Start()
+		cp := controlplane.NewEnvoyControlPlane(
+			viper.GetString("api-addr"),
+			viper.GetString("namespace"),
+			viper.GetString("snapshot-path"),
+			viper.GetUint32("domain-listener-port"),
+			viper.GetBool("tls-secrets"),
+			viper.GetStringSlice("tls-secret-namespaces"),
+			accessLog,
+		)
+		go cp.Start()
+		// start gateway API server
+		gatewaysrv.NewGatewayServer(":8083", os.Getenv(gatewaysrv.TokenEnv), cp, logger).
+			WithPeers(os.Getenv(debugtrace.PodIpEnv), viper.GetString("gateway-peers")).
+			Serve()
 
+		var supervisor *controlplane.Supervisor
 		if !viper.GetBool("envoy-xds-srv-only") {
 			logger.Info("starting Envoy XDS server")
-			// start envoy proxy and modsec (wafie-modsec.so) log rotation
-			go controlplane.
-				NewSupervisor(logger).
-				Start()
+			// start envoy proxy, restarted on crash, and the access and audit logs rotation
+			node := nodeId(logger)
+			supervisor = controlplane.
+				NewSupervisor(node, viper.GetString("gateway-group"), viper.GetDuration("drain-period"), logger).
+				RotateAccessLog(accessLog.FilePath, viper.GetInt64("access-log-max-size")).
+				RotateAuditLog(events.AuditLogPath, viper.GetInt64("audit-log-max-size"))
+			supervisor.Start()
+			// the gateway is ready once envoy is live and applied the node snapshot
+			healthCheckSrv.AddCheck(controlplane.EnvoyHealthService, func(ctx context.Context) bool {
+				return supervisor.Ready(ctx) && cp.NodeSynced(node)
+			})
+			// ship the modsec audit log security events to the API server and the configured sinks
+			startEventsCollector(logger)
 		}
+		// start health check server
+		healthCheckSrv.Serve()
 		// handle interrupts
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -54,9 +132,49 @@ var startCmd = &cobra.Command{
 			select {
 			case s := <-sigCh:
 				logger.Info("signal received, shutting down", zap.String("signal", s.String()))
+				// drain the in-flight requests before exiting
+				if supervisor != nil {
+					supervisor.Stop()
+				}
+				shutdownTracing(context.Background())
 				logger.Info("bye bye 👋")
 				os.Exit(0)
 			}
 		}
 	},
 }
+
+func nodeId(logger *zap.Logger) string {
+	if id := viper.GetString("node-id"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Fatal("failed to get hostname, set the node id explicitly", zap.Error(err))
+	}
+	return hostname
+}
+
+func startEventsCollector(logger *zap.Logger) {
+	collector := events.
+		NewCollector(events.AuditLogPath, logger).
+		AddSink(events.NewApiSink(viper.GetString("api-addr")), nil)
+	if path := viper.GetString("sinks-config"); path != "" {
+		sinks, err := events.LoadSinksConfig(path)
+		if err != nil {
+			logger.Fatal("failed to load sinks config", zap.Error(err))
+		}
+		for _, cfg := range sinks {
+			sink, err := cfg.Sink()
+			if err != nil {
+				logger.Fatal("invalid sink config", zap.Error(err))
+			}
+			filter, err := cfg.Filter()
+			if err != nil {
+				logger.Fatal("invalid sink config", zap.Error(err))
+			}
+			collector.AddSink(sink, filter)
+		}
+	}
+	collector.Start()
+}
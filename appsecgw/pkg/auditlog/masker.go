@@ -0,0 +1,375 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	Mask = "****"
+	// secrets shorter than minSecretLen are not masked
+	// across the whole entry, to avoid masking unrelated values
+	minSecretLen = 4
+)
+
+var (
+	defaultHeaders = []string{
+		"authorization",
+		"proxy-authorization",
+		"cookie",
+		"set-cookie",
+		"x-api-key",
+		"x-auth-token",
+		"x-csrf-token",
+		"x-xsrf-token",
+	}
+	defaultArgs = []string{
+		"password",
+		"passwd",
+		"pwd",
+		"secret",
+		"client_secret",
+		"token",
+		"access_token",
+		"refresh_token",
+		"id_token",
+		"api_key",
+		"apikey",
+		"session",
+		"sessionid",
+		"session_id",
+		"jsessionid",
+		"phpsessid",
+		"csrf_token",
+	}
+	defaultPatterns = []string{
+		// bearer tokens
+		`(?i)bearer\s+[a-z0-9._~+/=-]+`,
+		// JWTs
+		`eyJ[a-zA-Z0-9_-]{5,}\.[a-zA-Z0-9_-]{5,}\.[a-zA-Z0-9_-]*`,
+	}
+	// card numbers are masked only when passing the luhn check
+	cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+)
+
+// MaskingConfig is the per protection masking configuration,
+// the lists are added to the default ones, unless DisableDefaults is set
+type MaskingConfig struct {
+	Headers         []string
+	JsonPaths       []string
+	FormArgs        []string
+	Patterns        []string
+	DisableDefaults bool
+}
+
+// Masker masks the sensitive data of the ModSecurity JSON audit log entry
+type Masker struct {
+	headers     map[string]struct{}
+	formArgs    map[string]struct{}
+	jsonPaths   [][]string
+	patterns    []*regexp.Regexp
+	cardNumbers bool
+}
+
+func NewMasker(cfg *MaskingConfig) (*Masker, error) {
+	if cfg == nil {
+		cfg = &MaskingConfig{}
+	}
+	m := &Masker{
+		headers:  map[string]struct{}{},
+		formArgs: map[string]struct{}{},
+	}
+	headers, formArgs, jsonPaths, patterns := cfg.Headers, cfg.FormArgs, cfg.JsonPaths, cfg.Patterns
+	if !cfg.DisableDefaults {
+		headers = append(headers, defaultHeaders...)
+		formArgs = append(formArgs, defaultArgs...)
+		for _, arg := range defaultArgs {
+			jsonPaths = append(jsonPaths, "$.."+arg)
+		}
+		patterns = append(patterns, defaultPatterns...)
+		m.cardNumbers = true
+	}
+	for _, h := range headers {
+		m.headers[strings.ToLower(h)] = struct{}{}
+	}
+	for _, a := range formArgs {
+		m.formArgs[strings.ToLower(a)] = struct{}{}
+	}
+	for _, p := range jsonPaths {
+		segments, err := parseJsonPath(p)
+		if err != nil {
+			return nil, err
+		}
+		m.jsonPaths = append(m.jsonPaths, segments)
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid masking pattern %s: %w", p, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// parseJsonPath parses the $.a.b, $.a.*.b and $..b paths into segments,
+// ** stands for any depth, arrays are traversed transparently
+func parseJsonPath(path string) ([]string, error) {
+	p := strings.TrimPrefix(path, "$")
+	var segments []string
+	for p != "" {
+		if strings.HasPrefix(p, "..") {
+			segments = append(segments, "**")
+			p = p[2:]
+		} else {
+			p = strings.TrimPrefix(p, ".")
+		}
+		end := strings.Index(p, ".")
+		if end < 0 {
+			end = len(p)
+		}
+		if end > 0 {
+			segments = append(segments, p[:end])
+		}
+		p = p[end:]
+	}
+	if len(segments) == 0 || segments[len(segments)-1] == "**" {
+		return nil, fmt.Errorf("invalid masking json path %s", path)
+	}
+	return segments, nil
+}
+
+// Mask masks the entry in place
+func (m *Masker) Mask(entry map[string]interface{}) {
+	e := &maskedEntry{masker: m}
+	tx, _ := entry["transaction"].(map[string]interface{})
+	if tx != nil {
+		if req, ok := tx["request"].(map[string]interface{}); ok {
+			contentType := e.maskHeaders(req)
+			if uri, ok := req["uri"].(string); ok {
+				if path, query, found := strings.Cut(uri, "?"); found {
+					req["uri"] = path + "?" + e.maskForm(query)
+				}
+			}
+			if body, ok := req["body"].(string); ok {
+				req["body"] = e.maskBody(body, contentType)
+			}
+		}
+		if resp, ok := tx["response"].(map[string]interface{}); ok {
+			e.maskHeaders(resp)
+		}
+	}
+	// masked values might be repeated in the rule messages and matched data
+	for k, v := range entry {
+		entry[k] = e.maskStrings(v)
+	}
+}
+
+// MaskRequest masks the request copy sent outside the gateway, e.g. to the honeypot,
+// the headers are masked in place, the masked uri and body are returned
+func (m *Masker) MaskRequest(headers map[string][]string, uri, body string) (string, string) {
+	e := &maskedEntry{masker: m}
+	uri, body = e.maskRequest(headers, uri, body)
+	// masked values might be repeated in the other headers
+	for _, values := range headers {
+		for i, value := range values {
+			values[i] = e.maskString(value)
+		}
+	}
+	return e.maskString(uri), e.maskString(body)
+}
+
+// MaskText masks the free text written about the request, e.g. the rule evaluation trace,
+// the request sensitive values are masked wherever these are repeated in the text
+func (m *Masker) MaskText(text string, headers map[string][]string, uri, body string) string {
+	e := &maskedEntry{masker: m}
+	headersCopy := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		headersCopy[name] = append([]string(nil), values...)
+	}
+	e.maskRequest(headersCopy, uri, body)
+	return e.maskString(text)
+}
+
+// maskedEntry collects the masked values of a single entry
+type maskedEntry struct {
+	masker  *Masker
+	secrets []string
+}
+
+func (e *maskedEntry) secret(v interface{}) {
+	if s, ok := v.(string); ok && len(s) >= minSecretLen {
+		e.secrets = append(e.secrets, s)
+	}
+}
+
+// maskRequest masks the request headers in place and returns the masked uri and body
+func (e *maskedEntry) maskRequest(headers map[string][]string, uri, body string) (string, string) {
+	var contentType string
+	for name, values := range headers {
+		lowerName := strings.ToLower(name)
+		if lowerName == "content-type" && len(values) > 0 {
+			contentType = values[0]
+		}
+		if _, ok := e.masker.headers[lowerName]; !ok {
+			continue
+		}
+		for i, value := range values {
+			e.secret(value)
+			values[i] = Mask
+		}
+	}
+	if path, query, found := strings.Cut(uri, "?"); found {
+		uri = path + "?" + e.maskForm(query)
+	}
+	if body != "" {
+		body = e.maskBody(body, contentType)
+	}
+	return uri, body
+}
+
+// maskHeaders masks the headers and returns the content type
+func (e *maskedEntry) maskHeaders(msg map[string]interface{}) (contentType string) {
+	headers, ok := msg["headers"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for name, value := range headers {
+		lowerName := strings.ToLower(name)
+		if lowerName == "content-type" {
+			contentType, _ = value.(string)
+		}
+		if _, ok := e.masker.headers[lowerName]; ok {
+			e.secret(value)
+			headers[name] = Mask
+		}
+	}
+	return contentType
+}
+
+func (e *maskedEntry) maskBody(body, contentType string) string {
+	trimmed := strings.TrimSpace(body)
+	if strings.Contains(contentType, "json") ||
+		strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(body), &doc); err == nil {
+			for _, path := range e.masker.jsonPaths {
+				doc = e.maskJson(doc, path)
+			}
+			if masked, err := json.Marshal(doc); err == nil {
+				return string(masked)
+			}
+		}
+	}
+	if strings.Contains(contentType, "x-www-form-urlencoded") || strings.Contains(body, "=") {
+		return e.maskForm(body)
+	}
+	return body
+}
+
+func (e *maskedEntry) maskJson(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		e.secret(node)
+		return Mask
+	}
+	switch n := node.(type) {
+	case []interface{}:
+		for i := range n {
+			n[i] = e.maskJson(n[i], path)
+		}
+	case map[string]interface{}:
+		if path[0] == "**" {
+			e.maskJson(n, path[1:])
+			for k, v := range n {
+				n[k] = e.maskJson(v, path)
+			}
+			return n
+		}
+		for k, v := range n {
+			if path[0] == "*" || strings.EqualFold(k, path[0]) {
+				n[k] = e.maskJson(v, path[1:])
+			}
+		}
+	}
+	return node
+}
+
+// maskForm masks the urlencoded arguments, preserving the arguments order
+func (e *maskedEntry) maskForm(form string) string {
+	args := strings.Split(form, "&")
+	for i, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if _, ok := e.masker.formArgs[strings.ToLower(name)]; !ok {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			e.secret(unescaped)
+		}
+		e.secret(value)
+		args[i] = arg[:strings.Index(arg, "=")+1] + Mask
+	}
+	return strings.Join(args, "&")
+}
+
+func (e *maskedEntry) maskStrings(node interface{}) interface{} {
+	switch n := node.(type) {
+	case string:
+		return e.maskString(n)
+	case []interface{}:
+		for i := range n {
+			n[i] = e.maskStrings(n[i])
+		}
+	case map[string]interface{}:
+		for k, v := range n {
+			n[k] = e.maskStrings(v)
+		}
+	}
+	return node
+}
+
+func (e *maskedEntry) maskString(s string) string {
+	for _, secret := range e.secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	for _, re := range e.masker.patterns {
+		s = re.ReplaceAllString(s, Mask)
+	}
+	if e.masker.cardNumbers {
+		s = cardNumberPattern.ReplaceAllStringFunc(s, func(match string) string {
+			if luhn(match) {
+				return Mask
+			}
+			return match
+		})
+	}
+	return s
+}
+
+func luhn(number string) bool {
+	var sum, digits int
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits > 0 && sum%10 == 0
+}
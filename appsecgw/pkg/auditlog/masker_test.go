@@ -0,0 +1,119 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func entry(t *testing.T, raw string) map[string]interface{} {
+	e := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(raw), &e))
+	return e
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *MaskingConfig
+		entry  string
+		want   string
+	}{
+		{
+			name:  "default headers",
+			entry: `{"transaction":{"request":{"headers":{"Authorization":"Basic Zm9vOmJhcg==","Accept":"*/*"}},"response":{"headers":{"Set-Cookie":"sid=abcdef"}}}}`,
+			want:  `{"transaction":{"request":{"headers":{"Authorization":"****","Accept":"*/*"}},"response":{"headers":{"Set-Cookie":"****"}}}}`,
+		},
+		{
+			name:   "custom header",
+			config: &MaskingConfig{Headers: []string{"X-Tenant"}},
+			entry:  `{"transaction":{"request":{"headers":{"x-tenant":"acme-corp"}}}}`,
+			want:   `{"transaction":{"request":{"headers":{"x-tenant":"****"}}}}`,
+		},
+		{
+			name:  "default json paths at any depth",
+			entry: `{"transaction":{"request":{"headers":{"Content-Type":"application/json"},"body":"{\"user\":{\"name\":\"bob\",\"password\":\"hunter22\"},\"items\":[{\"token\":\"abcd1234\"}]}"}}}`,
+			want:  `{"transaction":{"request":{"headers":{"Content-Type":"application/json"},"body":"{\"items\":[{\"token\":\"****\"}],\"user\":{\"name\":\"bob\",\"password\":\"****\"}}"}}}`,
+		},
+		{
+			name:   "custom json path",
+			config: &MaskingConfig{JsonPaths: []string{"$.card.*"}, DisableDefaults: true},
+			entry:  `{"transaction":{"request":{"body":"{\"card\":{\"cvv\":\"123\",\"holder\":\"bob\"},\"password\":\"hunter22\"}"}}}`,
+			want:   `{"transaction":{"request":{"body":"{\"card\":{\"cvv\":\"****\",\"holder\":\"****\"},\"password\":\"hunter22\"}"}}}`,
+		},
+		{
+			name:  "form body and query args",
+			entry: `{"transaction":{"request":{"uri":"/login?next=%2Fhome&access_token=qwerty123","headers":{"Content-Type":"application/x-www-form-urlencoded"},"body":"user=bob&password=hunter22"}}}`,
+			want:  `{"transaction":{"request":{"uri":"/login?next=%2Fhome&access_token=****","headers":{"Content-Type":"application/x-www-form-urlencoded"},"body":"user=bob&password=****"}}}`,
+		},
+		{
+			name:  "masked values in rule messages",
+			entry: `{"transaction":{"request":{"body":"password=hunter22"},"messages":[{"details":{"data":"Matched Data: hunter22 found within ARGS:password"}}]}}`,
+			want:  `{"transaction":{"request":{"body":"password=****"},"messages":[{"details":{"data":"Matched Data: **** found within ARGS:password"}}]}}`,
+		},
+		{
+			name:  "card numbers pass the luhn check",
+			entry: `{"transaction":{"request":{"body":"card 4111 1111 1111 1111, order 1234567890123"}}}`,
+			want:  `{"transaction":{"request":{"body":"card ****, order 1234567890123"}}}`,
+		},
+		{
+			name:   "custom pattern",
+			config: &MaskingConfig{Patterns: []string{`\d{3}-\d{2}-\d{4}`}},
+			entry:  `{"transaction":{"request":{"body":"ssn 123-45-6789"}}}`,
+			want:   `{"transaction":{"request":{"body":"ssn ****"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMasker(tt.config)
+			assert.Nil(t, err)
+			e := entry(t, tt.entry)
+			m.Mask(e)
+			assert.Equal(t, entry(t, tt.want), e)
+		})
+	}
+}
+
+func TestNewMaskerInvalidConfig(t *testing.T) {
+	_, err := NewMasker(&MaskingConfig{Patterns: []string{"("}})
+	assert.NotNil(t, err)
+	_, err = NewMasker(&MaskingConfig{JsonPaths: []string{"$.."}})
+	assert.NotNil(t, err)
+}
+
+func TestMaskRequest(t *testing.T) {
+	m, err := NewMasker(nil)
+	assert.Nil(t, err)
+	headers := map[string][]string{
+		"authorization": {"Bearer abc.def.ghi"},
+		"cookie":        {"sid=abcdef"},
+		"content-type":  {"application/json"},
+		"x-forwarded":   {"sid=abcdef"},
+	}
+	uri, body := m.MaskRequest(headers, "/login?next=%2Fhome&access_token=qwerty123",
+		`{"user":"bob","password":"hunter22"}`)
+	assert.Equal(t, "/login?next=%2Fhome&access_token=****", uri)
+	assert.Equal(t, `{"password":"****","user":"bob"}`, body)
+	assert.Equal(t, map[string][]string{
+		"authorization": {"****"},
+		"cookie":        {"****"},
+		"content-type":  {"application/json"},
+		"x-forwarded":   {"****"},
+	}, headers)
+}
+
+func TestMaskText(t *testing.T) {
+	m, err := NewMasker(nil)
+	assert.Nil(t, err)
+	headers := map[string][]string{"cookie": {"sid=abcdef"}}
+	trace := `[4] Rule 942100: Target value: "sid=abcdef" (Variable: REQUEST_HEADERS:Cookie)
+[4] Rule 942100: Target value: "hunter22" (Variable: ARGS:password)
+[4] Rule 942100: Target value: "/login" (Variable: REQUEST_FILENAME)`
+	masked := m.MaskText(trace, headers, "/login?user=bob", "password=hunter22")
+	assert.Equal(t, `[4] Rule 942100: Target value: "****" (Variable: REQUEST_HEADERS:Cookie)
+[4] Rule 942100: Target value: "****" (Variable: ARGS:password)
+[4] Rule 942100: Target value: "/login" (Variable: REQUEST_FILENAME)`, masked)
+	// the request headers are not modified
+	assert.Equal(t, "sid=abcdef", headers["cookie"][0])
+}
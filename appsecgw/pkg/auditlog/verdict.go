@@ -0,0 +1,28 @@
+package auditlog
+
+// Verdict tracks the WAF decision and the response status of a request for its audit log entry,
+// the request is blocked only by the filter local reply, not by any response status
+type Verdict struct {
+	status  int
+	blocked bool
+}
+
+// Block records the filter local reply status
+func (v *Verdict) Block(status int) {
+	v.status = status
+	v.blocked = true
+}
+
+// Respond records the response status, either of the upstream or of the local reply
+func (v *Verdict) Respond(status int) {
+	v.status = status
+}
+
+// Status is the response status used for the audit log relevance
+func (v *Verdict) Status() int {
+	return v.status
+}
+
+func (v *Verdict) Blocked() bool {
+	return v.blocked
+}
@@ -0,0 +1,32 @@
+package auditlog
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerdict(t *testing.T) {
+	t.Run("allowed request", func(t *testing.T) {
+		var v Verdict
+		v.Respond(http.StatusOK)
+		assert.False(t, v.Blocked())
+		assert.Equal(t, http.StatusOK, v.Status())
+	})
+
+	t.Run("allowed request with upstream error", func(t *testing.T) {
+		var v Verdict
+		v.Respond(http.StatusForbidden)
+		assert.False(t, v.Blocked())
+	})
+
+	t.Run("blocked request", func(t *testing.T) {
+		var v Verdict
+		v.Block(http.StatusForbidden)
+		// the local reply response headers are encoded after the block
+		v.Respond(http.StatusForbidden)
+		assert.True(t, v.Blocked())
+		assert.Equal(t, http.StatusForbidden, v.Status())
+	})
+}
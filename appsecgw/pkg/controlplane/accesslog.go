@@ -0,0 +1,297 @@
+package controlplane
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	fileaccesslog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	celfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/filters/cel/v3"
+	grpcaccesslog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	stream "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	metadata "github.com/envoyproxy/go-control-plane/envoy/type/metadata/v3"
+	tracingtag "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	AccessLogSinkStdout = "stdout"
+	AccessLogSinkFile   = "file"
+	AccessLogSinkGrpc   = "grpc"
+	// DefaultAccessLogPath is the file sink path, rotated by the supervisor
+	DefaultAccessLogPath = "/data/access/access.log"
+	// accessLogMetadataNamespace is the route and the dynamic metadata namespace,
+	// the routes carry the protection identity and the wafie filter sets the WAF verdict
+	accessLogMetadataNamespace = "wafie"
+	alsClusterName             = "wafie-access-log-service"
+	alsLogName                 = "wafie"
+)
+
+// accessLogFormat joins the access log entries with the ModSecurity audit events by the request id
+var accessLogFormat = map[string]interface{}{
+	"start_time":            "%START_TIME%",
+	"request_id":            "%REQ(X-REQUEST-ID)%",
+	"protection_id":         "%METADATA(ROUTE:wafie:protection_id)%",
+	"application":           "%METADATA(ROUTE:wafie:application)%",
+	"waf_verdict":           "%DYNAMIC_METADATA(wafie:verdict)%",
+	"anomaly_score":         "%DYNAMIC_METADATA(wafie:anomaly_score)%",
+	"rule_ids":              "%DYNAMIC_METADATA(wafie:rule_ids)%",
+	"rate_limited":          "%REQ(X-WAFIE-RATE-LIMITED)%",
+	"client_ip":             "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%",
+	"x_forwarded_for":       "%REQ(X-FORWARDED-FOR)%",
+	"method":                "%REQ(:METHOD)%",
+	"authority":             "%REQ(:AUTHORITY)%",
+	"path":                  "%REQ(X-ENVOY-ORIGINAL-PATH?:PATH)%",
+	"protocol":              "%PROTOCOL%",
+	"user_agent":            "%REQ(USER-AGENT)%",
+	"response_code":         "%RESPONSE_CODE%",
+	"response_code_details": "%RESPONSE_CODE_DETAILS%",
+	"response_flags":        "%RESPONSE_FLAGS%",
+	"bytes_received":        "%BYTES_RECEIVED%",
+	"bytes_sent":            "%BYTES_SENT%",
+	"duration_ms":           "%DURATION%",
+	"upstream_cluster":      "%UPSTREAM_CLUSTER%",
+	"upstream_host":         "%UPSTREAM_HOST%",
+}
+
+// AccessLogConfig is the gateway access log sinks, shared by all the protections
+type AccessLogConfig struct {
+	Stdout bool
+	// file sink path, empty disables the file sink
+	FilePath string
+	// gRPC access log service host:port, empty disables the ALS sink
+	AlsAddr string
+}
+
+// NewAccessLogConfig enables the listed sinks, one of stdout|file|grpc
+func NewAccessLogConfig(sinks []string, filePath, alsAddr string) (*AccessLogConfig, error) {
+	cfg := &AccessLogConfig{}
+	for _, sink := range sinks {
+		switch sink {
+		case AccessLogSinkStdout:
+			cfg.Stdout = true
+		case AccessLogSinkFile:
+			if filePath == "" {
+				return nil, fmt.Errorf("access log file path is required for the file sink")
+			}
+			cfg.FilePath = filePath
+		case AccessLogSinkGrpc:
+			if _, _, err := net.SplitHostPort(alsAddr); err != nil {
+				return nil, fmt.Errorf("invalid access log service address %q: %w", alsAddr, err)
+			}
+			cfg.AlsAddr = alsAddr
+		default:
+			return nil, fmt.Errorf("unsupported access log sink %q", sink)
+		}
+	}
+	return cfg, nil
+}
+
+// routeMetadata identifies the protection of the route in the access log entries
+func routeMetadata(target *upstreamTarget) *core.Metadata {
+	return &core.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			accessLogMetadataNamespace: {
+				Fields: map[string]*structpb.Value{
+					"protection_id": structpb.NewStringValue(strconv.Itoa(int(target.protection.Id))),
+					"application":   structpb.NewStringValue(target.appName()),
+				},
+			},
+		},
+	}
+}
+
+// accessLogs builds the listener access logs of the configured sinks,
+// sampled per protection, see accessLogFilter
+func (s *state) accessLogs(protections []*wv1.Protection) []*accesslog.AccessLog {
+	if s.accessLog == nil {
+		return nil
+	}
+	logFormat := s.accessLogFormat()
+	var accessLogs []*accesslog.AccessLog
+	if s.accessLog.Stdout {
+		accessLogs = append(accessLogs, s.accessLogSink("envoy.access_loggers.stdout",
+			&stream.StdoutAccessLog{
+				AccessLogFormat: &stream.StdoutAccessLog_LogFormat{LogFormat: logFormat},
+			}))
+	}
+	if s.accessLog.FilePath != "" {
+		accessLogs = append(accessLogs, s.accessLogSink("envoy.access_loggers.file",
+			&fileaccesslog.FileAccessLog{
+				Path:            s.accessLog.FilePath,
+				AccessLogFormat: &fileaccesslog.FileAccessLog_LogFormat{LogFormat: logFormat},
+			}))
+	}
+	if s.accessLog.AlsAddr != "" {
+		accessLogs = append(accessLogs, s.accessLogSink("envoy.access_loggers.http_grpc", s.alsConfig()))
+	}
+	filter := s.accessLogFilter(protections)
+	for _, accessLog := range accessLogs {
+		accessLog.Filter = filter
+	}
+	return accessLogs
+}
+
+func (s *state) accessLogFormat() *core.SubstitutionFormatString {
+	jsonFormat, err := structpb.NewStruct(accessLogFormat)
+	if err != nil {
+		s.logger.Error("failed to create access log format", zap.Error(err))
+	}
+	return &core.SubstitutionFormatString{
+		Format: &core.SubstitutionFormatString_JsonFormat{JsonFormat: jsonFormat},
+	}
+}
+
+func (s *state) accessLogSink(name string, sinkCfg proto.Message) *accesslog.AccessLog {
+	typedCfg, err := anypb.New(sinkCfg)
+	if err != nil {
+		s.logger.Error("failed to create access log config", zap.String("sink", name), zap.Error(err))
+	}
+	return &accesslog.AccessLog{
+		Name:       name,
+		ConfigType: &accesslog.AccessLog_TypedConfig{TypedConfig: typedCfg},
+	}
+}
+
+// alsConfig streams the entries to the access log service,
+// the protection identity and the request id are sent as the entry custom tags
+// and the WAF verdict as the entry dynamic metadata
+func (s *state) alsConfig() *grpcaccesslog.HttpGrpcAccessLogConfig {
+	routeTag := func(key string) *tracingtag.CustomTag {
+		return &tracingtag.CustomTag{
+			Tag: key,
+			Type: &tracingtag.CustomTag_Metadata_{
+				Metadata: &tracingtag.CustomTag_Metadata{
+					Kind: &metadata.MetadataKind{Kind: &metadata.MetadataKind_Route_{Route: &metadata.MetadataKind_Route{}}},
+					MetadataKey: &metadata.MetadataKey{
+						Key:  accessLogMetadataNamespace,
+						Path: []*metadata.MetadataKey_PathSegment{{Segment: &metadata.MetadataKey_PathSegment_Key{Key: key}}},
+					},
+				},
+			},
+		}
+	}
+	return &grpcaccesslog.HttpGrpcAccessLogConfig{
+		CommonConfig: &grpcaccesslog.CommonGrpcAccessLogConfig{
+			LogName: alsLogName,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: alsClusterName},
+				},
+			},
+			TransportApiVersion: core.ApiVersion_V3,
+			CustomTags: []*tracingtag.CustomTag{
+				routeTag("protection_id"),
+				routeTag("application"),
+				{
+					Tag: "request_id",
+					Type: &tracingtag.CustomTag_RequestHeader{
+						RequestHeader: &tracingtag.CustomTag_Header{Name: "x-request-id"},
+					},
+				},
+			},
+		},
+		AdditionalRequestHeadersToLog: []string{rateLimitedHeader},
+	}
+}
+
+// accessLogFilter samples the requests of the protections with the sample percent set,
+// the requests of the other protections and the unrouted requests are all logged
+func (s *state) accessLogFilter(protections []*wv1.Protection) *accesslog.AccessLogFilter {
+	var sampled []*wv1.Protection
+	seen := map[uint32]bool{}
+	for _, protection := range protections {
+		accessLog := protection.GetDesiredState().GetAccessLog()
+		if accessLog == nil || accessLog.SamplePercent == nil || accessLog.GetSamplePercent() >= 100 || seen[protection.Id] {
+			continue
+		}
+		seen[protection.Id] = true
+		sampled = append(sampled, protection)
+	}
+	if len(sampled) == 0 {
+		return nil
+	}
+	sort.Slice(sampled, func(i, j int) bool { return sampled[i].Id < sampled[j].Id })
+	const protectionId = "xds.route_metadata.filter_metadata.wafie.protection_id"
+	var ids []string
+	var filters []*accesslog.AccessLogFilter
+	for _, protection := range sampled {
+		id := strconv.Itoa(int(protection.Id))
+		ids = append(ids, strconv.Quote(id))
+		filters = append(filters, &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_AndFilter{
+				AndFilter: &accesslog.AndFilter{
+					Filters: []*accesslog.AccessLogFilter{
+						s.celFilter(fmt.Sprintf("%s == %q", protectionId, id)),
+						{
+							FilterSpecifier: &accesslog.AccessLogFilter_RuntimeFilter{
+								RuntimeFilter: &accesslog.RuntimeFilter{
+									RuntimeKey: "access_log.protection_" + id,
+									PercentSampled: &typev3.FractionalPercent{
+										Numerator:   protection.DesiredState.AccessLog.GetSamplePercent(),
+										Denominator: typev3.FractionalPercent_HUNDRED,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	filters = append(filters, s.celFilter(fmt.Sprintf(
+		"!('wafie' in xds.route_metadata.filter_metadata) || !(%s in [%s])", protectionId, strings.Join(ids, ", "),
+	)))
+	return &accesslog.AccessLogFilter{
+		FilterSpecifier: &accesslog.AccessLogFilter_OrFilter{
+			OrFilter: &accesslog.OrFilter{Filters: filters},
+		},
+	}
+}
+
+func (s *state) celFilter(expression string) *accesslog.AccessLogFilter {
+	celCfg, err := anypb.New(&celfilter.ExpressionFilter{Expression: expression})
+	if err != nil {
+		s.logger.Error("failed to create access log cel filter", zap.Error(err))
+	}
+	return &accesslog.AccessLogFilter{
+		FilterSpecifier: &accesslog.AccessLogFilter_ExtensionFilter{
+			ExtensionFilter: &accesslog.ExtensionFilter{
+				Name:       "envoy.access_loggers.extension_filters.cel",
+				ConfigType: &accesslog.ExtensionFilter_TypedConfig{TypedConfig: celCfg},
+			},
+		},
+	}
+}
+
+// alsCluster is the HTTP/2 cluster of the gRPC access log service
+func (s *state) alsCluster() *cluster.Cluster {
+	host, port, err := net.SplitHostPort(s.accessLog.AlsAddr)
+	if err != nil {
+		s.logger.Error("invalid access log service address", zap.String("address", s.accessLog.AlsAddr), zap.Error(err))
+		return nil
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		s.logger.Error("invalid access log service port", zap.String("address", s.accessLog.AlsAddr), zap.Error(err))
+		return nil
+	}
+	alsEndpoints := []*endpoint.LbEndpoint{s.lbEndpoint(host, uint32(portNumber))}
+	return s.withProtocolOptions(
+		s.cluster(alsClusterName, alsEndpoints, cluster.Cluster_STRICT_DNS),
+		&wv1.Upstream{
+			ProtocolOptions: &wv1.UpstreamProtocolOptions{Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2},
+		},
+	)
+}
@@ -0,0 +1,119 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	fileaccesslog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	celfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/filters/cel/v3"
+	grpcaccesslog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	stream "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func listenerAccessLogs(t *testing.T, l *v3listener.Listener) []*accesslog.AccessLog {
+	httpConnectionMgr := &hcm.HttpConnectionManager{}
+	require.NoError(t, l.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(httpConnectionMgr))
+	return httpConnectionMgr.AccessLog
+}
+
+func TestNewAccessLogConfig(t *testing.T) {
+	cfg, err := NewAccessLogConfig([]string{"stdout", "file", "grpc"}, "/data/access/access.log", "als.wafie.svc:9001")
+	require.NoError(t, err)
+	assert.Equal(t, &AccessLogConfig{Stdout: true, FilePath: "/data/access/access.log", AlsAddr: "als.wafie.svc:9001"}, cfg)
+
+	_, err = NewAccessLogConfig([]string{"grpc"}, "", "als.wafie.svc")
+	assert.Error(t, err)
+	_, err = NewAccessLogConfig([]string{"syslog"}, "", "")
+	assert.Error(t, err)
+}
+
+func TestBuildResourcesAccessLogs(t *testing.T) {
+	t.Run("json stdout by default", func(t *testing.T) {
+		resources := newState(testDomainListenerPort, nil).buildResources(testProtections())
+		accessLogs := listenerAccessLogs(t, resources[resource.ListenerType][0].(*v3listener.Listener))
+		require.Len(t, accessLogs, 1)
+		assert.Nil(t, accessLogs[0].Filter)
+		stdoutLog := &stream.StdoutAccessLog{}
+		require.NoError(t, accessLogs[0].GetTypedConfig().UnmarshalTo(stdoutLog))
+		fields := stdoutLog.GetLogFormat().GetJsonFormat().GetFields()
+		assert.Equal(t, "%REQ(X-REQUEST-ID)%", fields["request_id"].GetStringValue())
+		assert.Equal(t, "%METADATA(ROUTE:wafie:protection_id)%", fields["protection_id"].GetStringValue())
+		assert.Equal(t, "%DYNAMIC_METADATA(wafie:verdict)%", fields["waf_verdict"].GetStringValue())
+		assert.Equal(t, "%DYNAMIC_METADATA(wafie:anomaly_score)%", fields["anomaly_score"].GetStringValue())
+
+		r := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0]
+		routeIdentity := r.Metadata.FilterMetadata[accessLogMetadataNamespace].GetFields()
+		assert.Equal(t, "1", routeIdentity["protection_id"].GetStringValue())
+		assert.Equal(t, "shop", routeIdentity["application"].GetStringValue())
+	})
+
+	t.Run("file and grpc sinks", func(t *testing.T) {
+		s := newState(testDomainListenerPort, nil)
+		s.accessLog = &AccessLogConfig{FilePath: DefaultAccessLogPath, AlsAddr: "als.wafie.svc:9001"}
+		resources := s.buildResources(testProtections())
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		accessLogs := listenerAccessLogs(t, resources[resource.ListenerType][0].(*v3listener.Listener))
+		require.Len(t, accessLogs, 2)
+		fileLog := &fileaccesslog.FileAccessLog{}
+		require.NoError(t, accessLogs[0].GetTypedConfig().UnmarshalTo(fileLog))
+		assert.Equal(t, DefaultAccessLogPath, fileLog.Path)
+		assert.NotNil(t, fileLog.GetLogFormat().GetJsonFormat())
+		alsLog := &grpcaccesslog.HttpGrpcAccessLogConfig{}
+		require.NoError(t, accessLogs[1].GetTypedConfig().UnmarshalTo(alsLog))
+		assert.Equal(t, alsClusterName, alsLog.CommonConfig.GetGrpcService().GetEnvoyGrpc().ClusterName)
+		assert.Len(t, alsLog.CommonConfig.CustomTags, 3)
+
+		clusters := resources[resource.ClusterType]
+		als := clusters[len(clusters)-1].(*cluster.Cluster)
+		assert.Equal(t, alsClusterName, als.Name)
+		assert.Contains(t, als.TypedExtensionProtocolOptions, httpProtocolOptionsName)
+		assert.Equal(t, uint32(9001), als.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().
+			GetAddress().GetSocketAddress().GetPortValue())
+	})
+
+	t.Run("sampled per protection", func(t *testing.T) {
+		sampled := domainProtection(2, "store", "store.example.com")
+		sampled.DesiredState.AccessLog = &wv1.AccessLogPolicy{SamplePercent: proto.Uint32(10)}
+		full := domainProtection(3, "blog", "blog.example.com")
+		full.DesiredState.AccessLog = &wv1.AccessLogPolicy{SamplePercent: proto.Uint32(100)}
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{sampled, full})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		accessLogs := listenerAccessLogs(t, resources[resource.ListenerType][0].(*v3listener.Listener))
+		require.Len(t, accessLogs, 1)
+		filters := accessLogs[0].Filter.GetOrFilter().GetFilters()
+		require.Len(t, filters, 2)
+		protectionFilters := filters[0].GetAndFilter().GetFilters()
+		require.Len(t, protectionFilters, 2)
+		celExpression := &celfilter.ExpressionFilter{}
+		require.NoError(t, protectionFilters[0].GetExtensionFilter().GetTypedConfig().UnmarshalTo(celExpression))
+		assert.Equal(t, `xds.route_metadata.filter_metadata.wafie.protection_id == "2"`, celExpression.Expression)
+		runtimeFilter := protectionFilters[1].GetRuntimeFilter()
+		assert.Equal(t, "access_log.protection_2", runtimeFilter.RuntimeKey)
+		assert.Equal(t, uint32(10), runtimeFilter.PercentSampled.Numerator)
+		// the other protections requests are all logged
+		require.NoError(t, filters[1].GetExtensionFilter().GetTypedConfig().UnmarshalTo(celExpression))
+		assert.Contains(t, celExpression.Expression, `in ["2"]`)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := newState(testDomainListenerPort, nil)
+		s.accessLog = nil
+		resources := s.buildResources(testProtections())
+		assert.Empty(t, listenerAccessLogs(t, resources[resource.ListenerType][0].(*v3listener.Listener)))
+	})
+}
@@ -2,16 +2,21 @@ package controlplane
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"connectrpc.com/connect"
 	wafiev1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
 	applogger "github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/tracing"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
@@ -23,40 +28,73 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	"github.com/envoyproxy/go-control-plane/pkg/test/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
 )
 
+// resourcesUpdate carries the gateway groups built resources with the build trace context
+type resourcesUpdate struct {
+	ctx    context.Context
+	groups map[string]map[resource.Type][]types.Resource
+}
+
 type EnvoyControlPlane struct {
 	state                 *state
 	cache                 cache.SnapshotCache
 	logger                *zap.Logger
-	resourcesCh           chan map[resource.Type][]types.Resource
+	resourcesCh           chan *resourcesUpdate
 	stateVersion          string
+	stateTraceparent      string
+	secretsChanged        atomic.Bool
+	snapshotPath          string
+	snapshotsMu           sync.Mutex
+	snapshotVersions      map[string]string
+	snapshotResources     map[string]map[resource.Type][]types.Resource
+	streams               *streamTracker
 	namespace             string
 	protectionSvcClient   wafiev1connect.ProtectionServiceClient
 	stateVersionSvcClient wafiev1connect.StateVersionServiceClient
 }
 
-func NewEnvoyControlPlane(apiAddr, namespace string) *EnvoyControlPlane {
+// NewEnvoyControlPlane creates the control plane serving a snapshot per gateway group,
+// the last consistent snapshots are persisted to the snapshotPath, empty path disables the persistence.
+// The protections routed by the ingress host share the domainListenerPort listener,
+// with tlsSecrets set, the TLS of their hosts is terminated with the ingresses tls secrets
+// of the tlsSecretNamespaces, all namespaces when empty.
+// The listeners write the JSON access log entries to the accessLog sinks
+func NewEnvoyControlPlane(apiAddr, namespace, snapshotPath string, domainListenerPort uint32, tlsSecrets bool, tlsSecretNamespaces []string, accessLog *AccessLogConfig) *EnvoyControlPlane {
 
 	cp := &EnvoyControlPlane{
-		state:       newState(),
-		logger:      applogger.NewLogger(),
-		resourcesCh: make(chan map[resource.Type][]types.Resource, 1),
-		namespace:   namespace,
+		state:             newState(domainListenerPort, nil),
+		logger:            applogger.NewLogger(),
+		resourcesCh:       make(chan *resourcesUpdate, 1),
+		namespace:         namespace,
+		snapshotPath:      snapshotPath,
+		snapshotVersions:  map[string]string{},
+		snapshotResources: map[string]map[resource.Type][]types.Resource{},
 		cache: cache.NewSnapshotCache(
-			false, cache.IDHash{}, applogger.NewLogger().Sugar(),
+			false, groupHash{}, applogger.NewLogger().Sugar(),
 		),
 		protectionSvcClient: wafiev1connect.NewProtectionServiceClient(
 			http.DefaultClient, apiAddr,
+			tracing.ClientOption(),
 		),
 		stateVersionSvcClient: wafiev1connect.NewStateVersionServiceClient(
 			http.DefaultClient, apiAddr,
+			tracing.ClientOption(),
 		),
 	}
+	cp.state.accessLog = accessLog
+	cp.streams = newStreamTracker(cp.nodeConnected)
+	if tlsSecrets {
+		cp.watchTlsSecrets(tlsSecretNamespaces)
+	}
+	// serve the last known good snapshots until the API server is reachable
+	cp.restoreSnapshots()
 	// start control plane data watcher
 	cp.startApiIngressWatcher()
 	// start envoy snapshot generator
@@ -65,7 +103,7 @@ func NewEnvoyControlPlane(apiAddr, namespace string) *EnvoyControlPlane {
 }
 
 func (p *EnvoyControlPlane) Start() {
-	envoySrv := server.NewServer(context.Background(), p.cache, &test.Callbacks{})
+	envoySrv := server.NewServer(context.Background(), p.cache, p.streams.callbacks())
 	grpcSrv := grpc.NewServer([]grpc.ServerOption{
 		grpc.KeepaliveParams(keepalive.ServerParameters{
 			MaxConnectionIdle:     5 * time.Minute,
@@ -97,7 +135,9 @@ func (p *EnvoyControlPlane) Start() {
 	}
 }
 
-func (p *EnvoyControlPlane) stateVersionChanged() bool {
+// stateVersionChanged returns the protection state version when it has changed since the last build,
+// the version is recorded by the caller once the resources are built, so a failed build is retried
+func (p *EnvoyControlPlane) stateVersionChanged() (string, bool) {
 	stateVersionResponse, err := p.stateVersionSvcClient.GetStateVersion(
 		context.Background(),
 		connect.NewRequest(
@@ -108,16 +148,16 @@ func (p *EnvoyControlPlane) stateVersionChanged() bool {
 	)
 	if err != nil {
 		p.logger.Error("failed to get protection state version", zap.Error(err))
-		return false
+		return "", false
 	}
 	// check if the protection state has changed since last iteration
 	if stateVersionResponse.Msg.StateVersionId == p.stateVersion {
-		return false
+		return "", false
 	}
 	p.logger.Info("protection state version has changed",
 		zap.String("versionId", stateVersionResponse.Msg.StateVersionId))
-	p.stateVersion = stateVersionResponse.Msg.StateVersionId
-	return true
+	p.stateTraceparent = stateVersionResponse.Msg.Traceparent
+	return stateVersionResponse.Msg.StateVersionId, true
 }
 
 func (p *EnvoyControlPlane) startApiIngressWatcher() {
@@ -125,9 +165,21 @@ func (p *EnvoyControlPlane) startApiIngressWatcher() {
 	go func() {
 		for {
 			time.Sleep(1 * time.Second)
-			if !p.stateVersionChanged() {
+			// rebuild on the protections state or the tls secrets change
+			secretsChanged := p.secretsChanged.Swap(false)
+			stateVersion, stateChanged := p.stateVersionChanged()
+			if !stateChanged && !secretsChanged {
 				continue
 			}
+			if !stateChanged {
+				stateVersion = p.stateVersion
+			}
+			// continue the trace of the request that changed the state
+			ctx, span := tracing.Tracer().Start(
+				tracing.ContextWithTraceparent(context.Background(), p.stateTraceparent),
+				"controlplane.BuildResources",
+				trace.WithAttributes(attribute.String("wafie.state_version", stateVersion)),
+			)
 			mode := wafiev1.ProtectionMode_PROTECTION_MODE_ON
 			includeApps := true
 			req := connect.NewRequest(&wafiev1.ListProtectionsRequest{
@@ -136,32 +188,167 @@ func (p *EnvoyControlPlane) startApiIngressWatcher() {
 					IncludeApps:    &includeApps,
 				},
 			})
-			listProtectionResp, err := p.protectionSvcClient.ListProtections(context.Background(), req)
+			listProtectionResp, err := p.protectionSvcClient.ListProtections(ctx, req)
 			if err != nil {
-				p.logger.Error("failed to list protections", zap.Error(err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+				p.logger.Error("failed to list protections", append(tracing.Fields(ctx), zap.Error(err))...)
+				if secretsChanged {
+					p.secretsChanged.Store(true)
+				}
 				continue
 			}
-			p.logger.Info("data version has changed, building new resources")
-			p.resourcesCh <- p.state.buildResources(listProtectionResp.Msg.Protections)
-
+			p.logger.Info("data version has changed, building new resources", tracing.Fields(ctx)...)
+			start := time.Now()
+			groups := map[string]map[resource.Type][]types.Resource{}
+			for group, protections := range groupProtections(listProtectionResp.Msg.Protections) {
+				groups[group] = p.state.buildResources(protections)
+			}
+			snapshotBuildDuration.Observe(time.Since(start).Seconds())
+			// the state version is recorded only once its resources are built
+			p.stateVersion = stateVersion
+			span.SetAttributes(
+				attribute.Int("wafie.protections", len(listProtectionResp.Msg.Protections)),
+				attribute.Int("wafie.gateway_groups", len(groups)),
+			)
+			span.End()
+			p.resourcesCh <- &resourcesUpdate{ctx: ctx, groups: groups}
 		}
 	}()
 }
 
+// watchTlsSecrets enables the TLS termination,
+// the resources are rebuilt once a secret is rotated
+func (p *EnvoyControlPlane) watchTlsSecrets(namespaces []string) {
+	watcher, err := newSecretWatcher(namespaces, func() { p.secretsChanged.Store(true) }, p.logger)
+	if err != nil {
+		p.logger.Error("failed to watch tls secrets, tls termination disabled", zap.Error(err))
+		return
+	}
+	p.state.secrets = watcher
+}
+
 func (p *EnvoyControlPlane) startSnapshotGenerator() {
 	p.logger.Info("starting envoy snapshot generator")
 	go func() {
-		for resources := range p.resourcesCh {
-			p.logger.Info("state has been changed, generating new snapshot...")
-			snap, _ := cache.NewSnapshot(fmt.Sprintf("%d", rand.Int()), resources)
-			if err := snap.Consistent(); err != nil {
-				p.logger.Error("snapshot inconsistency", zap.Error(err))
-				continue
+		for update := range p.resourcesCh {
+			ctx, span := tracing.Tracer().Start(update.ctx, "controlplane.SetSnapshot")
+			p.logger.Info("state has been changed, setting new snapshots...", tracing.Fields(ctx)...)
+			p.snapshotsMu.Lock()
+			// groups without protections anymore are reset to the empty snapshot
+			for group := range p.snapshotVersions {
+				if _, ok := update.groups[group]; !ok {
+					update.groups[group] = p.state.buildResources(nil)
+				}
 			}
-			if err := p.cache.SetSnapshot(context.Background(), "node-1", snap); err != nil {
-				p.logger.Error("failed to set snapshot", zap.Error(err))
-				continue
+			changed := false
+			for group, resources := range update.groups {
+				updated, err := p.setGroupSnapshot(group, resources)
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					continue
+				}
+				changed = changed || updated
+			}
+			if changed {
+				p.persistSnapshots()
 			}
+			p.snapshotsMu.Unlock()
+			span.End()
 		}
 	}()
 }
+
+// setGroupSnapshot sets the gateway group snapshot unless the resources are unchanged,
+// must be called with the snapshotsMu held
+func (p *EnvoyControlPlane) setGroupSnapshot(group string, resources map[resource.Type][]types.Resource) (bool, error) {
+	l := p.logger.With(zap.String("gatewayGroup", group))
+	snap, version, err := newSnapshot(resources)
+	if err != nil {
+		snapshotBuilds.WithLabelValues("error").Inc()
+		l.Error("failed to build snapshot", zap.Error(err))
+		return false, err
+	}
+	if version == p.snapshotVersions[group] {
+		snapshotBuilds.WithLabelValues("unchanged").Inc()
+		l.Info("resources unchanged, skipping snapshot", zap.String("version", version))
+		return false, nil
+	}
+	if err := snap.Consistent(); err != nil {
+		snapshotBuilds.WithLabelValues("inconsistent").Inc()
+		l.Error("snapshot inconsistency", zap.Error(err))
+		return false, err
+	}
+	if err := p.cache.SetSnapshot(context.Background(), group, snap); err != nil {
+		snapshotBuilds.WithLabelValues("error").Inc()
+		l.Error("failed to set snapshot", zap.Error(err))
+		return false, err
+	}
+	p.snapshotVersions[group] = version
+	p.snapshotResources[group] = resources
+	snapshotBuilds.WithLabelValues("success").Inc()
+	l.Info("snapshot has been set", zap.String("version", version))
+	return true, nil
+}
+
+// NodeSynced reports whether the envoy node is connected and applied a snapshot
+func (p *EnvoyControlPlane) NodeSynced(nodeId string) bool {
+	return p.streams.nodeSynced(nodeId)
+}
+
+// nodeConnected serves the empty snapshot to the nodes of a gateway group without protections,
+// so the node initial fetch is completed
+func (p *EnvoyControlPlane) nodeConnected(node *core.Node) {
+	group := nodeGatewayGroup(node)
+	p.logger.Info("envoy node connected",
+		zap.String("nodeId", node.GetId()), zap.String("gatewayGroup", group))
+	p.snapshotsMu.Lock()
+	defer p.snapshotsMu.Unlock()
+	if _, ok := p.snapshotVersions[group]; ok {
+		return
+	}
+	if _, err := p.setGroupSnapshot(group, p.state.buildResources(nil)); err == nil {
+		p.persistSnapshots()
+	}
+}
+
+// persistSnapshots must be called with the snapshotsMu held
+func (p *EnvoyControlPlane) persistSnapshots() {
+	if p.snapshotPath == "" {
+		return
+	}
+	if err := saveSnapshots(p.snapshotPath, p.snapshotResources); err != nil {
+		p.logger.Error("failed to persist snapshots", zap.String("path", p.snapshotPath), zap.Error(err))
+	}
+}
+
+// restoreSnapshots sets the persisted snapshots, if any,
+// these are replaced once the resources are built from the API server state
+func (p *EnvoyControlPlane) restoreSnapshots() {
+	if p.snapshotPath == "" {
+		return
+	}
+	l := p.logger.With(zap.String("path", p.snapshotPath))
+	groups, err := loadSnapshots(p.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		l.Info("no persisted snapshots found")
+		return
+	}
+	if err != nil {
+		l.Error("failed to load persisted snapshots", zap.Error(err))
+		return
+	}
+	p.snapshotsMu.Lock()
+	defer p.snapshotsMu.Unlock()
+	for group, resources := range groups {
+		// the secrets are not persisted
+		p.state.restoreTlsSecrets(resources)
+		if _, err := p.setGroupSnapshot(group, resources); err != nil {
+			continue
+		}
+		l.Info("serving last known good snapshot",
+			zap.String("gatewayGroup", group), zap.String("version", p.snapshotVersions[group]))
+	}
+}
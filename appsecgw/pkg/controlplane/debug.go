@@ -0,0 +1,287 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"connectrpc.com/connect"
+	wafiev1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// RenderedConfig renders the current snapshot resources serving the application protection
+// with the sync status of the gateway group nodes
+func (p *EnvoyControlPlane) RenderedConfig(ctx context.Context, applicationId uint32) (*wafiev1.GetRenderedConfigResponse, error) {
+	protections, err := p.listProtections(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(protections, func(protection *wafiev1.Protection) bool {
+		return protection.ApplicationId == applicationId
+	})
+	if idx < 0 {
+		return nil, connect.NewError(connect.CodeNotFound,
+			fmt.Errorf("no enabled protection found for application %d", applicationId))
+	}
+	protection := protections[idx]
+	group := protectionGatewayGroup(protection)
+	p.snapshotsMu.Lock()
+	resources, version := p.snapshotResources[group], p.snapshotVersions[group]
+	p.snapshotsMu.Unlock()
+	listeners, routes, clusters := renderedResources(resources, protection.Id)
+	resp := &wafiev1.GetRenderedConfigResponse{
+		ApplicationId: applicationId,
+		ProtectionId:  protection.Id,
+		GatewayGroup:  group,
+		Version:       version,
+	}
+	for _, rendered := range []struct {
+		items []types.Resource
+		out   *[]string
+	}{
+		{listeners, &resp.Listeners},
+		{routes, &resp.Routes},
+		{clusters, &resp.Clusters},
+	} {
+		if *rendered.out, err = renderResources(rendered.items); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+	// the group snapshot is not set until the first resources build
+	var snap cache.ResourceSnapshot
+	if s, err := p.cache.GetSnapshot(group); err == nil {
+		snap = s
+	}
+	resp.Nodes = p.streams.nodeStatuses(group, snap)
+	return resp, nil
+}
+
+// DiffSnapshot builds the gateway groups resources of the proposed protection update in dry-run
+// and compares them against the current snapshots
+func (p *EnvoyControlPlane) DiffSnapshot(ctx context.Context, req *wafiev1.PutProtectionRequest) (*wafiev1.DiffSnapshotResponse, error) {
+	protections, err := p.listProtections(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(protections, func(protection *wafiev1.Protection) bool {
+		return protection.Id == req.Id
+	})
+	if idx < 0 {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("protection %d not found", req.Id))
+	}
+	// both the current and the proposed gateway groups are affected by the group change
+	groups := []string{protectionGatewayGroup(protections[idx])}
+	protections[idx] = applyProtectionUpdate(protections[idx], req)
+	if group := protectionGatewayGroup(protections[idx]); group != groups[0] {
+		groups = append(groups, group)
+	}
+	var enabled []*wafiev1.Protection
+	for _, protection := range protections {
+		if protection.ProtectionMode == wafiev1.ProtectionMode_PROTECTION_MODE_ON {
+			enabled = append(enabled, protection)
+		}
+	}
+	proposed := groupProtections(enabled)
+	resp := &wafiev1.DiffSnapshotResponse{}
+	for _, group := range groups {
+		proposedResources := p.state.buildResources(proposed[group])
+		p.snapshotsMu.Lock()
+		currentResources := p.snapshotResources[group]
+		p.snapshotsMu.Unlock()
+		diffs, err := diffResources(group, currentResources, proposedResources)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		resp.Diffs = append(resp.Diffs, diffs...)
+	}
+	return resp, nil
+}
+
+func (p *EnvoyControlPlane) listProtections(ctx context.Context, enabledOnly bool) ([]*wafiev1.Protection, error) {
+	includeApps := true
+	options := &wafiev1.ListProtectionsOptions{IncludeApps: &includeApps}
+	if enabledOnly {
+		mode := wafiev1.ProtectionMode_PROTECTION_MODE_ON
+		options.ProtectionMode = &mode
+	}
+	resp, err := p.protectionSvcClient.ListProtections(ctx,
+		connect.NewRequest(&wafiev1.ListProtectionsRequest{Options: options}))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Msg.Protections, nil
+}
+
+// applyProtectionUpdate applies the update the same way the API server does,
+// the desired state is replaced as a whole
+func applyProtectionUpdate(protection *wafiev1.Protection, req *wafiev1.PutProtectionRequest) *wafiev1.Protection {
+	updated := proto.Clone(protection).(*wafiev1.Protection)
+	if req.ProtectionMode != nil && *req.ProtectionMode != wafiev1.ProtectionMode_PROTECTION_MODE_UNSPECIFIED {
+		updated.ProtectionMode = *req.ProtectionMode
+	}
+	if req.DesiredState != nil {
+		updated.DesiredState = req.DesiredState
+	}
+	if req.GatewayGroup != nil {
+		updated.GatewayGroup = *req.GatewayGroup
+	}
+	return updated
+}
+
+// renderedResources selects the resources serving the protection,
+// the route configurations keep the protection routes only,
+// the listeners and the clusters are those referenced by the kept routes
+func renderedResources(resources map[resource.Type][]types.Resource, protectionId uint32) (listeners, routes, clusters []types.Resource) {
+	protectionIdValue := strconv.Itoa(int(protectionId))
+	routeConfigNames := map[string]bool{}
+	clusterNames := map[string]bool{}
+	for _, item := range resources[resource.RouteType] {
+		routeConfig := proto.Clone(item).(*route.RouteConfiguration)
+		var virtualHosts []*route.VirtualHost
+		for _, virtualHost := range routeConfig.VirtualHosts {
+			var protectionRoutes []*route.Route
+			for _, r := range virtualHost.Routes {
+				metadata := r.GetMetadata().GetFilterMetadata()[accessLogMetadataNamespace]
+				if metadata.GetFields()["protection_id"].GetStringValue() != protectionIdValue {
+					continue
+				}
+				protectionRoutes = append(protectionRoutes, r)
+				clusterNames[r.GetRoute().GetCluster()] = true
+				for _, mirrorPolicy := range r.GetRoute().GetRequestMirrorPolicies() {
+					clusterNames[mirrorPolicy.Cluster] = true
+				}
+			}
+			if len(protectionRoutes) > 0 {
+				virtualHost.Routes = protectionRoutes
+				virtualHosts = append(virtualHosts, virtualHost)
+			}
+		}
+		if len(virtualHosts) == 0 {
+			continue
+		}
+		routeConfig.VirtualHosts = virtualHosts
+		routeConfigNames[routeConfig.Name] = true
+		routes = append(routes, routeConfig)
+	}
+	for _, item := range resources[resource.ListenerType] {
+		if routeConfigNames[listenerRouteConfigName(item.(*v3listener.Listener))] {
+			listeners = append(listeners, item)
+		}
+	}
+	for _, item := range resources[resource.ClusterType] {
+		if clusterNames[cache.GetResourceName(item)] {
+			clusters = append(clusters, item)
+		}
+	}
+	return listeners, routes, clusters
+}
+
+// listenerRouteConfigName is the RDS route configuration of the listener connection manager
+func listenerRouteConfigName(listener *v3listener.Listener) string {
+	for _, filterChain := range listener.FilterChains {
+		for _, filter := range filterChain.Filters {
+			httpConnectionMgr := &hcm.HttpConnectionManager{}
+			if filter.GetTypedConfig().UnmarshalTo(httpConnectionMgr) != nil {
+				continue
+			}
+			return httpConnectionMgr.GetRds().GetRouteConfigName()
+		}
+	}
+	return ""
+}
+
+func renderResources(items []types.Resource) ([]string, error) {
+	rendered := make([]string, 0, len(items))
+	for _, item := range items {
+		b, err := canonicalJSON(item)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, string(b))
+	}
+	return rendered, nil
+}
+
+// diffResources compares the gateway group resources by the type and the name,
+// the tls secrets are skipped, so the keys are never rendered
+func diffResources(group string, current, proposed map[resource.Type][]types.Resource) ([]*wafiev1.ResourceDiff, error) {
+	typeUrls := map[resource.Type]bool{}
+	for typeUrl := range current {
+		typeUrls[typeUrl] = true
+	}
+	for typeUrl := range proposed {
+		typeUrls[typeUrl] = true
+	}
+	delete(typeUrls, resource.SecretType)
+	var diffs []*wafiev1.ResourceDiff
+	for _, typeUrl := range sortedKeys(typeUrls) {
+		currentItems, err := renderedByName(current[typeUrl])
+		if err != nil {
+			return nil, err
+		}
+		proposedItems, err := renderedByName(proposed[typeUrl])
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		for name := range currentItems {
+			names[name] = true
+		}
+		for name := range proposedItems {
+			names[name] = true
+		}
+		for _, name := range sortedKeys(names) {
+			currentItem, inCurrent := currentItems[name]
+			proposedItem, inProposed := proposedItems[name]
+			diff := &wafiev1.ResourceDiff{
+				GatewayGroup: group,
+				TypeUrl:      typeUrl,
+				Name:         name,
+				Current:      currentItem,
+				Proposed:     proposedItem,
+			}
+			switch {
+			case !inCurrent:
+				diff.Change = wafiev1.ResourceChange_RESOURCE_CHANGE_ADDED
+			case !inProposed:
+				diff.Change = wafiev1.ResourceChange_RESOURCE_CHANGE_REMOVED
+			case currentItem != proposedItem:
+				diff.Change = wafiev1.ResourceChange_RESOURCE_CHANGE_MODIFIED
+			default:
+				continue
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
+
+func renderedByName(items []types.Resource) (map[string]string, error) {
+	rendered := make(map[string]string, len(items))
+	for _, item := range items {
+		b, err := canonicalJSON(item)
+		if err != nil {
+			return nil, err
+		}
+		rendered[cache.GetResourceName(item)] = string(b)
+	}
+	return rendered, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderedResources(t *testing.T) {
+	protections := append(testProtections(),
+		domainProtection(2, "store", "store.example.com"),
+		domainProtection(3, "blog", "blog.example.com"),
+	)
+	resources := newState(testDomainListenerPort, nil).buildResources(protections)
+
+	t.Run("port routed", func(t *testing.T) {
+		listeners, routes, clusters := renderedResources(resources, 1)
+		require.Len(t, listeners, 1)
+		assert.Equal(t, "listener-50010", cache.GetResourceName(listeners[0]))
+		require.Len(t, routes, 1)
+		assert.Equal(t, "shop-50010-route", cache.GetResourceName(routes[0]))
+		require.Len(t, clusters, 1)
+		assert.Equal(t, "shop-shop.default.svc.cluster.local-8080", cache.GetResourceName(clusters[0]))
+	})
+
+	t.Run("domain routed", func(t *testing.T) {
+		listeners, routes, clusters := renderedResources(resources, 2)
+		require.Len(t, listeners, 1)
+		assert.Equal(t, domainListenerName, cache.GetResourceName(listeners[0]))
+		require.Len(t, routes, 1)
+		// the shared route configuration keeps the protection virtual host only
+		virtualHosts := routes[0].(*route.RouteConfiguration).VirtualHosts
+		require.Len(t, virtualHosts, 1)
+		assert.Equal(t, "store.example.com", virtualHosts[0].Name)
+		require.Len(t, clusters, 1)
+		assert.Equal(t, "store-store.default.svc.cluster.local-80", cache.GetResourceName(clusters[0]))
+		// the snapshot resources are not modified
+		assert.Len(t, resources[resource.RouteType][1].(*route.RouteConfiguration).VirtualHosts, 2)
+	})
+
+	t.Run("unknown protection", func(t *testing.T) {
+		listeners, routes, clusters := renderedResources(resources, 4)
+		assert.Empty(t, listeners)
+		assert.Empty(t, routes)
+		assert.Empty(t, clusters)
+	})
+}
+
+func TestDiffResources(t *testing.T) {
+	s := newState(testDomainListenerPort, nil)
+	current := s.buildResources(testProtections())
+
+	t.Run("unchanged", func(t *testing.T) {
+		diffs, err := diffResources(DefaultGatewayGroup, current, s.buildResources(testProtections()))
+		require.NoError(t, err)
+		assert.Empty(t, diffs)
+	})
+
+	t.Run("protection update", func(t *testing.T) {
+		protections := testProtections()
+		protections[0] = applyProtectionUpdate(protections[0], &wv1.PutProtectionRequest{
+			Id: 1,
+			DesiredState: &wv1.ProtectionDesiredState{
+				ModeSec:    &wv1.ModSec{ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON},
+				RateLimits: []*wv1.RateLimitPolicy{{Requests: 5, IntervalSeconds: 60}},
+			},
+		})
+		protections = append(protections, domainProtection(2, "store", "store.example.com"))
+		diffs, err := diffResources(DefaultGatewayGroup, current, s.buildResources(protections))
+		require.NoError(t, err)
+		changes := map[string]wv1.ResourceChange{}
+		for _, diff := range diffs {
+			assert.Equal(t, DefaultGatewayGroup, diff.GatewayGroup)
+			changes[diff.Name] = diff.Change
+		}
+		assert.Equal(t, map[string]wv1.ResourceChange{
+			"store-store.default.svc.cluster.local-80": wv1.ResourceChange_RESOURCE_CHANGE_ADDED,
+			domainListenerName:                         wv1.ResourceChange_RESOURCE_CHANGE_ADDED,
+			"listener-50010":                           wv1.ResourceChange_RESOURCE_CHANGE_MODIFIED,
+			domainRouteConfigName:                      wv1.ResourceChange_RESOURCE_CHANGE_ADDED,
+			"shop-50010-route":                         wv1.ResourceChange_RESOURCE_CHANGE_MODIFIED,
+		}, changes)
+		// ordered by the type url and the name
+		assert.Equal(t, resource.ClusterType, diffs[0].TypeUrl)
+		assert.Empty(t, diffs[0].Current)
+		assert.NotEmpty(t, diffs[0].Proposed)
+	})
+
+	t.Run("removed protection", func(t *testing.T) {
+		diffs, err := diffResources(DefaultGatewayGroup, current, s.buildResources(nil))
+		require.NoError(t, err)
+		require.NotEmpty(t, diffs)
+		for _, diff := range diffs {
+			assert.Equal(t, wv1.ResourceChange_RESOURCE_CHANGE_REMOVED, diff.Change)
+			assert.Empty(t, diff.Proposed)
+		}
+	})
+}
+
+func TestApplyProtectionUpdate(t *testing.T) {
+	protection := testProtections()[0]
+	off := wv1.ProtectionMode_PROTECTION_MODE_OFF
+	group := "edge"
+	updated := applyProtectionUpdate(protection, &wv1.PutProtectionRequest{
+		Id:             1,
+		ProtectionMode: &off,
+		GatewayGroup:   &group,
+	})
+	assert.Equal(t, off, updated.ProtectionMode)
+	assert.Equal(t, "edge", updated.GatewayGroup)
+	// the desired state is kept when not set
+	assert.NotNil(t, updated.DesiredState.ModeSec)
+	// the listed protection is not modified
+	assert.Equal(t, wv1.ProtectionMode_PROTECTION_MODE_ON, protection.ProtectionMode)
+	assert.Empty(t, protection.GatewayGroup)
+}
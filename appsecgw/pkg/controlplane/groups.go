@@ -0,0 +1,46 @@
+package controlplane
+
+import (
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+const (
+	// DefaultGatewayGroup serves the protections without explicit gateway group
+	// and the envoy nodes without the gateway group metadata
+	DefaultGatewayGroup = "default"
+	// GatewayGroupMetadataKey is the envoy node metadata key selecting the gateway group
+	GatewayGroupMetadataKey = "gateway_group"
+)
+
+// groupHash keys the snapshots by the node gateway group,
+// all the nodes of the group share the same snapshot regardless of the node id
+type groupHash struct{}
+
+func (groupHash) ID(node *core.Node) string {
+	return nodeGatewayGroup(node)
+}
+
+func nodeGatewayGroup(node *core.Node) string {
+	if group := node.GetMetadata().GetFields()[GatewayGroupMetadataKey].GetStringValue(); group != "" {
+		return group
+	}
+	return DefaultGatewayGroup
+}
+
+func protectionGatewayGroup(protection *wv1.Protection) string {
+	if protection.GatewayGroup != "" {
+		return protection.GatewayGroup
+	}
+	return DefaultGatewayGroup
+}
+
+// groupProtections splits the protections by the gateway group
+func groupProtections(protections []*wv1.Protection) map[string][]*wv1.Protection {
+	groups := map[string][]*wv1.Protection{}
+	for _, protection := range protections {
+		group := protectionGatewayGroup(protection)
+		groups[group] = append(groups[group], protection)
+	}
+	return groups
+}
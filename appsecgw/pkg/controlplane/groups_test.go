@@ -0,0 +1,29 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGroupHash(t *testing.T) {
+	metadata, err := structpb.NewStruct(map[string]interface{}{GatewayGroupMetadataKey: "tenant-a"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-a", groupHash{}.ID(&core.Node{Id: "appsecgw-1", Metadata: metadata}))
+	assert.Equal(t, DefaultGatewayGroup, groupHash{}.ID(&core.Node{Id: "appsecgw-2"}))
+	assert.Equal(t, DefaultGatewayGroup, groupHash{}.ID(nil))
+}
+
+func TestGroupProtections(t *testing.T) {
+	groups := groupProtections([]*wv1.Protection{
+		{Id: 1},
+		{Id: 2, GatewayGroup: "tenant-a"},
+		{Id: 3, GatewayGroup: DefaultGatewayGroup},
+	})
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups[DefaultGatewayGroup], 2)
+	assert.Equal(t, uint32(2), groups["tenant-a"][0].Id)
+}
@@ -0,0 +1,253 @@
+package controlplane
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/metrics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	snapshotBuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "xds",
+		Name:      "snapshot_builds_total",
+		Help:      "Total number of envoy snapshot builds by result.",
+	}, []string{"result"})
+	snapshotBuildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "xds",
+		Name:      "snapshot_build_duration_seconds",
+		Help:      "Envoy resources and snapshot build duration.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	connectedNodes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "xds",
+		Name:      "connected_nodes",
+		Help:      "Number of envoy nodes with an open xDS stream.",
+	})
+	proxyRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "supervisor",
+		Name:      "envoy_restarts_total",
+		Help:      "Total number of envoy proxy restarts after an unexpected exit.",
+	})
+)
+
+// streamTracker tracks the xDS streams nodes for the connected nodes gauge
+// and the resource versions each node ACKed or NACKed, onNode is called for the node of each new stream
+type streamTracker struct {
+	mu      sync.Mutex
+	streams map[int64]string
+	// versions of the responses sent on the stream by the response nonce,
+	// removed once the node replies to the response
+	nonces map[int64]map[string]string
+	nodes  map[string]int
+	syncs  map[string]*nodeSync
+	onNode func(node *core.Node)
+}
+
+// nodeSync holds the last sent, ACKed and NACKed versions of the node per resource type
+type nodeSync struct {
+	group  string
+	sent   map[string]string
+	acked  map[string]string
+	nacked map[string]nack
+}
+
+type nack struct {
+	version string
+	message string
+}
+
+func newStreamTracker(onNode func(node *core.Node)) *streamTracker {
+	return &streamTracker{
+		streams: map[int64]string{},
+		nonces:  map[int64]map[string]string{},
+		nodes:   map[string]int{},
+		syncs:   map[string]*nodeSync{},
+		onNode:  onNode,
+	}
+}
+
+func (t *streamTracker) callbacks() server.Callbacks {
+	return server.CallbackFuncs{
+		StreamRequestFunc: func(streamID int64, req *discoverygrpc.DiscoveryRequest) error {
+			t.request(streamID, req.GetNode())
+			t.acknowledged(streamID, req.GetTypeUrl(), req.GetResponseNonce(), req.GetVersionInfo(),
+				req.GetErrorDetail().GetMessage())
+			return nil
+		},
+		StreamResponseFunc: func(_ context.Context, streamID int64, _ *discoverygrpc.DiscoveryRequest, resp *discoverygrpc.DiscoveryResponse) {
+			t.response(streamID, resp.GetTypeUrl(), resp.GetNonce(), resp.GetVersionInfo())
+		},
+		StreamClosedFunc: func(streamID int64, _ *core.Node) {
+			t.closed(streamID)
+		},
+		DeltaStreamOpenFunc: func(context.Context, int64, string) error {
+			return nil
+		},
+		StreamDeltaRequestFunc: func(streamID int64, req *discoverygrpc.DeltaDiscoveryRequest) error {
+			t.request(streamID, req.GetNode())
+			// the delta requests carry no version, the ACKed version is the one sent with the nonce
+			t.acknowledged(streamID, req.GetTypeUrl(), req.GetResponseNonce(), "",
+				req.GetErrorDetail().GetMessage())
+			return nil
+		},
+		StreamDeltaResponseFunc: func(streamID int64, _ *discoverygrpc.DeltaDiscoveryRequest, resp *discoverygrpc.DeltaDiscoveryResponse) {
+			t.response(streamID, resp.GetTypeUrl(), resp.GetNonce(), resp.GetSystemVersionInfo())
+		},
+		DeltaStreamClosedFunc: func(streamID int64, _ *core.Node) {
+			t.closed(streamID)
+		},
+	}
+}
+
+// request registers the stream node, envoy may send the node on the first request only
+func (t *streamTracker) request(streamID int64, node *core.Node) {
+	if node.GetId() == "" {
+		return
+	}
+	t.mu.Lock()
+	if _, ok := t.streams[streamID]; ok {
+		t.mu.Unlock()
+		return
+	}
+	t.streams[streamID] = node.GetId()
+	t.nonces[streamID] = map[string]string{}
+	t.nodes[node.GetId()]++
+	if _, ok := t.syncs[node.GetId()]; !ok {
+		t.syncs[node.GetId()] = &nodeSync{
+			group:  nodeGatewayGroup(node),
+			sent:   map[string]string{},
+			acked:  map[string]string{},
+			nacked: map[string]nack{},
+		}
+	}
+	connectedNodes.Set(float64(len(t.nodes)))
+	t.mu.Unlock()
+	if t.onNode != nil {
+		t.onNode(node)
+	}
+}
+
+// response records the version sent to the stream node with the response nonce
+func (t *streamTracker) response(streamID int64, typeUrl, nonce, version string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if nodeId, ok := t.streams[streamID]; ok {
+		t.syncs[nodeId].sent[typeUrl] = version
+		t.nonces[streamID][nonce] = version
+	}
+}
+
+// acknowledged records the node ACK or NACK of the response, the request replying to a response
+// carries its nonce, the applied version when ACKed and the error detail when NACKed.
+// The NACKed version is the one sent with the nonce, the node keeps the previously applied version
+func (t *streamTracker) acknowledged(streamID int64, typeUrl, responseNonce, versionInfo, errorMessage string) {
+	if responseNonce == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodeId, ok := t.streams[streamID]
+	if !ok {
+		return
+	}
+	node := t.syncs[nodeId]
+	sentVersion, sent := t.nonces[streamID][responseNonce]
+	delete(t.nonces[streamID], responseNonce)
+	if errorMessage != "" {
+		if sent {
+			node.nacked[typeUrl] = nack{version: sentVersion, message: errorMessage}
+		}
+		return
+	}
+	version := versionInfo
+	if version == "" {
+		version = sentVersion
+	}
+	if version == "" {
+		return
+	}
+	node.acked[typeUrl] = version
+	delete(node.nacked, typeUrl)
+}
+
+// nodeSynced reports whether the node has an open stream and applied a snapshot
+func (t *streamTracker) nodeSynced(nodeId string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node, ok := t.syncs[nodeId]
+	return ok && len(node.acked) > 0
+}
+
+// nodeStatuses reports the sync status of the gateway group nodes with the group snapshot,
+// the snapshot versions are per resource type, see newSnapshot
+func (t *streamTracker) nodeStatuses(group string, snapshot cache.ResourceSnapshot) []*wv1.NodeStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var statuses []*wv1.NodeStatus
+	for nodeId, node := range t.syncs {
+		if node.group != group {
+			continue
+		}
+		statuses = append(statuses, node.status(nodeId, snapshot))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].NodeId < statuses[j].NodeId })
+	return statuses
+}
+
+func (s *nodeSync) status(nodeId string, snapshot cache.ResourceSnapshot) *wv1.NodeStatus {
+	nodeStatus := &wv1.NodeStatus{
+		NodeId:       nodeId,
+		GatewayGroup: s.group,
+		Status:       wv1.NodeSyncStatus_NODE_SYNC_STATUS_PENDING,
+	}
+	if snapshot == nil {
+		return nodeStatus
+	}
+	for typeUrl, n := range s.nacked {
+		if n.version == snapshot.GetVersion(typeUrl) {
+			nodeStatus.Status = wv1.NodeSyncStatus_NODE_SYNC_STATUS_NACKED
+			nodeStatus.Error = n.message
+			return nodeStatus
+		}
+	}
+	// all the resource types sent to the node are ACKed with the snapshot version
+	if len(s.sent) == 0 {
+		return nodeStatus
+	}
+	for typeUrl := range s.sent {
+		if s.acked[typeUrl] != snapshot.GetVersion(typeUrl) {
+			return nodeStatus
+		}
+	}
+	nodeStatus.Status = wv1.NodeSyncStatus_NODE_SYNC_STATUS_ACKED
+	return nodeStatus
+}
+
+func (t *streamTracker) closed(streamID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodeId, ok := t.streams[streamID]
+	if !ok {
+		return
+	}
+	delete(t.streams, streamID)
+	delete(t.nonces, streamID)
+	if t.nodes[nodeId]--; t.nodes[nodeId] <= 0 {
+		delete(t.nodes, nodeId)
+		delete(t.syncs, nodeId)
+	}
+	connectedNodes.Set(float64(len(t.nodes)))
+}
@@ -0,0 +1,87 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestStreamTrackerNodeSynced(t *testing.T) {
+	tracker := newStreamTracker(nil)
+	tracker.request(1, &core.Node{Id: "node-1"})
+	// the initial request does not reply to a response
+	tracker.acknowledged(1, resource.ListenerType, "", "", "")
+	assert.False(t, tracker.nodeSynced("node-1"))
+	tracker.response(1, resource.ListenerType, "nonce-1", "v1")
+	tracker.acknowledged(1, resource.ListenerType, "nonce-1", "", "invalid listener")
+	assert.False(t, tracker.nodeSynced("node-1"))
+	tracker.response(1, resource.ListenerType, "nonce-2", "v2")
+	tracker.acknowledged(1, resource.ListenerType, "nonce-2", "v2", "")
+	assert.True(t, tracker.nodeSynced("node-1"))
+	tracker.closed(1)
+	assert.False(t, tracker.nodeSynced("node-1"))
+}
+
+func TestStreamTrackerNodeStatuses(t *testing.T) {
+	snap, _, err := newSnapshot(newState(testDomainListenerPort, nil).buildResources(testProtections()))
+	require.NoError(t, err)
+	listenersVersion := snap.GetVersion(resource.ListenerType)
+	clustersVersion := snap.GetVersion(resource.ClusterType)
+
+	tracker := newStreamTracker(nil)
+	tracker.request(1, &core.Node{Id: "node-1"})
+	tracker.request(2, &core.Node{Id: "node-2"})
+	tracker.request(3, &core.Node{Id: "node-3"})
+	tracker.request(4, &core.Node{
+		Id: "node-4",
+		Metadata: &structpb.Struct{Fields: map[string]*structpb.Value{
+			GatewayGroupMetadataKey: structpb.NewStringValue("edge"),
+		}},
+	})
+	for streamID := int64(1); streamID <= 3; streamID++ {
+		tracker.response(streamID, resource.ClusterType, "1", clustersVersion)
+		tracker.acknowledged(streamID, resource.ClusterType, "1", clustersVersion, "")
+		tracker.response(streamID, resource.ListenerType, "2", listenersVersion)
+	}
+	tracker.acknowledged(1, resource.ListenerType, "2", listenersVersion, "")
+	tracker.acknowledged(2, resource.ListenerType, "2", "", "unknown filter")
+
+	statuses := tracker.nodeStatuses(DefaultGatewayGroup, snap)
+	require.Len(t, statuses, 3)
+	assert.Equal(t, "node-1", statuses[0].NodeId)
+	assert.Equal(t, wv1.NodeSyncStatus_NODE_SYNC_STATUS_ACKED, statuses[0].Status)
+	assert.Equal(t, wv1.NodeSyncStatus_NODE_SYNC_STATUS_NACKED, statuses[1].Status)
+	assert.Equal(t, "unknown filter", statuses[1].Error)
+	// the listeners are not acknowledged yet
+	assert.Equal(t, wv1.NodeSyncStatus_NODE_SYNC_STATUS_PENDING, statuses[2].Status)
+
+	edge := tracker.nodeStatuses("edge", nil)
+	require.Len(t, edge, 1)
+	assert.Equal(t, wv1.NodeSyncStatus_NODE_SYNC_STATUS_PENDING, edge[0].Status)
+}
+
+func TestStreamTrackerAcknowledgedVersions(t *testing.T) {
+	tracker := newStreamTracker(nil)
+	tracker.request(1, &core.Node{Id: "node-1"})
+	node := tracker.syncs["node-1"]
+	tracker.response(1, resource.ListenerType, "1", "v1")
+	tracker.response(1, resource.ListenerType, "2", "v2")
+	// the ACK of the first response is credited to the version it applied, not the last sent one
+	tracker.acknowledged(1, resource.ListenerType, "1", "v1", "")
+	assert.Equal(t, "v1", node.acked[resource.ListenerType])
+	// the NACK carries the previously applied version, the rejected one is sent with the nonce
+	tracker.acknowledged(1, resource.ListenerType, "2", "v1", "invalid listener")
+	assert.Equal(t, "v1", node.acked[resource.ListenerType])
+	assert.Equal(t, nack{version: "v2", message: "invalid listener"}, node.nacked[resource.ListenerType])
+	// the delta ACK has no version, the version sent with the nonce is ACKed
+	tracker.response(1, resource.ListenerType, "3", "v3")
+	tracker.acknowledged(1, resource.ListenerType, "3", "", "")
+	assert.Equal(t, "v3", node.acked[resource.ListenerType])
+	assert.Empty(t, node.nacked)
+	assert.Empty(t, tracker.nonces[1])
+}
@@ -0,0 +1,137 @@
+package controlplane
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// mirrorTargets lists the mirror policy targets, the policy ip, port and dns being the first one
+func mirrorTargets(policy *wv1.MirrorPolicy) []*wv1.MirrorTarget {
+	var targets []*wv1.MirrorTarget
+	if policy.Ip != "" || policy.Dns != "" {
+		targets = append(targets, &wv1.MirrorTarget{Ip: policy.Ip, Port: policy.Port, Dns: policy.Dns})
+	}
+	return append(targets, policy.Targets...)
+}
+
+// mirrorAddress prefers the dns name over the ip
+func mirrorAddress(target *wv1.MirrorTarget) string {
+	if target.Dns != "" {
+		return target.Dns
+	}
+	return target.Ip
+}
+
+func mirrorBlocked(policy *wv1.MirrorPolicy) bool {
+	return policy.GetMode() == wv1.MirrorMode_MIRROR_MODE_BLOCKED
+}
+
+// mirrorPredicates reports whether only a subset of the routed requests is mirrored
+func mirrorPredicates(policy *wv1.MirrorPolicy) bool {
+	return len(policy.HeaderMatches) > 0 || policy.PathPrefix != ""
+}
+
+// requestMirrorPolicies mirrors the route requests to all the policy targets
+func (s *state) requestMirrorPolicies(target *upstreamTarget, policy *wv1.MirrorPolicy) []*route.RouteAction_RequestMirrorPolicy {
+	var mirrorPolicies []*route.RouteAction_RequestMirrorPolicy
+	for idx := range mirrorTargets(policy) {
+		mirrorPolicy := &route.RouteAction_RequestMirrorPolicy{
+			Cluster: target.mirroredClusterName(idx),
+		}
+		if policy.SamplePercent != nil {
+			mirrorPolicy.RuntimeFraction = &core.RuntimeFractionalPercent{
+				DefaultValue: &typev3.FractionalPercent{
+					Numerator:   policy.GetSamplePercent(),
+					Denominator: typev3.FractionalPercent_HUNDRED,
+				},
+				RuntimeKey: fmt.Sprintf("mirror.%s", target.mirroredClusterName(idx)),
+			}
+		}
+		mirrorPolicies = append(mirrorPolicies, mirrorPolicy)
+	}
+	return mirrorPolicies
+}
+
+// mirrorRoute is the ingress route copy mirroring the requests matching the policy headers and path,
+// the requests of the route policies paths are not mirrored
+func (s *state) mirrorRoute(target *upstreamTarget, ingressRoute *route.Route) *route.Route {
+	policy := target.routedMirrorPolicy()
+	if policy == nil || !mirrorPredicates(policy) {
+		return nil
+	}
+	prefix := target.pathPrefix()
+	if policy.PathPrefix != "" {
+		if !strings.HasPrefix(policy.PathPrefix, prefix) {
+			s.logger.Warn("mirror path prefix is not routed by the ingress, skipping",
+				zap.String("path", policy.PathPrefix), zap.String("application", target.appName()))
+			return nil
+		}
+		prefix = policy.PathPrefix
+	}
+	mirrorRoute := proto.Clone(ingressRoute).(*route.Route)
+	mirrorRoute.Name = target.clusterName() + "-mirror"
+	mirrorRoute.Match = s.prefixMatch(prefix)
+	for _, header := range policy.HeaderMatches {
+		headerMatcher := &route.HeaderMatcher{Name: header.Name}
+		if header.Value == "" {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: header.Value},
+				},
+			}
+		}
+		mirrorRoute.Match.Headers = append(mirrorRoute.Match.Headers, headerMatcher)
+	}
+	mirrorRoute.GetRoute().RequestMirrorPolicies = s.requestMirrorPolicies(target, policy)
+	return mirrorRoute
+}
+
+// honeypotConfig sets the wafie filter honeypots receiving a copy of the blocked requests,
+// envoy does not mirror the requests replied by the filter, so the filter copies them itself.
+// Each mirror policy is a honeypot with its own targets and sample percent
+func honeypotConfig(protection *wv1.Protection, cfg map[string]interface{}) {
+	var honeypots []interface{}
+	seen := map[string]bool{}
+	for _, ingress := range protection.GetApplication().GetIngress() {
+		policy := ingress.GetUpstream().GetMirrorPolicy()
+		if policy.GetStatus() != wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED || !mirrorBlocked(policy) {
+			continue
+		}
+		var targets []string
+		for _, target := range mirrorTargets(policy) {
+			address := net.JoinHostPort(mirrorAddress(target), strconv.Itoa(int(target.Port)))
+			// the same target of several policies receives a single copy
+			if !seen[address] {
+				seen[address] = true
+				targets = append(targets, address)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		samplePercent := uint32(100)
+		if policy.SamplePercent != nil {
+			samplePercent = policy.GetSamplePercent()
+		}
+		honeypots = append(honeypots, map[string]interface{}{
+			"targets":        structList(targets),
+			"sample_percent": samplePercent,
+		})
+	}
+	if len(honeypots) == 0 {
+		return
+	}
+	cfg["honeypots"] = honeypots
+}
@@ -0,0 +1,141 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	xds "github.com/cncf/xds/go/xds/type/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func mirroredProtection(mirrorPolicy *wv1.MirrorPolicy) *wv1.Protection {
+	protection := testProtections()[0]
+	mirrorPolicy.Status = wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED
+	protection.Application.Ingress[0].Upstream.MirrorPolicy = mirrorPolicy
+	return protection
+}
+
+func TestBuildResourcesMirroring(t *testing.T) {
+	t.Run("sampled to all targets", func(t *testing.T) {
+		protection := mirroredProtection(&wv1.MirrorPolicy{
+			Ip:            "10.0.1.1",
+			Port:          8080,
+			SamplePercent: proto.Uint32(10),
+			Targets:       []*wv1.MirrorTarget{{Dns: "shadow.default.svc", Port: 80}},
+		})
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		var names []string
+		for _, r := range resources[resource.ClusterType] {
+			names = append(names, r.(*cluster.Cluster).Name)
+		}
+		assert.Equal(t, []string{
+			"shop-shop.default.svc.cluster.local-8080",
+			"shop-shop.default.svc.cluster.local-mirrored",
+			"shop-shop.default.svc.cluster.local-mirrored-1",
+		}, names)
+
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 1)
+		mirrorPolicies := routes[0].GetRoute().RequestMirrorPolicies
+		require.Len(t, mirrorPolicies, 2)
+		assert.Equal(t, "shop-shop.default.svc.cluster.local-mirrored-1", mirrorPolicies[1].Cluster)
+		assert.Equal(t, uint32(10), mirrorPolicies[0].RuntimeFraction.DefaultValue.Numerator)
+	})
+
+	t.Run("header and path predicates", func(t *testing.T) {
+		protection := mirroredProtection(&wv1.MirrorPolicy{
+			Ip:            "10.0.1.1",
+			Port:          8080,
+			PathPrefix:    "/checkout",
+			HeaderMatches: []*wv1.MirrorHeaderMatch{{Name: "x-canary", Value: "true"}, {Name: "x-debug"}},
+		})
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 2)
+		mirrorRoute := routes[0]
+		assert.Equal(t, "/checkout", mirrorRoute.Match.GetPrefix())
+		require.Len(t, mirrorRoute.Match.Headers, 2)
+		assert.Equal(t, "true", mirrorRoute.Match.Headers[0].GetStringMatch().GetExact())
+		assert.True(t, mirrorRoute.Match.Headers[1].GetPresentMatch())
+		assert.Len(t, mirrorRoute.GetRoute().RequestMirrorPolicies, 1)
+		assert.Nil(t, mirrorRoute.GetRoute().RequestMirrorPolicies[0].RuntimeFraction)
+		assert.Equal(t, "/", routes[1].Match.GetPrefix())
+		assert.Empty(t, routes[1].GetRoute().RequestMirrorPolicies)
+	})
+
+	t.Run("blocked requests to honeypot", func(t *testing.T) {
+		protection := mirroredProtection(&wv1.MirrorPolicy{
+			Mode:          wv1.MirrorMode_MIRROR_MODE_BLOCKED,
+			Dns:           "honeypot.security.svc",
+			Port:          80,
+			SamplePercent: proto.Uint32(50),
+		})
+		protection.Application.Ingress[0].Upstream.UpstreamRouteType = wv1.UpstreamRouteType_UPSTREAM_ROUTE_TYPE_DOMAIN
+		protection.Application.Ingress[0].Host = "shop.example.com"
+		protection.Application.Ingress[0].Upstream.Ports = append(protection.Application.Ingress[0].Upstream.Ports,
+			&wv1.Port{Number: 80, PortType: wv1.PortType_PORT_TYPE_SVC_PORT})
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		// mirrored by the wafie filter, not by the router
+		assert.Len(t, resources[resource.ClusterType], 1)
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 1)
+		assert.Empty(t, routes[0].GetRoute().RequestMirrorPolicies)
+
+		typedStruct := &xds.TypedStruct{}
+		filterConfig, err := newState(testDomainListenerPort, nil).wafieFilterConfig(protection, protection.DesiredState.ModeSec)
+		require.NoError(t, err)
+		require.NoError(t, filterConfig.UnmarshalTo(typedStruct))
+		fields := typedStruct.Value.GetFields()
+		honeypots := fields["honeypots"].GetListValue().GetValues()
+		require.Len(t, honeypots, 1)
+		honeypot := honeypots[0].GetStructValue().GetFields()
+		assert.Equal(t, "honeypot.security.svc:80", honeypot["targets"].GetListValue().GetValues()[0].GetStringValue())
+		assert.Equal(t, float64(50), honeypot["sample_percent"].GetNumberValue())
+	})
+
+	t.Run("sample percent per honeypot policy", func(t *testing.T) {
+		protection := mirroredProtection(&wv1.MirrorPolicy{
+			Mode:          wv1.MirrorMode_MIRROR_MODE_BLOCKED,
+			Dns:           "honeypot.security.svc",
+			Port:          80,
+			SamplePercent: proto.Uint32(50),
+		})
+		second := proto.Clone(protection.Application.Ingress[0]).(*wv1.Ingress)
+		second.Upstream.MirrorPolicy = &wv1.MirrorPolicy{
+			Status: wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED,
+			Mode:   wv1.MirrorMode_MIRROR_MODE_BLOCKED,
+			Dns:    "trap.security.svc",
+			Port:   8080,
+		}
+		protection.Application.Ingress = append(protection.Application.Ingress, second)
+		cfg := map[string]interface{}{}
+		honeypotConfig(protection, cfg)
+		honeypots := cfg["honeypots"].([]interface{})
+		require.Len(t, honeypots, 2)
+		assert.Equal(t, map[string]interface{}{
+			"targets":        []interface{}{"honeypot.security.svc:80"},
+			"sample_percent": uint32(50),
+		}, honeypots[0])
+		assert.Equal(t, map[string]interface{}{
+			"targets":        []interface{}{"trap.security.svc:8080"},
+			"sample_percent": uint32(100),
+		}, honeypots[1])
+	})
+}
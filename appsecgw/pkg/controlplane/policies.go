@@ -0,0 +1,122 @@
+package controlplane
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// modSecOn reports whether the requests are evaluated by the wafie filter
+func modSecOn(modSec *wv1.ModSec) bool {
+	return modSec.GetProtectionMode() == wv1.ProtectionMode_PROTECTION_MODE_ON
+}
+
+// wafieFilterRequired reports whether any of the protection requests are evaluated,
+// either by the protection settings or by one of the route policies
+func wafieFilterRequired(protection *wv1.Protection) bool {
+	if modSecOn(protection.GetDesiredState().GetModeSec()) {
+		return true
+	}
+	for _, policy := range protection.GetDesiredState().GetRoutePolicies() {
+		if modSecOn(policyModSec(protection, policy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyModSec merges the route policy settings into the protection settings,
+// the policy unset fields inherit the protection values
+func policyModSec(protection *wv1.Protection, policy *wv1.RoutePolicy) *wv1.ModSec {
+	modSec := &wv1.ModSec{}
+	if base := protection.GetDesiredState().GetModeSec(); base != nil {
+		modSec = proto.Clone(base).(*wv1.ModSec)
+	}
+	override := policy.GetModeSec()
+	if override.GetProtectionMode() != wv1.ProtectionMode_PROTECTION_MODE_UNSPECIFIED {
+		modSec.ProtectionMode = override.ProtectionMode
+	}
+	if override.GetParanoiaLevel() != wv1.ParanoiaLevel_PARANOIA_LEVEL_UNSPECIFIED {
+		modSec.ParanoiaLevel = override.ParanoiaLevel
+	}
+	if override.GetFailurePolicy() != wv1.FailurePolicy_FAILURE_POLICY_UNSPECIFIED {
+		modSec.FailurePolicy = override.FailurePolicy
+	}
+	if override.GetEvaluationTimeoutMs() != 0 {
+		modSec.EvaluationTimeoutMs = override.EvaluationTimeoutMs
+	}
+	if override.GetBlockResponse() != nil {
+		modSec.BlockResponse = override.BlockResponse
+	}
+	if override.GetAuditLogMasking() != nil {
+		modSec.AuditLogMasking = override.AuditLogMasking
+	}
+	return modSec
+}
+
+// policyMatch builds the route match of the policy path and methods
+func policyMatch(policy *wv1.RoutePolicy) *route.RouteMatch {
+	match := &route.RouteMatch{}
+	switch policy.PathMatchType {
+	case wv1.PathMatchType_PATH_MATCH_TYPE_EXACT:
+		match.PathSpecifier = &route.RouteMatch_Path{Path: policy.Path}
+	case wv1.PathMatchType_PATH_MATCH_TYPE_REGEX:
+		match.PathSpecifier = &route.RouteMatch_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: policy.Path},
+		}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: policy.Path}
+	}
+	if len(policy.Methods) > 0 {
+		methods := make([]string, 0, len(policy.Methods))
+		for _, method := range policy.Methods {
+			methods = append(methods, regexp.QuoteMeta(strings.ToUpper(method)))
+		}
+		match.Headers = []*route.HeaderMatcher{
+			{
+				Name: ":method",
+				HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+					StringMatch: &matcher.StringMatcher{
+						MatchPattern: &matcher.StringMatcher_SafeRegex{
+							SafeRegex: &matcher.RegexMatcher{
+								Regex: fmt.Sprintf("^(%s)$", strings.Join(methods, "|")),
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	return match
+}
+
+// policyInPrefix reports whether the policy path is routed by the ingress path prefix,
+// the regex policies are scoped only to the ingresses routing the whole host
+func policyInPrefix(policy *wv1.RoutePolicy, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	if policy.PathMatchType == wv1.PathMatchType_PATH_MATCH_TYPE_REGEX {
+		return false
+	}
+	return strings.HasPrefix(policy.Path, prefix)
+}
+
+// policyRoutes routes the target requests matching the route policies,
+// each route overrides the wafie filter config with the policy settings
+func (s *state) policyRoutes(target *upstreamTarget, prefix string) (routes []*route.Route) {
+	for idx, policy := range target.protection.GetDesiredState().GetRoutePolicies() {
+		if !policyInPrefix(policy, prefix) {
+			continue
+		}
+		r := s.route(target, fmt.Sprintf("%s-policy-%d", target.clusterName(), idx), policyMatch(policy))
+		r.TypedPerFilterConfig = s.routeFilterConfig(target.protection, policyModSec(target.protection, policy))
+		routes = append(routes, r)
+	}
+	return routes
+}
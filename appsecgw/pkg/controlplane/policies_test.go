@@ -0,0 +1,144 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	xds "github.com/cncf/xds/go/xds/type/v3"
+	golangv3alpha "github.com/envoyproxy/go-control-plane/contrib/envoy/extensions/filters/http/golang/v3alpha"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeParanoiaLevel returns the paranoia level of the route wafie filter override,
+// or -1 when the filter is disabled for the route
+func routeParanoiaLevel(t *testing.T, r *route.Route) int {
+	perRoute := &golangv3alpha.ConfigsPerRoute{}
+	require.NoError(t, r.TypedPerFilterConfig[wafieFilterName].UnmarshalTo(perRoute))
+	plugin := perRoute.PluginsConfig[wafiePluginName]
+	if plugin.GetDisabled() {
+		return -1
+	}
+	typedStruct := &xds.TypedStruct{}
+	require.NoError(t, plugin.GetConfig().UnmarshalTo(typedStruct))
+	return int(typedStruct.Value.GetFields()["paranoia_level"].GetNumberValue())
+}
+
+func withRoutePolicies(p *wv1.Protection) {
+	p.DesiredState.ModeSec.ParanoiaLevel = wv1.ParanoiaLevel_PARANOIA_LEVEL_1
+	p.DesiredState.RoutePolicies = []*wv1.RoutePolicy{
+		{
+			Path:    "/api",
+			ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_2},
+		},
+		{
+			Path:    "/admin",
+			ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_4},
+		},
+		{
+			PathMatchType: wv1.PathMatchType_PATH_MATCH_TYPE_EXACT,
+			Path:          "/healthz",
+			Methods:       []string{"get", "HEAD"},
+			ModeSec:       &wv1.ModSec{ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_OFF},
+		},
+		{
+			PathMatchType: wv1.PathMatchType_PATH_MATCH_TYPE_REGEX,
+			Path:          "^/v[0-9]+/upload$",
+			ModeSec:       &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_3},
+		},
+	}
+}
+
+func TestPolicyModSec(t *testing.T) {
+	protection := testProtections()[0]
+	protection.DesiredState.ModeSec.FailurePolicy = wv1.FailurePolicy_FAILURE_POLICY_FAIL_CLOSED
+	protection.DesiredState.ModeSec.EvaluationTimeoutMs = 100
+	modSec := policyModSec(protection, &wv1.RoutePolicy{
+		ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_4, EvaluationTimeoutMs: 300},
+	})
+	assert.Equal(t, wv1.ProtectionMode_PROTECTION_MODE_ON, modSec.ProtectionMode)
+	assert.Equal(t, wv1.ParanoiaLevel_PARANOIA_LEVEL_4, modSec.ParanoiaLevel)
+	assert.Equal(t, wv1.FailurePolicy_FAILURE_POLICY_FAIL_CLOSED, modSec.FailurePolicy)
+	assert.Equal(t, uint32(300), modSec.EvaluationTimeoutMs)
+	// the protection settings are not modified
+	assert.Equal(t, wv1.ParanoiaLevel_PARANOIA_LEVEL_UNSPECIFIED, protection.DesiredState.ModeSec.ParanoiaLevel)
+}
+
+func TestBuildResourcesRoutePolicies(t *testing.T) {
+	t.Run("port routed", func(t *testing.T) {
+		protection := testProtections()[0]
+		withRoutePolicies(protection)
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 5)
+		assert.Equal(t, "/api", routes[0].Match.GetPrefix())
+		assert.Equal(t, 2, routeParanoiaLevel(t, routes[0]))
+		assert.Equal(t, "/admin", routes[1].Match.GetPrefix())
+		assert.Equal(t, 4, routeParanoiaLevel(t, routes[1]))
+		assert.Equal(t, "/healthz", routes[2].Match.GetPath())
+		assert.Equal(t, "^(GET|HEAD)$", routes[2].Match.Headers[0].GetStringMatch().GetSafeRegex().GetRegex())
+		assert.Equal(t, -1, routeParanoiaLevel(t, routes[2]))
+		assert.Equal(t, "^/v[0-9]+/upload$", routes[3].Match.GetSafeRegex().GetRegex())
+		assert.Equal(t, 3, routeParanoiaLevel(t, routes[3]))
+		// the protection settings are configured on the listener filter
+		assert.Equal(t, "/", routes[4].Match.GetPrefix())
+		assert.Empty(t, routes[4].TypedPerFilterConfig)
+		for _, r := range routes {
+			assert.Equal(t, "shop-shop.default.svc.cluster.local-8080", r.GetRoute().GetCluster())
+		}
+	})
+
+	t.Run("protection off with policy on", func(t *testing.T) {
+		protection := testProtections()[0]
+		protection.DesiredState.ModeSec.ProtectionMode = wv1.ProtectionMode_PROTECTION_MODE_OFF
+		protection.DesiredState.RoutePolicies = []*wv1.RoutePolicy{
+			{Path: "/login", ModeSec: &wv1.ModSec{ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON}},
+		}
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+
+		listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+		httpConnectionMgr := &hcm.HttpConnectionManager{}
+		require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(httpConnectionMgr))
+		require.Len(t, httpConnectionMgr.HttpFilters, 2)
+		assert.Equal(t, wafieFilterName, httpConnectionMgr.HttpFilters[0].Name)
+
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 2)
+		assert.Equal(t, 0, routeParanoiaLevel(t, routes[0]))
+		assert.Equal(t, -1, routeParanoiaLevel(t, routes[1]))
+	})
+
+	t.Run("domain routed", func(t *testing.T) {
+		protection := domainProtection(2, "store", "store.example.com")
+		protection.Application.Ingress[0].Path = "/shop"
+		protection.DesiredState.RoutePolicies = []*wv1.RoutePolicy{
+			{Path: "/shop/admin", ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_4}},
+			// outside the ingress path
+			{Path: "/api", ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_2}},
+			{
+				PathMatchType: wv1.PathMatchType_PATH_MATCH_TYPE_REGEX,
+				Path:          "^/shop/.*",
+				ModeSec:       &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_2},
+			},
+		}
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		routes := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+		require.Len(t, routes, 2)
+		assert.Equal(t, "/shop/admin", routes[0].Match.GetPrefix())
+		assert.Equal(t, 4, routeParanoiaLevel(t, routes[0]))
+		assert.Equal(t, "/shop", routes[1].Match.GetPrefix())
+		assert.Equal(t, 0, routeParanoiaLevel(t, routes[1]))
+	})
+}
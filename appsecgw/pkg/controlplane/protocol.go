@@ -0,0 +1,109 @@
+package controlplane
+
+import (
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const httpProtocolOptionsName = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+
+// withProtocolOptions configures the upstream TLS origination and the HTTP protocol of the cluster,
+// the cluster without protocol options stays plaintext HTTP/1.1
+func (s *state) withProtocolOptions(c *cluster.Cluster, upstream *wv1.Upstream) *cluster.Cluster {
+	options := upstream.GetProtocolOptions()
+	if options == nil {
+		return c
+	}
+	if options.GetTls().GetEnabled() {
+		if transportSocket := s.upstreamTransportSocket(upstream); transportSocket != nil {
+			c.TransportSocket = transportSocket
+		}
+	}
+	if protocolOptions := s.httpProtocolOptions(options); protocolOptions != nil {
+		c.TypedExtensionProtocolOptions = map[string]*anypb.Any{httpProtocolOptionsName: protocolOptions}
+	}
+	return c
+}
+
+// upstreamTransportSocket originates TLS to the upstream, the SNI defaults to the service fqdn,
+// the upstream certificate is verified only when the CA bundle is set
+func (s *state) upstreamTransportSocket(upstream *wv1.Upstream) *core.TransportSocket {
+	options := upstream.GetProtocolOptions()
+	sni := options.GetTls().GetSni()
+	if sni == "" {
+		sni = upstream.SvcFqdn
+	}
+	commonTlsContext := &tls.CommonTlsContext{
+		AlpnProtocols: alpnProtocols(options.Protocol),
+	}
+	if caBundle := options.GetTls().GetCaBundle(); caBundle != "" {
+		commonTlsContext.ValidationContextType = &tls.CommonTlsContext_ValidationContext{
+			ValidationContext: &tls.CertificateValidationContext{
+				TrustedCa: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: caBundle},
+				},
+			},
+		}
+	}
+	tlsContext, err := anypb.New(&tls.UpstreamTlsContext{
+		Sni:              sni,
+		CommonTlsContext: commonTlsContext,
+	})
+	if err != nil {
+		s.logger.Error("failed to create upstream tls context", zap.Error(err))
+		return nil
+	}
+	return &core.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: tlsContext,
+		},
+	}
+}
+
+// httpProtocolOptions selects the upstream HTTP protocol,
+// the auto protocol is negotiated with ALPN and requires TLS
+func (s *state) httpProtocolOptions(options *wv1.UpstreamProtocolOptions) *anypb.Any {
+	protocolOptions := &upstreamhttp.HttpProtocolOptions{}
+	switch {
+	case options.Protocol == wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2:
+		protocolOptions.UpstreamProtocolOptions = &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		}
+	case options.Protocol == wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_AUTO && options.GetTls().GetEnabled():
+		protocolOptions.UpstreamProtocolOptions = &upstreamhttp.HttpProtocolOptions_AutoConfig{
+			AutoConfig: &upstreamhttp.HttpProtocolOptions_AutoHttpConfig{
+				Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+			},
+		}
+	default:
+		return nil
+	}
+	typedOptions, err := anypb.New(protocolOptions)
+	if err != nil {
+		s.logger.Error("failed to create http protocol options", zap.Error(err))
+		return nil
+	}
+	return typedOptions
+}
+
+func alpnProtocols(protocol wv1.UpstreamProtocol) []string {
+	switch protocol {
+	case wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2:
+		return []string{"h2"}
+	case wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_AUTO:
+		return []string{"h2", "http/1.1"}
+	default:
+		return []string{"http/1.1"}
+	}
+}
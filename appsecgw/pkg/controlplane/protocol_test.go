@@ -0,0 +1,69 @@
+package controlplane
+
+import (
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func clusterProtocolOptions(t *testing.T, c *cluster.Cluster) *upstreamhttp.HttpProtocolOptions {
+	typedOptions, ok := c.TypedExtensionProtocolOptions[httpProtocolOptionsName]
+	require.True(t, ok)
+	protocolOptions := &upstreamhttp.HttpProtocolOptions{}
+	require.NoError(t, typedOptions.UnmarshalTo(protocolOptions))
+	return protocolOptions
+}
+
+func TestBuildResourcesProtocolOptions(t *testing.T) {
+	grpc := testProtections()[0]
+	grpc.Application.Ingress[0].Upstream.ProtocolOptions = &wv1.UpstreamProtocolOptions{
+		Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2,
+	}
+	https := domainProtection(2, "store", "store.example.com")
+	https.Application.Ingress[0].Upstream.ProtocolOptions = &wv1.UpstreamProtocolOptions{
+		Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_AUTO,
+		Tls:      &wv1.UpstreamTls{Enabled: true, CaBundle: "ca-pem"},
+	}
+	plain := domainProtection(3, "blog", "blog.example.com")
+	resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{grpc, https, plain})
+	snap, _, err := newSnapshot(resources)
+	require.NoError(t, err)
+	require.NoError(t, snap.Consistent())
+
+	clusters := map[string]*cluster.Cluster{}
+	for _, r := range resources[resource.ClusterType] {
+		clusters[r.(*cluster.Cluster).Name] = r.(*cluster.Cluster)
+	}
+
+	t.Run("http2 plaintext", func(t *testing.T) {
+		c := clusters["shop-shop.default.svc.cluster.local-8080"]
+		require.NotNil(t, c)
+		assert.Nil(t, c.TransportSocket)
+		assert.NotNil(t, clusterProtocolOptions(t, c).GetExplicitHttpConfig().GetHttp2ProtocolOptions())
+	})
+
+	t.Run("auto over tls", func(t *testing.T) {
+		c := clusters["store-store.default.svc.cluster.local-80"]
+		require.NotNil(t, c)
+		require.NotNil(t, c.TransportSocket)
+		tlsContext := &tls.UpstreamTlsContext{}
+		require.NoError(t, c.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+		assert.Equal(t, "store.default.svc.cluster.local", tlsContext.Sni)
+		assert.Equal(t, []string{"h2", "http/1.1"}, tlsContext.CommonTlsContext.AlpnProtocols)
+		assert.Equal(t, "ca-pem", tlsContext.CommonTlsContext.GetValidationContext().TrustedCa.GetInlineString())
+		assert.NotNil(t, clusterProtocolOptions(t, c).GetAutoConfig())
+	})
+
+	t.Run("default http1 plaintext", func(t *testing.T) {
+		c := clusters["blog-blog.default.svc.cluster.local-80"]
+		require.NotNil(t, c)
+		assert.Nil(t, c.TransportSocket)
+		assert.Empty(t, c.TypedExtensionProtocolOptions)
+	})
+}
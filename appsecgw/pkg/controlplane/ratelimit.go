@@ -0,0 +1,237 @@
+package controlplane
+
+import (
+	"strconv"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimitcommon "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	rateLimitFilterName        = "envoy.filters.http.local_ratelimit"
+	logOnlyRateLimitFilterName = "wafie.filters.http.local_ratelimit.log_only"
+	rateLimitDescriptorKey     = "wafie_rate_limit"
+	rateLimitedHeader          = "x-wafie-rate-limited"
+	// the default bucket is not consumed by the requests matching the policies descriptors
+	unlimitedTokens = 1 << 30
+)
+
+func hasRateLimits(protection *wv1.Protection) bool {
+	return len(protection.GetDesiredState().GetRateLimits()) > 0
+}
+
+func rateLimitLogOnly(policy *wv1.RateLimitPolicy) bool {
+	return policy.Action == wv1.RateLimitAction_RATE_LIMIT_ACTION_LOG_ONLY
+}
+
+// rateLimitFilters are disabled on the listener, the protection policies enable them per route,
+// the log only policies are counted by a dedicated filter which never enforces the limit
+func (s *state) rateLimitFilters() []*hcm.HttpFilter {
+	filters := make([]*hcm.HttpFilter, 0, 2)
+	for _, filterName := range []string{rateLimitFilterName, logOnlyRateLimitFilterName} {
+		rateLimitCfg, err := anypb.New(&localratelimit.LocalRateLimit{StatPrefix: rateLimitStatPrefix(filterName)})
+		if err != nil {
+			s.logger.Error("failed to create local rate limit config", zap.Error(err))
+		}
+		filters = append(filters, &hcm.HttpFilter{
+			Name: filterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: rateLimitCfg,
+			},
+		})
+	}
+	return filters
+}
+
+func rateLimitStatPrefix(filterName string) string {
+	if filterName == logOnlyRateLimitFilterName {
+		return "wafie_rate_limit_log_only"
+	}
+	return "wafie_rate_limit"
+}
+
+// withRateLimits enables the rate limit filters on the virtual host of the targets.
+// Envoy creates the local rate limiter per filter config, the config set on the virtual host
+// shares the policy buckets among the target ingress, route policies and mirror routes.
+// The virtual host of an ingress host routed to several protections limits each route instead,
+// the requests of the route policies and the mirror predicates consume the buckets of their route
+func (s *state) withRateLimits(virtualHost *route.VirtualHost, targets []*upstreamTarget) {
+	protections := map[string]*wv1.Protection{}
+	for _, target := range targets {
+		protections[strconv.Itoa(int(target.protection.Id))] = target.protection
+	}
+	if len(protections) == 1 {
+		virtualHost.TypedPerFilterConfig = s.rateLimitsConfig(targets[0].protection)
+		return
+	}
+	for _, r := range virtualHost.Routes {
+		metadata := r.GetMetadata().GetFilterMetadata()[accessLogMetadataNamespace]
+		protection, ok := protections[metadata.GetFields()["protection_id"].GetStringValue()]
+		if !ok {
+			continue
+		}
+		for filterName, rateLimitCfg := range s.rateLimitsConfig(protection) {
+			if r.TypedPerFilterConfig == nil {
+				r.TypedPerFilterConfig = map[string]*anypb.Any{}
+			}
+			r.TypedPerFilterConfig[filterName] = rateLimitCfg
+		}
+	}
+}
+
+// rateLimitsConfig is the rate limit filters config of the protection,
+// a token bucket descriptor per policy, nil without the rate limit policies
+func (s *state) rateLimitsConfig(protection *wv1.Protection) map[string]*anypb.Any {
+	if !hasRateLimits(protection) {
+		return nil
+	}
+	enforced := &localratelimit.LocalRateLimit{StatPrefix: rateLimitStatPrefix(rateLimitFilterName)}
+	logOnly := &localratelimit.LocalRateLimit{
+		StatPrefix: rateLimitStatPrefix(logOnlyRateLimitFilterName),
+		RequestHeadersToAddWhenNotEnforced: []*core.HeaderValueOption{
+			{Header: &core.HeaderValue{Key: rateLimitedHeader, Value: "true"}},
+		},
+	}
+	for idx, policy := range protection.DesiredState.RateLimits {
+		rateLimitCfg := enforced
+		if rateLimitLogOnly(policy) {
+			rateLimitCfg = logOnly
+		}
+		descriptorValue := strconv.Itoa(idx)
+		rateLimitCfg.RateLimits = append(rateLimitCfg.RateLimits, rateLimitActions(policy, descriptorValue))
+		rateLimitCfg.Descriptors = append(rateLimitCfg.Descriptors, rateLimitDescriptor(policy, descriptorValue))
+	}
+	perFilterCfg := map[string]*anypb.Any{}
+	for filterName, rateLimitCfg := range map[string]*localratelimit.LocalRateLimit{
+		rateLimitFilterName:        enforced,
+		logOnlyRateLimitFilterName: logOnly,
+	} {
+		if len(rateLimitCfg.Descriptors) == 0 {
+			continue
+		}
+		enforcedPercent := uint32(100)
+		if filterName == logOnlyRateLimitFilterName {
+			enforcedPercent = 0
+		}
+		rateLimitCfg.TokenBucket = tokenBucket(unlimitedTokens, time.Second)
+		rateLimitCfg.AlwaysConsumeDefaultTokenBucket = wrapperspb.Bool(false)
+		rateLimitCfg.FilterEnabled = runtimePercent(filterName+"_enabled", 100)
+		rateLimitCfg.FilterEnforced = runtimePercent(filterName+"_enforced", enforcedPercent)
+		perRouteCfg, err := anypb.New(rateLimitCfg)
+		if err != nil {
+			s.logger.Error("failed to create local rate limit per route config", zap.Error(err))
+			continue
+		}
+		perFilterCfg[filterName] = perRouteCfg
+	}
+	return perFilterCfg
+}
+
+// rateLimitActions builds the policy descriptor of the request,
+// the requests outside the policy path prefix produce no descriptor and are not counted
+func rateLimitActions(policy *wv1.RateLimitPolicy, descriptorValue string) *route.RateLimit {
+	policyAction := &route.RateLimit_Action{
+		ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+			GenericKey: &route.RateLimit_Action_GenericKey{
+				DescriptorKey:   rateLimitDescriptorKey,
+				DescriptorValue: descriptorValue,
+			},
+		},
+	}
+	if policy.PathPrefix != "" {
+		policyAction.ActionSpecifier = &route.RateLimit_Action_HeaderValueMatch_{
+			HeaderValueMatch: &route.RateLimit_Action_HeaderValueMatch{
+				DescriptorKey:   rateLimitDescriptorKey,
+				DescriptorValue: descriptorValue,
+				ExpectMatch:     wrapperspb.Bool(true),
+				Headers: []*route.HeaderMatcher{
+					{
+						Name: ":path",
+						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+							StringMatch: &matcher.StringMatcher{
+								MatchPattern: &matcher.StringMatcher_Prefix{Prefix: policy.PathPrefix},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	actions := []*route.RateLimit_Action{policyAction}
+	switch policy.KeyType {
+	case wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_PATH_PREFIX:
+	case wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_HEADER:
+		actions = append(actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &route.RateLimit_Action_RequestHeaders{
+					HeaderName:    policy.HeaderName,
+					DescriptorKey: rateLimitKey(policy),
+				},
+			},
+		})
+	default:
+		actions = append(actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+				RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+			},
+		})
+	}
+	return &route.RateLimit{Actions: actions}
+}
+
+// rateLimitDescriptor is the token bucket of the policy,
+// the empty key value makes a dynamic bucket per client ip or header value
+func rateLimitDescriptor(policy *wv1.RateLimitPolicy, descriptorValue string) *ratelimitcommon.LocalRateLimitDescriptor {
+	entries := []*ratelimitcommon.RateLimitDescriptor_Entry{
+		{Key: rateLimitDescriptorKey, Value: descriptorValue},
+	}
+	if key := rateLimitKey(policy); key != "" {
+		entries = append(entries, &ratelimitcommon.RateLimitDescriptor_Entry{Key: key})
+	}
+	return &ratelimitcommon.LocalRateLimitDescriptor{
+		Entries:     entries,
+		TokenBucket: tokenBucket(policy.Requests, time.Duration(policy.IntervalSeconds)*time.Second),
+	}
+}
+
+// rateLimitKey is the descriptor entry key of the policy key type,
+// empty for the path prefix shared bucket
+func rateLimitKey(policy *wv1.RateLimitPolicy) string {
+	switch policy.KeyType {
+	case wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_PATH_PREFIX:
+		return ""
+	case wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_HEADER:
+		return "header"
+	default:
+		return "remote_address"
+	}
+}
+
+func tokenBucket(tokens uint32, interval time.Duration) *typev3.TokenBucket {
+	return &typev3.TokenBucket{
+		MaxTokens:     tokens,
+		TokensPerFill: wrapperspb.UInt32(tokens),
+		FillInterval:  durationpb.New(interval),
+	}
+}
+
+func runtimePercent(runtimeKey string, percent uint32) *core.RuntimeFractionalPercent {
+	return &core.RuntimeFractionalPercent{
+		DefaultValue: &typev3.FractionalPercent{
+			Numerator:   percent,
+			Denominator: typev3.FractionalPercent_HUNDRED,
+		},
+		RuntimeKey: runtimeKey,
+	}
+}
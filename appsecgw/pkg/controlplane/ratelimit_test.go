@@ -0,0 +1,184 @@
+package controlplane
+
+import (
+	"testing"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func routeRateLimit(t *testing.T, perFilterCfg map[string]*anypb.Any, filterName string) *localratelimit.LocalRateLimit {
+	perRouteCfg, ok := perFilterCfg[filterName]
+	require.True(t, ok)
+	rateLimit := &localratelimit.LocalRateLimit{}
+	require.NoError(t, perRouteCfg.UnmarshalTo(rateLimit))
+	return rateLimit
+}
+
+func withRateLimits(p *wv1.Protection) {
+	p.DesiredState.RateLimits = []*wv1.RateLimitPolicy{
+		{Requests: 5, IntervalSeconds: 60, PathPrefix: "/login"},
+		{
+			Requests:        100,
+			IntervalSeconds: 1,
+			KeyType:         wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_HEADER,
+			HeaderName:      "x-api-key",
+			Action:          wv1.RateLimitAction_RATE_LIMIT_ACTION_LOG_ONLY,
+		},
+		{
+			Requests:        1000,
+			IntervalSeconds: 10,
+			KeyType:         wv1.RateLimitKeyType_RATE_LIMIT_KEY_TYPE_PATH_PREFIX,
+			PathPrefix:      "/search",
+		},
+	}
+}
+
+func TestBuildResourcesRateLimits(t *testing.T) {
+	t.Run("port routed", func(t *testing.T) {
+		protection := testProtections()[0]
+		withRateLimits(protection)
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+		httpConnectionMgr := &hcm.HttpConnectionManager{}
+		require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(httpConnectionMgr))
+		var filterNames []string
+		for _, filter := range httpConnectionMgr.HttpFilters {
+			filterNames = append(filterNames, filter.Name)
+		}
+		assert.Equal(t, []string{rateLimitFilterName, logOnlyRateLimitFilterName, wafieFilterName, "envoy.filters.http.router"}, filterNames)
+
+		virtualHost := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0]
+		// the routes share the virtual host buckets
+		assert.NotContains(t, virtualHost.Routes[0].TypedPerFilterConfig, rateLimitFilterName)
+		enforced := routeRateLimit(t, virtualHost.TypedPerFilterConfig, rateLimitFilterName)
+		assert.Equal(t, uint32(100), enforced.FilterEnforced.DefaultValue.Numerator)
+		assert.False(t, enforced.AlwaysConsumeDefaultTokenBucket.GetValue())
+		require.Len(t, enforced.Descriptors, 2)
+		// per client ip bucket of the login path
+		login := enforced.Descriptors[0]
+		assert.Equal(t, "0", login.Entries[0].Value)
+		assert.Equal(t, "remote_address", login.Entries[1].Key)
+		assert.Empty(t, login.Entries[1].Value)
+		assert.Equal(t, uint32(5), login.TokenBucket.MaxTokens)
+		assert.Equal(t, time.Minute, login.TokenBucket.FillInterval.AsDuration())
+		loginActions := enforced.RateLimits[0].Actions
+		assert.Equal(t, "/login", loginActions[0].GetHeaderValueMatch().Headers[0].GetStringMatch().GetPrefix())
+		assert.NotNil(t, loginActions[1].GetRemoteAddress())
+		// shared bucket of the search path
+		assert.Len(t, enforced.Descriptors[1].Entries, 1)
+		assert.Len(t, enforced.RateLimits[1].Actions, 1)
+
+		logOnly := routeRateLimit(t, virtualHost.TypedPerFilterConfig, logOnlyRateLimitFilterName)
+		assert.Equal(t, uint32(0), logOnly.FilterEnforced.DefaultValue.Numerator)
+		require.Len(t, logOnly.Descriptors, 1)
+		assert.Equal(t, "1", logOnly.Descriptors[0].Entries[0].Value)
+		assert.Equal(t, "x-api-key", logOnly.RateLimits[0].Actions[1].GetRequestHeaders().HeaderName)
+		assert.Equal(t, rateLimitedHeader, logOnly.RequestHeadersToAddWhenNotEnforced[0].Header.Key)
+	})
+
+	t.Run("domain routed", func(t *testing.T) {
+		limited := domainProtection(2, "store", "store.example.com")
+		withRateLimits(limited)
+		limited.DesiredState.RoutePolicies = []*wv1.RoutePolicy{
+			{Path: "/admin", ModeSec: &wv1.ModSec{ParanoiaLevel: wv1.ParanoiaLevel_PARANOIA_LEVEL_4}},
+		}
+		unlimited := domainProtection(3, "blog", "blog.example.com")
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{limited, unlimited})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+		httpConnectionMgr := &hcm.HttpConnectionManager{}
+		require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(httpConnectionMgr))
+		assert.Len(t, httpConnectionMgr.HttpFilters, 4)
+
+		virtualHosts := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts
+		require.Len(t, virtualHosts, 2)
+		// the policy and the ingress routes share the virtual host buckets
+		require.Len(t, virtualHosts[0].Routes, 2)
+		for _, r := range virtualHosts[0].Routes {
+			assert.Contains(t, r.TypedPerFilterConfig, wafieFilterName)
+			assert.NotContains(t, r.TypedPerFilterConfig, rateLimitFilterName)
+		}
+		assert.Len(t, routeRateLimit(t, virtualHosts[0].TypedPerFilterConfig, rateLimitFilterName).Descriptors, 2)
+		assert.Empty(t, virtualHosts[1].TypedPerFilterConfig)
+	})
+
+	t.Run("mirror route", func(t *testing.T) {
+		protection := mirroredProtection(&wv1.MirrorPolicy{
+			Ip:            "10.0.1.1",
+			Port:          8080,
+			Targets:       []*wv1.MirrorTarget{{Dns: "shadow.default.svc", Port: 80}},
+			HeaderMatches: []*wv1.MirrorHeaderMatch{{Name: "x-debug"}},
+		})
+		withRateLimits(protection)
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		virtualHost := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0]
+		// the mirror route does not split the ingress route buckets
+		require.Len(t, virtualHost.Routes, 2)
+		assert.NotEmpty(t, virtualHost.Routes[0].GetRoute().RequestMirrorPolicies)
+		for _, r := range virtualHost.Routes {
+			assert.NotContains(t, r.TypedPerFilterConfig, rateLimitFilterName)
+			assert.NotContains(t, r.TypedPerFilterConfig, logOnlyRateLimitFilterName)
+		}
+		assert.Len(t, routeRateLimit(t, virtualHost.TypedPerFilterConfig, rateLimitFilterName).Descriptors, 2)
+		assert.Len(t, routeRateLimit(t, virtualHost.TypedPerFilterConfig, logOnlyRateLimitFilterName).Descriptors, 1)
+	})
+
+	t.Run("shared ingress host", func(t *testing.T) {
+		limited := domainProtection(2, "store", "shop.example.com")
+		limited.Application.Ingress[0].Path = "/store"
+		withRateLimits(limited)
+		unlimited := domainProtection(3, "blog", "shop.example.com")
+		unlimited.Application.Ingress[0].Path = "/blog"
+		resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{limited, unlimited})
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+
+		virtualHosts := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts
+		require.Len(t, virtualHosts, 1)
+		// the protections routes are limited separately
+		assert.Empty(t, virtualHosts[0].TypedPerFilterConfig)
+		limitedRoutes := 0
+		for _, r := range virtualHosts[0].Routes {
+			switch r.Match.GetPrefix() {
+			case "/store":
+				limitedRoutes++
+				assert.Len(t, routeRateLimit(t, r.TypedPerFilterConfig, rateLimitFilterName).Descriptors, 2)
+			case "/blog":
+				assert.NotContains(t, r.TypedPerFilterConfig, rateLimitFilterName)
+			}
+		}
+		assert.Equal(t, 1, limitedRoutes)
+	})
+}
+
+func TestBuildResourcesWithoutRateLimits(t *testing.T) {
+	resources := newState(testDomainListenerPort, nil).buildResources(testProtections())
+	listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+	httpConnectionMgr := &hcm.HttpConnectionManager{}
+	require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(httpConnectionMgr))
+	assert.Len(t, httpConnectionMgr.HttpFilters, 2)
+	virtualHost := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0]
+	assert.Empty(t, virtualHost.TypedPerFilterConfig)
+	assert.Empty(t, virtualHost.Routes[0].TypedPerFilterConfig)
+}
@@ -0,0 +1,305 @@
+package controlplane
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsinspector "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/anypb"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	k8scache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// tlsSecretStore resolves the ingresses tls secrets references
+type tlsSecretStore interface {
+	tlsCertificate(namespace, name string) (certChain, privateKey []byte, ok bool)
+}
+
+// secretWatcher caches the kubernetes.io/tls secrets of the watched namespaces,
+// the onChange is called when a secret is added, rotated or removed
+type secretWatcher struct {
+	// listers by the watched namespace, metav1.NamespaceAll when all namespaces are watched
+	listers map[string]listersv1.SecretLister
+	logger  *zap.Logger
+}
+
+// newSecretWatcher watches the secrets of the namespaces, empty namespaces watches the whole cluster
+// and requires the cluster wide secrets read permission
+func newSecretWatcher(namespaces []string, onChange func(), logger *zap.Logger) (*secretWatcher, error) {
+	rc, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	w := &secretWatcher{listers: map[string]listersv1.SecretLister{}, logger: logger}
+	for _, namespace := range namespaces {
+		if _, ok := w.listers[namespace]; ok {
+			continue
+		}
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 10*time.Minute,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = "type=" + string(corev1.SecretTypeTLS)
+			}),
+		)
+		secrets := factory.Core().V1().Secrets()
+		_, err = secrets.Informer().AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) { onChange() },
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				// skip the informer resync
+				if oldObj.(*corev1.Secret).ResourceVersion != newObj.(*corev1.Secret).ResourceVersion {
+					onChange()
+				}
+			},
+			DeleteFunc: func(obj interface{}) { onChange() },
+		})
+		if err != nil {
+			return nil, err
+		}
+		factory.Start(wait.NeverStop)
+		for informerType, synced := range factory.WaitForCacheSync(wait.NeverStop) {
+			if !synced {
+				return nil, fmt.Errorf("failed to sync %v informer of namespace %q", informerType, namespace)
+			}
+		}
+		w.listers[namespace] = secrets.Lister()
+	}
+	logger.Info("tls secrets watcher started", zap.Strings("namespaces", namespaces))
+	return w, nil
+}
+
+func (w *secretWatcher) tlsCertificate(namespace, name string) ([]byte, []byte, bool) {
+	lister, ok := w.listers[namespace]
+	if !ok {
+		lister, ok = w.listers[metav1.NamespaceAll]
+	}
+	if !ok {
+		w.logger.Warn("tls secret namespace is not watched",
+			zap.String("namespace", namespace), zap.String("name", name))
+		return nil, nil, false
+	}
+	secret, err := lister.Secrets(namespace).Get(name)
+	if err != nil {
+		w.logger.Warn("tls secret not found",
+			zap.String("namespace", namespace), zap.String("name", name), zap.Error(err))
+		return nil, nil, false
+	}
+	certChain, privateKey := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	if len(certChain) == 0 || len(privateKey) == 0 {
+		w.logger.Warn("tls secret without certificate or key",
+			zap.String("namespace", namespace), zap.String("name", name))
+		return nil, nil, false
+	}
+	return certChain, privateKey, true
+}
+
+// tlsHost is the ingress host terminated by the gateway with the ingress tls secret
+type tlsHost struct {
+	host       string
+	secretName string
+	certChain  []byte
+	privateKey []byte
+}
+
+// tlsHosts lists the domain routed hosts with the resolved tls secrets,
+// the port routed listeners receive the requests already terminated by the ingress controller
+func (s *state) tlsHosts(targets []*upstreamTarget) (hosts []*tlsHost) {
+	if s.secrets == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if !target.domainRouted() || target.ingress.TlsSecretName == "" || target.ingress.Host == "" {
+			continue
+		}
+		if seen[target.ingress.Host] {
+			continue
+		}
+		seen[target.ingress.Host] = true
+		certChain, privateKey, ok := s.secrets.tlsCertificate(target.ingress.Namespace, target.ingress.TlsSecretName)
+		if !ok {
+			continue
+		}
+		hosts = append(hosts, &tlsHost{
+			host:       target.ingress.Host,
+			secretName: fmt.Sprintf("%s/%s", target.ingress.Namespace, target.ingress.TlsSecretName),
+			certChain:  certChain,
+			privateKey: privateKey,
+		})
+	}
+	return hosts
+}
+
+// tlsSecrets builds the SDS secrets of the tls hosts,
+// the rotated certificate is pushed to envoy without changing the listeners
+func (s *state) tlsSecrets(hosts []*tlsHost) []types.Resource {
+	secrets := make([]types.Resource, 0, len(hosts))
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if seen[host.secretName] {
+			continue
+		}
+		seen[host.secretName] = true
+		secrets = append(secrets, newTlsSecret(host.secretName, host.certChain, host.privateKey))
+	}
+	return secrets
+}
+
+func newTlsSecret(name string, certChain, privateKey []byte) *tls.Secret {
+	return &tls.Secret{
+		Name: name,
+		Type: &tls.Secret_TlsCertificate{
+			TlsCertificate: &tls.TlsCertificate{
+				CertificateChain: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{InlineBytes: certChain},
+				},
+				PrivateKey: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{InlineBytes: privateKey},
+				},
+			},
+		},
+	}
+}
+
+// restoreTlsSecrets resolves the SDS secrets of the restored listeners, which are not persisted.
+// The TLS filter chains of the unresolved secrets are removed,
+// otherwise envoy keeps warming the whole listener, the plain HTTP chain included
+func (s *state) restoreTlsSecrets(resources map[resource.Type][]types.Resource) {
+	var secrets []types.Resource
+	resolved := map[string]bool{}
+	for _, item := range resources[resource.ListenerType] {
+		listener, ok := item.(*v3listener.Listener)
+		if !ok {
+			continue
+		}
+		chains := make([]*v3listener.FilterChain, 0, len(listener.FilterChains))
+		for _, chain := range listener.FilterChains {
+			secretName := filterChainSecretName(chain)
+			if secretName == "" {
+				chains = append(chains, chain)
+				continue
+			}
+			found, seen := resolved[secretName]
+			if !seen {
+				if secret := s.resolveTlsSecret(secretName); secret != nil {
+					secrets = append(secrets, secret)
+					found = true
+				}
+				resolved[secretName] = found
+			}
+			if !found {
+				s.logger.Warn("tls secret of the restored listener not resolved, filter chain removed",
+					zap.String("listener", listener.Name), zap.String("secret", secretName))
+				continue
+			}
+			chains = append(chains, chain)
+		}
+		listener.FilterChains = chains
+	}
+	resources[resource.SecretType] = secrets
+}
+
+// resolveTlsSecret builds the SDS secret by the namespace/name secret name, nil when not resolved
+func (s *state) resolveTlsSecret(secretName string) *tls.Secret {
+	if s.secrets == nil {
+		return nil
+	}
+	namespace, name, ok := strings.Cut(secretName, "/")
+	if !ok {
+		return nil
+	}
+	certChain, privateKey, ok := s.secrets.tlsCertificate(namespace, name)
+	if !ok {
+		return nil
+	}
+	return newTlsSecret(secretName, certChain, privateKey)
+}
+
+// filterChainSecretName is the SDS secret of the filter chain TLS transport socket, empty for plain chains
+func filterChainSecretName(chain *v3listener.FilterChain) string {
+	if chain.GetTransportSocket() == nil {
+		return ""
+	}
+	tlsContext := &tls.DownstreamTlsContext{}
+	if chain.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext) != nil {
+		return ""
+	}
+	sdsConfigs := tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs()
+	if len(sdsConfigs) == 0 {
+		return ""
+	}
+	return sdsConfigs[0].Name
+}
+
+// tlsFilterChains terminates TLS per SNI host with the host certificate served over SDS
+func (s *state) tlsFilterChains(hosts []*tlsHost, filters []*v3listener.Filter) []*v3listener.FilterChain {
+	chains := make([]*v3listener.FilterChain, 0, len(hosts))
+	for _, host := range hosts {
+		tlsContext, err := anypb.New(&tls.DownstreamTlsContext{
+			CommonTlsContext: &tls.CommonTlsContext{
+				TlsCertificateSdsSecretConfigs: []*tls.SdsSecretConfig{
+					{
+						Name:      host.secretName,
+						SdsConfig: s.adsConfigSource(),
+					},
+				},
+				AlpnProtocols: []string{"h2", "http/1.1"},
+			},
+		})
+		if err != nil {
+			s.logger.Error("failed to create downstream tls context", zap.Error(err))
+			continue
+		}
+		chains = append(chains, &v3listener.FilterChain{
+			Name: host.host,
+			FilterChainMatch: &v3listener.FilterChainMatch{
+				ServerNames:       []string{host.host},
+				TransportProtocol: "tls",
+			},
+			Filters: filters,
+			TransportSocket: &core.TransportSocket{
+				Name: wellknown.TransportSocketTls,
+				ConfigType: &core.TransportSocket_TypedConfig{
+					TypedConfig: tlsContext,
+				},
+			},
+		})
+	}
+	return chains
+}
+
+// tlsInspector detects the TLS connections and the SNI host for the filter chains match
+func (s *state) tlsInspector() []*v3listener.ListenerFilter {
+	inspectorConfig, err := anypb.New(&tlsinspector.TlsInspector{})
+	if err != nil {
+		s.logger.Error("failed to create tls inspector config", zap.Error(err))
+	}
+	return []*v3listener.ListenerFilter{
+		{
+			Name: wellknown.TlsInspector,
+			ConfigType: &v3listener.ListenerFilter_TypedConfig{
+				TypedConfig: inspectorConfig,
+			},
+		},
+	}
+}
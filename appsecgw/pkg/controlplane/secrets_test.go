@@ -0,0 +1,156 @@
+package controlplane
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticSecrets is the tls secrets store keyed by namespace/name
+type staticSecrets map[string]string
+
+func (s staticSecrets) tlsCertificate(namespace, name string) ([]byte, []byte, bool) {
+	cert, ok := s[namespace+"/"+name]
+	if !ok {
+		return nil, nil, false
+	}
+	return []byte(cert), []byte("key-" + cert), true
+}
+
+func tlsProtection(id uint32, name, host, secretName string) *wv1.Protection {
+	p := domainProtection(id, name, host)
+	p.Application.Ingress[0].Namespace = "default"
+	p.Application.Ingress[0].TlsSecretName = secretName
+	return p
+}
+
+func TestBuildResourcesTls(t *testing.T) {
+	secrets := staticSecrets{"default/store-tls": "store-cert", "default/blog-tls": "blog-cert"}
+	protections := []*wv1.Protection{
+		tlsProtection(2, "store", "store.example.com", "store-tls"),
+		tlsProtection(3, "blog", "blog.example.com", "blog-tls"),
+		// secret not found, served over plain HTTP only
+		tlsProtection(4, "wiki", "wiki.example.com", "missing-tls"),
+	}
+	resources := newState(testDomainListenerPort, secrets).buildResources(protections)
+	snap, _, err := newSnapshot(resources)
+	require.NoError(t, err)
+	require.NoError(t, snap.Consistent())
+
+	listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+	require.Len(t, listener.ListenerFilters, 1)
+	require.Len(t, listener.FilterChains, 3)
+	assert.Equal(t, "raw_buffer", listener.FilterChains[0].FilterChainMatch.TransportProtocol)
+	for i, host := range []string{"store.example.com", "blog.example.com"} {
+		chain := listener.FilterChains[i+1]
+		assert.Equal(t, []string{host}, chain.FilterChainMatch.ServerNames)
+		tlsContext := &tls.DownstreamTlsContext{}
+		require.NoError(t, chain.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+		sdsConfig := tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0]
+		assert.Equal(t, "default/"+protections[i].Application.Name+"-tls", sdsConfig.Name)
+		assert.NotNil(t, sdsConfig.SdsConfig.GetAds())
+	}
+
+	require.Len(t, resources[resource.SecretType], 2)
+	secret := resources[resource.SecretType][0].(*tls.Secret)
+	assert.Equal(t, "default/store-tls", secret.Name)
+	assert.Equal(t, []byte("store-cert"), secret.GetTlsCertificate().CertificateChain.GetInlineBytes())
+
+	// the rotated certificate changes the secrets only
+	secrets["default/store-tls"] = "store-cert-rotated"
+	rotated, _, err := newSnapshot(newState(testDomainListenerPort, secrets).buildResources(protections))
+	require.NoError(t, err)
+	for _, typeUrl := range []resource.Type{resource.ListenerType, resource.RouteType, resource.ClusterType} {
+		assert.Equal(t, snap.GetVersion(typeUrl), rotated.GetVersion(typeUrl), typeUrl)
+	}
+	assert.NotEqual(t, snap.GetVersion(resource.SecretType), rotated.GetVersion(resource.SecretType))
+}
+
+func TestBuildResourcesTlsDisabled(t *testing.T) {
+	protections := []*wv1.Protection{tlsProtection(2, "store", "store.example.com", "store-tls")}
+	resources := newState(testDomainListenerPort, nil).buildResources(protections)
+	listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+	assert.Empty(t, listener.ListenerFilters)
+	assert.Len(t, listener.FilterChains, 1)
+	assert.Empty(t, resources[resource.SecretType])
+}
+
+func TestSaveSnapshotsSkipsSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	secrets := staticSecrets{"default/store-tls": "store-cert"}
+	protections := []*wv1.Protection{tlsProtection(2, "store", "store.example.com", "store-tls")}
+	groups := map[string]map[resource.Type][]types.Resource{
+		DefaultGatewayGroup: newState(testDomainListenerPort, secrets).buildResources(protections),
+	}
+	require.NoError(t, saveSnapshots(path, groups))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "key-store-cert")
+	loaded, err := loadSnapshots(path)
+	require.NoError(t, err)
+	assert.Empty(t, loaded[DefaultGatewayGroup][resource.SecretType])
+	assert.Len(t, loaded[DefaultGatewayGroup][resource.ListenerType], 1)
+}
+
+func TestRestoreTlsSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	protections := []*wv1.Protection{
+		tlsProtection(2, "store", "store.example.com", "store-tls"),
+		tlsProtection(3, "blog", "blog.example.com", "blog-tls"),
+	}
+	secrets := staticSecrets{"default/store-tls": "store-cert", "default/blog-tls": "blog-cert"}
+	groups := map[string]map[resource.Type][]types.Resource{
+		DefaultGatewayGroup: newState(testDomainListenerPort, secrets).buildResources(protections),
+	}
+	require.NoError(t, saveSnapshots(path, groups))
+
+	t.Run("secrets resolved", func(t *testing.T) {
+		loaded, err := loadSnapshots(path)
+		require.NoError(t, err)
+		resources := loaded[DefaultGatewayGroup]
+		newState(testDomainListenerPort, secrets).restoreTlsSecrets(resources)
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+		assert.Len(t, resources[resource.ListenerType][0].(*v3listener.Listener).FilterChains, 3)
+		require.Len(t, resources[resource.SecretType], 2)
+		secret := resources[resource.SecretType][0].(*tls.Secret)
+		assert.Equal(t, "default/store-tls", secret.Name)
+		assert.Equal(t, []byte("key-store-cert"), secret.GetTlsCertificate().PrivateKey.GetInlineBytes())
+	})
+
+	t.Run("secret removed", func(t *testing.T) {
+		loaded, err := loadSnapshots(path)
+		require.NoError(t, err)
+		resources := loaded[DefaultGatewayGroup]
+		newState(testDomainListenerPort, staticSecrets{"default/store-tls": "store-cert"}).restoreTlsSecrets(resources)
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+		listener := resources[resource.ListenerType][0].(*v3listener.Listener)
+		require.Len(t, listener.FilterChains, 2)
+		assert.Equal(t, "raw_buffer", listener.FilterChains[0].FilterChainMatch.TransportProtocol)
+		assert.Equal(t, []string{"store.example.com"}, listener.FilterChains[1].FilterChainMatch.ServerNames)
+		assert.Len(t, resources[resource.SecretType], 1)
+	})
+
+	t.Run("tls termination disabled", func(t *testing.T) {
+		loaded, err := loadSnapshots(path)
+		require.NoError(t, err)
+		resources := loaded[DefaultGatewayGroup]
+		newState(testDomainListenerPort, nil).restoreTlsSecrets(resources)
+		snap, _, err := newSnapshot(resources)
+		require.NoError(t, err)
+		require.NoError(t, snap.Consistent())
+		assert.Len(t, resources[resource.ListenerType][0].(*v3listener.Listener).FilterChains, 1)
+		assert.Empty(t, resources[resource.SecretType])
+	})
+}
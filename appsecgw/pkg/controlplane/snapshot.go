@@ -0,0 +1,168 @@
+package controlplane
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// persistedSnapshots is the on disk format of the last consistent snapshots of the gateway groups
+type persistedSnapshots struct {
+	Groups map[string]map[resource.Type][]json.RawMessage `json:"groups"`
+}
+
+// newSnapshot builds the snapshot with per type versions derived from the resources hash,
+// so envoy reloads only the changed resources types.
+// The returned version identifies the whole snapshot
+func newSnapshot(resources map[resource.Type][]types.Resource) (*cache.Snapshot, string, error) {
+	snap := &cache.Snapshot{}
+	typeUrls := make([]string, 0, len(resources))
+	versions := map[string]string{}
+	for typeUrl, items := range resources {
+		index := cache.GetResponseType(typeUrl)
+		if index == types.UnknownType {
+			return nil, "", fmt.Errorf("unknown resource type: %s", typeUrl)
+		}
+		version, err := resourcesVersion(items)
+		if err != nil {
+			return nil, "", err
+		}
+		snap.Resources[index] = cache.NewResources(version, items)
+		typeUrls = append(typeUrls, typeUrl)
+		versions[typeUrl] = version
+	}
+	sort.Strings(typeUrls)
+	h := sha256.New()
+	for _, typeUrl := range typeUrls {
+		h.Write([]byte(typeUrl))
+		h.Write([]byte(versions[typeUrl]))
+	}
+	return snap, shortHash(h.Sum(nil)), nil
+}
+
+// resourcesVersion hashes the resources ordered by name
+func resourcesVersion(items []types.Resource) (string, error) {
+	sorted := make([]types.Resource, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool {
+		return cache.GetResourceName(sorted[i]) < cache.GetResourceName(sorted[j])
+	})
+	h := sha256.New()
+	for _, item := range sorted {
+		if item == nil {
+			continue
+		}
+		b, err := canonicalJSON(item)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+	}
+	return shortHash(h.Sum(nil)), nil
+}
+
+// canonicalJSON renders the resource with the nested Any messages expanded and the keys sorted,
+// the binary encoding of Any holding maps, e.g. the filters typed struct, is not stable
+func canonicalJSON(item types.Resource) ([]byte, error) {
+	b, err := protojson.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func shortHash(sum []byte) string {
+	return hex.EncodeToString(sum)[:16]
+}
+
+// saveSnapshots atomically writes the gateway groups snapshots resources to the path,
+// the tls secrets are not written to the disk, those are resolved again on the restore
+func saveSnapshots(path string, groups map[string]map[resource.Type][]types.Resource) error {
+	persisted := &persistedSnapshots{
+		Groups: map[string]map[resource.Type][]json.RawMessage{},
+	}
+	for group, resources := range groups {
+		persisted.Groups[group] = map[resource.Type][]json.RawMessage{}
+		for typeUrl, items := range resources {
+			if typeUrl == resource.SecretType {
+				persisted.Groups[group][typeUrl] = []json.RawMessage{}
+				continue
+			}
+			raw := make([]json.RawMessage, 0, len(items))
+			for _, item := range items {
+				if item == nil {
+					continue
+				}
+				a, err := anypb.New(item)
+				if err != nil {
+					return err
+				}
+				b, err := protojson.Marshal(a)
+				if err != nil {
+					return err
+				}
+				raw = append(raw, b)
+			}
+			persisted.Groups[group][typeUrl] = raw
+		}
+	}
+	b, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadSnapshots reads the persisted gateway groups snapshots resources,
+// the resources types must be registered, i.e. imported by the control plane
+func loadSnapshots(path string) (map[string]map[resource.Type][]types.Resource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	persisted := &persistedSnapshots{}
+	if err := json.Unmarshal(b, persisted); err != nil {
+		return nil, err
+	}
+	groups := map[string]map[resource.Type][]types.Resource{}
+	for group, raws := range persisted.Groups {
+		groups[group] = map[resource.Type][]types.Resource{}
+		for typeUrl, raw := range raws {
+			items := make([]types.Resource, 0, len(raw))
+			for _, r := range raw {
+				a := &anypb.Any{}
+				if err := protojson.Unmarshal(r, a); err != nil {
+					return nil, err
+				}
+				msg, err := a.UnmarshalNew()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, msg)
+			}
+			groups[group][typeUrl] = items
+		}
+	}
+	return groups, nil
+}
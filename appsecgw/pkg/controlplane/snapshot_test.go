@@ -0,0 +1,116 @@
+package controlplane
+
+import (
+	"path/filepath"
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testProtections() []*wv1.Protection {
+	return []*wv1.Protection{
+		{
+			Id:             1,
+			ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON,
+			DesiredState: &wv1.ProtectionDesiredState{
+				ModeSec: &wv1.ModSec{ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON},
+			},
+			Application: &wv1.Application{
+				Name: "shop",
+				Ingress: []*wv1.Ingress{
+					{
+						Upstream: &wv1.Upstream{
+							SvcFqdn:   "shop.default.svc.cluster.local",
+							Endpoints: []*wv1.Endpoint{{Ip: "10.0.0.1"}, {Ip: "10.0.0.2"}},
+							Ports: []*wv1.Port{
+								{
+									Number:             8080,
+									PortType:           wv1.PortType_PORT_TYPE_CONTAINER_PORT,
+									ProxyListeningPort: 50010,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNewSnapshotVersionDeterministic(t *testing.T) {
+	s := newState(testDomainListenerPort, nil)
+	_, v1, err := newSnapshot(s.buildResources(testProtections()))
+	require.NoError(t, err)
+	_, v2, err := newSnapshot(s.buildResources(testProtections()))
+	require.NoError(t, err)
+	assert.Equal(t, v1, v2)
+
+	changed := testProtections()
+	changed[0].Application.Ingress[0].Upstream.Endpoints = changed[0].Application.Ingress[0].Upstream.Endpoints[:1]
+	_, v3, err := newSnapshot(s.buildResources(changed))
+	require.NoError(t, err)
+	assert.NotEqual(t, v1, v3)
+}
+
+func TestNewSnapshotEndpointsChurn(t *testing.T) {
+	s := newState(testDomainListenerPort, nil)
+	snap, _, err := newSnapshot(s.buildResources(testProtections()))
+	require.NoError(t, err)
+	require.NoError(t, snap.Consistent())
+
+	changed := testProtections()
+	changed[0].Application.Ingress[0].Upstream.Endpoints[0].Ip = "10.0.0.3"
+	changedSnap, _, err := newSnapshot(s.buildResources(changed))
+	require.NoError(t, err)
+	require.NoError(t, changedSnap.Consistent())
+	// only the endpoints are pushed to envoy
+	for _, typeUrl := range []resource.Type{resource.ListenerType, resource.RouteType, resource.ClusterType} {
+		assert.Equal(t, snap.GetVersion(typeUrl), changedSnap.GetVersion(typeUrl), typeUrl)
+	}
+	assert.NotEqual(t, snap.GetVersion(resource.EndpointType), changedSnap.GetVersion(resource.EndpointType))
+}
+
+func TestNewSnapshotVersionIgnoresOrder(t *testing.T) {
+	s := newState(testDomainListenerPort, nil)
+	resources := s.buildResources(testProtections())
+	clusters := resources[resource.ClusterType]
+	prepended := map[resource.Type][]types.Resource{
+		resource.ListenerType: resources[resource.ListenerType],
+		resource.ClusterType:  append([]types.Resource{s.cluster("other", nil, 0)}, clusters...),
+	}
+	appended := map[resource.Type][]types.Resource{
+		resource.ListenerType: resources[resource.ListenerType],
+		resource.ClusterType:  append(append([]types.Resource{}, clusters...), s.cluster("other", nil, 0)),
+	}
+	_, v1, err := newSnapshot(prepended)
+	require.NoError(t, err)
+	_, v2, err := newSnapshot(appended)
+	require.NoError(t, err)
+	assert.Equal(t, v1, v2)
+}
+
+func TestSaveLoadSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xds", "snapshot.json")
+	s := newState(testDomainListenerPort, nil)
+	groups := map[string]map[resource.Type][]types.Resource{
+		DefaultGatewayGroup: s.buildResources(testProtections()),
+		"tenant-a":          s.buildResources(nil),
+	}
+	require.NoError(t, saveSnapshots(path, groups))
+
+	loaded, err := loadSnapshots(path)
+	require.NoError(t, err)
+	require.Len(t, loaded, len(groups))
+	for group, resources := range groups {
+		_, version, err := newSnapshot(resources)
+		require.NoError(t, err)
+		restored, restoredVersion, err := newSnapshot(loaded[group])
+		require.NoError(t, err)
+		assert.Equal(t, version, restoredVersion, group)
+		assert.NoError(t, restored.Consistent(), group)
+	}
+}
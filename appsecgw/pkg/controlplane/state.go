@@ -2,10 +2,12 @@ package controlplane
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	applogger "github.com/Dimss/wafie/logger"
+	xds "github.com/cncf/xds/go/xds/type/v3"
 	golangv3alpha "github.com/envoyproxy/go-control-plane/contrib/envoy/extensions/filters/http/golang/v3alpha"
 	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
@@ -13,7 +15,6 @@ import (
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
-	stream "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
 	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
@@ -23,166 +24,384 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+const (
+	wafieFilterName       = "envoy.filters.http.golang"
+	wafiePluginName       = "wafie"
+	domainListenerName    = "listener-domain"
+	domainRouteConfigName = "domain-route"
+)
+
 type state struct {
 	logger *zap.Logger
+	// shared listener port of the protections routed by the ingress host
+	domainListenerPort uint32
+	// resolves the ingresses tls secrets, nil disables the TLS termination
+	secrets tlsSecretStore
+	// access log sinks of the listeners, nil disables the access logs
+	accessLog *AccessLogConfig
 }
 
-func newState() *state {
+func newState(domainListenerPort uint32, secrets tlsSecretStore) *state {
 	return &state{
-		logger: applogger.NewLogger(),
+		logger:             applogger.NewLogger(),
+		domainListenerPort: domainListenerPort,
+		secrets:            secrets,
+		accessLog:          &AccessLogConfig{Stdout: true},
 	}
 }
 
 func (s *state) httpFilters(protection *wv1.Protection) []*hcm.HttpFilter {
 	var filters []*hcm.HttpFilter
-	// wafie modsec filter
-	if protection.DesiredState.ModeSec.ProtectionMode == wv1.ProtectionMode_PROTECTION_MODE_ON {
-		wafieLibCfg, err := anypb.New(&golangv3alpha.Config{
-			LibraryId:   "wafie-v1",
-			LibraryPath: "/usr/local/lib/wafie-modsec.so",
-			PluginName:  "wafie",
-		})
-		if err != nil {
-			s.logger.Error("failed to create wafie config", zap.Error(err))
+	// the rate limited requests are rejected ahead of the WAF evaluation
+	if hasRateLimits(protection) {
+		filters = append(filters, s.rateLimitFilters()...)
+	}
+	// wafie modsec filter, the route policies override the config per route
+	if wafieFilterRequired(protection) {
+		var pluginCfg *anypb.Any
+		if modSec := protection.DesiredState.ModeSec; modSecOn(modSec) {
+			var err error
+			if pluginCfg, err = s.wafieFilterConfig(protection, modSec); err != nil {
+				s.logger.Error("failed to create wafie plugin config", zap.Error(err))
+			}
 		}
+		filters = append(filters, s.wafieFilter(pluginCfg))
+	}
+	return append(filters, s.routerFilter())
+}
 
-		filters = append(filters, &hcm.HttpFilter{
-			Name: "envoy.filters.http.golang",
-			ConfigType: &hcm.HttpFilter_TypedConfig{
-				TypedConfig: wafieLibCfg,
-			},
-		})
+// domainHttpFilters are the shared listener filters,
+// the wafie filter is configured per route and the rate limit filters per virtual host or route,
+// see routeFilterConfig and withRateLimits
+func (s *state) domainHttpFilters(rateLimited bool) []*hcm.HttpFilter {
+	var filters []*hcm.HttpFilter
+	if rateLimited {
+		filters = append(filters, s.rateLimitFilters()...)
+	}
+	return append(filters, s.wafieFilter(nil), s.routerFilter())
+}
+
+func (s *state) wafieFilter(pluginCfg *anypb.Any) *hcm.HttpFilter {
+	wafieLibCfg, err := anypb.New(&golangv3alpha.Config{
+		LibraryId:    "wafie-v1",
+		LibraryPath:  "/usr/local/lib/wafie-modsec.so",
+		PluginName:   wafiePluginName,
+		PluginConfig: pluginCfg,
+	})
+	if err != nil {
+		s.logger.Error("failed to create wafie config", zap.Error(err))
 	}
-	// http filter
+	return &hcm.HttpFilter{
+		Name: wafieFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: wafieLibCfg,
+		},
+	}
+}
+
+// routeFilterConfig overrides the listener wafie filter config for the route,
+// the filter is disabled when the modsec mode is off
+func (s *state) routeFilterConfig(protection *wv1.Protection, modSec *wv1.ModSec) map[string]*anypb.Any {
+	routerPlugin := &golangv3alpha.RouterPlugin{
+		Override: &golangv3alpha.RouterPlugin_Disabled{Disabled: true},
+	}
+	if modSecOn(modSec) {
+		pluginCfg, err := s.wafieFilterConfig(protection, modSec)
+		if err != nil {
+			s.logger.Error("failed to create wafie plugin config", zap.Error(err))
+		}
+		routerPlugin.Override = &golangv3alpha.RouterPlugin_Config{Config: pluginCfg}
+	}
+	perRouteCfg, err := anypb.New(&golangv3alpha.ConfigsPerRoute{
+		PluginsConfig: map[string]*golangv3alpha.RouterPlugin{wafiePluginName: routerPlugin},
+	})
+	if err != nil {
+		s.logger.Error("failed to create wafie per route config", zap.Error(err))
+	}
+	return map[string]*anypb.Any{wafieFilterName: perRouteCfg}
+}
+
+func (s *state) routerFilter() *hcm.HttpFilter {
 	routerConfig, err := anypb.New(&router.Router{})
 	if err != nil {
 		s.logger.Error("failed to create router config", zap.Error(err))
 	}
-	filters = append(filters, &hcm.HttpFilter{
+	return &hcm.HttpFilter{
 		Name: wellknown.Router,
 		ConfigType: &hcm.HttpFilter_TypedConfig{
 			TypedConfig: routerConfig,
 		},
-	})
-	return filters
+	}
 }
 
-func (s *state) mirroredClusterName(appName string) string {
-	return fmt.Sprintf("%s-mirrored", appName)
+// wafieFilterConfig builds the per protection configuration
+// of the wafie golang filter, parsed by the modsecfilter config parser,
+// the modSec is the protection settings or the route policy merged settings
+func (s *state) wafieFilterConfig(protection *wv1.Protection, modSec *wv1.ModSec) (*anypb.Any, error) {
+	cfg := map[string]interface{}{
+		"protection_id":         protection.Id,
+		"application_name":      protection.Application.Name,
+		"failure_policy":        uint32(modSec.FailurePolicy),
+		"evaluation_timeout_ms": modSec.EvaluationTimeoutMs,
+		"paranoia_level":        uint32(modSec.ParanoiaLevel),
+	}
+	if blockResponse := modSec.BlockResponse; blockResponse != nil {
+		cfg["block_status_code"] = blockResponse.StatusCode
+		cfg["block_body_template"] = blockResponse.BodyTemplate
+	}
+	honeypotConfig(protection, cfg)
+	if masking := modSec.AuditLogMasking; masking != nil {
+		cfg["mask_headers"] = structList(masking.Headers)
+		cfg["mask_json_paths"] = structList(masking.JsonPaths)
+		cfg["mask_form_args"] = structList(masking.FormArgs)
+		cfg["mask_patterns"] = structList(masking.Patterns)
+		cfg["mask_disable_defaults"] = masking.DisableDefaults
+	}
+	value, err := structpb.NewStruct(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return anypb.New(&xds.TypedStruct{Value: value})
 }
 
-func (s *state) routes(protection *wv1.Protection) []*route.Route {
-	routes := make([]*route.Route, 0)
+// route routes the matching requests to the target cluster
+func (s *state) route(target *upstreamTarget, name string, match *route.RouteMatch) *route.Route {
 	routeAction := &route.RouteAction{
 		Timeout: durationpb.New(0 * time.Second), // zero meaning disabled
 		ClusterSpecifier: &route.RouteAction_Cluster{
-			Cluster: protection.Application.Name,
+			Cluster: target.clusterName(),
 		},
 		HostRewriteSpecifier: &route.RouteAction_AutoHostRewrite{
 			AutoHostRewrite: &wrapperspb.BoolValue{Value: true},
 		},
 	}
-
-	mirrorPolicy := protection.Application.Ingress[0].Upstream.MirrorPolicy
-	if mirrorPolicy != nil && mirrorPolicy.Status == wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED {
-		routeAction.RequestMirrorPolicies = append(
-			routeAction.RequestMirrorPolicies,
-			&route.RouteAction_RequestMirrorPolicy{
-				Cluster: s.mirroredClusterName(protection.Application.Name),
-			},
-		)
+	// the requests matching the mirror predicates are mirrored by the mirror route
+	if mirrorPolicy := target.routedMirrorPolicy(); mirrorPolicy != nil && !mirrorPredicates(mirrorPolicy) {
+		routeAction.RequestMirrorPolicies = s.requestMirrorPolicies(target, mirrorPolicy)
 	}
-
-	return append(routes, &route.Route{
-		Name: protection.Application.Name,
-		Match: &route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: "/",
-			},
-		},
+	return &route.Route{
+		Name:     name,
+		Match:    match,
+		Metadata: routeMetadata(target),
 		Action: &route.Route_Route{
-			Route: routeAction,
+			Route: s.withRouteTrafficPolicy(routeAction, target.trafficPolicy()),
 		},
-	})
+	}
 }
 
-func (s *state) httpConnectionManager(protection *wv1.Protection) *hcm.HttpConnectionManager {
-	stdoutLogs, _ := anypb.New(&stream.StdoutAccessLog{})
+func (s *state) httpConnectionManager(filters []*hcm.HttpFilter, routeConfigName string, accessLogs []*accesslog.AccessLog) *hcm.HttpConnectionManager {
 	return &hcm.HttpConnectionManager{
 		CodecType:  hcm.HttpConnectionManager_AUTO,
 		StatPrefix: "http",
 		GenerateRequestId: &wrappers.BoolValue{
 			Value: true,
 		},
-		AccessLog: []*accesslog.AccessLog{
-			{
-				Name: "envoy.access_loggers.stdout",
-				ConfigType: &accesslog.AccessLog_TypedConfig{
-					TypedConfig: stdoutLogs,
-				},
-			},
-		},
-		HttpFilters: s.httpFilters(protection),
+		AccessLog:   accessLogs,
+		HttpFilters: filters,
 		UpgradeConfigs: []*hcm.HttpConnectionManager_UpgradeConfig{
 			{
 				UpgradeType: "websocket",
 			},
 		},
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &route.RouteConfiguration{
-				Name: "local_route",
-				VirtualHosts: []*route.VirtualHost{
-					{
-						Name: protection.Application.Name,
-						// TODO: when route by virtual host, real app domain should be used, i.e protection.Application.Ingress[0].Host
-						Domains: []string{"*"},
-						Routes:  s.routes(protection),
-					},
-				},
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource:    s.adsConfigSource(),
+				RouteConfigName: routeConfigName,
 			},
 		},
 	}
 }
 
-func (s *state) listeners(protections []*wv1.Protection) []types.Resource {
-	var listeners = make([]types.Resource, len(protections))
-	for i := 0; i < len(protections); i++ {
-		httpConnectionMgr, _ := anypb.New(s.httpConnectionManager(protections[i]))
-		port, err := protectionContainerPort(protections[i])
-		if err != nil {
-			s.logger.Error("unable detect proxy listening port", zap.Error(err))
+// adsConfigSource fetches the dynamic resources over the aggregated discovery stream
+func (s *state) adsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion: core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		},
+	}
+}
+
+func (s *state) prefixMatch(prefix string) *route.RouteMatch {
+	return &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{
+			Prefix: prefix,
+		},
+	}
+}
+
+// targetRoutes are the target route policies followed by the target ingress path route
+func (s *state) targetRoutes(target *upstreamTarget) []*route.Route {
+	routes := s.policyRoutes(target, target.pathPrefix())
+	ingressRoute := s.route(target, target.clusterName(), s.prefixMatch(target.pathPrefix()))
+	// the filter is present on the port listener for the policy routes only
+	if target.domainRouted() || (len(routes) > 0 && !modSecOn(target.protection.DesiredState.ModeSec)) {
+		ingressRoute.TypedPerFilterConfig = s.routeFilterConfig(target.protection, target.protection.DesiredState.ModeSec)
+	}
+	if mirrorRoute := s.mirrorRoute(target, ingressRoute); mirrorRoute != nil {
+		routes = append(routes, mirrorRoute)
+	}
+	return append(routes, ingressRoute)
+}
+
+func (s *state) routeConfig(target *upstreamTarget) *route.RouteConfiguration {
+	virtualHost := &route.VirtualHost{
+		Name: target.appName(),
+		// the listener is dedicated to the container port, see domainRouteConfig for routing by the ingress host
+		Domains: []string{"*"},
+		Routes:  s.targetRoutes(target),
+	}
+	s.withRateLimits(virtualHost, []*upstreamTarget{target})
+	return &route.RouteConfiguration{
+		Name:         target.routeConfigName(),
+		VirtualHosts: []*route.VirtualHost{virtualHost},
+	}
+}
+
+// domainRouteConfig routes the shared listener requests by the ingress host,
+// a virtual host per ingress host with the routes of the longest ingress path first
+func (s *state) domainRouteConfig(targets []*upstreamTarget) *route.RouteConfiguration {
+	routeConfig := &route.RouteConfiguration{Name: domainRouteConfigName}
+	var hosts []string
+	hostTargets := map[string][]*upstreamTarget{}
+	paths := map[string]bool{}
+	for _, target := range targets {
+		host, prefix := target.host(), target.pathPrefix()
+		if paths[host+prefix] {
+			s.logger.Warn("ingress path already routed, skipping",
+				zap.String("host", host), zap.String("path", prefix), zap.String("application", target.appName()))
 			continue
 		}
-		listeners[i] = &v3listener.Listener{
-			Name: fmt.Sprintf("listener-%d", i),
-			Address: &core.Address{
-				Address: &core.Address_SocketAddress{
-					SocketAddress: &core.SocketAddress{
-						Protocol: core.SocketAddress_TCP,
-						Address:  "0.0.0.0",
-						PortSpecifier: &core.SocketAddress_PortValue{
-							PortValue: port.ProxyListeningPort,
-						},
+		paths[host+prefix] = true
+		if _, ok := hostTargets[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		hostTargets[host] = append(hostTargets[host], target)
+	}
+	for _, host := range hosts {
+		targets := hostTargets[host]
+		sort.SliceStable(targets, func(i, j int) bool {
+			return len(targets[i].pathPrefix()) > len(targets[j].pathPrefix())
+		})
+		domains := []string{host}
+		if host != "*" {
+			domains = append(domains, host+":*")
+		}
+		virtualHost := &route.VirtualHost{Name: host, Domains: domains}
+		for _, target := range targets {
+			virtualHost.Routes = append(virtualHost.Routes, s.targetRoutes(target)...)
+		}
+		s.withRateLimits(virtualHost, targets)
+		routeConfig.VirtualHosts = append(routeConfig.VirtualHosts, virtualHost)
+	}
+	return routeConfig
+}
+
+// routeConfigs builds the RDS route configurations referenced by the listeners
+func (s *state) routeConfigs(targets []*upstreamTarget) []types.Resource {
+	routeConfigs := make([]types.Resource, 0, len(targets))
+	var domainTargets []*upstreamTarget
+	names := map[string]bool{}
+	for _, target := range targets {
+		if target.domainRouted() {
+			domainTargets = append(domainTargets, target)
+			continue
+		}
+		if names[target.routeConfigName()] {
+			continue
+		}
+		names[target.routeConfigName()] = true
+		routeConfigs = append(routeConfigs, s.routeConfig(target))
+	}
+	if len(domainTargets) > 0 {
+		routeConfigs = append(routeConfigs, s.domainRouteConfig(domainTargets))
+	}
+	return routeConfigs
+}
+
+func (s *state) listeners(targets []*upstreamTarget, tlsHosts []*tlsHost) []types.Resource {
+	var listeners = make([]types.Resource, 0, len(targets))
+	var domainProtections []*wv1.Protection
+	domainRateLimited := false
+	ports := map[uint32]bool{}
+	for _, target := range targets {
+		// routed by the ingress host on the shared listener
+		if target.domainRouted() {
+			domainProtections = append(domainProtections, target.protection)
+			domainRateLimited = domainRateLimited || hasRateLimits(target.protection)
+			continue
+		}
+		// the ingresses of the same upstream share the container port listener
+		if ports[target.port.ProxyListeningPort] {
+			continue
+		}
+		ports[target.port.ProxyListeningPort] = true
+		httpConnectionMgr := s.httpConnectionManager(s.httpFilters(target.protection), target.routeConfigName(),
+			s.accessLogs(portProtections(targets, target.port.ProxyListeningPort)))
+		listeners = append(listeners, s.listener(
+			fmt.Sprintf("listener-%d", target.port.ProxyListeningPort), target.port.ProxyListeningPort, httpConnectionMgr),
+		)
+	}
+	if len(domainProtections) > 0 {
+		listeners = append(listeners, s.domainListener(tlsHosts, domainRateLimited, s.accessLogs(domainProtections)))
+	}
+	return listeners
+}
+
+// portProtections are the protections of the container port listener targets
+func portProtections(targets []*upstreamTarget, port uint32) (protections []*wv1.Protection) {
+	for _, target := range targets {
+		if !target.domainRouted() && target.port.ProxyListeningPort == port {
+			protections = append(protections, target.protection)
+		}
+	}
+	return protections
+}
+
+// domainListener serves the plain HTTP connections and terminates TLS of the tls hosts
+func (s *state) domainListener(tlsHosts []*tlsHost, rateLimited bool, accessLogs []*accesslog.AccessLog) *v3listener.Listener {
+	httpConnectionMgr := s.httpConnectionManager(s.domainHttpFilters(rateLimited), domainRouteConfigName, accessLogs)
+	l := s.listener(domainListenerName, s.domainListenerPort, httpConnectionMgr)
+	if len(tlsHosts) == 0 {
+		return l
+	}
+	l.ListenerFilters = s.tlsInspector()
+	l.FilterChains[0].FilterChainMatch = &v3listener.FilterChainMatch{TransportProtocol: "raw_buffer"}
+	l.FilterChains = append(l.FilterChains, s.tlsFilterChains(tlsHosts, l.FilterChains[0].Filters)...)
+	return l
+}
+
+func (s *state) listener(name string, port uint32, httpConnectionMgr *hcm.HttpConnectionManager) *v3listener.Listener {
+	typedHttpConnectionMgr, _ := anypb.New(httpConnectionMgr)
+	return &v3listener.Listener{
+		Name: name,
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.SocketAddress_TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
 					},
 				},
 			},
-			FilterChains: []*v3listener.FilterChain{
-				{
-					Filters: []*v3listener.Filter{
-						{
-							Name: wellknown.HTTPConnectionManager,
-							ConfigType: &v3listener.Filter_TypedConfig{
-								TypedConfig: httpConnectionMgr,
-							},
+		},
+		FilterChains: []*v3listener.FilterChain{
+			{
+				Filters: []*v3listener.Filter{
+					{
+						Name: wellknown.HTTPConnectionManager,
+						ConfigType: &v3listener.Filter_TypedConfig{
+							TypedConfig: typedHttpConnectionMgr,
 						},
 					},
 				},
-			}}
-	}
-	return listeners
+			},
+		}}
 }
 
 func (s *state) lbEndpoint(ip string, port uint32) *endpoint.LbEndpoint {
@@ -205,6 +424,27 @@ func (s *state) lbEndpoint(ip string, port uint32) *endpoint.LbEndpoint {
 	}
 }
 
+// edsCluster builds the application cluster, the endpoints are published separately,
+// so the pods churn does not change the clusters and the listeners
+func (s *state) edsCluster(name string) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: s.adsConfigSource(),
+		},
+		ConnectTimeout: durationpb.New(20 * time.Second),
+		LbPolicy:       cluster.Cluster_ROUND_ROBIN,
+	}
+}
+
+func (s *state) loadAssignment(name string, lbep []*endpoint.LbEndpoint) *endpoint.ClusterLoadAssignment {
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbep}},
+	}
+}
+
 func (s *state) cluster(name string, lbep []*endpoint.LbEndpoint, t cluster.Cluster_DiscoveryType) *cluster.Cluster {
 	return &cluster.Cluster{
 		Name:                 name,
@@ -212,62 +452,80 @@ func (s *state) cluster(name string, lbep []*endpoint.LbEndpoint, t cluster.Clus
 		ConnectTimeout:       durationpb.New(20 * time.Second),
 		LbPolicy:             cluster.Cluster_ROUND_ROBIN,
 		DnsLookupFamily:      cluster.Cluster_V4_ONLY,
-		LoadAssignment: &endpoint.ClusterLoadAssignment{
-			ClusterName: name,
-			Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbep}},
-		},
+		LoadAssignment:       s.loadAssignment(name, lbep),
 	}
 }
 
-func (s *state) containerPortsEndpoints(
-	upstreamEp []*wv1.Endpoint, upstreamPorts []*wv1.Port) (lbEndpoints []*endpoint.LbEndpoint) {
-	for _, uep := range upstreamEp {
-		for _, port := range upstreamPorts {
-			if port.PortType == wv1.PortType_PORT_TYPE_CONTAINER_PORT {
-				lbEndpoints = append(lbEndpoints, s.lbEndpoint(uep.Ip, port.Number))
+func (s *state) mirroredCluster(mirrorTarget *wv1.MirrorTarget, name string) *cluster.Cluster {
+	mirroEndpoints := []*endpoint.LbEndpoint{s.lbEndpoint(mirrorAddress(mirrorTarget), mirrorTarget.Port)}
+	return s.cluster(name, mirroEndpoints, cluster.Cluster_STRICT_DNS)
+}
+
+func (s *state) clusters(targets []*upstreamTarget) (clusters []types.Resource) {
+	clusters = make([]types.Resource, 0, len(targets))
+	names := map[string]bool{}
+	for _, target := range targets {
+		if !names[target.clusterName()] {
+			names[target.clusterName()] = true
+			if target.domainRouted() {
+				// routed to the service, the endpoints are balanced by the service
+				svcEndpoints := []*endpoint.LbEndpoint{
+					s.lbEndpoint(target.ingress.Upstream.SvcFqdn, target.port.Number),
+				}
+				c := s.cluster(target.clusterName(), svcEndpoints, cluster.Cluster_STRICT_DNS)
+				c = s.withTrafficPolicy(c, target.trafficPolicy())
+				clusters = append(clusters, s.withProtocolOptions(c, target.ingress.Upstream))
+			} else {
+				c := s.withTrafficPolicy(s.edsCluster(target.clusterName()), target.trafficPolicy())
+				clusters = append(clusters, s.withProtocolOptions(c, target.ingress.Upstream))
 			}
 		}
+		// check for mirror policy, if enabled create a mirroring cluster per mirror target
+		if mirrorPolicy := target.routedMirrorPolicy(); mirrorPolicy != nil {
+			for idx, mirrorTarget := range mirrorTargets(mirrorPolicy) {
+				if names[target.mirroredClusterName(idx)] {
+					continue
+				}
+				names[target.mirroredClusterName(idx)] = true
+				clusters = append(clusters, s.mirroredCluster(mirrorTarget, target.mirroredClusterName(idx)))
+			}
+		}
+	}
+	if s.accessLog != nil && s.accessLog.AlsAddr != "" {
+		if c := s.alsCluster(); c != nil {
+			clusters = append(clusters, c)
+		}
 	}
-	return lbEndpoints
+	return clusters
 }
 
-func (s *state) clusters(protections []*wv1.Protection) (clusters []types.Resource) {
-	clusters = make([]types.Resource, 0, len(protections))
-	for _, protection := range protections {
-		// if protection disabled, skip it
-		if shouldSkipProtection(protection) {
+// endpoints builds the EDS load assignments of the container port clusters,
+// a.k.a routing by dedicated listener port
+func (s *state) endpoints(targets []*upstreamTarget) []types.Resource {
+	loadAssignments := make([]types.Resource, 0, len(targets))
+	names := map[string]bool{}
+	for _, target := range targets {
+		if target.domainRouted() || names[target.clusterName()] {
 			continue
 		}
-		// first generate container port endpoints, a.k.a routing by dedicated listener port
-		lbEndpoints := s.containerPortsEndpoints(
-			protection.Application.Ingress[0].Upstream.Endpoints,
-			protection.Application.Ingress[0].Upstream.Ports,
-		)
-		clusters = append(clusters, s.cluster(protection.Application.Name, lbEndpoints, cluster.Cluster_STATIC))
-		// check for mirror policy, if enabled create a mirroring cluster
-		mirrorPolicy := protection.Application.Ingress[0].Upstream.MirrorPolicy
-		if mirrorPolicy != nil && mirrorPolicy.Status == wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED {
-			address := mirrorPolicy.Ip
-			// always use dns id set
-			if mirrorPolicy.Dns != "" {
-				address = mirrorPolicy.Dns
-			}
-			// mirrored endpoints
-			mirroEndpoints := []*endpoint.LbEndpoint{s.lbEndpoint(address, mirrorPolicy.Port)}
-			// mirrored cluster
-			mirroredCluster := s.cluster(s.mirroredClusterName(protection.Application.Name),
-				mirroEndpoints,
-				cluster.Cluster_STRICT_DNS,
-			)
-			clusters = append(clusters, mirroredCluster)
+		names[target.clusterName()] = true
+		lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(target.ingress.Upstream.Endpoints))
+		for _, uep := range target.ingress.Upstream.Endpoints {
+			lbEndpoints = append(lbEndpoints, s.lbEndpoint(uep.Ip, target.port.Number))
 		}
+		loadAssignments = append(loadAssignments, s.loadAssignment(target.clusterName(), lbEndpoints))
 	}
-	return clusters
+	return loadAssignments
 }
 
 func (s *state) buildResources(protections []*wv1.Protection) map[resource.Type][]types.Resource {
+	targets := upstreamTargets(protections)
+	tlsHosts := s.tlsHosts(targets)
 	return map[resource.Type][]types.Resource{
-		resource.ListenerType: s.listeners(protections),
-		resource.ClusterType:  s.clusters(protections),
+		resource.ListenerType: s.listeners(targets, tlsHosts),
+		resource.RouteType:    s.routeConfigs(targets),
+		resource.ClusterType:  s.clusters(targets),
+		resource.EndpointType: s.endpoints(targets),
+		resource.SecretType:   s.tlsSecrets(tlsHosts),
 	}
 }
@@ -0,0 +1,244 @@
+package controlplane
+
+import (
+	"fmt"
+	"testing"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+const testDomainListenerPort = 50080
+
+func domainProtection(id uint32, name, host string) *wv1.Protection {
+	return &wv1.Protection{
+		Id:             id,
+		ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON,
+		DesiredState: &wv1.ProtectionDesiredState{
+			ModeSec: &wv1.ModSec{ProtectionMode: wv1.ProtectionMode_PROTECTION_MODE_ON},
+		},
+		Application: &wv1.Application{
+			Name: name,
+			Ingress: []*wv1.Ingress{
+				{
+					Host: host,
+					Upstream: &wv1.Upstream{
+						SvcFqdn:           name + ".default.svc.cluster.local",
+						UpstreamRouteType: wv1.UpstreamRouteType_UPSTREAM_ROUTE_TYPE_DOMAIN,
+						Endpoints:         []*wv1.Endpoint{{Ip: "10.0.0.1"}},
+						Ports: []*wv1.Port{
+							{Number: 80, PortType: wv1.PortType_PORT_TYPE_SVC_PORT},
+							{Number: 8080, PortType: wv1.PortType_PORT_TYPE_CONTAINER_PORT, ProxyListeningPort: 50011},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestBuildResourcesDomainRouting(t *testing.T) {
+	protections := append(testProtections(),
+		domainProtection(2, "store", "store.example.com"),
+		domainProtection(3, "blog", "blog.example.com"),
+	)
+	resources := newState(testDomainListenerPort, nil).buildResources(protections)
+	snap, _, err := newSnapshot(resources)
+	require.NoError(t, err)
+	require.NoError(t, snap.Consistent())
+
+	// dedicated listener of the port routed protection and the shared domain listener
+	listeners := resources[resource.ListenerType]
+	require.Len(t, listeners, 2)
+	domainListener := listeners[1].(*v3listener.Listener)
+	assert.Equal(t, domainListenerName, domainListener.Name)
+	assert.Equal(t, uint32(testDomainListenerPort), domainListener.Address.GetSocketAddress().GetPortValue())
+
+	var domainRoute *route.RouteConfiguration
+	for _, r := range resources[resource.RouteType] {
+		if r.(*route.RouteConfiguration).Name == domainRouteConfigName {
+			domainRoute = r.(*route.RouteConfiguration)
+		}
+	}
+	require.NotNil(t, domainRoute)
+	require.Len(t, domainRoute.VirtualHosts, 2)
+	assert.Equal(t, []string{"store.example.com", "store.example.com:*"}, domainRoute.VirtualHosts[0].Domains)
+	assert.Contains(t, domainRoute.VirtualHosts[0].Routes[0].TypedPerFilterConfig, wafieFilterName)
+	// domain routed protections are balanced by the service, without EDS
+	assert.Len(t, resources[resource.EndpointType], 1)
+}
+
+func TestBuildResources(t *testing.T) {
+	containerPort := func(number, proxyPort uint32) *wv1.Port {
+		return &wv1.Port{Number: number, PortType: wv1.PortType_PORT_TYPE_CONTAINER_PORT, ProxyListeningPort: proxyPort}
+	}
+	withIngress := func(p *wv1.Protection, ingress ...*wv1.Ingress) *wv1.Protection {
+		p.Application.Ingress = append(p.Application.Ingress, ingress...)
+		return p
+	}
+	domainIngress := func(p *wv1.Protection, host, path string, port int32) *wv1.Ingress {
+		upstream := proto.Clone(p.Application.Ingress[0].Upstream).(*wv1.Upstream)
+		upstream.Ports = append(upstream.Ports, &wv1.Port{Number: uint32(port), PortType: wv1.PortType_PORT_TYPE_SVC_PORT})
+		return &wv1.Ingress{Host: host, Path: path, Port: port, Upstream: upstream}
+	}
+	multiPort := testProtections()[0]
+	multiPort.Application.Ingress[0].Upstream.Ports = append(
+		multiPort.Application.Ingress[0].Upstream.Ports, containerPort(9090, 50011),
+	)
+	multiIngress := testProtections()[0]
+	multiIngress = withIngress(multiIngress, &wv1.Ingress{
+		Upstream: &wv1.Upstream{
+			SvcFqdn:   "shop-admin.default.svc.cluster.local",
+			Endpoints: []*wv1.Endpoint{{Ip: "10.0.1.1"}},
+			Ports:     []*wv1.Port{containerPort(8081, 50012)},
+		},
+	})
+	multiPath := domainProtection(2, "store", "store.example.com")
+	multiPath = withIngress(multiPath,
+		domainIngress(multiPath, "store.example.com", "/api", 81),
+		domainIngress(multiPath, "shop.example.com", "", 80),
+	)
+	sharedHost := domainProtection(2, "store", "example.com")
+	other := domainProtection(3, "blog", "example.com")
+	other.Application.Ingress[0].Path = "/blog"
+	other.DesiredState.ModeSec.ProtectionMode = wv1.ProtectionMode_PROTECTION_MODE_OFF
+	noHost := domainProtection(2, "store", "")
+	noUpstream := withIngress(testProtections()[0], &wv1.Ingress{Host: "broken.example.com"})
+
+	tests := []struct {
+		name        string
+		protections []*wv1.Protection
+		listeners   []string
+		routes      map[string][]string // route config name to virtual host routes "<domain> <prefix> <cluster>"
+		clusters    []string
+		endpoints   map[string][]string // load assignment name to endpoint addresses
+	}{
+		{
+			name:        "listener per container port",
+			protections: []*wv1.Protection{multiPort},
+			listeners:   []string{"listener-50010", "listener-50011"},
+			routes: map[string][]string{
+				"shop-50010-route": {"* / shop-shop.default.svc.cluster.local-8080"},
+				"shop-50011-route": {"* / shop-shop.default.svc.cluster.local-9090"},
+			},
+			clusters: []string{"shop-shop.default.svc.cluster.local-8080", "shop-shop.default.svc.cluster.local-9090"},
+			endpoints: map[string][]string{
+				"shop-shop.default.svc.cluster.local-8080": {"10.0.0.1:8080", "10.0.0.2:8080"},
+				"shop-shop.default.svc.cluster.local-9090": {"10.0.0.1:9090", "10.0.0.2:9090"},
+			},
+		},
+		{
+			name:        "cluster per ingress upstream",
+			protections: []*wv1.Protection{multiIngress},
+			listeners:   []string{"listener-50010", "listener-50012"},
+			routes: map[string][]string{
+				"shop-50010-route": {"* / shop-shop.default.svc.cluster.local-8080"},
+				"shop-50012-route": {"* / shop-shop-admin.default.svc.cluster.local-8081"},
+			},
+			clusters: []string{"shop-shop.default.svc.cluster.local-8080", "shop-shop-admin.default.svc.cluster.local-8081"},
+			endpoints: map[string][]string{
+				"shop-shop.default.svc.cluster.local-8080":       {"10.0.0.1:8080", "10.0.0.2:8080"},
+				"shop-shop-admin.default.svc.cluster.local-8081": {"10.0.1.1:8081"},
+			},
+		},
+		{
+			name:        "route per ingress host and path",
+			protections: []*wv1.Protection{multiPath},
+			listeners:   []string{domainListenerName},
+			routes: map[string][]string{
+				domainRouteConfigName: {
+					"store.example.com /api store-store.default.svc.cluster.local-81",
+					"store.example.com / store-store.default.svc.cluster.local-80",
+					"shop.example.com / store-store.default.svc.cluster.local-80",
+				},
+			},
+			clusters:  []string{"store-store.default.svc.cluster.local-80", "store-store.default.svc.cluster.local-81"},
+			endpoints: map[string][]string{},
+		},
+		{
+			name:        "protections sharing the ingress host",
+			protections: []*wv1.Protection{sharedHost, other},
+			listeners:   []string{domainListenerName},
+			routes: map[string][]string{
+				domainRouteConfigName: {
+					"example.com /blog blog-blog.default.svc.cluster.local-80",
+					"example.com / store-store.default.svc.cluster.local-80",
+				},
+			},
+			clusters:  []string{"store-store.default.svc.cluster.local-80", "blog-blog.default.svc.cluster.local-80"},
+			endpoints: map[string][]string{},
+		},
+		{
+			name:        "ingress without host",
+			protections: []*wv1.Protection{noHost},
+			listeners:   []string{domainListenerName},
+			routes: map[string][]string{
+				domainRouteConfigName: {"* / store-store.default.svc.cluster.local-80"},
+			},
+			clusters:  []string{"store-store.default.svc.cluster.local-80"},
+			endpoints: map[string][]string{},
+		},
+		{
+			name:        "ingress without upstream",
+			protections: []*wv1.Protection{noUpstream},
+			listeners:   []string{"listener-50010"},
+			routes: map[string][]string{
+				"shop-50010-route": {"* / shop-shop.default.svc.cluster.local-8080"},
+			},
+			clusters: []string{"shop-shop.default.svc.cluster.local-8080"},
+			endpoints: map[string][]string{
+				"shop-shop.default.svc.cluster.local-8080": {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := newState(testDomainListenerPort, nil).buildResources(tt.protections)
+			snap, _, err := newSnapshot(resources)
+			require.NoError(t, err)
+			require.NoError(t, snap.Consistent())
+
+			var listeners []string
+			for _, l := range resources[resource.ListenerType] {
+				listeners = append(listeners, l.(*v3listener.Listener).Name)
+			}
+			assert.Equal(t, tt.listeners, listeners)
+
+			routes := map[string][]string{}
+			for _, r := range resources[resource.RouteType] {
+				routeConfig := r.(*route.RouteConfiguration)
+				for _, virtualHost := range routeConfig.VirtualHosts {
+					for _, vhRoute := range virtualHost.Routes {
+						routes[routeConfig.Name] = append(routes[routeConfig.Name], fmt.Sprintf("%s %s %s",
+							virtualHost.Domains[0], vhRoute.GetMatch().GetPrefix(), vhRoute.GetRoute().GetCluster()))
+					}
+				}
+			}
+			assert.Equal(t, tt.routes, routes)
+
+			var clusters []string
+			for _, c := range resources[resource.ClusterType] {
+				clusters = append(clusters, c.(*cluster.Cluster).Name)
+			}
+			assert.Equal(t, tt.clusters, clusters)
+
+			endpoints := map[string][]string{}
+			for _, e := range resources[resource.EndpointType] {
+				loadAssignment := e.(*endpoint.ClusterLoadAssignment)
+				for _, lbEndpoint := range loadAssignment.Endpoints[0].LbEndpoints {
+					address := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+					endpoints[loadAssignment.ClusterName] = append(endpoints[loadAssignment.ClusterName],
+						fmt.Sprintf("%s:%d", address.Address, address.GetPortValue()))
+				}
+			}
+			assert.Equal(t, tt.endpoints, endpoints)
+		})
+	}
+}
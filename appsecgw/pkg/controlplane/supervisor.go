@@ -2,66 +2,261 @@ package controlplane
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+const (
+	// EnvoyHealthService is the gRPC health service name of the envoy proxy readiness
+	EnvoyHealthService = "envoy"
+	// accessLogBackups is the number of the rotated access log files kept
+	accessLogBackups = 3
+	// auditLogBackups is the number of the rotated ModSecurity audit log files kept,
+	// the events tailer and fluent-bit follow the truncated file
+	auditLogBackups = 1
+	// the restart backoff is doubled on each crash and reset once the proxy runs for the stable period
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	stableRunPeriod   = time.Minute
+	// the proxy is killed when it's not stopped in time after the drain period
+	proxyStopTimeout    = 10 * time.Second
+	logRotationInterval = time.Minute
+)
+
 type Supervisor struct {
-	envoyPath           string
-	envoyConfigFile     string
-	logrotatePath       string
-	logrotateConfigFile string
-	logger              *zap.Logger
+	envoyPath       string
+	envoyConfigFile string
+	// envoy admin interface, bound to the loopback by the bootstrap config
+	adminAddr    string
+	adminClient  *http.Client
+	nodeId       string
+	gatewayGroup string
+	// drainPeriod is the graceful drain duration of the listeners before the proxy is stopped
+	drainPeriod time.Duration
+	logger      *zap.Logger
+	// envoy file access log and ModSecurity audit log, rotated once they exceed the max size
+	rotatedLogs []rotatedLog
+	// proxy is the running envoy process, nil while the proxy is restarted
+	proxyMu  sync.Mutex
+	proxy    *os.Process
+	draining atomic.Bool
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
 }
 
-func NewSupervisor(log *zap.Logger) *Supervisor {
+// NewSupervisor creates the envoy process supervisor,
+// the envoy node identifies itself by the nodeId and selects the gatewayGroup snapshot,
+// on shutdown the listeners are drained for the drainPeriod
+func NewSupervisor(nodeId, gatewayGroup string, drainPeriod time.Duration, log *zap.Logger) *Supervisor {
 	return &Supervisor{
-		envoyPath:           "/usr/local/bin/envoy",
-		envoyConfigFile:     "/etc/envoy/envoy-xds.yaml",
-		logrotatePath:       "/usr/sbin/logrotate",
-		logrotateConfigFile: "/etc/envoy/wafie-logrotate.conf",
-		logger:              log,
+		envoyPath:       "/usr/local/bin/envoy",
+		envoyConfigFile: "/etc/envoy/envoy-xds.yaml",
+		adminAddr:       "http://127.0.0.1:19000",
+		adminClient:     &http.Client{Timeout: 2 * time.Second},
+		nodeId:          nodeId,
+		gatewayGroup:    gatewayGroup,
+		drainPeriod:     drainPeriod,
+		logger:          log,
+		stopCh:          make(chan struct{}),
+		doneCh:          make(chan struct{}),
+	}
+}
+
+// rotatedLog is a log file written by envoy and rotated by the supervisor
+type rotatedLog struct {
+	name     string
+	path     string
+	maxBytes int64
+	backups  int
+}
+
+// RotateAccessLog rotates the envoy file access log sink once it exceeds maxBytes
+func (s *Supervisor) RotateAccessLog(path string, maxBytes int64) *Supervisor {
+	if path != "" {
+		s.rotatedLogs = append(s.rotatedLogs,
+			rotatedLog{name: "access log", path: path, maxBytes: maxBytes, backups: accessLogBackups})
 	}
+	return s
 }
 
+// RotateAuditLog rotates the ModSecurity audit log once it exceeds maxBytes,
+// the log is appended by both the wafie filter and the ModSecurity native audit log writer
+func (s *Supervisor) RotateAuditLog(path string, maxBytes int64) *Supervisor {
+	if path != "" {
+		s.rotatedLogs = append(s.rotatedLogs,
+			rotatedLog{name: "audit log", path: path, maxBytes: maxBytes, backups: auditLogBackups})
+	}
+	return s
+}
+
+// Start runs the envoy proxy, restarted with backoff when it exits, and the logs rotation
 func (s *Supervisor) Start() {
-	s.startProxyProcess()
-	s.startLogRotationProcess()
+	for _, l := range s.rotatedLogs {
+		// envoy creates the log files but not their directory
+		if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+			s.logger.Error("failed to create log directory", zap.String("log", l.name), zap.Error(err))
+		}
+		go s.rotateLog(l)
+	}
+	go s.superviseProxy()
 }
 
-func (s *Supervisor) startProxyProcess() {
-	s.logger.Info("starting envoy proxy")
-	s.runBackgroundCmd(
-		exec.Command(
-			s.envoyPath, []string{"-c", s.envoyConfigFile}...,
-		),
-	)
+// Ready reports whether the proxy is running, not draining and live,
+// envoy is live once the initial xDS fetch of the listeners and the clusters is completed
+func (s *Supervisor) Ready(ctx context.Context) bool {
+	if s.draining.Load() {
+		return false
+	}
+	s.proxyMu.Lock()
+	running := s.proxy != nil
+	s.proxyMu.Unlock()
+	if !running {
+		return false
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.adminAddr+"/ready", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := s.adminClient.Do(req)
+	if err != nil {
+		s.logger.Warn("envoy readiness check failed", zap.Error(err))
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
 }
 
-func (s *Supervisor) startLogRotationProcess() {
-	go func() {
-		s.logger.Info("starting log rotation process")
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				s.runBackgroundCmd(
-					exec.Command(
-						s.logrotatePath, []string{"-f", s.logrotateConfigFile}...,
-					),
-				)
-			}
+// Stop drains the listeners for the drain period and stops the proxy,
+// the readiness fails from the drain start, so the gateway is removed from the service endpoints
+// while the in-flight requests are completed
+func (s *Supervisor) Stop() {
+	s.draining.Store(true)
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	if err := s.drainListeners(); err != nil {
+		s.logger.Error("failed to drain envoy listeners", zap.Error(err))
+	} else {
+		s.logger.Info("draining envoy listeners", zap.Duration("drainPeriod", s.drainPeriod))
+		time.Sleep(s.drainPeriod)
+	}
+	s.signalProxy(syscall.SIGTERM)
+	select {
+	case <-s.doneCh:
+	case <-time.After(proxyStopTimeout):
+		s.logger.Warn("envoy proxy did not stop in time, killing it")
+		s.signalProxy(syscall.SIGKILL)
+		<-s.doneCh
+	}
+	s.logger.Info("envoy proxy stopped")
+}
+
+func (s *Supervisor) stopping() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainListeners starts the graceful drain, envoy keeps serving the listeners
+// and closes the downstream connections gradually over the --drain-time-s
+func (s *Supervisor) drainListeners() error {
+	resp, err := s.adminClient.Post(s.adminAddr+"/drain_listeners?graceful", "", nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected drain listeners response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Supervisor) signalProxy(sig os.Signal) {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	if s.proxy == nil {
+		return
+	}
+	if err := s.proxy.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		s.logger.Error("failed to signal envoy proxy", zap.String("signal", sig.String()), zap.Error(err))
+	}
+}
+
+// superviseProxy restarts the proxy with backoff until the supervisor is stopped
+func (s *Supervisor) superviseProxy() {
+	defer close(s.doneCh)
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		err := s.runProxy()
+		if s.stopping() {
+			return
 		}
-	}()
+		if time.Since(started) >= stableRunPeriod {
+			backoff = minRestartBackoff
+		}
+		proxyRestarts.Inc()
+		s.logger.Error("envoy proxy exited, restarting", zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRestartBackoff)
+	}
 }
 
-func (s *Supervisor) runBackgroundCmd(cmd *exec.Cmd) {
+// runProxy runs the proxy until it exits
+func (s *Supervisor) runProxy() error {
+	s.logger.Info("starting envoy proxy",
+		zap.String("nodeId", s.nodeId), zap.String("gatewayGroup", s.gatewayGroup))
+	// the node overrides are merged into the bootstrap config file
+	nodeCfg := fmt.Sprintf(`{"node": {"id": %q, "metadata": {%q: %q}}}`,
+		s.nodeId, GatewayGroupMetadataKey, s.gatewayGroup)
+	cmd := exec.Command(s.envoyPath,
+		"-c", s.envoyConfigFile,
+		"--config-yaml", nodeCfg,
+		"--drain-time-s", strconv.Itoa(int(s.drainPeriod.Seconds())),
+	)
+	output := pipeOutput(cmd)
+	defer output.Close()
+	s.proxyMu.Lock()
+	// the supervisor might be stopped during the restart backoff
+	if s.stopping() {
+		s.proxyMu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		s.proxyMu.Unlock()
+		return err
+	}
+	s.proxy = cmd.Process
+	s.proxyMu.Unlock()
+	err := cmd.Wait()
+	s.proxyMu.Lock()
+	s.proxy = nil
+	s.proxyMu.Unlock()
+	return err
+}
+
+// pipeOutput prints the command output to the supervisor stdout,
+// the returned writer is closed once the command exits
+func pipeOutput(cmd *exec.Cmd) io.Closer {
 	reader, writer := io.Pipe()
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = writer
@@ -69,17 +264,63 @@ func (s *Supervisor) runBackgroundCmd(cmd *exec.Cmd) {
 	go func() {
 		scanner := bufio.NewScanner(reader)
 		for scanner.Scan() {
-			msg := scanner.Text()
-			fmt.Println(msg)
+			fmt.Println(scanner.Text())
 		}
 	}()
-	go func() {
-		if err := cmd.Run(); err != nil {
-			s.logger.Error(
-				"error running command",
-				zap.Strings("args", cmd.Args),
-				zap.Error(err),
-			)
+	return writer
+}
+
+func (s *Supervisor) rotateLog(l rotatedLog) {
+	s.logger.Info("starting log rotation", zap.String("log", l.name), zap.String("path", l.path))
+	ticker := time.NewTicker(logRotationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if err := rotateFile(l.path, l.maxBytes, l.backups); err != nil {
+				s.logger.Error("failed to rotate log",
+					zap.String("log", l.name), zap.String("path", l.path), zap.Error(err))
+			}
 		}
-	}()
+	}
+}
+
+// rotateFile copies the file to the numbered backups and truncates it once it exceeds maxBytes,
+// the writers keep appending to the truncated file, the same as the logrotate copytruncate
+func rotateFile(path string, maxBytes int64, backups int) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < maxBytes {
+		return nil
+	}
+	for i := backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + ".1")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Truncate(path, 0)
 }
@@ -0,0 +1,80 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeEnvoy runs a long living process in place of envoy with a fake admin interface
+func fakeEnvoy(t *testing.T) (*Supervisor, *atomic.Bool) {
+	envoyPath := filepath.Join(t.TempDir(), "envoy")
+	require.NoError(t, os.WriteFile(envoyPath, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755))
+	drained := &atomic.Bool{}
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ready" && r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/drain_listeners" && r.Method == http.MethodPost && r.URL.Query().Has("graceful"):
+			drained.Store(true)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(admin.Close)
+	s := NewSupervisor("node-1", DefaultGatewayGroup, 100*time.Millisecond, zap.NewNop())
+	s.envoyPath = envoyPath
+	s.adminAddr = admin.URL
+	return s, drained
+}
+
+func TestSupervisorDrainOnStop(t *testing.T) {
+	s, drained := fakeEnvoy(t)
+	assert.False(t, s.Ready(context.Background()))
+	s.Start()
+	require.Eventually(t, func() bool { return s.Ready(context.Background()) }, 5*time.Second, 10*time.Millisecond)
+
+	s.Stop()
+	assert.True(t, drained.Load())
+	assert.False(t, s.Ready(context.Background()))
+	select {
+	case <-s.doneCh:
+	default:
+		t.Fatal("envoy proxy is still supervised")
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// missing file is not an error
+	require.NoError(t, rotateFile(path, 10, 2))
+
+	require.NoError(t, os.WriteFile(path, []byte("short"), 0o644))
+	require.NoError(t, rotateFile(path, 10, 2))
+	assert.NoFileExists(t, path+".1")
+
+	for _, entry := range []string{"first entry", "second entry", "third entry"} {
+		require.NoError(t, os.WriteFile(path, []byte(entry), 0o644))
+		require.NoError(t, rotateFile(path, 10, 2))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Zero(t, info.Size())
+	}
+	latest, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "third entry", string(latest))
+	previous, err := os.ReadFile(path + ".2")
+	require.NoError(t, err)
+	assert.Equal(t, "second entry", string(previous))
+	assert.NoFileExists(t, path+".3")
+}
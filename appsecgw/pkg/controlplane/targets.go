@@ -0,0 +1,106 @@
+package controlplane
+
+import (
+	"fmt"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+)
+
+// upstreamTarget is the upstream port of a protection ingress served by the gateway,
+// the container port behind a dedicated listener port, or the service port
+// behind the ingress host and path on the shared listener
+type upstreamTarget struct {
+	protection *wv1.Protection
+	ingress    *wv1.Ingress
+	port       *wv1.Port
+}
+
+// upstreamTargets lists the container ports of the port routed ingresses
+// and the service port of the domain routed ingresses of all the protections
+func upstreamTargets(protections []*wv1.Protection) (targets []*upstreamTarget) {
+	for _, protection := range protections {
+		if shouldSkipProtection(protection) {
+			continue
+		}
+		for _, ingress := range protection.Application.Ingress {
+			if ingress.Upstream == nil {
+				continue
+			}
+			if isDomainRouted(ingress) {
+				port, err := ingressSvcPort(ingress)
+				if err != nil {
+					continue
+				}
+				targets = append(targets, &upstreamTarget{protection: protection, ingress: ingress, port: port})
+				continue
+			}
+			for _, port := range ingress.Upstream.Ports {
+				if port.PortType == wv1.PortType_PORT_TYPE_CONTAINER_PORT {
+					targets = append(targets, &upstreamTarget{protection: protection, ingress: ingress, port: port})
+				}
+			}
+		}
+	}
+	return targets
+}
+
+func (t *upstreamTarget) domainRouted() bool {
+	return isDomainRouted(t.ingress)
+}
+
+func (t *upstreamTarget) appName() string {
+	return t.protection.Application.Name
+}
+
+// clusterName identifies the upstream port, shared by the ingresses of the same upstream
+func (t *upstreamTarget) clusterName() string {
+	return fmt.Sprintf("%s-%s-%d", t.appName(), t.ingress.Upstream.SvcFqdn, t.port.Number)
+}
+
+// mirroredClusterName of the mirror policy target, the first target keeps the unsuffixed name
+func (t *upstreamTarget) mirroredClusterName(idx int) string {
+	if idx == 0 {
+		return fmt.Sprintf("%s-%s-mirrored", t.appName(), t.ingress.Upstream.SvcFqdn)
+	}
+	return fmt.Sprintf("%s-%s-mirrored-%d", t.appName(), t.ingress.Upstream.SvcFqdn, idx)
+}
+
+// routeConfigName of the port routed target dedicated listener
+func (t *upstreamTarget) routeConfigName() string {
+	return fmt.Sprintf("%s-%d-route", t.appName(), t.port.ProxyListeningPort)
+}
+
+// host is the virtual host domain of the domain routed target,
+// the ingress without host matches any host
+func (t *upstreamTarget) host() string {
+	if t.ingress.Host == "" {
+		return "*"
+	}
+	return t.ingress.Host
+}
+
+// pathPrefix routed to the target, the port routed target listener
+// receives the requests already routed by the ingress controller
+func (t *upstreamTarget) pathPrefix() string {
+	if !t.domainRouted() || t.ingress.Path == "" {
+		return "/"
+	}
+	return t.ingress.Path
+}
+
+func (t *upstreamTarget) mirrorPolicy() *wv1.MirrorPolicy {
+	mirrorPolicy := t.ingress.Upstream.MirrorPolicy
+	if mirrorPolicy != nil && mirrorPolicy.Status == wv1.MirrorPolicyStatus_MIRROR_POLICY_STATUS_ENABLED {
+		return mirrorPolicy
+	}
+	return nil
+}
+
+// routedMirrorPolicy is the enabled mirror policy mirrored by the envoy router,
+// the blocked requests are mirrored by the wafie filter
+func (t *upstreamTarget) routedMirrorPolicy() *wv1.MirrorPolicy {
+	if mirrorPolicy := t.mirrorPolicy(); mirrorPolicy != nil && !mirrorBlocked(mirrorPolicy) {
+		return mirrorPolicy
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package controlplane
+
+import (
+	"strings"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = time.Second
+	defaultUnhealthyThreshold   = 3
+	defaultHealthyThreshold     = 1
+	defaultRetryOn              = "5xx,connect-failure,reset"
+	defaultNumRetries           = 1
+	defaultOutlierDetectionTime = 10 * time.Second
+)
+
+func msDuration(ms uint32) *durationpb.Duration {
+	return durationpb.New(time.Duration(ms) * time.Millisecond)
+}
+
+// msDurationOr returns the default duration when the ms value is not set
+func msDurationOr(ms uint32, defaultDuration time.Duration) *durationpb.Duration {
+	if ms == 0 {
+		return durationpb.New(defaultDuration)
+	}
+	return msDuration(ms)
+}
+
+// uint32Value returns nil for the zero value, so envoy applies its default
+func uint32Value(v uint32) *wrapperspb.UInt32Value {
+	if v == 0 {
+		return nil
+	}
+	return wrapperspb.UInt32(v)
+}
+
+// uint32Or returns the default value when the value is not set
+func uint32Or(v, defaultValue uint32) *wrapperspb.UInt32Value {
+	if v == 0 {
+		return wrapperspb.UInt32(defaultValue)
+	}
+	return wrapperspb.UInt32(v)
+}
+
+func (t *upstreamTarget) trafficPolicy() *wv1.TrafficPolicy {
+	return t.ingress.Upstream.GetTrafficPolicy()
+}
+
+// withTrafficPolicy configures the cluster connections, load balancing and the unhealthy endpoints ejection
+func (s *state) withTrafficPolicy(c *cluster.Cluster, policy *wv1.TrafficPolicy) *cluster.Cluster {
+	if policy == nil {
+		return c
+	}
+	if policy.ConnectTimeoutMs != 0 {
+		c.ConnectTimeout = msDuration(policy.ConnectTimeoutMs)
+	}
+	c.LbPolicy = lbPolicy(policy.LbPolicy)
+	if cb := policy.CircuitBreakers; cb != nil {
+		c.CircuitBreakers = &cluster.CircuitBreakers{
+			Thresholds: []*cluster.CircuitBreakers_Thresholds{
+				{
+					Priority:           core.RoutingPriority_DEFAULT,
+					MaxConnections:     uint32Value(cb.MaxConnections),
+					MaxPendingRequests: uint32Value(cb.MaxPendingRequests),
+					MaxRequests:        uint32Value(cb.MaxRequests),
+					MaxRetries:         uint32Value(cb.MaxRetries),
+				},
+			},
+		}
+	}
+	if od := policy.OutlierDetection; od != nil {
+		c.OutlierDetection = &cluster.OutlierDetection{
+			Consecutive_5Xx:           uint32Value(od.Consecutive_5Xx),
+			ConsecutiveGatewayFailure: uint32Value(od.ConsecutiveGatewayFailure),
+			Interval:                  msDurationOr(od.IntervalMs, defaultOutlierDetectionTime),
+			BaseEjectionTime:          msDurationOr(od.BaseEjectionTimeMs, defaultOutlierDetectionTime),
+			MaxEjectionPercent:        uint32Value(od.MaxEjectionPercent),
+		}
+	}
+	if hc := policy.HealthCheck; hc != nil {
+		c.HealthChecks = []*core.HealthCheck{
+			{
+				Timeout:            msDurationOr(hc.TimeoutMs, defaultHealthCheckTimeout),
+				Interval:           msDurationOr(hc.IntervalMs, defaultHealthCheckInterval),
+				UnhealthyThreshold: uint32Or(hc.UnhealthyThreshold, defaultUnhealthyThreshold),
+				HealthyThreshold:   uint32Or(hc.HealthyThreshold, defaultHealthyThreshold),
+				HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+					HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: hc.Path},
+				},
+			},
+		}
+	}
+	return c
+}
+
+func lbPolicy(policy wv1.LoadBalancingPolicy) cluster.Cluster_LbPolicy {
+	switch policy {
+	case wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_LEAST_REQUEST:
+		return cluster.Cluster_LEAST_REQUEST
+	case wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_RANDOM:
+		return cluster.Cluster_RANDOM
+	case wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_RING_HASH:
+		return cluster.Cluster_RING_HASH
+	case wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_MAGLEV:
+		return cluster.Cluster_MAGLEV
+	default:
+		return cluster.Cluster_ROUND_ROBIN
+	}
+}
+
+// withRouteTrafficPolicy configures the route timeouts and retries,
+// the consistent hashing load balancers hash the client source ip
+func (s *state) withRouteTrafficPolicy(routeAction *route.RouteAction, policy *wv1.TrafficPolicy) *route.RouteAction {
+	if policy == nil {
+		return routeAction
+	}
+	routeAction.Timeout = msDuration(policy.RequestTimeoutMs)
+	if policy.IdleTimeoutMs != 0 {
+		routeAction.IdleTimeout = msDuration(policy.IdleTimeoutMs)
+	}
+	if rp := policy.RetryPolicy; rp != nil {
+		retryOn := defaultRetryOn
+		if len(rp.RetryOn) > 0 {
+			retryOn = strings.Join(rp.RetryOn, ",")
+		}
+		routeAction.RetryPolicy = &route.RetryPolicy{
+			RetryOn:    retryOn,
+			NumRetries: uint32Or(rp.NumRetries, defaultNumRetries),
+		}
+		if rp.PerTryTimeoutMs != 0 {
+			routeAction.RetryPolicy.PerTryTimeout = msDuration(rp.PerTryTimeoutMs)
+		}
+	}
+	switch policy.LbPolicy {
+	case wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_RING_HASH, wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_MAGLEV:
+		routeAction.HashPolicy = []*route.RouteAction_HashPolicy{
+			{
+				PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+					ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+				},
+			},
+		}
+	}
+	return routeAction
+}
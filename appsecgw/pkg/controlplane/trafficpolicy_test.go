@@ -0,0 +1,66 @@
+package controlplane
+
+import (
+	"testing"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildResourcesTrafficPolicy(t *testing.T) {
+	protection := testProtections()[0]
+	protection.Application.Ingress[0].Upstream.TrafficPolicy = &wv1.TrafficPolicy{
+		ConnectTimeoutMs: 2000,
+		RequestTimeoutMs: 15000,
+		IdleTimeoutMs:    60000,
+		LbPolicy:         wv1.LoadBalancingPolicy_LOAD_BALANCING_POLICY_RING_HASH,
+		RetryPolicy:      &wv1.RetryPolicy{PerTryTimeoutMs: 500},
+		CircuitBreakers:  &wv1.CircuitBreakers{MaxConnections: 100, MaxPendingRequests: 10},
+		OutlierDetection: &wv1.OutlierDetection{Consecutive_5Xx: 5, MaxEjectionPercent: 50},
+		HealthCheck:      &wv1.HealthCheck{Path: "/healthz", UnhealthyThreshold: 2},
+	}
+	resources := newState(testDomainListenerPort, nil).buildResources([]*wv1.Protection{protection})
+	snap, _, err := newSnapshot(resources)
+	require.NoError(t, err)
+	require.NoError(t, snap.Consistent())
+
+	c := resources[resource.ClusterType][0].(*cluster.Cluster)
+	assert.Equal(t, 2*time.Second, c.ConnectTimeout.AsDuration())
+	assert.Equal(t, cluster.Cluster_RING_HASH, c.LbPolicy)
+	thresholds := c.CircuitBreakers.Thresholds[0]
+	assert.Equal(t, uint32(100), thresholds.MaxConnections.GetValue())
+	assert.Equal(t, uint32(10), thresholds.MaxPendingRequests.GetValue())
+	assert.Nil(t, thresholds.MaxRequests)
+	assert.Equal(t, uint32(5), c.OutlierDetection.Consecutive_5Xx.GetValue())
+	assert.Equal(t, uint32(50), c.OutlierDetection.MaxEjectionPercent.GetValue())
+	assert.Equal(t, defaultOutlierDetectionTime, c.OutlierDetection.Interval.AsDuration())
+	require.Len(t, c.HealthChecks, 1)
+	assert.Equal(t, "/healthz", c.HealthChecks[0].GetHttpHealthCheck().Path)
+	assert.Equal(t, uint32(2), c.HealthChecks[0].UnhealthyThreshold.GetValue())
+	assert.Equal(t, uint32(defaultHealthyThreshold), c.HealthChecks[0].HealthyThreshold.GetValue())
+
+	routeAction := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute()
+	assert.Equal(t, 15*time.Second, routeAction.Timeout.AsDuration())
+	assert.Equal(t, time.Minute, routeAction.IdleTimeout.AsDuration())
+	assert.Equal(t, defaultRetryOn, routeAction.RetryPolicy.RetryOn)
+	assert.Equal(t, uint32(defaultNumRetries), routeAction.RetryPolicy.NumRetries.GetValue())
+	assert.Equal(t, 500*time.Millisecond, routeAction.RetryPolicy.PerTryTimeout.AsDuration())
+	assert.True(t, routeAction.HashPolicy[0].GetConnectionProperties().SourceIp)
+}
+
+func TestBuildResourcesDefaultTrafficPolicy(t *testing.T) {
+	resources := newState(testDomainListenerPort, nil).buildResources(testProtections())
+	c := resources[resource.ClusterType][0].(*cluster.Cluster)
+	assert.Equal(t, cluster.Cluster_ROUND_ROBIN, c.LbPolicy)
+	assert.Nil(t, c.CircuitBreakers)
+	assert.Nil(t, c.OutlierDetection)
+	assert.Empty(t, c.HealthChecks)
+	routeAction := resources[resource.RouteType][0].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute()
+	assert.Equal(t, time.Duration(0), routeAction.Timeout.AsDuration())
+	assert.Nil(t, routeAction.RetryPolicy)
+}
@@ -16,11 +16,37 @@ func shouldSkipProtection(protection *wv1.Protection) bool {
 	return false
 }
 
-func protectionContainerPort(protection *wv1.Protection) (*wv1.Port, error) {
-	for _, port := range protection.Application.Ingress[0].Upstream.Ports {
-		if port.PortType == wv1.PortType_PORT_TYPE_CONTAINER_PORT {
+// ingressSvcPort returns the service port targeted by the ingress,
+// or the first service port of the upstream
+func ingressSvcPort(ingress *wv1.Ingress) (*wv1.Port, error) {
+	var svcPort *wv1.Port
+	for _, port := range ingress.Upstream.Ports {
+		if port.PortType != wv1.PortType_PORT_TYPE_SVC_PORT {
+			continue
+		}
+		if int32(port.Number) == ingress.Port {
 			return port, nil
 		}
+		if svcPort == nil {
+			svcPort = port
+		}
+	}
+	if svcPort == nil {
+		return nil, fmt.Errorf("ingress [%s] upstream does not have service ports", ingress.Name)
+	}
+	return svcPort, nil
+}
+
+// isDomainRouted reports whether the ingress is routed by the host on the shared listener
+func isDomainRouted(ingress *wv1.Ingress) bool {
+	return ingress.Upstream.UpstreamRouteType == wv1.UpstreamRouteType_UPSTREAM_ROUTE_TYPE_DOMAIN
+}
+
+// structList converts the string slice into the structpb list value
+func structList(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		list = append(list, v)
 	}
-	return nil, fmt.Errorf("protectoin [%d] does not have container ports", protection.Id)
+	return list
 }
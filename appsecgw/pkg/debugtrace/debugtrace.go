@@ -0,0 +1,84 @@
+package debugtrace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Header carries the signed debug token: <expires unix timestamp>:<hex hmac-sha256>,
+	// the hmac covers the expiration and the request host, so the token is valid for a single host only
+	Header = "x-wafie-debug"
+	// RequestIdHeader is set on the response of the traced request
+	RequestIdHeader = "x-wafie-debug-request-id"
+	// GatewayHeader is set on the response of the traced request to the pod ip of the gateway holding the trace,
+	// the traces are kept on the gateway pod, so the trace request is forwarded to it
+	GatewayHeader = "x-wafie-debug-gateway"
+	// PodIpEnv is the env variable holding the gateway pod ip
+	PodIpEnv = "POD_IP"
+	// SecretEnv is the env variable holding the per gateway signing secret
+	SecretEnv       = "WAFIE_DEBUG_SECRET"
+	DefaultTraceDir = "/data/debug"
+	// MaxTokenTTL limits the lifetime of a signed debug token
+	MaxTokenTTL = time.Hour
+)
+
+var unsafeRequestIdChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func signature(secret []byte, host string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(expires, 10) + ":" + normalizeHost(host)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeHost drops the port and lower cases the host,
+// so the token is valid regardless of the authority form
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// Sign returns the debug header value valid for the host requests until expires
+func Sign(secret []byte, host string, expires time.Time) string {
+	return fmt.Sprintf("%d:%s", expires.Unix(), signature(secret, host, expires.Unix()))
+}
+
+// Verify checks the debug header value signature, expiration and the request host
+func Verify(secret []byte, host, value string, now time.Time) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("debug secret is not set")
+	}
+	expiresStr, sig, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("malformed debug token")
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed debug token expiration: %w", err)
+	}
+	if now.Unix() > expires {
+		return fmt.Errorf("debug token expired")
+	}
+	if time.Unix(expires, 0).Sub(now) > MaxTokenTTL {
+		return fmt.Errorf("debug token ttl exceeds %s", MaxTokenTTL)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, host, expires))) {
+		return fmt.Errorf("invalid debug token signature")
+	}
+	return nil
+}
+
+// TracePath returns the trace file path of the request
+func TracePath(dir, requestId string) string {
+	return filepath.Join(dir, unsafeRequestIdChars.ReplaceAllString(requestId, "_")+".log")
+}
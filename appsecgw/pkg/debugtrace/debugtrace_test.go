@@ -0,0 +1,40 @@
+package debugtrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	host := "shop.example.com"
+	tests := []struct {
+		name    string
+		secret  []byte
+		host    string
+		value   string
+		wantErr bool
+	}{
+		{name: "valid", secret: secret, host: host, value: Sign(secret, host, now.Add(time.Minute))},
+		{name: "host with port", secret: secret, host: "Shop.Example.com:8443", value: Sign(secret, host, now.Add(time.Minute))},
+		{name: "other host", secret: secret, host: "blog.example.com", value: Sign(secret, host, now.Add(time.Minute)), wantErr: true},
+		{name: "expired", secret: secret, host: host, value: Sign(secret, host, now.Add(-time.Minute)), wantErr: true},
+		{name: "ttl too long", secret: secret, host: host, value: Sign(secret, host, now.Add(2*MaxTokenTTL)), wantErr: true},
+		{name: "wrong secret", secret: secret, host: host, value: Sign([]byte("other"), host, now.Add(time.Minute)), wantErr: true},
+		{name: "empty secret", secret: nil, host: host, value: Sign(nil, host, now.Add(time.Minute)), wantErr: true},
+		{name: "malformed", secret: secret, host: host, value: "foo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.host, tt.value, now)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestTracePath(t *testing.T) {
+	assert.Equal(t, "/data/debug/______etc_passwd.log", TracePath("/data/debug", "../../etc/passwd"))
+}
@@ -0,0 +1,35 @@
+package events
+
+import (
+	"context"
+	"net/http"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/tracing"
+)
+
+// ApiSink sends the events to the API server EventService
+type ApiSink struct {
+	eventSvcClient wafiev1connect.EventServiceClient
+}
+
+func NewApiSink(apiAddr string) *ApiSink {
+	return &ApiSink{
+		eventSvcClient: wafiev1connect.NewEventServiceClient(
+			http.DefaultClient, apiAddr,
+			tracing.ClientOption(),
+		),
+	}
+}
+
+func (s *ApiSink) Name() string {
+	return "api-server"
+}
+
+func (s *ApiSink) Send(ctx context.Context, events []*wv1.SecurityEvent) error {
+	_, err := s.eventSvcClient.CreateEvents(ctx,
+		connect.NewRequest(&wv1.CreateEventsRequest{Events: events}))
+	return err
+}
@@ -0,0 +1,48 @@
+package events
+
+import (
+	"go.uber.org/zap"
+)
+
+const AuditLogPath = "/data/audit/modsec.log"
+
+// Collector tails the audit log and dispatches
+// the normalized security events to the sinks
+type Collector struct {
+	logger      *zap.Logger
+	tailer      *Tailer
+	dispatchers []*dispatcher
+}
+
+func NewCollector(auditLogPath string, log *zap.Logger) *Collector {
+	return &Collector{
+		logger: log,
+		tailer: NewTailer(auditLogPath, log),
+	}
+}
+
+// AddSink registers the sink, must be called before Start
+func (c *Collector) AddSink(sink Sink, filter *Filter) *Collector {
+	c.dispatchers = append(c.dispatchers, newDispatcher(sink, filter, c.logger))
+	return c
+}
+
+func (c *Collector) Start() {
+	c.logger.Info("starting security events collector", zap.Int("sinks", len(c.dispatchers)))
+	c.tailer.Start()
+	for _, d := range c.dispatchers {
+		d.start()
+	}
+	go func() {
+		for line := range c.tailer.Lines() {
+			event, err := Normalize(line)
+			if err != nil {
+				c.logger.Error("failed to normalize audit log entry", zap.Error(err))
+				continue
+			}
+			for _, d := range c.dispatchers {
+				d.dispatch(event)
+			}
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/spf13/viper"
+)
+
+// SinkConfig is a single sink entry of the sinks config file, e.g.
+//
+//	sinks:
+//	  - name: siem
+//	    type: syslog
+//	    minSeverity: warning
+//	    applications: [shop]
+//	    syslog: {network: tcp, address: "siem.local:514"}
+//	  - name: hook
+//	    type: webhook
+//	    webhook: {url: "https://hooks.local/waf", headers: {Authorization: "Bearer ..."}}
+//	  - name: otel
+//	    type: otlp
+//	    otlp: {endpoint: "http://otel-collector:4318"}
+type SinkConfig struct {
+	Name         string   `mapstructure:"name"`
+	Type         string   `mapstructure:"type"`
+	MinSeverity  string   `mapstructure:"minSeverity"`
+	Applications []string `mapstructure:"applications"`
+	Syslog       struct {
+		Network string `mapstructure:"network"`
+		Address string `mapstructure:"address"`
+	} `mapstructure:"syslog"`
+	Webhook struct {
+		Url     string            `mapstructure:"url"`
+		Headers map[string]string `mapstructure:"headers"`
+	} `mapstructure:"webhook"`
+	Otlp struct {
+		Endpoint string            `mapstructure:"endpoint"`
+		Headers  map[string]string `mapstructure:"headers"`
+	} `mapstructure:"otlp"`
+}
+
+// LoadSinksConfig reads the sinks from the config file
+func LoadSinksConfig(path string) ([]*SinkConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read sinks config: %w", err)
+	}
+	var sinks []*SinkConfig
+	if err := v.UnmarshalKey("sinks", &sinks); err != nil {
+		return nil, fmt.Errorf("failed to parse sinks config: %w", err)
+	}
+	return sinks, nil
+}
+
+func (c *SinkConfig) Sink() (Sink, error) {
+	name := c.Name
+	if name == "" {
+		name = c.Type
+	}
+	switch c.Type {
+	case "syslog":
+		return NewSyslogSink(name, c.Syslog.Network, c.Syslog.Address)
+	case "webhook":
+		if c.Webhook.Url == "" {
+			return nil, fmt.Errorf("sink %s: webhook url is required", name)
+		}
+		return NewWebhookSink(name, c.Webhook.Url, c.Webhook.Headers), nil
+	case "otlp":
+		if c.Otlp.Endpoint == "" {
+			return nil, fmt.Errorf("sink %s: otlp endpoint is required", name)
+		}
+		return NewOtlpSink(name, c.Otlp.Endpoint, c.Otlp.Headers), nil
+	default:
+		return nil, fmt.Errorf("sink %s: unsupported sink type %s", name, c.Type)
+	}
+}
+
+func (c *SinkConfig) Filter() (*Filter, error) {
+	f := &Filter{Applications: c.Applications}
+	if c.MinSeverity != "" {
+		severity, ok := wv1.EventSeverity_value["EVENT_SEVERITY_"+strings.ToUpper(c.MinSeverity)]
+		if !ok {
+			return nil, fmt.Errorf("sink %s: unknown severity %s", c.Name, c.MinSeverity)
+		}
+		f.MinSeverity = wv1.EventSeverity(severity)
+	}
+	return f, nil
+}
@@ -0,0 +1,113 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	batchSize      = 100
+	flushInterval  = 5 * time.Second
+	maxBufferSize  = 10000
+	maxRetryPeriod = 30 * time.Second
+	sendTimeout    = 10 * time.Second
+	queueSize      = 1000
+)
+
+var droppedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "events",
+	Name:      "dropped_total",
+	Help:      "Total number of security events dropped by sink, when the sink queue or the buffer is full.",
+}, []string{"sink"})
+
+// dispatcher sends the filtered events in batches to the sink,
+// failed batches are retried with backoff, when the buffer is full
+// the oldest events are dropped
+type dispatcher struct {
+	logger  *zap.Logger
+	sink    Sink
+	filter  *Filter
+	events  chan *wv1.SecurityEvent
+	dropped prometheus.Counter
+}
+
+func newDispatcher(sink Sink, filter *Filter, log *zap.Logger) *dispatcher {
+	return &dispatcher{
+		logger:  log.With(zap.String("sink", sink.Name())),
+		sink:    sink,
+		filter:  filter,
+		events:  make(chan *wv1.SecurityEvent, queueSize),
+		dropped: droppedEvents.WithLabelValues(sink.Name()),
+	}
+}
+
+// dispatch queues the event without blocking,
+// so a slow sink does not stall the audit log tailing and the other sinks.
+// The event is dropped when the sink queue is full
+func (d *dispatcher) dispatch(event *wv1.SecurityEvent) {
+	if !d.filter.Match(event) {
+		return
+	}
+	select {
+	case d.events <- event:
+	default:
+		d.dropped.Inc()
+		d.logger.Debug("events queue is full, dropping event", zap.String("requestId", event.RequestId))
+	}
+}
+
+func (d *dispatcher) start() {
+	go func() {
+		var buffer []*wv1.SecurityEvent
+		retryPeriod := flushInterval
+		timer := time.NewTimer(flushInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case event := <-d.events:
+				buffer = append(buffer, event)
+				if len(buffer) > maxBufferSize {
+					d.logger.Warn("events buffer is full, dropping oldest events",
+						zap.Int("dropped", len(buffer)-maxBufferSize))
+					d.dropped.Add(float64(len(buffer) - maxBufferSize))
+					buffer = buffer[len(buffer)-maxBufferSize:]
+				}
+				if len(buffer) < batchSize || retryPeriod > flushInterval {
+					continue
+				}
+			case <-timer.C:
+			}
+			buffer = d.flush(buffer)
+			if len(buffer) > 0 {
+				retryPeriod = min(retryPeriod*2, maxRetryPeriod)
+			} else {
+				retryPeriod = flushInterval
+			}
+			timer.Reset(retryPeriod)
+		}
+	}()
+}
+
+// flush sends the buffered events and returns the unsent ones
+func (d *dispatcher) flush(buffer []*wv1.SecurityEvent) []*wv1.SecurityEvent {
+	for len(buffer) > 0 {
+		batch := buffer[:min(batchSize, len(buffer))]
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := d.sink.Send(ctx, batch)
+		cancel()
+		if err != nil {
+			d.logger.Error("failed to send security events",
+				zap.Int("pending", len(buffer)), zap.Error(err))
+			return buffer
+		}
+		buffer = buffer[len(batch):]
+	}
+	return nil
+}
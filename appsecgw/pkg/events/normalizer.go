@@ -0,0 +1,99 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// modsecTimeLayout is the ModSecurity JSON audit log time_stamp layout
+const modsecTimeLayout = "Mon Jan _2 15:04:05 2006"
+
+// auditEntry is the ModSecurity JSON audit log entry,
+// extended with the wafie section by the modsecfilter
+type auditEntry struct {
+	Transaction struct {
+		ClientIp  string `json:"client_ip"`
+		TimeStamp string `json:"time_stamp"`
+		Request   struct {
+			Method string `json:"method"`
+			Uri    string `json:"uri"`
+		} `json:"request"`
+		Response struct {
+			HttpCode uint32 `json:"http_code"`
+		} `json:"response"`
+		Messages []struct {
+			Message string `json:"message"`
+			Details struct {
+				RuleId   string `json:"ruleId"`
+				Severity string `json:"severity"`
+			} `json:"details"`
+		} `json:"messages"`
+	} `json:"transaction"`
+	Wafie struct {
+		ProtectionId uint32 `json:"protection_id"`
+		Application  string `json:"application"`
+		RequestId    string `json:"request_id"`
+		Blocked      bool   `json:"blocked"`
+	} `json:"wafie"`
+}
+
+// Normalize converts the audit log line into the security event
+func Normalize(line []byte) (*wv1.SecurityEvent, error) {
+	entry := &auditEntry{}
+	if err := json.Unmarshal(line, entry); err != nil {
+		return nil, fmt.Errorf("malformed audit log entry: %w", err)
+	}
+	tx := entry.Transaction
+	event := &wv1.SecurityEvent{
+		RequestId:    entry.Wafie.RequestId,
+		ProtectionId: entry.Wafie.ProtectionId,
+		Application:  entry.Wafie.Application,
+		ClientIp:     tx.ClientIp,
+		Uri:          tx.Request.Uri,
+		Method:       tx.Request.Method,
+		StatusCode:   tx.Response.HttpCode,
+		Blocked:      entry.Wafie.Blocked,
+		Timestamp:    timestamppb.Now(),
+	}
+	if ts, err := time.ParseInLocation(modsecTimeLayout, tx.TimeStamp, time.Local); err == nil {
+		event.Timestamp = timestamppb.New(ts)
+	}
+	seenRules := map[string]struct{}{}
+	for _, msg := range tx.Messages {
+		if msg.Details.RuleId != "" {
+			if _, ok := seenRules[msg.Details.RuleId]; !ok {
+				seenRules[msg.Details.RuleId] = struct{}{}
+				event.RuleIds = append(event.RuleIds, msg.Details.RuleId)
+			}
+		}
+		if msg.Message != "" {
+			event.Messages = append(event.Messages, msg.Message)
+		}
+		event.Severity = moreSevere(event.Severity, severity(msg.Details.Severity))
+	}
+	return event, nil
+}
+
+// severity maps the ModSecurity severity (0 - emergency, 7 - debug)
+func severity(modsecSeverity string) wv1.EventSeverity {
+	s, err := strconv.Atoi(modsecSeverity)
+	if err != nil || s < 0 || s > 7 {
+		return wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED
+	}
+	return wv1.EventSeverity(s + 1)
+}
+
+func moreSevere(a, b wv1.EventSeverity) wv1.EventSeverity {
+	if a == wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED {
+		return b
+	}
+	if b != wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED && b < a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,35 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	line := `{"transaction":{"client_ip":"10.0.0.1","time_stamp":"Mon Nov 10 18:43:19 2025",` +
+		`"request":{"method":"GET","uri":"/?id=1%27%20or%201=1"},"response":{"http_code":403},` +
+		`"messages":[` +
+		`{"message":"SQL Injection Attack Detected","details":{"ruleId":"942100","severity":"2"}},` +
+		`{"message":"Inbound Anomaly Score Exceeded","details":{"ruleId":"949110","severity":"0"}},` +
+		`{"message":"SQL Injection Attack Detected","details":{"ruleId":"942100","severity":"2"}}]},` +
+		`"wafie":{"protection_id":3,"application":"shop","request_id":"abc","blocked":true}}`
+	event, err := Normalize([]byte(line))
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", event.RequestId)
+	assert.Equal(t, uint32(3), event.ProtectionId)
+	assert.Equal(t, "shop", event.Application)
+	assert.Equal(t, []string{"942100", "949110"}, event.RuleIds)
+	assert.Equal(t, wv1.EventSeverity_EVENT_SEVERITY_EMERGENCY, event.Severity)
+	assert.Equal(t, "10.0.0.1", event.ClientIp)
+	assert.Equal(t, "GET", event.Method)
+	assert.Equal(t, uint32(403), event.StatusCode)
+	assert.True(t, event.Blocked)
+	assert.Len(t, event.Messages, 3)
+	assert.Equal(t, time.Date(2025, 11, 10, 18, 43, 19, 0, time.Local), event.Timestamp.AsTime().In(time.Local))
+
+	_, err = Normalize([]byte("not a json"))
+	assert.NotNil(t, err)
+}
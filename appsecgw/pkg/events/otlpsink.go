@@ -0,0 +1,161 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+)
+
+const otlpServiceName = "wafie-appsecgw"
+
+// OtlpSink exports the events as OTLP log records over HTTP with the JSON encoding
+type OtlpSink struct {
+	name     string
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// the OTLP/JSON logs payload, see opentelemetry-proto logs/v1
+type otlpLogsData struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpString(key, v string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &v}}
+}
+
+func otlpInt(key string, v int64) otlpKeyValue {
+	s := strconv.FormatInt(v, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func otlpBool(key string, v bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &v}}
+}
+
+// NewOtlpSink creates the sink, the logs are posted to <endpoint>/v1/logs
+func NewOtlpSink(name, endpoint string, headers map[string]string) *OtlpSink {
+	return &OtlpSink{
+		name:     name,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/logs",
+		headers:  headers,
+		client:   http.DefaultClient,
+	}
+}
+
+func (s *OtlpSink) Name() string {
+	return s.name
+}
+
+func (s *OtlpSink) Send(ctx context.Context, events []*wv1.SecurityEvent) error {
+	records := make([]otlpLogRecord, 0, len(events))
+	for _, event := range events {
+		records = append(records, otlpRecord(event))
+	}
+	body, err := json.Marshal(&otlpLogsData{
+		ResourceLogs: []otlpResourceLogs{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{
+				otlpString("service.name", otlpServiceName),
+			}},
+			ScopeLogs: []otlpScopeLogs{{
+				Scope:      otlpScope{Name: "wafie.events"},
+				LogRecords: records,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJson(ctx, s.client, s.endpoint, s.headers, body)
+}
+
+func otlpRecord(event *wv1.SecurityEvent) otlpLogRecord {
+	body := "WAF event"
+	if len(event.Messages) > 0 {
+		body = strings.Join(event.Messages, "; ")
+	}
+	severityNumber, severityText := otlpSeverity(event.Severity)
+	return otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(event.Timestamp.AsTime().UnixNano(), 10),
+		SeverityNumber: severityNumber,
+		SeverityText:   severityText,
+		Body:           otlpAnyValue{StringValue: &body},
+		Attributes: []otlpKeyValue{
+			otlpString("wafie.request_id", event.RequestId),
+			otlpInt("wafie.protection_id", int64(event.ProtectionId)),
+			otlpString("wafie.application", event.Application),
+			otlpString("wafie.rule_ids", strings.Join(event.RuleIds, ",")),
+			otlpBool("wafie.blocked", event.Blocked),
+			otlpString("client.address", event.ClientIp),
+			otlpString("url.full", event.Uri),
+			otlpString("http.request.method", event.Method),
+			otlpInt("http.response.status_code", int64(event.StatusCode)),
+		},
+	}
+}
+
+// otlpSeverity maps the severity into the OpenTelemetry severity number
+func otlpSeverity(severity wv1.EventSeverity) (int, string) {
+	switch severity {
+	case wv1.EventSeverity_EVENT_SEVERITY_EMERGENCY:
+		return 24, "FATAL4"
+	case wv1.EventSeverity_EVENT_SEVERITY_ALERT:
+		return 22, "FATAL2"
+	case wv1.EventSeverity_EVENT_SEVERITY_CRITICAL:
+		return 21, "FATAL"
+	case wv1.EventSeverity_EVENT_SEVERITY_ERROR:
+		return 17, "ERROR"
+	case wv1.EventSeverity_EVENT_SEVERITY_WARNING:
+		return 13, "WARN"
+	case wv1.EventSeverity_EVENT_SEVERITY_NOTICE:
+		return 10, "INFO2"
+	case wv1.EventSeverity_EVENT_SEVERITY_INFO:
+		return 9, "INFO"
+	case wv1.EventSeverity_EVENT_SEVERITY_DEBUG:
+		return 5, "DEBUG"
+	default:
+		return 0, ""
+	}
+}
@@ -0,0 +1,36 @@
+package events
+
+import (
+	"context"
+	"slices"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+)
+
+// Sink exports the security events batches
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, events []*wv1.SecurityEvent) error
+}
+
+// Filter selects the events exported by a sink
+type Filter struct {
+	// events with the same or more severe severity,
+	// unspecified matches all the events
+	MinSeverity  wv1.EventSeverity
+	Applications []string
+}
+
+func (f *Filter) Match(event *wv1.SecurityEvent) bool {
+	if f == nil {
+		return true
+	}
+	if f.MinSeverity != wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED &&
+		(event.Severity == wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED || event.Severity > f.MinSeverity) {
+		return false
+	}
+	if len(f.Applications) > 0 && !slices.Contains(f.Applications, event.Application) {
+		return false
+	}
+	return true
+}
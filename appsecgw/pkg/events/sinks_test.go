@@ -0,0 +1,175 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	applogger "github.com/Dimss/wafie/logger"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testEvent() *wv1.SecurityEvent {
+	return &wv1.SecurityEvent{
+		RequestId:    "req-1",
+		ProtectionId: 3,
+		Application:  "shop",
+		RuleIds:      []string{"942100", "949110"},
+		Severity:     wv1.EventSeverity_EVENT_SEVERITY_CRITICAL,
+		ClientIp:     "10.0.0.1",
+		Uri:          "/search?q=a=b",
+		Method:       "GET",
+		StatusCode:   403,
+		Blocked:      true,
+		Messages:     []string{"SQL Injection | Attack Detected"},
+		Timestamp:    timestamppb.New(time.Unix(1700000000, 0)),
+	}
+}
+
+func TestCEF(t *testing.T) {
+	assert.Equal(t,
+		`CEF:0|Wafie|AppSecGateway|1.0|942100|SQL Injection \| Attack Detected|9|`+
+			`rt=1700000000000 src=10.0.0.1 request=/search?q\=a\=b requestMethod=GET act=blocked `+
+			`cn1Label=protectionId cn1=3 cs1Label=application cs1=shop cs2Label=ruleIds cs2=942100,949110 `+
+			`cs3Label=requestId cs3=req-1`,
+		CEF(testEvent()))
+}
+
+func TestSyslogSinkTcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// octet counting framing
+		size, _ := r.ReadString(' ')
+		n, _ := strconv.Atoi(strings.TrimSpace(size))
+		msg := make([]byte, n)
+		io.ReadFull(r, msg)
+		received <- string(msg)
+	}()
+	sink, err := NewSyslogSink("siem", "tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Send(context.Background(), []*wv1.SecurityEvent{testEvent()}))
+	msg := <-received
+	// local0 (16) * 8 + critical (2)
+	assert.True(t, strings.HasPrefix(msg, "<130>1 2023-11-14T22:13:20Z "), msg)
+	assert.True(t, strings.HasSuffix(msg, CEF(testEvent())), msg)
+}
+
+func TestSyslogSinkUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	sink, err := NewSyslogSink("siem", "udp", conn.LocalAddr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Send(context.Background(), []*wv1.SecurityEvent{testEvent(), testEvent()}))
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(buf[:n]), "<130>1 "))
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var batches [][]map[string]interface{}
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&batch))
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+	sink := NewWebhookSink("hook", srv.URL, map[string]string{"Authorization": "Bearer token"})
+	events := []*wv1.SecurityEvent{testEvent(), testEvent()}
+	assert.NotNil(t, sink.Send(context.Background(), events))
+	// the dispatcher retries the failed batch
+	d := newDispatcher(sink, nil, applogger.NewLogger())
+	assert.Empty(t, d.flush(events))
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 2)
+	assert.Equal(t, "shop", batches[0][0]["application"])
+}
+
+func TestDispatchQueueFull(t *testing.T) {
+	sink := NewWebhookSink("stalled", "http://127.0.0.1:0", nil)
+	d := newDispatcher(sink, nil, applogger.NewLogger())
+	// the dispatcher is not started, so the queue is never drained
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < queueSize+10; i++ {
+			d.dispatch(testEvent())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch blocked on the full queue")
+	}
+	assert.Len(t, d.events, queueSize)
+	assert.Equal(t, float64(10), testutil.ToFloat64(d.dropped))
+}
+
+func TestOtlpSink(t *testing.T) {
+	var payload otlpLogsData
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	defer srv.Close()
+	sink := NewOtlpSink("otel", srv.URL+"/", nil)
+	assert.Nil(t, sink.Send(context.Background(), []*wv1.SecurityEvent{testEvent()}))
+	assert.Len(t, payload.ResourceLogs, 1)
+	records := payload.ResourceLogs[0].ScopeLogs[0].LogRecords
+	assert.Len(t, records, 1)
+	assert.Equal(t, "1700000000000000000", records[0].TimeUnixNano)
+	assert.Equal(t, 21, records[0].SeverityNumber)
+	assert.Equal(t, "SQL Injection | Attack Detected", *records[0].Body.StringValue)
+}
+
+func TestFilter(t *testing.T) {
+	event := testEvent()
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   bool
+	}{
+		{name: "no filter", filter: nil, want: true},
+		{name: "more severe", filter: &Filter{MinSeverity: wv1.EventSeverity_EVENT_SEVERITY_WARNING}, want: true},
+		{name: "less severe", filter: &Filter{MinSeverity: wv1.EventSeverity_EVENT_SEVERITY_ALERT}, want: false},
+		{name: "application", filter: &Filter{Applications: []string{"shop"}}, want: true},
+		{name: "other application", filter: &Filter{Applications: []string{"blog"}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(event))
+		})
+	}
+}
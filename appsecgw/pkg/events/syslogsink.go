@@ -0,0 +1,158 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+)
+
+const (
+	// local0 facility
+	syslogFacility = 16
+	cefVendor      = "Wafie"
+	cefProduct     = "AppSecGateway"
+	cefVersion     = "1.0"
+)
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// SyslogSink sends the events as RFC 5424 messages in the CEF format,
+// TCP messages are framed with the octet counting (RFC 6587)
+type SyslogSink struct {
+	name     string
+	network  string
+	address  string
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+func NewSyslogSink(name, network, address string) (*SyslogSink, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("unsupported syslog network %s", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &SyslogSink{name: name, network: network, address: address, hostname: hostname}, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return s.name
+}
+
+func (s *SyslogSink) Send(ctx context.Context, events []*wv1.SecurityEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, s.network, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	for i, event := range events {
+		msg := s.message(event)
+		if s.network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			// reconnect on the next batch, the whole batch is retried
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("failed to send event %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// message formats the RFC 5424 message
+func (s *SyslogSink) message(event *wv1.SecurityEvent) string {
+	return fmt.Sprintf("<%d>1 %s %s wafie-appsecgw - waf - %s",
+		syslogFacility*8+syslogSeverity(event.Severity),
+		event.Timestamp.AsTime().UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		CEF(event),
+	)
+}
+
+// CEF formats the event in the ArcSight Common Event Format
+func CEF(event *wv1.SecurityEvent) string {
+	signatureId, name := "0", "WAF event"
+	if len(event.RuleIds) > 0 {
+		signatureId = event.RuleIds[0]
+	}
+	if len(event.Messages) > 0 {
+		name = event.Messages[0]
+	}
+	act := "detected"
+	if event.Blocked {
+		act = "blocked"
+	}
+	ext := []string{
+		"rt=" + fmt.Sprint(event.Timestamp.AsTime().UnixMilli()),
+		"src=" + cefExtensionEscaper.Replace(event.ClientIp),
+		"request=" + cefExtensionEscaper.Replace(event.Uri),
+		"requestMethod=" + cefExtensionEscaper.Replace(event.Method),
+		"act=" + act,
+		"cn1Label=protectionId",
+		"cn1=" + fmt.Sprint(event.ProtectionId),
+		"cs1Label=application",
+		"cs1=" + cefExtensionEscaper.Replace(event.Application),
+		"cs2Label=ruleIds",
+		"cs2=" + cefExtensionEscaper.Replace(strings.Join(event.RuleIds, ",")),
+		"cs3Label=requestId",
+		"cs3=" + cefExtensionEscaper.Replace(event.RequestId),
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefVendor,
+		cefProduct,
+		cefVersion,
+		cefHeaderEscaper.Replace(signatureId),
+		cefHeaderEscaper.Replace(name),
+		cefSeverity(event.Severity),
+		strings.Join(ext, " "),
+	)
+}
+
+// syslogSeverity maps back to the ModSecurity (syslog) severity
+func syslogSeverity(severity wv1.EventSeverity) int {
+	if severity == wv1.EventSeverity_EVENT_SEVERITY_UNSPECIFIED {
+		return 6 // informational
+	}
+	return int(severity) - 1
+}
+
+// cefSeverity maps the severity into the CEF 0-10 scale
+func cefSeverity(severity wv1.EventSeverity) int {
+	switch severity {
+	case wv1.EventSeverity_EVENT_SEVERITY_EMERGENCY, wv1.EventSeverity_EVENT_SEVERITY_ALERT:
+		return 10
+	case wv1.EventSeverity_EVENT_SEVERITY_CRITICAL:
+		return 9
+	case wv1.EventSeverity_EVENT_SEVERITY_ERROR:
+		return 7
+	case wv1.EventSeverity_EVENT_SEVERITY_WARNING:
+		return 5
+	case wv1.EventSeverity_EVENT_SEVERITY_NOTICE:
+		return 3
+	case wv1.EventSeverity_EVENT_SEVERITY_INFO:
+		return 1
+	default:
+		return 0
+	}
+}
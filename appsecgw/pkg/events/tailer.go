@@ -0,0 +1,125 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const tailPollInterval = time.Second
+
+// Tailer follows the audit log file, handling rotation and truncation
+type Tailer struct {
+	path   string
+	logger *zap.Logger
+	lines  chan []byte
+}
+
+func NewTailer(path string, log *zap.Logger) *Tailer {
+	return &Tailer{
+		path:   path,
+		logger: log,
+		lines:  make(chan []byte, 1000),
+	}
+}
+
+func (t *Tailer) Lines() <-chan []byte {
+	return t.lines
+}
+
+func (t *Tailer) Start() {
+	go func() {
+		// only new entries are shipped on start
+		fromStart := false
+		for {
+			if err := t.follow(fromStart); err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.logger.Error("error tailing audit log", zap.String("path", t.path), zap.Error(err))
+			}
+			// any file opened after the first one is a rotated one
+			fromStart = true
+			time.Sleep(tailPollInterval)
+		}
+	}()
+}
+
+// follow reads the current file until it's rotated
+func (t *Tailer) follow(fromStart bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset := int64(0)
+	if !fromStart {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	t.logger.Info("tailing audit log", zap.String("path", t.path), zap.Int64("offset", offset))
+	reader := bufio.NewReader(f)
+	var partial []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if err == nil {
+			line = append(partial, line...)
+			partial = nil
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				t.lines <- line
+			}
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		partial = append(partial, line...)
+		time.Sleep(tailPollInterval)
+		rotated, truncated, err := t.changed(f, offset)
+		if err != nil {
+			return err
+		}
+		if rotated {
+			// drain the leftovers of the rotated file
+			if rest, _ := io.ReadAll(reader); len(rest) > 0 {
+				for _, l := range bytes.Split(append(partial, rest...), []byte("\n")) {
+					if l = bytes.TrimSpace(l); len(l) > 0 {
+						t.lines <- l
+					}
+				}
+			}
+			return nil
+		}
+		if truncated {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+			partial = nil
+			reader.Reset(f)
+		}
+	}
+}
+
+func (t *Tailer) changed(f *os.File, offset int64) (rotated, truncated bool, err error) {
+	current, err := f.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	latest, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// wait for the new file to be created
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if !os.SameFile(current, latest) {
+		return true, false, nil
+	}
+	return false, current.Size() < offset, nil
+}
@@ -0,0 +1,46 @@
+package events
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	applogger "github.com/Dimss/wafie/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func nextLine(t *testing.T, tailer *Tailer) string {
+	select {
+	case line := <-tailer.Lines():
+		return string(line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the audit log line")
+	}
+	return ""
+}
+
+func TestTailerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "modsec.log")
+	assert.Nil(t, os.WriteFile(path, []byte("old\n"), 0o644))
+	tailer := NewTailer(path, applogger.NewLogger())
+	tailer.Start()
+	time.Sleep(2 * tailPollInterval)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.Nil(t, err)
+	_, err = f.WriteString("first\nsec")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", nextLine(t, tailer))
+	_, err = f.WriteString("ond\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", nextLine(t, tailer))
+	// rotate the log the way lumberjack does
+	_, err = f.WriteString("third\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, os.WriteFile(path, []byte("fourth\n"), 0o644))
+	assert.Equal(t, "third", nextLine(t, tailer))
+	assert.Equal(t, "fourth", nextLine(t, tailer))
+}
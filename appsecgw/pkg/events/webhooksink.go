@@ -0,0 +1,66 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// WebhookSink posts the events batch as a JSON array
+type WebhookSink struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookSink(name, url string, headers map[string]string) *WebhookSink {
+	return &WebhookSink{name: name, url: url, headers: headers, client: http.DefaultClient}
+}
+
+func (s *WebhookSink) Name() string {
+	return s.name
+}
+
+func (s *WebhookSink) Send(ctx context.Context, events []*wv1.SecurityEvent) error {
+	batch := make([]json.RawMessage, 0, len(events))
+	for _, event := range events {
+		e, err := protojson.Marshal(event)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, e)
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return postJson(ctx, s.client, s.url, s.headers, body)
+}
+
+func postJson(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package gatewaysrv
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"buf.build/go/protovalidate"
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	"github.com/Dimss/wafie/tracing"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	traceRetention = 24 * time.Hour
+	peerTimeout    = 10 * time.Second
+	// TokenEnv is the env variable holding the gateway API bearer token,
+	// the API exposes the debug traces and the rendered config, so all the requests are rejected when unset
+	TokenEnv = "WAFIE_GATEWAY_API_TOKEN"
+)
+
+// ControlPlane renders the envoy resources served to the gateway nodes
+type ControlPlane interface {
+	RenderedConfig(ctx context.Context, applicationId uint32) (*wv1.GetRenderedConfigResponse, error)
+	DiffSnapshot(ctx context.Context, req *wv1.PutProtectionRequest) (*wv1.DiffSnapshotResponse, error)
+}
+
+type Server struct {
+	wafiev1connect.UnimplementedGatewayServiceHandler
+	logger       *zap.Logger
+	listenAddr   string
+	traceDir     string
+	token        string
+	controlPlane ControlPlane
+	// podIp is the address of the gateway, the traces held by the other gateways are fetched from them
+	podIp string
+	// peers is the headless service of all the gateways,
+	// the trace requests are forwarded to its addresses only, so the token is never sent elsewhere
+	peers      string
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	peerClient *http.Client
+}
+
+func NewGatewayServer(listenAddr, token string, controlPlane ControlPlane, log *zap.Logger) *Server {
+	return &Server{
+		logger:       log,
+		listenAddr:   listenAddr,
+		traceDir:     debugtrace.DefaultTraceDir,
+		token:        token,
+		controlPlane: controlPlane,
+		lookupHost:   net.DefaultResolver.LookupHost,
+		peerClient:   &http.Client{Timeout: peerTimeout},
+	}
+}
+
+// WithPeers enables the debug trace requests forwarding to the gateway holding the trace
+func (s *Server) WithPeers(podIp, peers string) *Server {
+	s.podIp = podIp
+	s.peers = peers
+	return s
+}
+
+func (s *Server) Serve() {
+	if err := os.MkdirAll(s.traceDir, 0o755); err != nil {
+		s.logger.Error("failed to create debug trace directory", zap.Error(err))
+	}
+	s.startTraceCleanup()
+	if s.token == "" {
+		s.logger.Warn("gateway api token is not set, all the gateway api requests are rejected",
+			zap.String("env", TokenEnv))
+	}
+	go func() {
+		s.logger.Info("starting gateway server", zap.String("address", s.listenAddr))
+		if err := http.ListenAndServe(s.listenAddr, h2c.NewHandler(s.handler(), &http2.Server{})); err != nil {
+			s.logger.Error("failed to start gateway server", zap.Error(err))
+		}
+	}()
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(wafiev1connect.NewGatewayServiceHandler(s,
+		connect.WithInterceptors(newAuthInterceptor(s.token)),
+		tracing.HandlerOption(),
+	))
+	return mux
+}
+
+// newAuthInterceptor requires the Authorization: Bearer <token> header on all the requests
+func newAuthInterceptor(token string) connect.Interceptor {
+	return connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			bearer, ok := strings.CutPrefix(req.Header().Get("Authorization"), "Bearer ")
+			if token == "" || !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid gateway api token"))
+			}
+			return next(ctx, req)
+		}
+	})
+}
+
+func (s *Server) GetDebugTrace(
+	ctx context.Context,
+	req *connect.Request[wv1.GetDebugTraceRequest]) (
+	*connect.Response[wv1.GetDebugTraceResponse], error) {
+	if err := protovalidate.Validate(req.Msg); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if gateway := net.ParseIP(req.Msg.Gateway); gateway != nil && !gateway.Equal(net.ParseIP(s.podIp)) {
+		return s.peerDebugTrace(ctx, req, gateway)
+	}
+	trace, err := os.ReadFile(debugtrace.TracePath(s.traceDir, req.Msg.RequestId))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, connect.NewError(connect.CodeNotFound,
+				fmt.Errorf("debug trace for request %s not found", req.Msg.RequestId))
+		}
+		s.logger.Error("error reading debug trace", zap.Error(err))
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(&wv1.GetDebugTraceResponse{
+		RequestId: req.Msg.RequestId,
+		Trace:     string(trace),
+	}), nil
+}
+
+// peerDebugTrace fetches the trace from the gateway holding it,
+// the gateway must be one of the peers service addresses
+func (s *Server) peerDebugTrace(
+	ctx context.Context,
+	req *connect.Request[wv1.GetDebugTraceRequest],
+	gateway net.IP) (
+	*connect.Response[wv1.GetDebugTraceResponse], error) {
+	if s.peers == "" {
+		return nil, connect.NewError(connect.CodeFailedPrecondition,
+			fmt.Errorf("gateway peers are not configured, the trace of gateway %s can't be fetched", gateway))
+	}
+	addrs, err := s.lookupHost(ctx, s.peers)
+	if err != nil {
+		s.logger.Error("error resolving gateway peers", zap.String("peers", s.peers), zap.Error(err))
+		return nil, connect.NewError(connect.CodeUnavailable, err)
+	}
+	if !containsIP(addrs, gateway) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("gateway %s not found", gateway))
+	}
+	_, port, err := net.SplitHostPort(s.listenAddr)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	client := wafiev1connect.NewGatewayServiceClient(s.peerClient,
+		"http://"+net.JoinHostPort(gateway.String(), port), tracing.ClientOption())
+	// the peer reads the trace locally
+	peerReq := connect.NewRequest(&wv1.GetDebugTraceRequest{RequestId: req.Msg.RequestId})
+	peerReq.Header().Set("Authorization", req.Header().Get("Authorization"))
+	resp, err := client.GetDebugTrace(ctx, peerReq)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(resp.Msg), nil
+}
+
+func containsIP(addrs []string, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) GetRenderedConfig(
+	ctx context.Context,
+	req *connect.Request[wv1.GetRenderedConfigRequest]) (
+	*connect.Response[wv1.GetRenderedConfigResponse], error) {
+	if err := protovalidate.Validate(req.Msg); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	renderedConfig, err := s.controlPlane.RenderedConfig(ctx, req.Msg.ApplicationId)
+	if err != nil {
+		s.logger.Error("error rendering application config",
+			zap.Uint32("applicationId", req.Msg.ApplicationId), zap.Error(err))
+		return nil, err
+	}
+	return connect.NewResponse(renderedConfig), nil
+}
+
+// DiffSnapshot is a dry-run of the protection update,
+// the proposed resources are neither persisted nor served to the gateway nodes
+func (s *Server) DiffSnapshot(
+	ctx context.Context,
+	req *connect.Request[wv1.DiffSnapshotRequest]) (
+	*connect.Response[wv1.DiffSnapshotResponse], error) {
+	if err := protovalidate.Validate(req.Msg); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	diff, err := s.controlPlane.DiffSnapshot(ctx, req.Msg.Protection)
+	if err != nil {
+		s.logger.Error("error diffing snapshot",
+			zap.Uint32("protectionId", req.Msg.Protection.Id), zap.Error(err))
+		return nil, err
+	}
+	return connect.NewResponse(diff), nil
+}
+
+// startTraceCleanup removes the debug traces older than the retention period
+func (s *Server) startTraceCleanup() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			traces, err := filepath.Glob(filepath.Join(s.traceDir, "*.log"))
+			if err != nil {
+				s.logger.Error("error listing debug traces", zap.Error(err))
+				continue
+			}
+			for _, trace := range traces {
+				info, err := os.Stat(trace)
+				if err != nil || time.Since(info.ModTime()) < traceRetention {
+					continue
+				}
+				if err := os.Remove(trace); err != nil {
+					s.logger.Error("error removing debug trace", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
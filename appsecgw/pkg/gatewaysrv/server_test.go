@@ -0,0 +1,109 @@
+package gatewaysrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"connectrpc.com/connect"
+	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
+	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	applogger "github.com/Dimss/wafie/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthInterceptor(t *testing.T) {
+	traceDir := t.TempDir()
+	require.NoError(t, os.WriteFile(debugtrace.TracePath(traceDir, "req-1"), []byte("trace"), 0o600))
+	tests := []struct {
+		name     string
+		token    string
+		bearer   string
+		wantCode connect.Code
+	}{
+		{name: "valid token", token: "secret", bearer: "secret"},
+		{name: "invalid token", token: "secret", bearer: "other", wantCode: connect.CodeUnauthenticated},
+		{name: "missing token", token: "secret", wantCode: connect.CodeUnauthenticated},
+		{name: "token not configured", bearer: "", wantCode: connect.CodeUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewGatewayServer(":0", tt.token, nil, applogger.NewLogger())
+			s.traceDir = traceDir
+			srv := httptest.NewServer(s.handler())
+			defer srv.Close()
+			client := wafiev1connect.NewGatewayServiceClient(http.DefaultClient, srv.URL)
+			req := connect.NewRequest(&wv1.GetDebugTraceRequest{RequestId: "req-1"})
+			if tt.bearer != "" {
+				req.Header().Set("Authorization", "Bearer "+tt.bearer)
+			}
+			resp, err := client.GetDebugTrace(context.Background(), req)
+			if tt.wantCode != 0 {
+				assert.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "trace", resp.Msg.Trace)
+		})
+	}
+}
+
+func TestAuthInterceptorControlPlaneRpcs(t *testing.T) {
+	// the control plane is never reached without the token
+	s := NewGatewayServer(":0", "secret", nil, applogger.NewLogger())
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	client := wafiev1connect.NewGatewayServiceClient(http.DefaultClient, srv.URL)
+	_, err := client.GetRenderedConfig(context.Background(),
+		connect.NewRequest(&wv1.GetRenderedConfigRequest{ApplicationId: 1}))
+	assert.Equal(t, connect.CodeUnauthenticated, connect.CodeOf(err))
+	_, err = client.DiffSnapshot(context.Background(),
+		connect.NewRequest(&wv1.DiffSnapshotRequest{Protection: &wv1.PutProtectionRequest{Id: 1}}))
+	assert.Equal(t, connect.CodeUnauthenticated, connect.CodeOf(err))
+}
+
+func TestGetDebugTracePeer(t *testing.T) {
+	traceDir := t.TempDir()
+	require.NoError(t, os.WriteFile(debugtrace.TracePath(traceDir, "req-1"), []byte("peer trace"), 0o600))
+	peer := NewGatewayServer(":0", "secret", nil, applogger.NewLogger()).WithPeers("127.0.0.1", "appsecgw-peers")
+	peer.traceDir = traceDir
+	peerSrv := httptest.NewServer(peer.handler())
+	defer peerSrv.Close()
+	_, peerPort, err := net.SplitHostPort(strings.TrimPrefix(peerSrv.URL, "http://"))
+	require.NoError(t, err)
+
+	// the gateway serving the call holds no traces, it listens on the same port as its peers
+	s := NewGatewayServer(":"+peerPort, "secret", nil, applogger.NewLogger()).WithPeers("10.0.0.1", "appsecgw-peers")
+	s.traceDir = t.TempDir()
+	s.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1", "127.0.0.1"}, nil
+	}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	client := wafiev1connect.NewGatewayServiceClient(http.DefaultClient, srv.URL)
+	getTrace := func(gateway string) (*connect.Response[wv1.GetDebugTraceResponse], error) {
+		req := connect.NewRequest(&wv1.GetDebugTraceRequest{RequestId: "req-1", Gateway: gateway})
+		req.Header().Set("Authorization", "Bearer secret")
+		return client.GetDebugTrace(context.Background(), req)
+	}
+
+	resp, err := getTrace("127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, "peer trace", resp.Msg.Trace)
+	// the trace is read locally when the gateway is the serving one or not set
+	_, err = getTrace("10.0.0.1")
+	assert.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+	_, err = getTrace("")
+	assert.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+	// the request is never forwarded out of the peers
+	_, err = getTrace("192.168.0.1")
+	assert.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+	_, err = getTrace("not-an-ip")
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
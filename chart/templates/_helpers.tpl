@@ -0,0 +1,19 @@
+{{/*
+Gateway group deployment and service name,
+the default group keeps the appsecgw name
+*/}}
+{{- define "wafie.appsecgwName" -}}
+{{- if eq . "default" -}}
+appsecgw
+{{- else -}}
+appsecgw-{{ . }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Comma separated namespaces of the watched ingress tls secrets,
+the release namespace when none are configured
+*/}}
+{{- define "wafie.tlsSecretNamespaces" -}}
+{{- .Values.appSecGw.tlsSecretNamespaces | default (list .Release.Namespace) | uniq | join "," -}}
+{{- end -}}
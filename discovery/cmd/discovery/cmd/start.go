@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -10,6 +11,7 @@ import (
 	"github.com/Dimss/wafie/discovery/pkg/discovery/endpointslice"
 	"github.com/Dimss/wafie/discovery/pkg/discovery/ingress"
 	applogger "github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -26,8 +28,12 @@ func init() {
 			ingress.RouteIngressType),
 	)
 	startCmd.PersistentFlags().StringP("api-addr", "a", "http://localhost:8080", "API address")
+	startCmd.PersistentFlags().StringP("tracing-exporter", "", tracing.ExporterNone, "Tracing exporter, one of none|otlp|stdout")
+	startCmd.PersistentFlags().StringP("tracing-endpoint", "", "", "OTLP HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces")
 	viper.BindPFlag("ingress-type", startCmd.PersistentFlags().Lookup("ingress-type"))
 	viper.BindPFlag("api-addr", startCmd.PersistentFlags().Lookup("api-addr"))
+	viper.BindPFlag("tracing-exporter", startCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-endpoint", startCmd.PersistentFlags().Lookup("tracing-endpoint"))
 	rootCmd.AddCommand(startCmd)
 }
 
@@ -35,6 +41,11 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "start wafie discovery agent",
 	Run: func(cmd *cobra.Command, args []string) {
+		shutdownTracing, err := tracing.Init("wafie-discovery-agent",
+			viper.GetString("tracing-exporter"), viper.GetString("tracing-endpoint"), applogger.NewLogger())
+		if err != nil {
+			zap.S().Fatalf("failed to initialize tracing: %s", err)
+		}
 		// start health check server
 		hsrv.NewHealthCheckServer(
 			":8081", viper.GetString("api-addr"),
@@ -57,6 +68,7 @@ var startCmd = &cobra.Command{
 			select {
 			case s := <-sigCh:
 				zap.S().Infof("signal: %s, shutting down", s)
+				shutdownTracing(context.Background())
 				zap.S().Info("bye bye 👋")
 				os.Exit(0)
 			}
@@ -10,6 +10,11 @@ import (
 	"connectrpc.com/connect"
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/discovery/pkg/discovery"
+	"github.com/Dimss/wafie/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/client-go/informers"
@@ -34,6 +39,7 @@ func NewCache(apiAddr string, logger *zap.Logger) *Cache {
 		routeSvcClient: v1.NewRouteServiceClient(
 			http.DefaultClient,
 			apiAddr,
+			tracing.ClientOption(),
 		),
 		logger: logger,
 	}
@@ -64,11 +70,17 @@ func (c *Cache) RunUpstreamIPsSyncer() {
 						Endpoints: c.endpoints(eps),
 					},
 				}
+				ctx, span := tracing.Tracer().Start(context.Background(), "discovery.UpdateRoute",
+					trace.WithAttributes(attribute.String("wafie.svc_fqdn", svcFqdn)))
 				if _, err := c.routeSvcClient.UpdateRoute(
-					context.Background(),
+					ctx,
 					connect.NewRequest(req)); err != nil {
+					discovery.RouteFailures.WithLabelValues("update").Inc()
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
 					c.logger.Info("update route failed", zap.Error(err))
 				}
+				span.End()
 				c.logger.Info("endpoints were updated", zap.String("svcFqdn", svcFqdn))
 
 			case c.svcFqdnCache = <-c.svcFqdnCacheUpdaterCh:
@@ -153,13 +165,16 @@ func (c *Cache) RunInformer() {
 				AddEventHandler(
 					cache.ResourceEventHandlerFuncs{
 						AddFunc: func(obj interface{}) {
+							discovery.InformerEvents.WithLabelValues("endpointslice", "add").Inc()
 							c.EpsCh <- obj.(*discoveryv1.EndpointSlice)
 						},
 						UpdateFunc: func(oldObj, newObj interface{}) {
+							discovery.InformerEvents.WithLabelValues("endpointslice", "update").Inc()
 							c.EpsCh <- newObj.(*discoveryv1.EndpointSlice)
 						},
 						DeleteFunc: func(obj interface{}) {
 							// TODO: implement delete logic
+							discovery.InformerEvents.WithLabelValues("endpointslice", "delete").Inc()
 							eps := obj.(*discoveryv1.EndpointSlice)
 							serviceName := eps.Labels["kubernetes.io/service-name"]
 							fmt.Printf("EndpointSlice deleted for service %s\n", serviceName)
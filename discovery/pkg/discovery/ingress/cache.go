@@ -7,6 +7,11 @@ import (
 
 	"connectrpc.com/connect"
 	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/discovery/pkg/discovery"
+	"github.com/Dimss/wafie/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -50,6 +55,7 @@ func NewIngressCache(ingressType IngressType, apiAddr string, logger *zap.Logger
 		routeSvcClient: v1.NewRouteServiceClient(
 			http.DefaultClient,
 			apiAddr,
+			tracing.ClientOption(),
 		),
 	}
 	return cache
@@ -86,6 +92,7 @@ func (c *Cache) Run() {
 			}
 			r, err := genericInformer.Informer().AddEventHandler(cache2.ResourceEventHandlerFuncs{
 				AddFunc: func(obj interface{}) {
+					discovery.InformerEvents.WithLabelValues(c.ingressType, "add").Inc()
 					unstructuredIngress := obj.(*unstructured.Unstructured)
 					if err := c.createUpstream(unstructuredIngress); err != nil {
 						l.With(
@@ -95,6 +102,7 @@ func (c *Cache) Run() {
 					}
 				},
 				UpdateFunc: func(oldObj, newObj interface{}) {
+					discovery.InformerEvents.WithLabelValues(c.ingressType, "update").Inc()
 					unstructuredIngress := newObj.(*unstructured.Unstructured)
 					if err := c.createUpstream(unstructuredIngress); err != nil {
 						l.With(
@@ -105,6 +113,7 @@ func (c *Cache) Run() {
 					}
 				},
 				DeleteFunc: func(obj interface{}) {
+					discovery.InformerEvents.WithLabelValues(c.ingressType, "delete").Inc()
 					l.Info("deleted ingress", zap.Any("object", obj))
 				},
 			})
@@ -123,10 +132,22 @@ func (c *Cache) createUpstream(obj *unstructured.Unstructured) error {
 	if req == nil {
 		return nil
 	}
+	ctx, span := tracing.Tracer().Start(context.Background(), "discovery.CreateRoute",
+		trace.WithAttributes(
+			attribute.String("k8s.namespace.name", obj.GetNamespace()),
+			attribute.String("wafie.ingress", obj.GetName()),
+		),
+	)
+	defer span.End()
 	_, upstreamCreateErr := c.routeSvcClient.CreateRoute(
-		context.Background(),
+		ctx,
 		connect.NewRequest(req),
 	)
+	if upstreamCreateErr != nil {
+		discovery.RouteFailures.WithLabelValues("create").Inc()
+		span.RecordError(upstreamCreateErr)
+		span.SetStatus(codes.Error, upstreamCreateErr.Error())
+	}
 	return errors.Join(normalizerErr, upstreamCreateErr)
 
 }
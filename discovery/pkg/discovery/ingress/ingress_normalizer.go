@@ -2,6 +2,7 @@ package ingress
 
 import (
 	"fmt"
+	"strings"
 
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	applogger "github.com/Dimss/wafie/logger"
@@ -66,6 +67,11 @@ func (i *ingress) normalize(obj *unstructured.Unstructured) (createRouteReq *wv1
 			IngressType:     wv1.IngressType_INGRESS_TYPE_NGINX,
 			DiscoveryStatus: wv1.DiscoveryStatusType_DISCOVERY_STATUS_TYPE_SUCCESS,
 		}
+		// set the tls secret of the ingress host, the port is switched to 443 for the TLS host only
+		if secretName := tlsSecretName(k8sIngress, createRouteReq.Ingress.Host); secretName != "" {
+			createRouteReq.Ingress.Port = 443
+			createRouteReq.Ingress.TlsSecretName = secretName
+		}
 		// set upstream service fqdn
 		createRouteReq.Upstream.SvcFqdn = fmt.Sprintf("%s.%s.svc",
 			k8sIngress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name,
@@ -74,6 +80,8 @@ func (i *ingress) normalize(obj *unstructured.Unstructured) (createRouteReq *wv1
 		if err := i.discoverSvcPorts(k8sIngress, &createRouteReq.Ports); err != nil {
 			return i.normalizedWithError(createRouteReq, err)
 		}
+		// set upstream protocol defaults
+		i.discoverProtocolOptions(k8sIngress, createRouteReq.Upstream)
 		// set upstream containers port
 		if err := i.discoverContainerPorts(k8sIngress, &createRouteReq.Ports); err != nil {
 			return i.normalizedWithError(createRouteReq, err)
@@ -91,6 +99,38 @@ func (i *ingress) normalize(obj *unstructured.Unstructured) (createRouteReq *wv1
 	return nil, nil
 }
 
+// tlsSecretName returns the spec.tls secret covering the host,
+// the tls entry without hosts covers the host only when it is the single ingress rule host,
+// otherwise the hosts of the other rules would be served over TLS with a certificate not issued for them
+func tlsSecretName(ing *v1.Ingress, host string) string {
+	for _, tls := range ing.Spec.TLS {
+		for _, tlsHost := range tls.Hosts {
+			if tlsHost == host {
+				return tls.SecretName
+			}
+		}
+	}
+	if !singleRuleHost(ing, host) {
+		return ""
+	}
+	for _, tls := range ing.Spec.TLS {
+		if len(tls.Hosts) == 0 {
+			return tls.SecretName
+		}
+	}
+	return ""
+}
+
+// singleRuleHost reports whether the host is the only host of the ingress rules
+func singleRuleHost(ing *v1.Ingress, host string) bool {
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host != host {
+			return false
+		}
+	}
+	return true
+}
+
 // discoverSvcPorts is in use when envoy making routing by virtual host
 func (i *ingress) discoverSvcPorts(ing *v1.Ingress, ports *[]*wv1.Port) error {
 	//
@@ -121,6 +161,51 @@ func (i *ingress) discoverSvcPorts(ing *v1.Ingress, ports *[]*wv1.Port) error {
 	return nil
 }
 
+// discoverProtocolOptions sets the upstream protocol from the backend service port appProtocol,
+// the upstream without appProtocol, or with the failed service lookup, keeps the plaintext HTTP/1.1 default.
+// The discovered options are defaults, the API server keeps the options already set on the upstream
+func (i *ingress) discoverProtocolOptions(ing *v1.Ingress, upstream *wv1.Upstream) {
+	appProtocol, err := getSvcPortAppProtocol(
+		intstr.IntOrString{
+			IntVal: ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number,
+			StrVal: ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Name,
+		},
+		ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name,
+		ing.Namespace,
+	)
+	if err != nil {
+		i.logger.Warn("failed to get service port appProtocol, using the plaintext HTTP/1.1 default",
+			zap.String("ingress", ing.Name+"."+ing.Namespace), zap.Error(err))
+		return
+	}
+	if appProtocol == "" {
+		i.logger.Debug("service port without appProtocol, using the plaintext HTTP/1.1 default",
+			zap.String("ingress", ing.Name+"."+ing.Namespace))
+	}
+	upstream.ProtocolOptions = protocolOptions(appProtocol)
+}
+
+// protocolOptions maps the service port appProtocol to the upstream protocol options,
+// the discovered TLS has no CA bundle, so the upstream certificate is not verified
+// until the CA bundle is set on the route with UpdateRoute
+func protocolOptions(appProtocol string) *wv1.UpstreamProtocolOptions {
+	switch strings.ToLower(appProtocol) {
+	case "https", "kubernetes.io/wss", "wss":
+		return &wv1.UpstreamProtocolOptions{
+			Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_AUTO,
+			Tls:      &wv1.UpstreamTls{Enabled: true},
+		}
+	case "h2", "grpcs":
+		return &wv1.UpstreamProtocolOptions{
+			Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2,
+			Tls:      &wv1.UpstreamTls{Enabled: true},
+		}
+	case "h2c", "kubernetes.io/h2c", "http2", "grpc", "grpc-web":
+		return &wv1.UpstreamProtocolOptions{Protocol: wv1.UpstreamProtocol_UPSTREAM_PROTOCOL_HTTP2}
+	}
+	return nil
+}
+
 // discoverContainerPorts in use when envoy making routing by listeners port
 func (i *ingress) discoverContainerPorts(ing *v1.Ingress, ports *[]*wv1.Port) error {
 	if portNumber, portName, err := getContainerPortBySvcPort(
@@ -43,6 +43,19 @@ func getSvcPortNumberBySvcPortName(portName, svcName, namespace string) (int32,
 	return 0, nil
 }
 
+func getSvcPortAppProtocol(kPort intstr.IntOrString, svcName, namespace string) (string, error) {
+	service, err := getSvc(svcName, namespace)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range service.Spec.Ports {
+		if (p.Name == kPort.StrVal || p.Port == kPort.IntVal) && p.AppProtocol != nil {
+			return *p.AppProtocol, nil
+		}
+	}
+	return "", nil
+}
+
 func getContainerPortBySvcPort(kPort intstr.IntOrString, svcName, namespace string) (portNumber int32, portName string, err error) {
 	service, err := getSvc(svcName, namespace)
 	if err != nil {
@@ -0,0 +1,22 @@
+package discovery
+
+import (
+	"github.com/Dimss/wafie/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	InformerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "discovery",
+		Name:      "informer_events_total",
+		Help:      "Total number of received informer events by resource and event type.",
+	}, []string{"resource", "event"})
+	RouteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "discovery",
+		Name:      "route_failures_total",
+		Help:      "Total number of failed route API calls by operation.",
+	}, []string{"operation"})
+)
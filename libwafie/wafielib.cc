@@ -0,0 +1,441 @@
+#include <algorithm>
+#include <cstdlib>
+#include <cstring>
+#include <filesystem>
+#include <fstream>
+#include <iostream>
+#include <memory>
+#include <mutex>
+#include <set>
+#include <string>
+#include <unordered_map>
+#include <vector>
+
+#include <modsecurity/audit_log.h>
+#include <modsecurity/debug_log.h>
+#include <modsecurity/intervention.h>
+#include <modsecurity/modsecurity.h>
+#include <modsecurity/rule_message.h>
+#include <modsecurity/rule_with_actions.h>
+#include <modsecurity/rules_set.h>
+#include <modsecurity/transaction.h>
+
+using modsecurity::ModSecurity;
+using modsecurity::ModSecurityIntervention;
+using modsecurity::RulesSet;
+using modsecurity::Transaction;
+using modsecurity::audit_log::AuditLog;
+
+#include <wafie/wafielib.h>
+
+namespace {
+
+// traceDebugLevel is the highest ModSecurity debug log level, the full rule evaluation
+constexpr int traceDebugLevel = 9;
+
+// TransactionTraceLog routes the debug log of the traced transactions into the per transaction trace file,
+// it is the debug log of the debug rules set only, the transactions on the default rules set are never traced
+class TransactionTraceLog : public modsecurity::debug_log::DebugLog {
+ public:
+    TransactionTraceLog() {
+        // the debug log level of the loaded configuration is not merged into the already set level
+        setDebugLogLevel(traceDebugLevel);
+    }
+
+    // the engine messages without a transaction are not traced
+    void write(int /*level*/, const std::string & /*msg*/) override {}
+
+    void write(int level, const std::string &id, const std::string &uri, const std::string &msg) override {
+        std::lock_guard<std::mutex> lock(m_mutex);
+        auto trace = m_traces.find(id);
+        if (trace == m_traces.end()) {
+            return;
+        }
+        *trace->second << "[" << id << "] [" << uri << "] [" << level << "] " << msg << "\n";
+    }
+
+    // the debug log file of the loaded configuration is ignored
+    bool isLogFileSet() override { return true; }
+
+    bool open(const std::string &id, char const *path) {
+        auto trace = std::make_unique<std::ofstream>(path, std::ios::out | std::ios::trunc);
+        if (!trace->is_open()) {
+            return false;
+        }
+        std::lock_guard<std::mutex> lock(m_mutex);
+        m_traces[id] = std::move(trace);
+        return true;
+    }
+
+    void close(const std::string &id) {
+        std::lock_guard<std::mutex> lock(m_mutex);
+        m_traces.erase(id);
+    }
+
+ private:
+    std::mutex m_mutex;
+    std::unordered_map<std::string, std::unique_ptr<std::ofstream>> m_traces;
+};
+
+ModSecurity *modsec = nullptr;
+RulesSet *rules = nullptr;
+// debugRules is the same configuration loaded with the trace log,
+// the traced transactions are created on it, so the other transactions pay no debug log cost
+RulesSet *debugRules = nullptr;
+TransactionTraceLog *traceLog = nullptr;
+
+// configFiles returns the ModSecurity configuration, the CRS setup and the CRS rules in the load order
+std::vector<std::string> configFiles(char const *config_path) {
+    std::filesystem::path dir(config_path);
+    std::vector<std::string> files = {
+        (dir / "modsecurity.conf").string(),
+        (dir / "crs-setup.conf").string(),
+    };
+    std::vector<std::string> crsRules;
+    std::error_code ec;
+    for (auto const &entry : std::filesystem::directory_iterator(dir / "rules", ec)) {
+        if (entry.path().extension() == ".conf") {
+            crsRules.push_back(entry.path().string());
+        }
+    }
+    std::sort(crsRules.begin(), crsRules.end());
+    files.insert(files.end(), crsRules.begin(), crsRules.end());
+    return files;
+}
+
+bool loadRules(RulesSet *rulesSet, std::vector<std::string> const &files) {
+    for (auto const &file : files) {
+        if (rulesSet->loadFromUri(file.c_str()) < 0) {
+            std::cerr << "wafie: failed to load " << file << ": " << rulesSet->getParserError() << std::endl;
+            return false;
+        }
+    }
+    return true;
+}
+
+// httpVersion strips the HTTP/ prefix of the envoy protocol, ModSecurity expects the bare version
+char const *httpVersion(char const *protocol) {
+    if (protocol != nullptr && std::strncmp(protocol, "HTTP/", 5) == 0) {
+        return protocol + 5;
+    }
+    return protocol;
+}
+
+int anomalyScore(Transaction *tx) {
+    auto score = tx->m_collections.m_tx_collection->resolveFirst("blocking_inbound_anomaly_score");
+    if (!score) {
+        return -1;
+    }
+    try {
+        return std::stoi(*score);
+    } catch (...) {
+        return -1;
+    }
+}
+
+// fillIntervention sets the matched rule ids, the disruptive rule message and the anomaly score
+void fillIntervention(Transaction *tx, EvaluationIntervention *intervention) {
+    std::string ruleIds;
+    std::string message;
+    std::set<int64_t> seen;
+    for (auto const &ruleMessage : tx->m_rulesMessages) {
+        if (ruleMessage.m_isDisruptive && !ruleMessage.m_message.empty()) {
+            message = ruleMessage.m_message;
+        }
+        if (!seen.insert(ruleMessage.m_rule.m_ruleId).second) {
+            continue;
+        }
+        if (!ruleIds.empty()) {
+            ruleIds += ",";
+        }
+        ruleIds += std::to_string(ruleMessage.m_rule.m_ruleId);
+    }
+    intervention->rule_ids = strdup(ruleIds.c_str());
+    intervention->message = strdup(message.c_str());
+    intervention->anomaly_score = anomalyScore(tx);
+}
+
+void resetIntervention(EvaluationIntervention *intervention) {
+    std::memset(intervention, 0, sizeof(*intervention));
+    intervention->anomaly_score = -1;
+}
+
+// intervene fills the intervention of the disrupted transaction, returns 1 when the transaction is disrupted
+int intervene(Transaction *tx, EvaluationIntervention *intervention) {
+    ModSecurityIntervention it;
+    modsecurity::intervention::clean(&it);
+    bool disrupted = tx->intervention(&it);
+    modsecurity::intervention::free(&it);
+    if (!disrupted) {
+        return 0;
+    }
+    // the status is written into the audit log of the blocked transaction
+    tx->updateStatusCode(it.status);
+    intervention->status = it.status;
+    intervention->disruptive = it.disruptive;
+    fillIntervention(tx, intervention);
+    return 1;
+}
+
+// auditRelevant mirrors the ModSecurity native audit log relevance, the SecAuditEngine directive is
+// not exposed by the ModSecurity API, the transactions follow RelevantOnly unless overridden by ctl:auditEngine
+bool auditRelevant(Transaction *tx, AuditLog *auditLog) {
+    switch (tx->m_ctlAuditEngine) {
+        case AuditLog::OffAuditLogStatus:
+            return false;
+        case AuditLog::OnAuditLogStatus:
+            return true;
+        default:
+            break;
+    }
+    for (auto const &ruleMessage : tx->m_rulesMessages) {
+        if (!ruleMessage.m_noAuditLog) {
+            return true;
+        }
+    }
+    return auditLog->isRelevant(tx->m_httpCodeReturned);
+}
+
+// auditParts applies the ctl:auditLogParts modifications of the transaction
+int auditParts(Transaction *tx, AuditLog *auditLog) {
+    int parts = auditLog->getParts();
+    for (auto const &modifier : tx->m_auditLogModifier) {
+        if (modifier.first == 0) {
+            parts = AuditLog::addParts(parts, modifier.second);
+        } else {
+            parts = AuditLog::removeParts(parts, modifier.second);
+        }
+    }
+    return parts;
+}
+
+}  // namespace
+
+void wafie_library_init(char const *config_path) {
+    modsec = new ModSecurity();
+    modsec->setConnectorInformation("wafie");
+    rules = new RulesSet();
+    traceLog = new TransactionTraceLog();
+    // the rules set owns and releases its debug log
+    debugRules = new RulesSet(traceLog);
+    auto files = configFiles(config_path);
+    if (!loadRules(rules, files)) {
+        delete debugRules;
+        debugRules = nullptr;
+        traceLog = nullptr;
+        // the transactions are not initiated, the filter applies the protection failure policy
+        wafie_cleanup("failed to load the rules", rules, modsec);
+        return;
+    }
+    if (!loadRules(debugRules, files)) {
+        std::cerr << "wafie: debug trace disabled" << std::endl;
+        delete debugRules;
+        debugRules = nullptr;
+        traceLog = nullptr;
+    }
+}
+
+int wafie_init_request_transaction(EvaluationRequest *request) {
+    request->transaction = nullptr;
+    request->audit_logged = 0;
+    if (modsec == nullptr || rules == nullptr) {
+        return 1;
+    }
+    try {
+        request->transaction = new Transaction(modsec, rules, nullptr);
+    } catch (...) {
+        return 1;
+    }
+    return 0;
+}
+
+int wafie_enable_transaction_debug(EvaluationRequest *request, char const *trace_path) {
+    if (debugRules == nullptr || request->transaction == nullptr) {
+        return 1;
+    }
+    try {
+        auto traced = std::make_unique<Transaction>(modsec, debugRules, nullptr);
+        if (!traceLog->open(traced->m_id, trace_path)) {
+            return 1;
+        }
+        delete request->transaction;
+        request->transaction = traced.release();
+    } catch (...) {
+        return 1;
+    }
+    return 0;
+}
+
+int wafie_set_transaction_paranoia_level(EvaluationRequest const *request, int paranoia_level) {
+    if (request->transaction == nullptr || paranoia_level < 1 || paranoia_level > 4) {
+        return 1;
+    }
+    // the CRS initialization keeps the paranoia level set before the first phase
+    auto level = std::to_string(paranoia_level);
+    auto *tx = request->transaction->m_collections.m_tx_collection;
+    if (!tx->storeOrUpdateFirst("blocking_paranoia_level", level) ||
+        !tx->storeOrUpdateFirst("detection_paranoia_level", level)) {
+        return 1;
+    }
+    return 0;
+}
+
+int wafie_process_request_headers(EvaluationRequest const *request, EvaluationIntervention *intervention) {
+    resetIntervention(intervention);
+    Transaction *tx = request->transaction;
+    if (tx == nullptr) {
+        return -1;
+    }
+    try {
+        // phase 0, the connection
+        tx->processConnection(request->client_ip, 0, "127.0.0.1", 0);
+        if (intervene(tx, intervention)) {
+            return 1;
+        }
+        // phase 1, the uri and the request headers
+        tx->processURI(request->uri, request->http_method, httpVersion(request->http_version));
+        for (size_t i = 0; i < request->headers_count; i++) {
+            tx->addRequestHeader(request->headers[i].key, request->headers[i].value);
+        }
+        tx->processRequestHeaders();
+        return intervene(tx, intervention);
+    } catch (...) {
+        return -1;
+    }
+}
+
+int wafie_process_request_body(EvaluationRequest const *request, EvaluationIntervention *intervention) {
+    resetIntervention(intervention);
+    Transaction *tx = request->transaction;
+    if (tx == nullptr) {
+        return -1;
+    }
+    try {
+        if (request->body != nullptr) {
+            tx->appendRequestBody(reinterpret_cast<const unsigned char *>(request->body), std::strlen(request->body));
+        }
+        // phase 2, the request body
+        tx->processRequestBody();
+        return intervene(tx, intervention);
+    } catch (...) {
+        return -1;
+    }
+}
+
+int wafie_transaction_score(EvaluationRequest const *request, EvaluationIntervention *intervention) {
+    resetIntervention(intervention);
+    if (request->transaction == nullptr) {
+        return 1;
+    }
+    try {
+        fillIntervention(request->transaction, intervention);
+    } catch (...) {
+        return 1;
+    }
+    return 0;
+}
+
+void wafie_intervention_cleanup(EvaluationIntervention *intervention) {
+    std::free(intervention->rule_ids);
+    std::free(intervention->message);
+    intervention->rule_ids = nullptr;
+    intervention->message = nullptr;
+}
+
+char *wafie_transaction_audit_log(EvaluationRequest *request, int response_status) {
+    Transaction *tx = request->transaction;
+    if (tx == nullptr) {
+        return nullptr;
+    }
+    try {
+        tx->updateStatusCode(response_status);
+        // phase 5, the logging
+        if (tx->getRuleEngineState() != RulesSet::DisabledRuleEngine) {
+            tx->m_rules->evaluate(modsecurity::LoggingPhase, tx);
+        }
+        request->audit_logged = 1;
+        AuditLog *auditLog = tx->m_rules->m_auditLog;
+        if (auditLog == nullptr || !auditRelevant(tx, auditLog)) {
+            return nullptr;
+        }
+        return strdup(tx->toJSON(auditParts(tx, auditLog)).c_str());
+    } catch (...) {
+        return nullptr;
+    }
+}
+
+void wafie_transaction_cleanup(EvaluationRequest const *request) {
+    Transaction *tx = request->transaction;
+    if (tx == nullptr) {
+        return;
+    }
+    try {
+        // the native audit log writes the entry not taken by the filter (SecAuditLog)
+        if (!request->audit_logged) {
+            tx->processLogging();
+        }
+    } catch (...) {
+    }
+    if (traceLog != nullptr) {
+        traceLog->close(tx->m_id);
+    }
+    delete tx;
+}
+
+char *wafie_rule_ids() {
+    if (rules == nullptr) {
+        return nullptr;
+    }
+    std::string ruleIds;
+    std::set<int64_t> seen;
+    try {
+        for (int phase = 0; phase < modsecurity::Phases::NUMBER_OF_PHASES; phase++) {
+            auto *phaseRules = rules->m_rulesSetPhases.at(phase);
+            for (size_t i = 0; i < phaseRules->size(); i++) {
+                auto *rule = dynamic_cast<modsecurity::RuleWithActions *>(phaseRules->at(i).get());
+                // the rules without msg are not reported as the matched rules
+                if (rule == nullptr || rule->m_ruleId == 0 || !rule->hasMsg() ||
+                    !seen.insert(rule->m_ruleId).second) {
+                    continue;
+                }
+                if (!ruleIds.empty()) {
+                    ruleIds += ",";
+                }
+                ruleIds += std::to_string(rule->m_ruleId);
+            }
+        }
+    } catch (...) {
+        return nullptr;
+    }
+    return strdup(ruleIds.c_str());
+}
+
+void wafie_dump_rules() {
+    if (rules != nullptr) {
+        rules->dump();
+    }
+}
+
+void wafie_cleanup(char const *error, RulesSet *rulesSet, ModSecurity *modSecurity) {
+    if (error != nullptr) {
+        std::cerr << "wafie: " << error << std::endl;
+    }
+    if (rulesSet == rules) {
+        rules = nullptr;
+    }
+    if (modSecurity == modsec) {
+        modsec = nullptr;
+    }
+    delete rulesSet;
+    delete modSecurity;
+}
+
+int wafie_add_rule(char const *rule) {
+    if (rules == nullptr || rules->load(rule) < 0) {
+        return 1;
+    }
+    if (debugRules != nullptr && debugRules->load(rule) < 0) {
+        return 1;
+    }
+    return 0;
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// Namespace is the metrics name prefix shared by all wafie binaries
+const Namespace = "wafie"
+
+const Path = "/metrics"
+
+var (
+	rpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "rpc",
+		Name:      "requests_total",
+		Help:      "Total number of handled RPC requests by procedure and response code.",
+	}, []string{"procedure", "code"})
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "rpc",
+		Name:      "duration_seconds",
+		Help:      "RPC handling latency by procedure.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"procedure"})
+)
+
+// Handler returns the prometheus metrics handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve starts a dedicated metrics server, for binaries without an HTTP server
+func Serve(listenAddr string, logger *zap.Logger) {
+	go func() {
+		logger.Info("starting metrics server", zap.String("address", listenAddr))
+		mux := http.NewServeMux()
+		mux.Handle(Path, Handler())
+		if err := http.ListenAndServe(listenAddr, mux); err != nil {
+			logger.Error("failed to start metrics server", zap.Error(err))
+		}
+	}()
+}
+
+// NewRpcInterceptor records the unary RPC handlers latency and response codes
+func NewRpcInterceptor() connect.Interceptor {
+	return connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			start := time.Now()
+			resp, err := next(ctx, req)
+			procedure := req.Spec().Procedure
+			rpcDuration.WithLabelValues(procedure).Observe(time.Since(start).Seconds())
+			rpcRequests.WithLabelValues(procedure, code(err)).Inc()
+			return resp, err
+		}
+	})
+}
+
+// RegisterDBStats exposes the database connections pool stats
+func RegisterDBStats(db *sql.DB, dbName string) error {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, dbName))
+	are := prometheus.AlreadyRegisteredError{}
+	if errors.As(err, &are) {
+		return nil
+	}
+	return err
+}
+
+func code(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return connect.CodeOf(err).String()
+}
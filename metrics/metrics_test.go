@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRpcInterceptor(t *testing.T) {
+	interceptor := NewRpcInterceptor()
+	ok := interceptor.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return nil, nil
+	})
+	notFound := interceptor.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("not found"))
+	})
+	req := connect.NewRequest(&struct{}{})
+	ok(context.Background(), req)
+	ok(context.Background(), req)
+	notFound(context.Background(), req)
+	procedure := req.Spec().Procedure
+	assert.Equal(t, float64(2), testutil.ToFloat64(rpcRequests.WithLabelValues(procedure, "ok")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(rpcRequests.WithLabelValues(procedure, "not_found")))
+}
@@ -0,0 +1,29 @@
+package main
+
+import "strings"
+
+// accessLogNamespace is the dynamic metadata namespace
+// read by the gateway JSON access log format
+const accessLogNamespace = "wafie"
+
+const (
+	verdictAllowed     = "allowed"
+	verdictBlocked     = "blocked"
+	verdictEngineError = "engine_error"
+)
+
+// setVerdict exposes the WAF verdict of the request to the access log,
+// the verdict of a later phase overrides the earlier one,
+// the intervention is the block details or the transaction score of the allowed request
+func (f *filter) setVerdict(verdict string, in *intervention) {
+	metadata := f.callbacks.StreamInfo().DynamicMetadata()
+	metadata.Set(accessLogNamespace, "verdict", verdict)
+	f.verdictScore = in
+	if in != nil {
+		// the anomaly score is not set when the CRS blocking evaluation did not run
+		if in.anomalyScore >= 0 {
+			metadata.Set(accessLogNamespace, "anomaly_score", in.anomalyScore)
+		}
+		metadata.Set(accessLogNamespace, "rule_ids", strings.Join(in.ruleIds, ","))
+	}
+}
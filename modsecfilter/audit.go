@@ -0,0 +1,78 @@
+package main
+
+/*
+#include <stdlib.h>
+#include <wafie/wafielib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// auditLogPath is the ModSecurity SecAuditLog, the filter appends the masked entries
+// and the native audit log the entries not taken by the filter,
+// the file is rotated with copytruncate by the appsecgw supervisor
+const auditLogPath = "/data/audit/modsec.log"
+
+// auditLog is shared by all the filter instances
+var auditLog = &auditLogWriter{path: auditLogPath}
+
+// auditLogWriter appends the entries to the audit log, each entry is written with a single write,
+// so the entries of the filter and of the native audit log are not interleaved
+type auditLogWriter struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (w *auditLogWriter) Write(entry []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return 0, err
+		}
+		w.file = file
+	}
+	return w.file.Write(entry)
+}
+
+// writeAuditLog masks and writes the transaction audit log entry,
+// must be called only once no evaluation is running on the transaction
+func (f *filter) writeAuditLog() {
+	if f.evalRequest.transaction == nil {
+		return
+	}
+	raw := C.wafie_transaction_audit_log(&f.evalRequest, C.int(f.verdict.Status()))
+	if raw == nil {
+		return
+	}
+	defer C.free(unsafe.Pointer(raw))
+	l := f.logger.With(f.logCtx...)
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(C.GoString(raw)), &entry); err != nil {
+		l.Error("failed to parse audit log entry", zap.Error(err))
+		return
+	}
+	entry["wafie"] = map[string]interface{}{
+		"protection_id": f.conf.protectionId,
+		"application":   f.conf.applicationName,
+		"request_id":    f.requestId,
+		"blocked":       f.verdict.Blocked(),
+	}
+	f.conf.masker.Mask(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.Error("failed to serialize audit log entry", zap.Error(err))
+		return
+	}
+	if _, err := auditLog.Write(append(line, '\n')); err != nil {
+		l.Error("failed to write audit log entry", zap.Error(err))
+	}
+}
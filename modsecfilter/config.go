@@ -7,14 +7,45 @@ package main
 */
 import "C"
 import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unsafe"
+
+	"github.com/Dimss/wafie/appsecgw/pkg/auditlog"
 	applogger "github.com/Dimss/wafie/logger"
+	xds "github.com/cncf/xds/go/xds/type/v3"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
 	"github.com/envoyproxy/envoy/contrib/golang/filters/http/source/go/pkg/http"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	defaultBlockStatusCode   = 403
+	defaultBlockBodyTemplate = "Access denied, request id: {{.RequestId}}\n"
+	defaultEvaluationTimeout = 500 * time.Millisecond
+	engineErrorStatusCode    = 503
+	engineErrorBody          = "Service unavailable\n"
+)
+
+// failurePolicy mirrors the wafie.v1.FailurePolicy enum
+type failurePolicy uint32
+
+const (
+	failurePolicyUnspecified failurePolicy = iota
+	failurePolicyFailOpen
+	failurePolicyFailClosed
 )
 
+// ruleIds are the loaded rules, their hit counters are defined along with the protection metrics
+var ruleIds []string
+
 func init() {
 	C.wafie_library_init(C.CString("/config"))
+	ruleIds = loadedRuleIds()
 	c := config{}
 	http.RegisterHttpFilterFactoryAndConfigParser("wafie", wafieFilterFactory, c)
 
@@ -23,17 +54,197 @@ func init() {
 type config struct {
 }
 
+// loadedRuleIds lists the rules reported as the matched rules by the engine
+func loadedRuleIds() []string {
+	ids := C.wafie_rule_ids()
+	if ids == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(ids))
+	if s := C.GoString(ids); s != "" {
+		return strings.Split(s, ",")
+	}
+	return nil
+}
+
+// filterConfig is the per protection configuration
+// rendered by the appsecgw control plane into the golang filter plugin config
+type filterConfig struct {
+	protectionId      uint32
+	applicationName   string
+	blockStatusCode   int
+	blockBodyTemplate *template.Template
+	failurePolicy     failurePolicy
+	// evaluationTimeout is the request evaluation budget, a phase is not started once it's spent
+	evaluationTimeout time.Duration
+	// CRS paranoia level of the protection or the route policy,
+	// zero keeps the crs-setup.conf level
+	paranoiaLevel int
+	// honeypots receive the blocked requests copy, a honeypot per mirror policy
+	honeypots []*honeypot
+	metrics   *filterMetrics
+	// protectionMetrics is set on the listener config, it's passed on to the merged route configs
+	protectionMetrics *protectionMetrics
+	masker            *auditlog.Masker
+}
+
+// blockResponseData is the data passed to the block response body template
+type blockResponseData struct {
+	RequestId    string
+	Status       int
+	RuleIds      []string
+	Message      string
+	AnomalyScore int
+}
+
+func newFilterConfig() *filterConfig {
+	masker, _ := auditlog.NewMasker(nil)
+	return &filterConfig{
+		masker:            masker,
+		blockBodyTemplate: template.Must(template.New("block").Parse(defaultBlockBodyTemplate)),
+		failurePolicy:     failurePolicyFailOpen,
+		evaluationTimeout: defaultEvaluationTimeout,
+	}
+}
+
 func (c config) Parse(any *anypb.Any, callbacks api.ConfigCallbackHandler) (interface{}, error) {
-	return nil, nil
+	filterCfg := newFilterConfig()
+	// callbacks are nil when parsing the route config
+	if callbacks != nil {
+		filterCfg.protectionMetrics = newProtectionMetrics(callbacks, ruleIds)
+	}
+	if any == nil || any.GetTypeUrl() == "" {
+		return filterCfg, nil
+	}
+	configStruct := &xds.TypedStruct{}
+	if err := any.UnmarshalTo(configStruct); err != nil {
+		return nil, err
+	}
+	fields := configStruct.Value.GetFields()
+	if v, ok := fields["protection_id"]; ok {
+		filterCfg.protectionId = uint32(v.GetNumberValue())
+	}
+	if v, ok := fields["application_name"]; ok {
+		filterCfg.applicationName = v.GetStringValue()
+	}
+	if v, ok := fields["block_status_code"]; ok {
+		filterCfg.blockStatusCode = int(v.GetNumberValue())
+	}
+	if v, ok := fields["block_body_template"]; ok && v.GetStringValue() != "" {
+		tmpl, err := template.New("block").Parse(v.GetStringValue())
+		if err != nil {
+			return nil, fmt.Errorf("invalid block body template: %w", err)
+		}
+		filterCfg.blockBodyTemplate = tmpl
+	}
+	if v, ok := fields["failure_policy"]; ok && failurePolicy(v.GetNumberValue()) != failurePolicyUnspecified {
+		filterCfg.failurePolicy = failurePolicy(v.GetNumberValue())
+	}
+	if v, ok := fields["evaluation_timeout_ms"]; ok && v.GetNumberValue() > 0 {
+		filterCfg.evaluationTimeout = time.Duration(v.GetNumberValue()) * time.Millisecond
+	}
+	if v, ok := fields["paranoia_level"]; ok {
+		filterCfg.paranoiaLevel = int(v.GetNumberValue())
+		if filterCfg.paranoiaLevel < 0 || filterCfg.paranoiaLevel > 4 {
+			return nil, fmt.Errorf("invalid paranoia level: %d", filterCfg.paranoiaLevel)
+		}
+	}
+	if v, ok := fields["honeypots"]; ok {
+		for _, item := range v.GetListValue().GetValues() {
+			honeypotFields := item.GetStructValue().GetFields()
+			var targets []string
+			for _, target := range honeypotFields["targets"].GetListValue().GetValues() {
+				targets = append(targets, target.GetStringValue())
+			}
+			if len(targets) == 0 {
+				continue
+			}
+			samplePercent := 100
+			if v, ok := honeypotFields["sample_percent"]; ok {
+				samplePercent = int(v.GetNumberValue())
+			}
+			filterCfg.honeypots = append(filterCfg.honeypots, newHoneypot(targets, samplePercent))
+		}
+	}
+	if masker, err := newMasker(fields); err != nil {
+		return nil, err
+	} else if masker != nil {
+		filterCfg.masker = masker
+	}
+	filterCfg.metrics = filterCfg.protectionMetrics.get(filterCfg.protectionId, filterCfg.applicationName)
+	return filterCfg, nil
+}
+
+// newMasker returns the protection audit log masker,
+// or nil when the protection does not configure the masking
+func newMasker(fields map[string]*structpb.Value) (*auditlog.Masker, error) {
+	if _, ok := fields["mask_disable_defaults"]; !ok {
+		return nil, nil
+	}
+	stringList := func(name string) (list []string) {
+		for _, v := range fields[name].GetListValue().GetValues() {
+			list = append(list, v.GetStringValue())
+		}
+		return list
+	}
+	return auditlog.NewMasker(&auditlog.MaskingConfig{
+		Headers:         stringList("mask_headers"),
+		JsonPaths:       stringList("mask_json_paths"),
+		FormArgs:        stringList("mask_form_args"),
+		Patterns:        stringList("mask_patterns"),
+		DisableDefaults: fields["mask_disable_defaults"].GetBoolValue(),
+	})
 }
 
+// Merge returns the route config with the metrics of the route protection,
+// defined by the listener config, the merged config is cached by envoy per route
 func (c config) Merge(parentConfig interface{}, childConfig interface{}) interface{} {
-	return nil
+	child, ok := childConfig.(*filterConfig)
+	if !ok {
+		return parentConfig
+	}
+	parent, ok := parentConfig.(*filterConfig)
+	if !ok {
+		return child
+	}
+	merged := *child
+	merged.protectionMetrics = parent.protectionMetrics
+	merged.metrics = parent.protectionMetrics.get(child.protectionId, child.applicationName)
+	return &merged
+}
+
+// blockStatus returns the configured block status code,
+// or the intervention status code when the former is not set
+func (c *filterConfig) blockStatus(in *intervention) int {
+	if c.blockStatusCode != 0 {
+		return c.blockStatusCode
+	}
+	if in.status != 0 {
+		return in.status
+	}
+	return defaultBlockStatusCode
 }
 
-func wafieFilterFactory(config interface{}, callbacks api.FilterCallbackHandler) api.StreamFilter {
+func (c *filterConfig) failClosed() bool {
+	return c.failurePolicy == failurePolicyFailClosed
+}
+
+func (c *filterConfig) blockBody(data *blockResponseData) (string, error) {
+	var body bytes.Buffer
+	if err := c.blockBodyTemplate.Execute(&body, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+func wafieFilterFactory(cfg interface{}, callbacks api.FilterCallbackHandler) api.StreamFilter {
+	filterCfg, ok := cfg.(*filterConfig)
+	if !ok {
+		filterCfg = newFilterConfig()
+	}
 	return &filter{
 		callbacks: callbacks,
+		conf:      filterCfg,
 		logger:    applogger.NewLogger(),
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+/*
+#include <stdlib.h>
+#include <wafie/wafielib.h>
+*/
+import "C"
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"go.uber.org/zap"
+)
+
+// debugSecret is the per gateway secret used to sign the debug header
+var debugSecret = []byte(os.Getenv(debugtrace.SecretEnv))
+
+// podIp addresses the gateway holding the traces of its requests
+var podIp = os.Getenv(debugtrace.PodIpEnv)
+
+// debugToken pops the debug header,
+// so the token is never passed to the upstream
+func (f *filter) debugToken(headerMap api.RequestHeaderMap) string {
+	token, _ := headerMap.Get(debugtrace.Header)
+	headerMap.Del(debugtrace.Header)
+	return token
+}
+
+// debugRequest is the traced request, its sensitive values are masked in the trace
+type debugRequest struct {
+	headers map[string][]string
+	uri     string
+	body    string
+}
+
+// enableDebug turns on the rule evaluation trace for the transaction
+// when the debug header signature is valid for the request host
+func (f *filter) enableDebug(token string, headerMap api.RequestHeaderMap) {
+	if token == "" {
+		return
+	}
+	l := f.logger.With(f.logCtx...)
+	if f.requestId == "" {
+		l.Warn("debug trace requested without request id, skipping")
+		return
+	}
+	if err := debugtrace.Verify(debugSecret, headerMap.Host(), token, time.Now()); err != nil {
+		l.Warn("invalid debug token", zap.Error(err))
+		return
+	}
+	tracePath := C.CString(debugtrace.TracePath(debugtrace.DefaultTraceDir, f.requestId))
+	defer C.free(unsafe.Pointer(tracePath))
+	if C.wafie_enable_transaction_debug(&f.evalRequest, tracePath) != 0 {
+		l.Error("failed to enable transaction debug trace")
+		return
+	}
+	f.debug = true
+	f.debugRequest = &debugRequest{headers: headerMap.GetAllHeaders(), uri: headerMap.Path()}
+	l.Info("transaction debug trace enabled")
+}
+
+// maskDebugTrace rewrites the trace with the request sensitive values masked,
+// must be called once the transaction is released and the trace is complete
+func (f *filter) maskDebugTrace() {
+	if !f.debug {
+		return
+	}
+	l := f.logger.With(f.logCtx...)
+	tracePath := debugtrace.TracePath(debugtrace.DefaultTraceDir, f.requestId)
+	trace, err := os.ReadFile(tracePath)
+	if err != nil {
+		l.Error("failed to read debug trace", zap.Error(err))
+		return
+	}
+	masked := f.conf.masker.MaskText(string(trace),
+		f.debugRequest.headers, f.debugRequest.uri, f.debugRequest.body)
+	tmp := tracePath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(masked), 0o600); err != nil {
+		l.Error("failed to write masked debug trace", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, tracePath); err != nil {
+		l.Error("failed to replace debug trace", zap.Error(err))
+		// the unmasked trace is not served
+		_ = os.Remove(tmp)
+		_ = os.Remove(tracePath)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+/*
+#include <stdlib.h>
+#include <wafie/wafielib.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"go.uber.org/zap"
+)
+
+var (
+	errTransactionInit    = errors.New("failed to init modsecurity transaction")
+	errEvaluation         = errors.New("modsecurity transaction evaluation failed")
+	errParanoiaLevel      = errors.New("failed to set transaction paranoia level")
+	errEvaluationDeadline = errors.New("evaluation deadline exceeded")
+)
+
+type evaluationFunc func(in *C.EvaluationIntervention) C.int
+
+type evaluationResult struct {
+	in *intervention
+	// score is the matched rules and the anomaly score of the allowed request
+	score *intervention
+	err   error
+}
+
+// setParanoiaLevel applies the protection or the route policy paranoia level to the transaction,
+// the transaction is not evaluated at the default paranoia level when the configured one is not applied
+func (f *filter) setParanoiaLevel() error {
+	if f.conf.paranoiaLevel == 0 {
+		return nil
+	}
+	if C.wafie_set_transaction_paranoia_level(&f.evalRequest, C.int(f.conf.paranoiaLevel)) != 0 {
+		return fmt.Errorf("%w: %d", errParanoiaLevel, f.conf.paranoiaLevel)
+	}
+	return nil
+}
+
+// evaluate runs the ModSecurity phase evaluation on the worker thread, so the stream is never continued
+// while the engine uses the transaction. A running phase can't be interrupted, the evaluation timeout
+// is the request evaluation budget checked before each phase: once it's spent,
+// the next phase is not evaluated and the failure policy is applied
+func (f *filter) evaluate(phase string, eval evaluationFunc) api.StatusType {
+	if f.evaluated >= f.conf.evaluationTimeout {
+		return f.engineError(phase, fmt.Errorf("%w: %s spent", errEvaluationDeadline, f.evaluated))
+	}
+	res := f.runEvaluation(eval)
+	if res.err != nil {
+		return f.engineError(phase, res.err)
+	}
+	if res.in != nil {
+		return f.block(phase, res.in)
+	}
+	l := f.logger.With(f.logCtx...).With(zap.String("phase", phase))
+	if res.score != nil {
+		l = l.With(
+			zap.Strings("rule_ids", res.score.ruleIds),
+			zap.Int("anomaly_score", res.score.anomalyScore),
+		)
+	}
+	l.Info("request evaluation done")
+	f.setVerdict(verdictAllowed, res.score)
+	return api.Continue
+}
+
+func (f *filter) runEvaluation(eval evaluationFunc) *evaluationResult {
+	var in C.EvaluationIntervention
+	defer C.wafie_intervention_cleanup(&in)
+	start := time.Now()
+	rc := eval(&in)
+	elapsed := time.Since(start)
+	f.evaluated += elapsed
+	f.conf.metrics.observeLatency(elapsed)
+	if rc < 0 {
+		return &evaluationResult{err: errEvaluation}
+	}
+	if rc != 0 {
+		return &evaluationResult{in: newIntervention(&in)}
+	}
+	return &evaluationResult{score: f.transactionScore()}
+}
+
+// transactionScore reads the anomaly score and the matched rules of the not disrupted transaction
+func (f *filter) transactionScore() *intervention {
+	var score C.EvaluationIntervention
+	defer C.wafie_intervention_cleanup(&score)
+	if C.wafie_transaction_score(&f.evalRequest, &score) != 0 {
+		f.logger.With(f.logCtx...).Error("failed to read transaction score")
+		return nil
+	}
+	return newIntervention(&score)
+}
+
+// engineError applies the protection failure policy,
+// fail-closed rejects the request, fail-open passes it without evaluation
+func (f *filter) engineError(phase string, err error) api.StatusType {
+	f.conf.metrics.countEngineError()
+	f.bypass = true
+	f.setVerdict(verdictEngineError, nil)
+	l := f.logger.With(f.logCtx...).With(
+		zap.Uint32("protection_id", f.conf.protectionId),
+		zap.String("application", f.conf.applicationName),
+		zap.String("phase", phase),
+		zap.Bool("fail_closed", f.conf.failClosed()),
+	)
+	l.Error("waf engine error", zap.Error(err))
+	if !f.conf.failClosed() {
+		return api.Continue
+	}
+	f.callbacks.DecoderFilterCallbacks().SendLocalReply(
+		engineErrorStatusCode,
+		engineErrorBody,
+		map[string][]string{"x-request-id": {f.requestId}},
+		0,
+		"wafie_engine_error_on_"+phase,
+	)
+	return api.LocalReply
+}
+
+// recoverPanic recovers a panic raised in the filter callbacks
+// and sets the filter status according to the failure policy
+func (f *filter) recoverPanic(phase string, status *api.StatusType) {
+	if r := recover(); r != nil {
+		*status = f.engineError(phase, fmt.Errorf("filter panic: %v", r))
+	}
+}
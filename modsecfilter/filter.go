@@ -7,9 +7,14 @@ package main
 */
 import "C"
 import (
+	"context"
 	"strings"
+	"time"
 	"unsafe"
 
+	"github.com/Dimss/wafie/appsecgw/pkg/auditlog"
+	"github.com/Dimss/wafie/appsecgw/pkg/debugtrace"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
 	"go.uber.org/zap"
 )
@@ -19,7 +24,25 @@ type filter struct {
 	evalRequest C.EvaluationRequest
 	logger      *zap.Logger
 	logCtx      []zap.Field
-	//conf      configuration
+	requestId   string
+	conf        *filterConfig
+	// evaluated is the time spent by the engine on the request phases
+	evaluated time.Duration
+	// bypass is set once the engine failed,
+	// the rest of the stream is not evaluated
+	bypass bool
+	// bodyBuffered is set while the request body is buffered for the request body phase
+	bodyBuffered bool
+	// debug is set when the transaction rule evaluation is traced
+	debug        bool
+	debugRequest *debugRequest
+	// verdict is the request WAF decision and response status written to the audit log
+	verdict auditlog.Verdict
+	// verdictScore is the anomaly score and the matched rules of the last verdict
+	verdictScore *intervention
+	// blockedRequest is kept for the honeypot copy,
+	// set only when the protection configures the honeypots
+	blockedRequest *blockedRequest
 }
 
 func (f *filter) evaluationRequestHeaders(allHeaders map[string][]string) *C.EvaluationRequestHeader {
@@ -40,7 +63,7 @@ func (f *filter) evaluationRequestHeaders(allHeaders map[string][]string) *C.Eva
 	return headers
 }
 
-func (f *filter) newEvaluationRequest(headerMap api.RequestHeaderMap) {
+func (f *filter) newEvaluationRequest(headerMap api.RequestHeaderMap) error {
 	var clientIp, httpVersion string
 	clientIp, _ = headerMap.Get("X-Forwarded-For")
 	httpVersion, _ = f.callbacks.StreamInfo().Protocol()
@@ -51,15 +74,26 @@ func (f *filter) newEvaluationRequest(headerMap api.RequestHeaderMap) {
 	f.evalRequest.headers_count = C.size_t(len(headerMap.GetAllHeaders()))
 	f.evalRequest.headers = f.evaluationRequestHeaders(headerMap.GetAllHeaders())
 	f.evalRequest.body = nil
-	C.wafie_init_request_transaction(&f.evalRequest)
-	f.logger.Info("new evaluation request",
-		zap.String("client_ip", f.evalRequest.client_ip),
-		zap.String("uri", f.evalRequest.uri),
-		zap.String("method", f.evalRequest.http_method),
-		zap.String("version", f.evalRequest.http_version),
-		zap.String("headers_count", f.evalRequest.headers_count),
-		zap.String("headers", f.evalRequest.headers),
+	if len(f.conf.honeypots) > 0 {
+		f.blockedRequest = &blockedRequest{
+			method:    headerMap.Method(),
+			host:      headerMap.Host(),
+			path:      headerMap.Path(),
+			headers:   headerMap.GetAllHeaders(),
+			requestId: f.requestId,
+		}
+	}
+	if C.wafie_init_request_transaction(&f.evalRequest) != 0 {
+		return errTransactionInit
+	}
+	f.logger.With(f.logCtx...).Info("new evaluation request",
+		zap.String("client_ip", clientIp),
+		zap.String("uri", headerMap.Host()+headerMap.Path()),
+		zap.String("method", headerMap.Method()),
+		zap.String("version", httpVersion),
+		zap.Int("headers_count", int(f.evalRequest.headers_count)),
 	)
+	return nil
 }
 
 func (f *filter) freeEvaluationRequest() {
@@ -67,6 +101,7 @@ func (f *filter) freeEvaluationRequest() {
 	C.free(unsafe.Pointer(f.evalRequest.uri))
 	C.free(unsafe.Pointer(f.evalRequest.http_method))
 	C.free(unsafe.Pointer(f.evalRequest.http_version))
+	C.free(unsafe.Pointer(f.evalRequest.body))
 	for i := 0; i < int(f.evalRequest.headers_count); i++ {
 		hdr := (*C.EvaluationRequestHeader)(
 			unsafe.Pointer(uintptr(unsafe.Pointer(f.evalRequest.headers)) + uintptr(i)*
@@ -78,44 +113,137 @@ func (f *filter) freeEvaluationRequest() {
 }
 
 func (f *filter) newLogCtx(headerMap api.RequestHeaderMap) {
-	requestId := ""
-	requestId, _ = headerMap.Get("X-Request-ID")
-	f.logCtx = []zap.Field{zap.String("x-request-id", requestId)}
+	f.requestId, _ = headerMap.Get("X-Request-ID")
+	f.logCtx = []zap.Field{zap.String("x-request-id", f.requestId)}
+	// correlate the filter log lines with the incoming request trace
+	if traceparent, ok := headerMap.Get(tracing.TraceparentHeader); ok {
+		f.logCtx = append(f.logCtx,
+			tracing.Fields(tracing.ContextWithTraceparent(context.Background(), traceparent))...)
+	}
 }
 
-func (f *filter) DecodeHeaders(headerMap api.RequestHeaderMap, b bool) api.StatusType {
+// block sends the local reply built from the intervention details
+// and the protection block response configuration
+func (f *filter) block(phase string, in *intervention) api.StatusType {
+	f.conf.metrics.countBlocked(phase, in)
+	f.setVerdict(verdictBlocked, in)
+	status := f.conf.blockStatus(in)
+	f.verdict.Block(status)
+	body, err := f.conf.blockBody(&blockResponseData{
+		RequestId:    f.requestId,
+		Status:       status,
+		RuleIds:      in.ruleIds,
+		Message:      in.message,
+		AnomalyScore: in.anomalyScore,
+	})
+	if err != nil {
+		f.logger.With(f.logCtx...).Error("failed to render block response body", zap.Error(err))
+		body = "Access denied"
+	}
+	f.logger.With(f.logCtx...).Warn("request blocked",
+		zap.Uint32("protection_id", f.conf.protectionId),
+		zap.String("application", f.conf.applicationName),
+		zap.String("phase", phase),
+		zap.Int("status", status),
+		zap.Strings("rule_ids", in.ruleIds),
+		zap.String("message", in.message),
+		zap.Int("anomaly_score", in.anomalyScore),
+		zap.String("client_ip", C.GoString(f.evalRequest.client_ip)),
+		zap.String("uri", C.GoString(f.evalRequest.uri)),
+	)
+	if f.blockedRequest != nil {
+		f.blockedRequest.ruleIds = in.ruleIds
+		if f.evalRequest.body != nil {
+			f.blockedRequest.body = C.GoString(f.evalRequest.body)
+		}
+		for _, honeypot := range f.conf.honeypots {
+			honeypot.mirror(f.blockedRequest, f.conf.masker, f.conf.metrics, f.logger.With(f.logCtx...))
+		}
+	}
+	f.callbacks.DecoderFilterCallbacks().SendLocalReply(
+		status,
+		body,
+		map[string][]string{"x-request-id": {f.requestId}},
+		0,
+		"wafie_blocked_on_"+phase,
+	)
+	return api.LocalReply
+}
+
+func (f *filter) DecodeHeaders(headerMap api.RequestHeaderMap, b bool) (status api.StatusType) {
+	defer f.recoverPanic("headers", &status)
 	// set new logger context
 	f.newLogCtx(headerMap)
+	debugToken := f.debugToken(headerMap)
 	// create new evaluation request
-	f.newEvaluationRequest(headerMap)
+	if err := f.newEvaluationRequest(headerMap); err != nil {
+		return f.engineError("headers", err)
+	}
+	f.conf.metrics.countEvaluated()
+	// the traced transaction is recreated on the debug rules set, so the debug trace is enabled first
+	f.enableDebug(debugToken, headerMap)
+	if err := f.setParanoiaLevel(); err != nil {
+		return f.engineError("headers", err)
+	}
 	//C.wafie_add_rule(C.CString("SecRule REMOTE_ADDR \"@ipMatch 10.244.0.22\" \"id:203948180384," +
 	//	"phase:0,deny,status:403,msg:'Blocking connection from specific IP'\""))
 	//C.wafie_add_rule(C.CString("SecAction \"id:203948180384,phase:1,log,pass,msg:'FOO-PARANOIA-LEVEL: %{tx.blocking_paranoia_level}'\""))
 	// evaluate request headers and connection (modsecurity: phase0, phase1)
-	if C.wafie_process_request_headers(&f.evalRequest) != 0 {
-		f.callbacks.DecoderFilterCallbacks().SendLocalReply(403,
-			"Access denied on headers processing", nil, 0, "some details here")
-		return api.LocalReply
+	status = f.evaluate("headers", func(in *C.EvaluationIntervention) C.int {
+		return C.wafie_process_request_headers(&f.evalRequest, in)
+	})
+	// the request without body still runs the request body phase,
+	// the CRS blocking evaluation of the anomaly score is done in phase 2
+	if status == api.Continue && b && !f.bypass {
+		return f.evaluateBody()
 	}
-	f.logger.With(f.logCtx...).Info("request headers evaluation done")
-	return api.Continue
+	return status
 }
 
-func (f *filter) DecodeData(instance api.BufferInstance, b bool) api.StatusType {
+func (f *filter) DecodeData(instance api.BufferInstance, b bool) (status api.StatusType) {
+	defer f.recoverPanic("body", &status)
+	if f.bypass {
+		return api.Continue
+	}
+	// the body is buffered, so the request body phase is evaluated once on the whole body
+	if !b {
+		f.bodyBuffered = true
+		return api.StopAndBuffer
+	}
+	f.bodyBuffered = false
+	C.free(unsafe.Pointer(f.evalRequest.body))
 	f.evalRequest.body = C.CString(string(instance.Bytes()))
-	if C.wafie_process_request_body(&f.evalRequest) != 0 {
-		f.callbacks.DecoderFilterCallbacks().SendLocalReply(403,
-			"Access denied on body processing", nil, 0, "some details here")
-		return api.LocalReply
+	return f.evaluateBody()
+}
+
+func (f *filter) DecodeTrailers(trailerMap api.RequestTrailerMap) (status api.StatusType) {
+	defer f.recoverPanic("body", &status)
+	// the buffered body is not passed with the trailers,
+	// the request body phase of the request with trailers runs without the body
+	if f.bodyBuffered && !f.bypass {
+		f.bodyBuffered = false
+		return f.evaluateBody()
 	}
 	return api.Continue
 }
 
-func (f *filter) DecodeTrailers(trailerMap api.RequestTrailerMap) api.StatusType {
-	return api.Continue
+// evaluateBody evaluates the request body (modsecurity: phase2)
+func (f *filter) evaluateBody() api.StatusType {
+	return f.evaluate("body", func(in *C.EvaluationIntervention) C.int {
+		return C.wafie_process_request_body(&f.evalRequest, in)
+	})
 }
 
 func (f *filter) EncodeHeaders(headerMap api.ResponseHeaderMap, b bool) api.StatusType {
+	if f.debug {
+		headerMap.Set(debugtrace.RequestIdHeader, f.requestId)
+		if podIp != "" {
+			headerMap.Set(debugtrace.GatewayHeader, podIp)
+		}
+	}
+	if status, ok := headerMap.Status(); ok {
+		f.verdict.Respond(status)
+	}
 	//TODO: understand how valuable this feature is
 	return api.Continue
 }
@@ -147,14 +275,24 @@ func (f *filter) OnLogDownstreamPeriodic(
 }
 
 func (f *filter) OnDestroy(reason api.DestroyReason) {
-	defer f.logger.
+	f.logger.
 		With(f.logCtx...).
 		Info("destroying filter instance", zap.Int("reason", int(reason)))
-	f.freeEvaluationRequest()
-	C.wafie_transaction_cleanup(&f.evalRequest)
-
+	// the evaluation is synchronous, so the transaction is no longer in use,
+	// the audit log entry is serialized and the transaction released off the worker thread
+	go func() {
+		f.writeAuditLog()
+		if f.debug && f.evalRequest.body != nil {
+			f.debugRequest.body = C.GoString(f.evalRequest.body)
+		}
+		C.wafie_transaction_cleanup(&f.evalRequest)
+		f.freeEvaluationRequest()
+		f.maskDebugTrace()
+	}()
 }
 
 func (f *filter) OnStreamComplete() {
-
+	if f.verdictScore != nil {
+		f.conf.metrics.observeAnomalyScore(f.verdictScore.anomalyScore)
+	}
 }
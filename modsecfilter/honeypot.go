@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dimss/wafie/appsecgw/pkg/auditlog"
+	"go.uber.org/zap"
+)
+
+const (
+	honeypotTimeout = 5 * time.Second
+	// the honeypot copies are sent by a fixed number of workers,
+	// the copies are dropped when the queue is full, e.g. the targets are slow during an attack
+	honeypotWorkers   = 4
+	honeypotQueueSize = 256
+)
+
+var (
+	honeypotQueue     = make(chan *honeypotCopy, honeypotQueueSize)
+	honeypotStartOnce sync.Once
+)
+
+// honeypot copies the blocked requests to the honeypot targets,
+// envoy does not mirror the requests replied by the filter
+type honeypot struct {
+	targets       []string
+	samplePercent int
+	client        *http.Client
+}
+
+// blockedRequest is the copy of the blocked request sent to the honeypot
+type blockedRequest struct {
+	method    string
+	host      string
+	path      string
+	headers   map[string][]string
+	body      string
+	requestId string
+	ruleIds   []string
+}
+
+// honeypotCopy is the queued copy of the blocked request to a single target
+type honeypotCopy struct {
+	honeypot *honeypot
+	target   string
+	req      *blockedRequest
+	logger   *zap.Logger
+}
+
+func newHoneypot(targets []string, samplePercent int) *honeypot {
+	honeypotStartOnce.Do(func() {
+		for i := 0; i < honeypotWorkers; i++ {
+			go honeypotWorker()
+		}
+	})
+	return &honeypot{
+		targets:       targets,
+		samplePercent: samplePercent,
+		client:        &http.Client{Timeout: honeypotTimeout},
+	}
+}
+
+func honeypotWorker() {
+	for c := range honeypotQueue {
+		c.honeypot.send(c.target, c.req, c.logger)
+	}
+}
+
+func (h *honeypot) sampled() bool {
+	return h.samplePercent >= 100 || rand.IntN(100) < h.samplePercent
+}
+
+// mirror queues the masked copy of the blocked request to all the targets,
+// the client receives the block response regardless of the honeypot responses.
+// The sensitive headers, query and body arguments are masked before leaving the gateway
+func (h *honeypot) mirror(req *blockedRequest, masker *auditlog.Masker, metrics *filterMetrics, logger *zap.Logger) {
+	if !h.sampled() {
+		return
+	}
+	masked := *req
+	masked.headers = make(map[string][]string, len(req.headers))
+	for key, values := range req.headers {
+		masked.headers[key] = append([]string(nil), values...)
+	}
+	masked.path, masked.body = masker.MaskRequest(masked.headers, req.path, req.body)
+	for _, target := range h.targets {
+		select {
+		case honeypotQueue <- &honeypotCopy{honeypot: h, target: target, req: &masked, logger: logger}:
+		default:
+			metrics.countHoneypotDropped()
+			logger.Warn("honeypot queue is full, blocked request copy dropped",
+				zap.String("target", target), zap.String("x-request-id", req.requestId))
+		}
+	}
+}
+
+func (h *honeypot) send(target string, req *blockedRequest, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), honeypotTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, "http://"+target+req.path, strings.NewReader(req.body))
+	if err != nil {
+		logger.Warn("failed to create honeypot request", zap.String("target", target), zap.Error(err))
+		return
+	}
+	httpReq.Host = req.host
+	for key, values := range req.headers {
+		// skip the pseudo and the connection headers
+		if strings.HasPrefix(key, ":") || strings.EqualFold(key, "content-length") ||
+			strings.EqualFold(key, "transfer-encoding") || strings.EqualFold(key, "connection") {
+			continue
+		}
+		for _, v := range values {
+			httpReq.Header.Add(key, v)
+		}
+	}
+	httpReq.Header.Set("x-wafie-blocked", "true")
+	httpReq.Header.Set("x-wafie-rule-ids", strings.Join(req.ruleIds, ","))
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		logger.Warn("failed to mirror blocked request to honeypot",
+			zap.String("target", target), zap.String("x-request-id", req.requestId), zap.Error(err))
+		return
+	}
+	_ = resp.Body.Close()
+}
@@ -2,6 +2,12 @@
 #define WAFIELIB_LIBRARY_H
 #include <modsecurity/transaction.h>
 
+// the libwafie bridge is built from libwafie/wafielib.cc against the vendored ModSecurity headers,
+// the C++ callers must bring the modsecurity types into scope before including this header
+#ifdef __cplusplus
+extern "C" {
+#endif
+
 typedef struct {
     const unsigned char *key;
     const unsigned char *value;
@@ -16,24 +22,68 @@ typedef struct {
     size_t headers_count;
     EvaluationRequestHeader *headers;
     Transaction *transaction;
+    // set once the audit log entry is taken by wafie_transaction_audit_log,
+    // otherwise the entry is written by the ModSecurity native audit log on the transaction cleanup
+    int audit_logged;
 } EvaluationRequest;
 
+typedef struct {
+    int status;
+    int disruptive;
+    // comma separated list of the matched rule ids
+    char *rule_ids;
+    char *message;
+    int anomaly_score;
+} EvaluationIntervention;
+
 void wafie_library_init(char const *config_path);
 
-int wafie_process_request_headers(EvaluationRequest const *request);
+// the request processing functions return 1 when the transaction is disrupted,
+// 0 when it passes and -1 on the engine error, the intervention must be released with wafie_intervention_cleanup
+int wafie_process_request_headers(EvaluationRequest const *request, EvaluationIntervention *intervention);
+
+int wafie_process_request_body(EvaluationRequest const *request, EvaluationIntervention *intervention);
+
+void wafie_intervention_cleanup(EvaluationIntervention *intervention);
 
-int wafie_process_request_body(EvaluationRequest const *request);
+// fills the matched rule ids and the anomaly score of the transaction evaluated so far,
+// called for the not disrupted transaction, the intervention must be released with wafie_intervention_cleanup
+int wafie_transaction_score(EvaluationRequest const *request, EvaluationIntervention *intervention);
 
-void wafie_init_request_transaction(EvaluationRequest *request);
+// returns non zero value when the transaction could not be initiated
+int wafie_init_request_transaction(EvaluationRequest *request);
 
+// raises the debug log level of the request transaction only,
+// the full rule evaluation trace is written into trace_path.
+// the transaction is recreated on the debug rules set, so it must be called right after
+// wafie_init_request_transaction, before any other transaction call
+int wafie_enable_transaction_debug(EvaluationRequest *request, char const *trace_path);
+
+// sets the CRS blocking and detection paranoia level of the request transaction,
+// must be called before the request headers are processed
+int wafie_set_transaction_paranoia_level(EvaluationRequest const *request, int paranoia_level);
+
+// runs the logging phase and serializes the SecAuditLogParts of the transaction into the JSON audit log entry,
+// returns NULL when the transaction is not relevant (SecAuditLogRelevantStatus, the rules auditlog action).
+// the returned string must be released by the caller
+char *wafie_transaction_audit_log(EvaluationRequest *request, int response_status);
+
+// releases the transaction, the transaction audit log entry not taken by wafie_transaction_audit_log
+// is written by the ModSecurity native audit log (SecAuditLog)
 void wafie_transaction_cleanup(EvaluationRequest const *request);
 
+// returns the comma separated ids of the loaded rules reported as the matched rules,
+// NULL when the rules are not loaded. the returned string must be released by the caller
+char *wafie_rule_ids();
+
 void wafie_dump_rules();
 
 void wafie_cleanup(char const *error, RulesSet *rules, ModSecurity *modsec);
 
 int wafie_add_rule(char const *rule);
 
-
+#ifdef __cplusplus
+}
+#endif
 
 #endif //WAFIELIB_LIBRARY_H
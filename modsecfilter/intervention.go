@@ -0,0 +1,29 @@
+package main
+
+/*
+#include <stdlib.h>
+#include <wafie/wafielib.h>
+*/
+import "C"
+import "strings"
+
+// intervention holds the ModSecurity intervention details
+// returned by the wafie C bridge when a transaction is disrupted
+type intervention struct {
+	status       int
+	ruleIds      []string
+	message      string
+	anomalyScore int
+}
+
+func newIntervention(in *C.EvaluationIntervention) *intervention {
+	i := &intervention{
+		status:       int(in.status),
+		message:      C.GoString(in.message),
+		anomalyScore: int(in.anomaly_score),
+	}
+	if ruleIds := C.GoString(in.rule_ids); ruleIds != "" {
+		i.ruleIds = strings.Split(ruleIds, ",")
+	}
+	return i
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+)
+
+// the golang filter metrics api has no histograms,
+// distributions are exported as cumulative bucket counters
+// with the le tag, so they can be used with histogram_quantile
+var (
+	anomalyScoreBounds      = []uint64{0, 5, 10, 15, 20, 25, 50, 100}
+	evaluationLatencyBounds = []uint64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+	statNameUnsafeChars     = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// otherRuleId is the rule_id tag of the hits of the rules not listed by the engine on load
+const otherRuleId = "other"
+
+// filterMetrics are the per protection stats,
+// the stat names are converted into the protection_id, application,
+// phase, rule_id and le tags by the envoy bootstrap stats_tags
+type filterMetrics struct {
+	callbacks         api.ConfigCallbackHandler
+	prefix            string
+	requestsEvaluated api.CounterMetric
+	engineErrors      api.CounterMetric
+	honeypotDropped   api.CounterMetric
+	blocked           map[string]api.CounterMetric
+	anomalyScore      *bucketCounter
+	evaluationLatency *bucketCounter
+	// ruleHits are defined along with the protection metrics, the map is never updated afterward
+	ruleHits map[string]api.CounterMetric
+}
+
+// protectionMetrics defines the metrics of each protection once per listener config,
+// the route level configs are parsed without the config callbacks,
+// so they take the protection metrics of the listener config on merge
+type protectionMetrics struct {
+	callbacks api.ConfigCallbackHandler
+	ruleIds   []string
+	mu        sync.Mutex
+	metrics   map[uint32]*filterMetrics
+}
+
+type bucketCounter struct {
+	bounds  []uint64
+	buckets []api.CounterMetric
+	inf     api.CounterMetric
+	sum     api.CounterMetric
+	count   api.CounterMetric
+}
+
+func statNameSegment(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return statNameUnsafeChars.ReplaceAllString(s, "_")
+}
+
+func newProtectionMetrics(callbacks api.ConfigCallbackHandler, ruleIds []string) *protectionMetrics {
+	return &protectionMetrics{
+		callbacks: callbacks,
+		ruleIds:   ruleIds,
+		metrics:   map[uint32]*filterMetrics{},
+	}
+}
+
+// get returns the protection metrics, defining them on the first call for the protection,
+// it's nil when parsing the route config, the route config metrics are set on merge
+func (p *protectionMetrics) get(protectionId uint32, applicationName string) *filterMetrics {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m, ok := p.metrics[protectionId]; ok {
+		return m
+	}
+	m := newFilterMetrics(p.callbacks, protectionId, applicationName, p.ruleIds)
+	p.metrics[protectionId] = m
+	return m
+}
+
+func newFilterMetrics(callbacks api.ConfigCallbackHandler, protectionId uint32, applicationName string, ruleIds []string) *filterMetrics {
+	m := &filterMetrics{
+		callbacks: callbacks,
+		prefix: fmt.Sprintf("wafie.protection_id.%d.app.%s.",
+			protectionId, statNameSegment(applicationName)),
+		blocked:  map[string]api.CounterMetric{},
+		ruleHits: map[string]api.CounterMetric{},
+	}
+	m.requestsEvaluated = callbacks.DefineCounterMetric(m.prefix + "requests_evaluated")
+	m.engineErrors = callbacks.DefineCounterMetric(m.prefix + "engine_errors")
+	m.honeypotDropped = callbacks.DefineCounterMetric(m.prefix + "honeypot_dropped")
+	for _, phase := range []string{"headers", "body"} {
+		m.blocked[phase] = callbacks.DefineCounterMetric(m.prefix + "blocked.phase." + phase)
+	}
+	m.anomalyScore = m.newBucketCounter("anomaly_score", anomalyScoreBounds)
+	m.evaluationLatency = m.newBucketCounter("evaluation_latency_ms", evaluationLatencyBounds)
+	for _, ruleId := range append(ruleIds, otherRuleId) {
+		m.ruleHits[ruleId] = callbacks.DefineCounterMetric(m.prefix + "rule_hits.rule_id." + statNameSegment(ruleId))
+	}
+	return m
+}
+
+func (m *filterMetrics) newBucketCounter(name string, bounds []uint64) *bucketCounter {
+	b := &bucketCounter{
+		bounds: bounds,
+		inf:    m.callbacks.DefineCounterMetric(m.prefix + name + "_bucket.le.+Inf"),
+		sum:    m.callbacks.DefineCounterMetric(m.prefix + name + "_sum"),
+		count:  m.callbacks.DefineCounterMetric(m.prefix + name + "_count"),
+	}
+	for _, bound := range bounds {
+		b.buckets = append(b.buckets,
+			m.callbacks.DefineCounterMetric(m.prefix+name+"_bucket.le."+strconv.FormatUint(bound, 10)))
+	}
+	return b
+}
+
+func (b *bucketCounter) observe(v uint64) {
+	for i, bound := range b.bounds {
+		if v <= bound {
+			b.buckets[i].Increment(1)
+		}
+	}
+	b.inf.Increment(1)
+	b.sum.Increment(int64(v))
+	b.count.Increment(1)
+}
+
+// all the methods are no-op on nil metrics,
+// the filter config of the listener without the wafie config has no protection metrics
+func (m *filterMetrics) countEvaluated() {
+	if m != nil {
+		m.requestsEvaluated.Increment(1)
+	}
+}
+
+func (m *filterMetrics) countEngineError() {
+	if m != nil {
+		m.engineErrors.Increment(1)
+	}
+}
+
+func (m *filterMetrics) countHoneypotDropped() {
+	if m != nil {
+		m.honeypotDropped.Increment(1)
+	}
+}
+
+func (m *filterMetrics) observeLatency(d time.Duration) {
+	if m != nil {
+		m.evaluationLatency.observe(uint64(d.Milliseconds()))
+	}
+}
+
+// observeAnomalyScore records the final anomaly score of the evaluated request,
+// both of the allowed and of the blocked one
+func (m *filterMetrics) observeAnomalyScore(score int) {
+	if m != nil && score >= 0 {
+		m.anomalyScore.observe(uint64(score))
+	}
+}
+
+func (m *filterMetrics) countBlocked(phase string, in *intervention) {
+	if m == nil {
+		return
+	}
+	if c, ok := m.blocked[phase]; ok {
+		c.Increment(1)
+	}
+	for _, ruleId := range in.ruleIds {
+		m.ruleHit(ruleId).Increment(1)
+	}
+}
+
+// ruleHit returns the rule hits counter, the hits of the rules
+// not listed on load (e.g. the rules without msg) are counted as the other rule
+func (m *filterMetrics) ruleHit(ruleId string) api.CounterMetric {
+	if c, ok := m.ruleHits[ruleId]; ok {
+		return c
+	}
+	return m.ruleHits[otherRuleId]
+}
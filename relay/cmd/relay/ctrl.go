@@ -1,12 +1,15 @@
 package relay
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
 
 	applogger "github.com/Dimss/wafie/logger"
+	"github.com/Dimss/wafie/metrics"
 	"github.com/Dimss/wafie/relay/pkg/control"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -16,8 +19,20 @@ import (
 func init() {
 	controllerCmd.PersistentFlags().StringP("api-addr", "a", "http://localhost:8080", "API address")
 	controllerCmd.PersistentFlags().StringP("node-name", "n", "", "K8s node name")
+	controllerCmd.PersistentFlags().Uint32P("gateway-domain-port", "", 50080,
+		"Gateway shared listener port of the protections routed by the ingress host")
+	controllerCmd.PersistentFlags().StringP("gateway-namespace", "", "default",
+		"Namespace of the gateway groups services")
+	controllerCmd.PersistentFlags().StringP("metrics-addr", "", ":9090", "Metrics listen address")
+	controllerCmd.PersistentFlags().StringP("tracing-exporter", "", tracing.ExporterNone, "Tracing exporter, one of none|otlp|stdout")
+	controllerCmd.PersistentFlags().StringP("tracing-endpoint", "", "", "OTLP HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces")
 	viper.BindPFlag("api-addr", controllerCmd.PersistentFlags().Lookup("api-addr"))
 	viper.BindPFlag("node-name", controllerCmd.PersistentFlags().Lookup("node-name"))
+	viper.BindPFlag("gateway-domain-port", controllerCmd.PersistentFlags().Lookup("gateway-domain-port"))
+	viper.BindPFlag("gateway-namespace", controllerCmd.PersistentFlags().Lookup("gateway-namespace"))
+	viper.BindPFlag("metrics-addr", controllerCmd.PersistentFlags().Lookup("metrics-addr"))
+	viper.BindPFlag("tracing-exporter", controllerCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-endpoint", controllerCmd.PersistentFlags().Lookup("tracing-endpoint"))
 	startCmd.AddCommand(controllerCmd)
 }
 
@@ -26,11 +41,18 @@ var controllerCmd = &cobra.Command{
 	Short: "start relay instance controller",
 	Run: func(cmd *cobra.Command, args []string) {
 		zap.S().Info("starting relay instance controller")
+		shutdownTracing, err := tracing.Init("wafie-relay-controller",
+			viper.GetString("tracing-exporter"), viper.GetString("tracing-endpoint"), applogger.NewLogger())
+		if err != nil {
+			panic(err)
+		}
 		epsCh := make(chan *discoveryv1.EndpointSlice, 100)
 		// start relay controller
 		relayCtrl, err := control.NewController(
 			viper.GetString("api-addr"),
 			viper.GetString("node-name"),
+			viper.GetUint32("gateway-domain-port"),
+			viper.GetString("gateway-namespace"),
 			epsCh,
 			applogger.NewLogger(),
 		)
@@ -38,15 +60,17 @@ var controllerCmd = &cobra.Command{
 			panic(err)
 		}
 		relayCtrl.Run()
-		controllerShutdown()
+		metrics.Serve(viper.GetString("metrics-addr"), applogger.NewLogger())
+		controllerShutdown(shutdownTracing)
 	},
 }
 
-func controllerShutdown() {
+func controllerShutdown(shutdownTracing func(context.Context) error) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	gracefullyExit := func(sig os.Signal) {
 		zap.S().Infof("shutting down with sig: %s, bye bye 👋\n", sig.String())
+		shutdownTracing(context.Background())
 		if s, ok := sig.(syscall.Signal); ok {
 			os.Exit(128 + int(s))
 		}
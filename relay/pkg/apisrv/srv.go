@@ -11,6 +11,7 @@ import (
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
 	"github.com/Dimss/wafie/relay/pkg/relay"
+	"github.com/Dimss/wafie/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
@@ -40,7 +41,7 @@ func (s *Server) Start() {
 		s.logger.Info("starting health check server", zap.String("address", s.listenAddr))
 		mux := http.NewServeMux()
 		mux.Handle(grpchealth.NewHandler(s))
-		mux.Handle(wafiev1connect.NewRelayServiceHandler(s))
+		mux.Handle(wafiev1connect.NewRelayServiceHandler(s, tracing.HandlerOption()))
 		reflector := grpcreflect.NewStaticReflector(
 			wafiev1connect.RelayServiceName,
 			grpchealth.HealthV1ServiceName,
@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"connectrpc.com/connect"
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	v1 "github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"github.com/Dimss/wafie/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -17,19 +22,38 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
+const (
+	statusReportInterval = 30 * time.Second
+	// relay port of the first relayed container port,
+	// TODO: currently static-inline, must be configurable
+	relayBasePort = 50010
+	// defaultGatewayGroup serves the protections without explicit gateway group
+	defaultGatewayGroup = "default"
+)
+
 // Controller is responsible for manging a lifecycle (start,stop,restart) of relay instances
 type Controller struct {
 	logger             *zap.Logger
 	epsCh              chan *discoveryv1.EndpointSlice
 	nodeName           string
+	gatewayDomainPort  uint32
+	gatewayNamespace   string
 	stateVersion       string
+	stateTraceparent   string
 	protectionClient   v1.ProtectionServiceClient
 	stateVersionClient v1.StateVersionServiceClient
 	routeClient        v1.RouteServiceClient
+	componentClient    v1.ComponentServiceClient
 	clientset          *kubernetes.Clientset
+	// deployed relay instances by pod name, reported to the api server
+	deployed   map[string]*RelayInstanceSpec
+	deployedMu sync.Mutex
 }
 
-func NewController(apiAddr, nodeName string, epsCh chan *discoveryv1.EndpointSlice, logger *zap.Logger) (*Controller, error) {
+// NewController creates the relay instances controller,
+// the gatewayDomainPort is the gateway shared listener of the protections routed by the ingress host,
+// the gateway groups services are resolved in the gatewayNamespace
+func NewController(apiAddr, nodeName string, gatewayDomainPort uint32, gatewayNamespace string, epsCh chan *discoveryv1.EndpointSlice, logger *zap.Logger) (*Controller, error) {
 	rc, err := config.GetConfig()
 	if err != nil {
 		return nil, err
@@ -39,25 +63,36 @@ func NewController(apiAddr, nodeName string, epsCh chan *discoveryv1.EndpointSli
 		return nil, err
 	}
 	return &Controller{
-		logger:   logger,
-		epsCh:    epsCh,
-		nodeName: nodeName,
+		logger:            logger,
+		epsCh:             epsCh,
+		nodeName:          nodeName,
+		gatewayDomainPort: gatewayDomainPort,
+		gatewayNamespace:  gatewayNamespace,
 		protectionClient: v1.NewProtectionServiceClient(
 			http.DefaultClient,
 			apiAddr,
+			tracing.ClientOption(),
 		),
 		routeClient: v1.NewRouteServiceClient(
 			http.DefaultClient,
 			apiAddr,
+			tracing.ClientOption(),
 		),
 		stateVersionClient: v1.NewStateVersionServiceClient(
 			http.DefaultClient, apiAddr,
+			tracing.ClientOption(),
+		),
+		componentClient: v1.NewComponentServiceClient(
+			http.DefaultClient, apiAddr,
+			tracing.ClientOption(),
 		),
 		clientset: clientset,
+		deployed:  map[string]*RelayInstanceSpec{},
 	}, nil
 }
 
 func (c *Controller) Run() {
+	go c.reportStatus()
 	go func() {
 		{
 			for {
@@ -65,15 +100,23 @@ func (c *Controller) Run() {
 				if !c.stateVersionChanged() {
 					continue
 				}
-				c.logger.Debug("listing protections")
+				// continue the trace of the request that changed the state
+				ctx, span := tracing.Tracer().Start(
+					tracing.ContextWithTraceparent(context.Background(), c.stateTraceparent),
+					"relay.Reconcile",
+					trace.WithAttributes(attribute.String("k8s.node.name", c.nodeName)),
+				)
+				c.logger.Debug("listing protections", tracing.Fields(ctx)...)
 				includeApps := true
 				req := connect.NewRequest(&wv1.ListProtectionsRequest{
 					Options: &wv1.ListProtectionsOptions{
 						IncludeApps: &includeApps,
 					},
 				})
-				listResp, err := c.protectionClient.ListProtections(context.Background(), req)
+				listResp, err := c.protectionClient.ListProtections(ctx, req)
 				if err != nil {
+					span.RecordError(err)
+					span.End()
 					c.logger.Error("failed to list protections", zap.Error(err))
 					continue
 				}
@@ -84,11 +127,12 @@ func (c *Controller) Run() {
 					case wv1.ProtectionMode_PROTECTION_MODE_UNSPECIFIED:
 						c.logger.Debug("app protection mode unspecified, skipping")
 					case wv1.ProtectionMode_PROTECTION_MODE_ON:
-						c.deployRelayInstances(specs)
+						c.deployRelayInstances(ctx, specs)
 					case wv1.ProtectionMode_PROTECTION_MODE_OFF:
-						c.destroyRelayInstances(specs)
+						c.destroyRelayInstances(ctx, specs)
 					}
 				}
+				span.End()
 
 			}
 		}
@@ -115,94 +159,199 @@ func (c *Controller) stateVersionChanged() bool {
 	c.logger.Info("protection state version has changed",
 		zap.String("versionId", stateVersionResponse.Msg.StateVersionId))
 	c.stateVersion = stateVersionResponse.Msg.StateVersionId
+	c.stateTraceparent = stateVersionResponse.Msg.Traceparent
 	return true
 }
 
-func (c *Controller) discoverRelayOptions(p *wv1.Protection) (*wv1.RelayOptions, error) {
+// discoverRelayOptions maps the pod container ports of the protection ingresses
+// to the gateway listeners, a relay port per container port
+func (c *Controller) discoverRelayOptions(p *wv1.Protection, ingresses []*wv1.Ingress) (*wv1.RelayOptions, error) {
 	if p.ProtectionMode == wv1.ProtectionMode_PROTECTION_MODE_OFF ||
 		p.ProtectionMode == wv1.ProtectionMode_PROTECTION_MODE_UNSPECIFIED {
 		return &wv1.RelayOptions{}, nil // if protection is off or unspecified, return empty options
 	}
-	port, err := protectionContainerPort(p)
-	if err != nil {
-		return &wv1.RelayOptions{}, err
+	// container port to the gateway listening port
+	proxyListeningPorts := map[uint32]uint32{}
+	for _, ingress := range ingresses {
+		for _, port := range ingress.Upstream.Ports {
+			if port.PortType != wv1.PortType_PORT_TYPE_CONTAINER_PORT {
+				continue
+			}
+			if _, ok := proxyListeningPorts[port.Number]; ok {
+				continue
+			}
+			proxyListeningPorts[port.Number] = port.ProxyListeningPort
+			// the gateway routes by the ingress host on the shared listener
+			if ingress.Upstream.UpstreamRouteType == wv1.UpstreamRouteType_UPSTREAM_ROUTE_TYPE_DOMAIN {
+				proxyListeningPorts[port.Number] = c.gatewayDomainPort
+			}
+		}
 	}
-	return &wv1.RelayOptions{
-		ProxyFqdn:          "appsecgw.default.svc", // TODO: parameterize this!
-		ProxyListeningPort: strconv.Itoa(int(port.ProxyListeningPort)),
-		AppContainerPort:   strconv.Itoa(int(port.Number)),
-		RelayPort:          "50010", // TODO: currently static-inline, must be configurable
-	}, nil
+	if len(proxyListeningPorts) == 0 {
+		return &wv1.RelayOptions{}, fmt.Errorf("protectoin [%d] does not have container ports", p.Id)
+	}
+	containerPorts := make([]uint32, 0, len(proxyListeningPorts))
+	for containerPort := range proxyListeningPorts {
+		containerPorts = append(containerPorts, containerPort)
+	}
+	// stable relay ports, the relay is restarted on the port mappings change
+	slices.Sort(containerPorts)
+	options := &wv1.RelayOptions{
+		ProxyFqdn: gatewayServiceFqdn(p.GatewayGroup, c.gatewayNamespace),
+	}
+	for idx, containerPort := range containerPorts {
+		options.PortMappings = append(options.PortMappings, &wv1.RelayPortMapping{
+			ProxyListeningPort: strconv.Itoa(int(proxyListeningPorts[containerPort])),
+			AppContainerPort:   strconv.Itoa(int(containerPort)),
+			RelayPort:          strconv.Itoa(relayBasePort + idx),
+		})
+	}
+	// single port options of the relay instances started by the older controllers
+	options.ProxyListeningPort = options.PortMappings[0].ProxyListeningPort
+	options.AppContainerPort = options.PortMappings[0].AppContainerPort
+	options.RelayPort = options.PortMappings[0].RelayPort
+	return options, nil
+}
+
+// gatewayServiceFqdn is the service of the gateway group serving the protection,
+// the default group keeps the appsecgw service name, see chart/templates/appsecgw/svc.yml
+func gatewayServiceFqdn(gatewayGroup, namespace string) string {
+	if gatewayGroup == "" || gatewayGroup == defaultGatewayGroup {
+		return fmt.Sprintf("appsecgw.%s.svc", namespace)
+	}
+	return fmt.Sprintf("appsecgw-%s.%s.svc", gatewayGroup, namespace)
+}
+
+// podIngresses is the protection endpoint pod and the ingresses it serves
+type podIngresses struct {
+	endpoint  *wv1.Endpoint
+	ingresses []*wv1.Ingress
 }
 
 func (c *Controller) getRelayInstanceSpecs(protection *wv1.Protection) (rInstances []*RelayInstanceSpec) {
+	// a relay instance per pod, relaying the container ports of all the pod ingresses
+	var pods []*podIngresses
+	podsByName := map[string]*podIngresses{}
 	for _, i := range protection.Application.Ingress {
+		if i.Upstream == nil {
+			continue
+		}
 		for _, ep := range i.Upstream.Endpoints {
-			podsClient := c.clientset.CoreV1().Pods(ep.Namespace)
-			pod, err := podsClient.Get(context.Background(), ep.Name, metav1.GetOptions{})
-			if err != nil {
-				c.logger.Error(err.Error())
+			key := ep.Namespace + "/" + ep.Name
+			if pod, ok := podsByName[key]; ok {
+				pod.ingresses = append(pod.ingresses, i)
 				continue
 			}
-			if len(pod.Status.ContainerStatuses) == 0 {
-				c.logger.Warn("pod does not contain container status", zap.String("podName", pod.Name))
-				continue
-			}
-			// if current relay instance manager
-			// running on different node from the endpoint, skip it
-			if ep.NodeName != c.nodeName {
-				c.logger.Debug("pod name does not match",
-					zap.String("endpoint", ep.Name),
-					zap.String("endpointNodename", ep.NodeName),
-					zap.String("controllerNodename", c.nodeName))
-				continue
-			}
-			// discover relay options
-			relayOptions, err := c.discoverRelayOptions(protection)
-			if err != nil {
-				c.logger.Error("relay options discovery failed", zap.Error(err))
-				continue
-			}
-			i, err := NewRelayInstanceSpec(
-				pod.Status.ContainerStatuses[0].ContainerID,
-				pod.Name,
-				ep.NodeName,
-				relayOptions,
-				c.logger,
-			)
-			if err != nil {
-				// TODO: handle an error when container not found due to running on another node
-				c.logger.Error(err.Error())
-				continue
-			}
-			rInstances = append(rInstances, i)
+			podsByName[key] = &podIngresses{endpoint: ep, ingresses: []*wv1.Ingress{i}}
+			pods = append(pods, podsByName[key])
 		}
 	}
+	for _, p := range pods {
+		ep := p.endpoint
+		// if current relay instance manager
+		// running on different node from the endpoint, skip it
+		if ep.NodeName != c.nodeName {
+			c.logger.Debug("pod name does not match",
+				zap.String("endpoint", ep.Name),
+				zap.String("endpointNodename", ep.NodeName),
+				zap.String("controllerNodename", c.nodeName))
+			continue
+		}
+		podsClient := c.clientset.CoreV1().Pods(ep.Namespace)
+		pod, err := podsClient.Get(context.Background(), ep.Name, metav1.GetOptions{})
+		if err != nil {
+			c.logger.Error(err.Error())
+			continue
+		}
+		if len(pod.Status.ContainerStatuses) == 0 {
+			c.logger.Warn("pod does not contain container status", zap.String("podName", pod.Name))
+			continue
+		}
+		// discover relay options
+		relayOptions, err := c.discoverRelayOptions(protection, p.ingresses)
+		if err != nil {
+			c.logger.Error("relay options discovery failed", zap.Error(err))
+			continue
+		}
+		i, err := NewRelayInstanceSpec(
+			pod.Status.ContainerStatuses[0].ContainerID,
+			pod.Name,
+			ep.NodeName,
+			relayOptions,
+			c.logger,
+		)
+		if err != nil {
+			// TODO: handle an error when container not found due to running on another node
+			c.logger.Error(err.Error())
+			continue
+		}
+		i.protectionId = protection.Id
+		rInstances = append(rInstances, i)
+	}
 
 	return rInstances
 }
 
-func (c *Controller) destroyRelayInstances(relayInstanceSpecs []*RelayInstanceSpec) {
+func (c *Controller) destroyRelayInstances(ctx context.Context, relayInstanceSpecs []*RelayInstanceSpec) {
 	for _, spec := range relayInstanceSpecs {
-		if err := spec.StopSpec(); err != nil {
+		if err := spec.StopSpec(ctx); err != nil {
+			relayStopFailures.WithLabelValues(c.nodeName).Inc()
 			c.logger.Error(err.Error())
 		}
+		c.deployedMu.Lock()
+		delete(c.deployed, spec.podName)
+		relayInstances.WithLabelValues(c.nodeName).Set(float64(len(c.deployed)))
+		c.deployedMu.Unlock()
 	}
 }
 
-func (c *Controller) deployRelayInstances(relayInstanceSpecs []*RelayInstanceSpec) {
+func (c *Controller) deployRelayInstances(ctx context.Context, relayInstanceSpecs []*RelayInstanceSpec) {
 	for _, spec := range relayInstanceSpecs {
-		if err := spec.StartSpec(); err != nil {
+		if err := spec.StartSpec(ctx); err != nil {
+			relayStartFailures.WithLabelValues(c.nodeName).Inc()
 			c.logger.Error(err.Error(), zap.String("podName", spec.podName))
 		}
+		c.deployedMu.Lock()
+		c.deployed[spec.podName] = spec
+		relayInstances.WithLabelValues(c.nodeName).Set(float64(len(c.deployed)))
+		c.deployedMu.Unlock()
 	}
 }
 
-func protectionContainerPort(protection *wv1.Protection) (*wv1.Port, error) {
-	for _, port := range protection.Application.Ingress[0].Upstream.Ports {
-		if port.PortType == wv1.PortType_PORT_TYPE_CONTAINER_PORT {
-			return port, nil
+// reportStatus periodically reports the deployed relay instances health to the api server
+func (c *Controller) reportStatus() {
+	ticker := time.NewTicker(statusReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.deployedMu.Lock()
+		specs := make([]*RelayInstanceSpec, 0, len(c.deployed))
+		for _, spec := range c.deployed {
+			specs = append(specs, spec)
+		}
+		c.deployedMu.Unlock()
+		if len(specs) == 0 {
+			continue
+		}
+		statuses := make([]*wv1.ComponentStatus, 0, len(specs))
+		for _, spec := range specs {
+			status := &wv1.ComponentStatus{
+				Type:         wv1.ComponentType_COMPONENT_TYPE_RELAY_INSTANCE,
+				InstanceId:   spec.podName,
+				ProtectionId: spec.protectionId,
+				NodeName:     spec.nodeName,
+				Healthy:      spec.relayRunning(),
+			}
+			if !status.Healthy {
+				status.Message = "relay instance is not running"
+			}
+			statuses = append(statuses, status)
+		}
+		_, err := c.componentClient.ReportStatus(
+			context.Background(),
+			connect.NewRequest(&wv1.ReportStatusRequest{Statuses: statuses}),
+		)
+		if err != nil {
+			c.logger.Error("failed to report relay instances status", zap.Error(err))
 		}
 	}
-	return nil, fmt.Errorf("protectoin [%d] does not have container ports", protection.Id)
 }
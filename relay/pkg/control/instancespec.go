@@ -19,7 +19,11 @@ import (
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
 	"github.com/Dimss/wafie/relay/pkg/apisrv"
+	"github.com/Dimss/wafie/tracing"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
@@ -40,6 +44,7 @@ type RelayInstanceSpec struct {
 	logger       *zap.Logger
 	apiAddr      string
 	podName      string
+	protectionId uint32
 	relayOptions *wv1.RelayOptions
 }
 
@@ -74,8 +79,10 @@ func NewRelayInstanceSpec(containerId, podName, nodeName string, options *wv1.Re
 
 // StartSpec idempotent method, will do nothing if instance already injected and running
 // otherwise will clean up previous instance and start a new one
-func (s *RelayInstanceSpec) StartSpec() error {
-	s.logger.Debug("starting relay", zap.Any("relayOptions", s.relayOptions.String()))
+func (s *RelayInstanceSpec) StartSpec(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "relay.StartSpec")
+	defer endSpan(span, &err)
+	s.logger.Debug("starting relay", append(tracing.Fields(ctx), zap.Any("relayOptions", s.relayOptions.String()))...)
 	if !s.relayRunning() {
 		if err := s.runRelayBinary(); err != nil {
 			return err
@@ -86,28 +93,46 @@ func (s *RelayInstanceSpec) StartSpec() error {
 		// TODO: implement readiness endpoint instead
 		time.Sleep(2 * time.Second)
 	}
-	return s.startRelay()
+	return s.startRelay(ctx)
 }
 
-func (s *RelayInstanceSpec) StopSpec() error {
-	s.logger.Debug("stopping relay")
+func (s *RelayInstanceSpec) StopSpec(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "relay.StopSpec")
+	defer endSpan(span, &err)
+	s.logger.Debug("stopping relay", tracing.Fields(ctx)...)
 	if !s.relayRunning() {
 		return nil
 	}
-	_, err := wafiev1connect.NewRelayServiceClient(s.namespacedHttpClient(), s.apiAddr).
-		StopRelay(context.Background(), connect.NewRequest(&wv1.StopRelayRequest{}))
+	_, err = wafiev1connect.NewRelayServiceClient(s.namespacedHttpClient(), s.apiAddr, tracing.ClientOption()).
+		StopRelay(ctx, connect.NewRequest(&wv1.StopRelayRequest{}))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *RelayInstanceSpec) startRelay() error {
+func (s *RelayInstanceSpec) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(
+		attribute.String("k8s.pod.name", s.podName),
+		attribute.String("k8s.node.name", s.nodeName),
+		attribute.Int64("wafie.protection_id", int64(s.protectionId)),
+	))
+}
+
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+func (s *RelayInstanceSpec) startRelay(ctx context.Context) error {
 	if !s.relayRunning() {
 		return nil
 	}
-	_, err := wafiev1connect.NewRelayServiceClient(s.namespacedHttpClient(), s.apiAddr).
-		StartRelay(context.Background(),
+	_, err := wafiev1connect.NewRelayServiceClient(s.namespacedHttpClient(), s.apiAddr, tracing.ClientOption()).
+		StartRelay(ctx,
 			connect.NewRequest(&wv1.StartRelayRequest{
 				Options: s.relayOptions,
 			}),
@@ -0,0 +1,28 @@
+package control
+
+import (
+	"github.com/Dimss/wafie/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	relayInstances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "relay",
+		Name:      "instances",
+		Help:      "Number of relay instances managed by the controller.",
+	}, []string{"node"})
+	relayStartFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "relay",
+		Name:      "instance_start_failures_total",
+		Help:      "Total number of failed relay instance starts.",
+	}, []string{"node"})
+	relayStopFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "relay",
+		Name:      "instance_stop_failures_total",
+		Help:      "Total number of failed relay instance stops.",
+	}, []string{"node"})
+)
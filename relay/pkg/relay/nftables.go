@@ -122,8 +122,10 @@ func add(tx *knftables.Transaction, options *wv1.RelayOptions) {
 	tx.Add(set())
 	// add proxy ip to set
 	tx.Add(ipElement(options.ProxyIp))
-	// add rules
-	tx.Add(rule(options))
+	// add rules, a redirect per relayed container port
+	for _, mapping := range PortMappings(options) {
+		tx.Add(rule(mapping))
+	}
 
 }
 
@@ -170,7 +172,7 @@ func chain() *knftables.Chain {
 // iptables -t nat -A PREROUTING -p tcp --dport 80 ! -s 192.168.1.100 -j DNAT --to-destination 10.0.0.10:8080
 // nft replace rule inet nat prerouting ip saddr != 10.244.0.29 tcp dport 8080 redirect to :9090 comment "wafie-owned-object"
 
-func rule(options *wv1.RelayOptions) *knftables.Rule {
+func rule(mapping *wv1.RelayPortMapping) *knftables.Rule {
 	comment := WafieOwnedComment
 	return &knftables.Rule{
 		Table:   WafieGatewayNatTable,
@@ -178,8 +180,8 @@ func rule(options *wv1.RelayOptions) *knftables.Rule {
 		Comment: &comment,
 		Rule: knftables.Concat(
 			"ip saddr != @", AppSecGwIpsSet,
-			"tcp dport", options.AppContainerPort,
-			"redirect to :", options.RelayPort,
+			"tcp dport", mapping.AppContainerPort,
+			"redirect to :", mapping.RelayPort,
 		),
 	}
 }
@@ -8,3 +8,21 @@ type StopRelayFunc func()
 type Relay interface {
 	Configure(*wv1.RelayOptions) (StartRelayFunc, StopRelayFunc)
 }
+
+// PortMappings returns the relayed container ports,
+// falling back to the single port options of the older controllers
+func PortMappings(options *wv1.RelayOptions) []*wv1.RelayPortMapping {
+	if len(options.GetPortMappings()) > 0 {
+		return options.PortMappings
+	}
+	if options.GetAppContainerPort() == "" {
+		return nil
+	}
+	return []*wv1.RelayPortMapping{
+		{
+			ProxyListeningPort: options.ProxyListeningPort,
+			AppContainerPort:   options.AppContainerPort,
+			RelayPort:          options.RelayPort,
+		},
+	}
+}
@@ -3,7 +3,6 @@
 package relay
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"log"
@@ -16,10 +15,19 @@ import (
 
 	wv1 "github.com/Dimss/wafie/api/gen/wafie/v1"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
+// socatProcess is the socat relaying the container port,
+// the done channel is closed once the process exits
+type socatProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
 type SocatRelay struct {
-	cmd                *exec.Cmd
+	// socat process per relayed container port
+	processes          []*socatProcess
 	command            string
 	args               []string
 	logger             *zap.Logger
@@ -42,10 +50,19 @@ func (r *SocatRelay) shouldRestart(cfgOptions *wv1.RelayOptions) bool {
 	if cfgOptions == nil {
 		return false
 	}
-	return r.options.ProxyFqdn != cfgOptions.ProxyFqdn ||
-		r.options.AppContainerPort != cfgOptions.AppContainerPort ||
-		r.options.RelayPort != cfgOptions.RelayPort ||
-		r.options.ProxyListeningPort != cfgOptions.ProxyListeningPort
+	if r.options.ProxyFqdn != cfgOptions.ProxyFqdn {
+		return true
+	}
+	current, desired := PortMappings(r.options), PortMappings(cfgOptions)
+	if len(current) != len(desired) {
+		return true
+	}
+	for i := range current {
+		if !proto.Equal(current[i], desired[i]) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *SocatRelay) netNsOk() (ok bool) {
@@ -60,8 +77,18 @@ func (r *SocatRelay) netNsOk() (ok bool) {
 	return true
 }
 
+// proxyOk checks the proxy listeners of all the relayed ports
 func (r *SocatRelay) proxyOk() (ok bool) {
-	address := fmt.Sprintf("%s:%s", r.options.ProxyIp, r.options.ProxyListeningPort)
+	for _, mapping := range PortMappings(r.options) {
+		if !r.proxyPortOk(mapping.ProxyListeningPort) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *SocatRelay) proxyPortOk(proxyListeningPort string) (ok bool) {
+	address := net.JoinHostPort(r.options.ProxyIp, proxyListeningPort)
 	pingMaxAttempts := 2
 	for attempt := 0; attempt < pingMaxAttempts; attempt++ {
 		time.Sleep(1 * time.Second)
@@ -174,12 +201,15 @@ func (r *SocatRelay) deactivateHealthMonitor() {
 }
 
 func (r *SocatRelay) socatRunning() bool {
-	if r.cmd == nil || r.cmd.Process == nil {
+	if len(r.processes) == 0 {
 		return false
 	}
-	if err := r.cmd.Process.Signal(syscall.Signal(0)); err != nil {
-		r.logger.Debug("signal 0 result", zap.Error(err))
-		return false
+	for _, process := range r.processes {
+		select {
+		case <-process.done:
+			return false
+		default:
+		}
 	}
 	return true
 }
@@ -189,40 +219,50 @@ func (r *SocatRelay) startInternal() {
 		r.logger.Info("socat already running")
 		return
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	r.cmd = exec.CommandContext(ctx,
+	// partially running relay, terminate the remaining processes
+	r.stopSocat()
+	for _, mapping := range PortMappings(r.options) {
+		process, err := r.startSocat(mapping)
+		if err != nil {
+			r.logger.Error("socat start error", zap.Error(err), zap.String("relayPort", mapping.RelayPort))
+			continue
+		}
+		r.processes = append(r.processes, process)
+	}
+	if err := r.setupNetwork(); err != nil {
+		r.logger.Error("failed to setup network rules", zap.Error(err))
+	}
+}
+
+func (r *SocatRelay) startSocat(mapping *wv1.RelayPortMapping) (*socatProcess, error) {
+	cmd := exec.Command(
 		"socat",
 		"-d",
 		fmt.Sprintf("TCP-LISTEN:%s,"+
 			"reuseaddr,fork,backlog=2048,rcvbuf=262144,sndbuf=262144,keepalive,nodelay,quickack",
-			r.options.RelayPort),
+			mapping.RelayPort),
 		fmt.Sprintf("TCP:%s:%s,"+
 			"rcvbuf=262144,sndbuf=262144,keepalive,nodelay,quickack,connect-timeout=3",
-			r.options.ProxyIp, r.options.ProxyListeningPort),
+			r.options.ProxyIp, mapping.ProxyListeningPort),
 	)
-	r.cmd.SysProcAttr = &syscall.SysProcAttr{
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true, // Create new process group
 		Pgid:    0,    // Use process ID as group ID
 	}
+	setupLogs(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	r.logger.Debug("socat started successfully",
+		zap.Int("pid", cmd.Process.Pid), zap.String("relayPort", mapping.RelayPort))
+	process := &socatProcess{cmd: cmd, done: make(chan struct{})}
 	go func() {
-		r.setupLogs()
-		if err := r.cmd.Start(); err != nil {
-			r.logger.Error("socat start error", zap.Error(err))
-			cancel()
-		}
-		pgid, err := syscall.Getpgid(r.cmd.Process.Pid)
-		if err != nil {
-			panic(err)
-		}
-		r.logger.Debug("pgid", zap.Int("pgid", pgid))
-		if err := r.setupNetwork(); err != nil {
-			r.logger.Error("failed to setup network rules", zap.Error(err))
-		}
-		if err := r.cmd.Wait(); err != nil {
-			r.logger.Error("socat run error", zap.Error(err))
+		defer close(process.done)
+		if err := cmd.Wait(); err != nil {
+			r.logger.Error("socat run error", zap.Error(err), zap.String("relayPort", mapping.RelayPort))
 		}
-		r.logger.Debug("socat started successfully", zap.Int("pid", r.cmd.Process.Pid))
 	}()
+	return process, nil
 }
 
 func (r *SocatRelay) start() {
@@ -235,39 +275,33 @@ func (r *SocatRelay) setupNetwork() error {
 }
 
 func (r *SocatRelay) stopInternal() {
-	if r.cmd == nil || r.cmd.Process == nil {
-		// un-program nft
-		_ = ProgramNft(DeleteOp, r.options)
-		//return fmt.Errorf("socat not running")
-	}
-
-	pid := r.cmd.Process.Pid
-	//fmt.Printf("Stopping socat process group with PGID: %d\n", pid)
-
-	// Kill the entire process group
-	if err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGTERM); err != nil {
-		fmt.Printf("Failed to send SIGTERM to process group: %v\n", err)
-	}
-
-	// Wait for graceful shutdown
-	done := make(chan error, 1)
-	go func() {
-		done <- r.cmd.Wait()
-	}()
+	r.stopSocat()
+	// un-program nft
+	_ = ProgramNft(DeleteOp, r.options)
+}
 
-	select {
-	case err := <-done:
-		fmt.Println("Socat stopped gracefully")
-		fmt.Println(err)
-	case <-time.After(5 * time.Second):
-		fmt.Println("Timeout reached, force killing process group")
-		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
-			fmt.Printf("Failed to send SIGKILL: %v\n", err)
+// stopSocat kills the socat process groups
+func (r *SocatRelay) stopSocat() {
+	for _, process := range r.processes {
+		pid := process.cmd.Process.Pid
+		// Kill the entire process group
+		if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+			r.logger.Debug("failed to send SIGTERM to process group", zap.Int("pid", pid), zap.Error(err))
+		}
+		// Wait for graceful shutdown
+		select {
+		case <-process.done:
+			r.logger.Debug("socat stopped gracefully", zap.Int("pid", pid))
+		case <-time.After(5 * time.Second):
+			r.logger.Info("timeout reached, force killing process group", zap.Int("pid", pid))
+			if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+				r.logger.Debug("failed to send SIGKILL", zap.Int("pid", pid), zap.Error(err))
+			}
 		}
 	}
-	// un-program nft
-	_ = ProgramNft(DeleteOp, r.options)
+	r.processes = nil
 }
+
 func (r *SocatRelay) stop() {
 	r.deactivateHealthMonitor()
 	r.stopInternal()
@@ -275,9 +309,9 @@ func (r *SocatRelay) stop() {
 
 func (r *SocatRelay) Status() {}
 
-func (r *SocatRelay) setupLogs() {
-	stdout, _ := r.cmd.StdoutPipe()
-	stderr, _ := r.cmd.StderrPipe()
+func setupLogs(cmd *exec.Cmd) {
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
 	go readProgramOutput(stdout)
 	go readProgramOutput(stderr)
 }
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"connectrpc.com/connect"
+	"connectrpc.com/otelconnect"
+	"github.com/Dimss/wafie/api/gen/wafie/v1/wafiev1connect"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+
+	TraceparentHeader = "traceparent"
+
+	instrumentationName = "github.com/Dimss/wafie"
+)
+
+var propagator = propagation.TraceContext{}
+
+// untracedProcedures are polled by the wafie components, tracing them is noise
+var untracedProcedures = map[string]bool{
+	wafiev1connect.StateVersionServiceGetStateVersionProcedure: true,
+	"/grpc.health.v1.Health/Check":                             true,
+}
+
+// Init sets the global tracer provider and the trace context propagator,
+// the otlp exporter endpoint falls back to the OTEL_EXPORTER_OTLP_* env vars when empty.
+// The returned function flushes and stops the tracer provider
+func Init(serviceName, exporter, endpoint string, logger *zap.Logger) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOtlp:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		spanExporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %q, one of %s|%s|%s",
+			exporter, ExporterNone, ExporterOtlp, ExporterStdout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("tracing enabled", zap.String("exporter", exporter), zap.String("service", serviceName))
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// ClientOption traces the connect client calls and propagates the trace context
+func ClientOption() connect.ClientOption {
+	return connect.WithInterceptors(newInterceptor())
+}
+
+// HandlerOption traces the connect handlers, the incoming trace context is trusted,
+// so the wafie components spans are in a single trace
+func HandlerOption() connect.HandlerOption {
+	return connect.WithInterceptors(newInterceptor(otelconnect.WithTrustRemote()))
+}
+
+func newInterceptor(opts ...otelconnect.Option) connect.Interceptor {
+	opts = append(opts, otelconnect.WithFilter(func(_ context.Context, spec connect.Spec) bool {
+		return !untracedProcedures[spec.Procedure]
+	}))
+	interceptor, err := otelconnect.NewInterceptor(opts...)
+	if err != nil {
+		// the interceptor fails only on invalid options
+		panic(err)
+	}
+	return interceptor
+}
+
+// Traceparent returns the W3C traceparent of the context span, empty when not sampled
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceparentHeader)
+}
+
+// ContextWithTraceparent returns the context with the W3C traceparent remote span
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{TraceparentHeader: traceparent})
+}
+
+// Fields returns the context span ids log fields
+func Fields(ctx context.Context) []zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("trace_id", sc.TraceID().String()),
+		zap.String("span_id", sc.SpanID().String()),
+	}
+}
@@ -0,0 +1,25 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := ContextWithTraceparent(context.Background(), traceparent)
+	assert.Equal(t, traceparent, Traceparent(ctx))
+	fields := Fields(ctx)
+	assert.Len(t, fields, 2)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", fields[0].String)
+	assert.Equal(t, "00f067aa0ba902b7", fields[1].String)
+}
+
+func TestInvalidTraceparent(t *testing.T) {
+	ctx := ContextWithTraceparent(context.Background(), "invalid")
+	assert.Empty(t, Traceparent(ctx))
+	assert.Empty(t, Fields(ctx))
+	assert.Empty(t, Traceparent(context.Background()))
+}